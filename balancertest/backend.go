@@ -0,0 +1,153 @@
+// Package balancertest provides fake backends with scripted behaviour for
+// testing the load balancer in-process, without docker.
+package balancertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Response scripts how a backend answers a single request.
+type Response struct {
+	// Delay is waited before answering, or until the request is cancelled.
+	Delay  time.Duration
+	Status int
+	Body   string
+}
+
+// OK is a successful response.
+func OK() Response {
+	return Response{Status: http.StatusOK, Body: "OK"}
+}
+
+// Fail is a response with the given error status.
+func Fail(status int) Response {
+	return Response{Status: status, Body: http.StatusText(status)}
+}
+
+// Slow is a successful response delayed by d.
+func Slow(d time.Duration) Response {
+	return Response{Delay: d, Status: http.StatusOK, Body: "OK"}
+}
+
+// Backend is an httptest server answering requests by its script. Script
+// steps and health states are consumed in order and the last one repeats.
+// /health is answered from the health states, everything else from the
+// response script.
+type Backend struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	responses []Response
+	health    []bool
+
+	requests     atomic.Int32
+	healthChecks atomic.Int32
+}
+
+// NewBackend starts a healthy backend answering OK. It is closed when the
+// test finishes.
+func NewBackend(t testing.TB) *Backend {
+	b := &Backend{responses: []Response{OK()}, health: []bool{true}}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// NewPool starts n backends.
+func NewPool(t testing.TB, n int) []*Backend {
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = NewBackend(t)
+	}
+	return backends
+}
+
+// Addr is the host:port of the backend.
+func (b *Backend) Addr() string {
+	return strings.TrimPrefix(b.URL, "http://")
+}
+
+// Script replaces the responses given to the following requests.
+func (b *Backend) Script(responses ...Response) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.responses = responses
+	return b
+}
+
+// Health replaces the answers given to the following health checks.
+func (b *Backend) Health(states ...bool) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.health = states
+	return b
+}
+
+// Flap makes the health alternate between healthy and failing every period
+// checks, starting healthy, for the next cycles periods.
+func (b *Backend) Flap(period, cycles int) *Backend {
+	var states []bool
+	for i := 0; i < cycles; i++ {
+		for j := 0; j < period; j++ {
+			states = append(states, i%2 == 0)
+		}
+	}
+	return b.Health(states...)
+}
+
+// Requests is the number of non-health requests received.
+func (b *Backend) Requests() int {
+	return int(b.requests.Load())
+}
+
+// HealthChecks is the number of health checks received.
+func (b *Backend) HealthChecks() int {
+	return int(b.healthChecks.Load())
+}
+
+func (b *Backend) serve(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		b.healthChecks.Add(1)
+		if next(b, &b.health) {
+			_, _ = rw.Write([]byte("OK"))
+		} else {
+			rw.WriteHeader(http.StatusInternalServerError)
+			_, _ = rw.Write([]byte("FAILURE"))
+		}
+		return
+	}
+
+	b.requests.Add(1)
+	response := next(b, &b.responses)
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if response.Status != 0 {
+		rw.WriteHeader(response.Status)
+	}
+	_, _ = rw.Write([]byte(response.Body))
+}
+
+func next[T any](b *Backend, steps *[]T) T {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var step T
+	if len(*steps) == 0 {
+		return step
+	}
+	step = (*steps)[0]
+	if len(*steps) > 1 {
+		*steps = (*steps)[1:]
+	}
+	return step
+}
@@ -0,0 +1,38 @@
+package balancertest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackend_Script(t *testing.T) {
+	backend := NewBackend(t).Script(Fail(http.StatusBadGateway), OK())
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(backend.URL + "/data")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	assert.Equal(t, []int{http.StatusBadGateway, http.StatusOK, http.StatusOK}, statuses)
+	assert.Equal(t, 3, backend.Requests())
+	assert.Equal(t, map[string]int{backend.Addr(): 3}, Distribution([]*Backend{backend}))
+}
+
+func TestBackend_Flap(t *testing.T) {
+	backend := NewBackend(t).Flap(2, 3)
+
+	var states []bool
+	for i := 0; i < 7; i++ {
+		resp, err := http.Get(backend.URL + "/health")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		states = append(states, resp.StatusCode == http.StatusOK)
+	}
+	assert.Equal(t, []bool{true, true, false, false, true, true, true}, states)
+	assert.Equal(t, 7, backend.HealthChecks())
+	assert.Equal(t, 0, backend.Requests())
+}
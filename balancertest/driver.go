@@ -0,0 +1,42 @@
+package balancertest
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// Send passes a request through the handler and returns the recorded
+// response.
+func Send(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(method, target, nil))
+	return rw
+}
+
+// SendN sends n GET requests to target and returns the response statuses.
+func SendN(h http.Handler, n int, target string) []int {
+	statuses := make([]int, n)
+	for i := range statuses {
+		statuses[i] = Send(h, http.MethodGet, target).Code
+	}
+	return statuses
+}
+
+// Addrs returns the host:port addresses of the backends.
+func Addrs(backends []*Backend) []string {
+	addrs := make([]string, len(backends))
+	for i, b := range backends {
+		addrs[i] = b.Addr()
+	}
+	return addrs
+}
+
+// Distribution returns the number of requests each backend received, keyed
+// by its address.
+func Distribution(backends []*Backend) map[string]int {
+	counts := make(map[string]int, len(backends))
+	for _, b := range backends {
+		counts[b.Addr()] = b.Requests()
+	}
+	return counts
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procsSuffix is the GOMAXPROCS suffix go test appends to benchmark names.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// results holds the measurements of every run, by benchmark name and unit.
+type results map[string]map[string][]float64
+
+// parseResults reads the output of go test -bench. Benchmarks run several
+// times with -count contribute one measurement per run.
+func parseResults(in io.Reader) (results, error) {
+	res := make(results)
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		if res[name] == nil {
+			res[name] = make(map[string][]float64)
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q of %s", fields[i], name)
+			}
+			unit := fields[i+1]
+			res[name][unit] = append(res[name][unit], value)
+		}
+	}
+	return res, scanner.Err()
+}
+
+// comparison is the change of one metric of one benchmark.
+type comparison struct {
+	name, unit string
+	old, new   float64
+	// delta is the relative change in percent, positive when worse.
+	delta      float64
+	regression bool
+}
+
+// compare matches the benchmarks present in both results. A metric regresses
+// when it got worse by more than the budget of its benchmark, or threshold
+// when the benchmark has no budget.
+func compare(old, current results, threshold float64, budgets map[string]float64) []comparison {
+	var comparisons []comparison
+	for name, units := range current {
+		for unit, values := range units {
+			oldValues := old[name][unit]
+			if len(oldValues) == 0 {
+				continue
+			}
+			c := comparison{name: name, unit: unit, old: median(oldValues), new: median(values)}
+			if c.old != 0 {
+				c.delta = (c.new - c.old) / c.old * 100
+			}
+			if higherIsBetter(unit) {
+				c.delta = -c.delta
+			}
+			limit, found := budgets[name]
+			if !found {
+				limit = threshold
+			}
+			c.regression = c.delta > limit
+			comparisons = append(comparisons, c)
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool {
+		if comparisons[i].name != comparisons[j].name {
+			return comparisons[i].name < comparisons[j].name
+		}
+		return comparisons[i].unit < comparisons[j].unit
+	})
+	return comparisons
+}
+
+func higherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const oldOutput = `goos: linux
+pkg: github.com/QuantumGurus/Lab4-KPI/datastore
+BenchmarkDb_Put-8   	  300000	      1000 ns/op	     100 B/op	       2 allocs/op
+BenchmarkDb_Put-8   	  300000	      1200 ns/op	     100 B/op	       2 allocs/op
+BenchmarkDb_Put-8   	  300000	      1100 ns/op	     100 B/op	       2 allocs/op
+BenchmarkDb_Get-8   	  500000	       500 ns/op	      50.00 MB/s
+PASS
+`
+
+const newOutput = `BenchmarkDb_Put-4   	  300000	      1300 ns/op	     100 B/op	       2 allocs/op
+BenchmarkDb_Get-4   	  500000	       510 ns/op	      40.00 MB/s
+BenchmarkDb_New-4   	  500000	       510 ns/op
+`
+
+func TestCompare(t *testing.T) {
+	old, err := parseResults(strings.NewReader(oldOutput))
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{1000, 1200, 1100}, old["BenchmarkDb_Put"]["ns/op"])
+	current, err := parseResults(strings.NewReader(newOutput))
+	assert.Nil(t, err)
+
+	comparisons := compare(old, current, 10, map[string]float64{"BenchmarkDb_Put": 20})
+	byMetric := map[string]comparison{}
+	for _, c := range comparisons {
+		byMetric[c.name+" "+c.unit] = c
+	}
+	assert.Len(t, comparisons, 5, "benchmarks missing in the old results are skipped")
+
+	put := byMetric["BenchmarkDb_Put ns/op"]
+	assert.Equal(t, 1100.0, put.old)
+	assert.InDelta(t, 18.18, put.delta, 0.01)
+	assert.False(t, put.regression, "within the benchmark budget")
+
+	assert.InDelta(t, 2, byMetric["BenchmarkDb_Get ns/op"].delta, 0.01)
+	assert.False(t, byMetric["BenchmarkDb_Get ns/op"].regression)
+	assert.InDelta(t, 20, byMetric["BenchmarkDb_Get MB/s"].delta, 0.01, "lower throughput is worse")
+	assert.True(t, byMetric["BenchmarkDb_Get MB/s"].regression)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const usage = `Usage: benchcompare [flags] <old results> <new results>
+
+Compares two outputs of go test -bench (ideally run with -count) and exits
+with status 1 when a benchmark regressed by more than its budget.
+
+Flags:
+`
+
+// budgetFlag collects per-benchmark budgets given as name=percent.
+type budgetFlag map[string]float64
+
+func (b budgetFlag) String() string {
+	var parts []string
+	for name, limit := range b {
+		parts = append(parts, fmt.Sprintf("%s=%g", name, limit))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (b budgetFlag) Set(value string) error {
+	name, limit, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("budget %q is not in the name=percent form", value)
+	}
+	percent, err := strconv.ParseFloat(limit, 64)
+	if err != nil {
+		return fmt.Errorf("bad budget %q: %w", value, err)
+	}
+	b[name] = percent
+	return nil
+}
+
+func main() {
+	threshold := flag.Float64("threshold", 10, "allowed regression in percent for benchmarks without a budget")
+	budgets := budgetFlag{}
+	flag.Var(budgets, "budget", "allowed regression of one benchmark as `name=percent`, may be repeated")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	old, err := readResults(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	current, err := readResults(flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	comparisons := compare(old, current, *threshold, budgets)
+	regressions := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "benchmark\tunit\told\tnew\tdelta\t")
+	for _, c := range comparisons {
+		mark := ""
+		if c.regression {
+			mark = "REGRESSION"
+			regressions++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.4g\t%.4g\t%+.1f%%\t%s\n", c.name, c.unit, c.old, c.new, c.delta, mark)
+	}
+	w.Flush()
+
+	if regressions > 0 {
+		fmt.Fprintf(os.Stderr, "%d metric(s) over budget\n", regressions)
+		os.Exit(1)
+	}
+}
+
+func readResults(path string) (results, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseResults(file)
+}
@@ -5,16 +5,43 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
-var target = flag.String("target", "http://localhost:8090", "request target")
+var (
+	target = flag.String("target", "http://localhost:8090", "request target")
+
+	soakDuration       = flag.Duration("soak", 0, "run a soak test this long, sampling the balancer's /lb-admin/vars and /lb-admin/metrics, and fail if a leak heuristic triggers; 0 sends requests forever")
+	sampleInterval     = flag.Duration("sample-interval", time.Minute, "how often a soak test samples the target")
+	maxHeapGrowth      = flag.Float64("max-heap-growth", 0.5, "share the target heap may grow by during a soak test")
+	maxGoroutineGrowth = flag.Int("max-goroutine-growth", 50, "number of goroutines the target may add during a soak test")
+	maxErrorRate       = flag.Float64("max-error-rate", 0.01, "share of failed requests allowed in the last sample interval of a soak test")
+)
 
 func main() {
 	flag.Parse()
 	client := new(http.Client)
 	client.Timeout = 10 * time.Second
 
+	if *soakDuration > 0 {
+		report, err := soak(client, *target, time.Tick(1*time.Second), time.Second, soakConfig{
+			Duration:           *soakDuration,
+			SampleInterval:     *sampleInterval,
+			MaxHeapGrowth:      *maxHeapGrowth,
+			MaxGoroutineGrowth: *maxGoroutineGrowth,
+			MaxErrorRate:       *maxErrorRate,
+		})
+		if err != nil {
+			log.Fatalf("Soak test failed: %s", err)
+		}
+		fmt.Print(report)
+		if len(report.Leaks) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	for range time.Tick(1 * time.Second) {
 		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", *target))
 		if err == nil {
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// soakConfig sets how long a soak run lasts, how often the target is
+// sampled and the growth that counts as a leak.
+type soakConfig struct {
+	Duration       time.Duration
+	SampleInterval time.Duration
+	// MaxHeapGrowth is the share the live heap may grow by over the run,
+	// MaxGoroutineGrowth the number of goroutines that may be added.
+	MaxHeapGrowth      float64
+	MaxGoroutineGrowth int
+	// MaxErrorRate is the share of failed requests allowed in the last
+	// sample interval.
+	MaxErrorRate float64
+}
+
+// soakSample is what the target reported at one point of the run, with
+// the requests sent since the previous sample.
+type soakSample struct {
+	Time       time.Time
+	HeapAlloc  uint64
+	Goroutines int
+	Blocked    int64
+	Requests   int
+	Errors     int
+}
+
+func (s soakSample) errorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// runtimeVars is the part of the balancer's /lb-admin/vars read.
+type runtimeVars struct {
+	Goroutines int `json:"goroutines"`
+	Memstats   struct {
+		HeapAlloc uint64 `json:"HeapAlloc"`
+	} `json:"memstats"`
+}
+
+// soak sends a request on every tick, period apart, for cfg.Duration,
+// sampling the target runtime and metrics every cfg.SampleInterval, and
+// returns the report with the leak heuristics that triggered.
+func soak(client *http.Client, target string, tick <-chan time.Time, period time.Duration, cfg soakConfig) (soakReport, error) {
+	first, err := sampleTarget(client, target)
+	if err != nil {
+		return soakReport{}, fmt.Errorf("initial sample: %w", err)
+	}
+	first.Time = time.Now()
+	samples := []soakSample{first}
+
+	ticks := max(int(cfg.Duration/period), 1)
+	every := max(int(cfg.SampleInterval/period), 1)
+	var requests, errors int
+	for i := 1; i <= ticks; i++ {
+		now := <-tick
+		if err := get(client, target); err != nil {
+			errors++
+		}
+		requests++
+		if i%every != 0 && i != ticks {
+			continue
+		}
+		sample, err := sampleTarget(client, target)
+		if err != nil {
+			return soakReport{}, err
+		}
+		sample.Time, sample.Requests, sample.Errors = now, requests, errors
+		requests, errors = 0, 0
+		samples = append(samples, sample)
+		logSample(sample)
+	}
+	return analyzeSoak(samples, cfg), nil
+}
+
+// get requests the data endpoint, failing on a 5xx response.
+func get(client *http.Client, target string) error {
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", target))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("response %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sampleTarget reads the runtime variables and the filter metrics of the
+// balancer at target.
+func sampleTarget(client *http.Client, target string) (soakSample, error) {
+	var vars runtimeVars
+	if err := getJSON(client, target+"/lb-admin/vars", &vars); err != nil {
+		return soakSample{}, err
+	}
+	var metrics struct {
+		Blocked map[string]int64 `json:"blocked"`
+	}
+	if err := getJSON(client, target+"/lb-admin/metrics", &metrics); err != nil {
+		return soakSample{}, err
+	}
+	sample := soakSample{HeapAlloc: vars.Memstats.HeapAlloc, Goroutines: vars.Goroutines}
+	for _, count := range metrics.Blocked {
+		sample.Blocked += count
+	}
+	return sample, nil
+}
+
+func getJSON(client *http.Client, url string, v any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: response %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// soakReport compares the end of a soak run with its start.
+type soakReport struct {
+	Samples         []soakSample
+	HeapGrowth      float64
+	GoroutineGrowth int
+	LastErrorRate   float64
+	// Leaks names the heuristics that triggered, empty when none did.
+	Leaks []string
+}
+
+// analyzeSoak compares the lowest values of the last third of the
+// samples with the first one, so a garbage collection that is just due
+// does not count as growth.
+func analyzeSoak(samples []soakSample, cfg soakConfig) soakReport {
+	report := soakReport{Samples: samples}
+	if len(samples) < 2 {
+		return report
+	}
+	first, tail := samples[0], samples[len(samples)-1-(len(samples)-1)/3:]
+	heap, goroutines := tail[0].HeapAlloc, tail[0].Goroutines
+	for _, s := range tail {
+		heap = min(heap, s.HeapAlloc)
+		goroutines = min(goroutines, s.Goroutines)
+	}
+	if first.HeapAlloc > 0 {
+		report.HeapGrowth = float64(heap)/float64(first.HeapAlloc) - 1
+	}
+	report.GoroutineGrowth = goroutines - first.Goroutines
+	report.LastErrorRate = samples[len(samples)-1].errorRate()
+
+	if report.HeapGrowth > cfg.MaxHeapGrowth {
+		report.Leaks = append(report.Leaks, fmt.Sprintf("heap grew by %.0f%%, over %.0f%%", report.HeapGrowth*100, cfg.MaxHeapGrowth*100))
+	}
+	if report.GoroutineGrowth > cfg.MaxGoroutineGrowth {
+		report.Leaks = append(report.Leaks, fmt.Sprintf("%d goroutines added, over %d", report.GoroutineGrowth, cfg.MaxGoroutineGrowth))
+	}
+	if report.LastErrorRate > cfg.MaxErrorRate {
+		report.Leaks = append(report.Leaks, fmt.Sprintf("error rate %.1f%% at the end, over %.1f%%", report.LastErrorRate*100, cfg.MaxErrorRate*100))
+	}
+	return report
+}
+
+func logSample(s soakSample) {
+	fmt.Printf("%s heap=%dKiB goroutines=%d blocked=%d requests=%d errors=%d\n",
+		s.Time.Format(time.TimeOnly), s.HeapAlloc/1024, s.Goroutines, s.Blocked, s.Requests, s.Errors)
+}
+
+func (r soakReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Soak report over %d samples\n", len(r.Samples))
+	fmt.Fprintf(&b, "  heap growth:      %+.1f%%\n", r.HeapGrowth*100)
+	fmt.Fprintf(&b, "  goroutine growth: %+d\n", r.GoroutineGrowth)
+	fmt.Fprintf(&b, "  last error rate:  %.1f%%\n", r.LastErrorRate*100)
+	if len(r.Leaks) == 0 {
+		b.WriteString("No leak detected\n")
+	}
+	for _, leak := range r.Leaks {
+		fmt.Fprintf(&b, "LEAK: %s\n", leak)
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSoak(t *testing.T) {
+	var heap, goroutines, failing atomic.Int64
+	heap.Store(1000)
+	goroutines.Store(10)
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lb-admin/vars":
+			fmt.Fprintf(rw, `{"goroutines": %d, "memstats": {"HeapAlloc": %d}}`, goroutines.Load(), heap.Load())
+		case "/lb-admin/metrics":
+			fmt.Fprint(rw, `{"blocked": {"path": 2}}`)
+		default:
+			if failing.Load() > 0 {
+				rw.WriteHeader(http.StatusBadGateway)
+			}
+		}
+	}))
+	defer target.Close()
+
+	cfg := soakConfig{
+		Duration:           9 * time.Second,
+		SampleInterval:     3 * time.Second,
+		MaxHeapGrowth:      0.5,
+		MaxGoroutineGrowth: 5,
+		MaxErrorRate:       0.1,
+	}
+	run := func(step func(i int)) soakReport {
+		tick := make(chan time.Time)
+		go func() {
+			start := time.Now()
+			for i := 1; i <= 9; i++ {
+				step(i)
+				tick <- start.Add(time.Duration(i) * time.Second)
+			}
+		}()
+		report, err := soak(target.Client(), target.URL, tick, time.Second, cfg)
+		assert.Nil(t, err)
+		return report
+	}
+
+	// A heap spiking once in the middle is no leak.
+	report := run(func(i int) {
+		if i == 4 {
+			heap.Store(5000)
+		} else {
+			heap.Store(1100)
+		}
+	})
+	assert.Len(t, report.Samples, 4)
+	assert.Equal(t, 3, report.Samples[1].Requests)
+	assert.Equal(t, int64(2), report.Samples[1].Blocked)
+	assert.Empty(t, report.Leaks)
+
+	// Steady growth and failing requests at the end are.
+	report = run(func(i int) {
+		heap.Store(1000 + int64(i)*200)
+		goroutines.Store(10 + int64(i)*2)
+		if i > 6 {
+			failing.Store(1)
+		}
+	})
+	assert.Len(t, report.Leaks, 3)
+	assert.InDelta(t, 1.0, report.HeapGrowth, 0.3)
+	assert.Equal(t, 1.0, report.LastErrorRate)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+var (
+	errNotEmpty            = errors.New("the node already holds data")
+	errBootstrapInProgress = errors.New("a bootstrap is already in progress")
+	errCacheMode           = errors.New("nodes in cache mode can't be bootstrapped")
+)
+
+// bootstrapMu lets one bootstrap run at a time.
+var bootstrapMu sync.Mutex
+
+// dbSnapshotHandler streams a snapshot of the database, the body a new
+// node is bootstrapped with.
+func dbSnapshotHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "application/x-tar")
+	if err := db.WriteSnapshot(limitBandwidth(responseWriter)); err != nil {
+		// The status is sent already, the client sees a snapshot without
+		// its checksums.
+		log.Printf("Failed to write a snapshot: %s", err)
+	}
+}
+
+// dbBootstrapHandler fills an empty node with the snapshot streamed in the
+// request body, produced by GET /db-admin/snapshot of another node:
+//
+//	curl http://db1:8080/db-admin/snapshot | curl --data-binary @- http://db2:8080/db-admin/bootstrap
+//
+// The snapshot is verified before it replaces the empty database.
+func dbBootstrapHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	err := bootstrap(req.Body, dataDir)
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotEmpty), errors.Is(err, errBootstrapInProgress), errors.Is(err, errCacheMode):
+		http.Error(responseWriter, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, datastore.ErrChecksumMismatch):
+		http.Error(responseWriter, err.Error(), http.StatusUnprocessableEntity)
+		return
+	default:
+		log.Printf("Bootstrap failed: %s", err)
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Println("Bootstrapped the database from a snapshot")
+	dbStatsHandler(responseWriter, req)
+}
+
+// bootstrap restores the snapshot read from r next to dir and swaps it in
+// place of the empty database there. The node reports itself unhealthy
+// while the databases are swapped.
+func bootstrap(r io.Reader, dir string) error {
+	if !bootstrapMu.TryLock() {
+		return errBootstrapInProgress
+	}
+	defer bootstrapMu.Unlock()
+	if storage != store(db) {
+		return errCacheMode
+	}
+	if len(db.Keys("", "", 1).Keys) > 0 {
+		return errNotEmpty
+	}
+
+	staging, old := dir+".bootstrap", dir+".old"
+	_ = os.RemoveAll(staging)
+	if err := datastore.RestoreSnapshot(r, staging); err != nil {
+		_ = os.RemoveAll(staging)
+		return err
+	}
+
+	ready.Store(false)
+	defer ready.Store(true)
+	if err := db.Close(); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(old)
+	if err := os.Rename(dir, old); err != nil {
+		return reopen(dir, err)
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		_ = os.Rename(old, dir)
+		return reopen(dir, err)
+	}
+	restored, err := datastore.Open(dir, dbOptions)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		_ = os.Rename(old, dir)
+		return reopen(dir, err)
+	}
+	db, storage = restored, restored
+	return os.RemoveAll(old)
+}
+
+// reopen opens the database in dir again after a failed swap and returns
+// the error of the swap.
+func reopen(dir string, swapErr error) error {
+	previous, err := datastore.Open(dir, dbOptions)
+	if err != nil {
+		log.Fatalf("Failed to reopen the database after a failed bootstrap: %s", err)
+	}
+	db, storage = previous, previous
+	return fmt.Errorf("can't swap in the snapshot: %w", swapErr)
+}
+
+// restoreAtStartup fills the empty dir with the snapshot in the file at
+// path, rebuilding a node that lost its data without a live node to
+// bootstrap from. A dir holding files is left alone and reported not
+// restored, so the setting can stay in place across restarts.
+func restoreAtStartup(path, dir string) (bool, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return false, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// A failed restore leaves no partial database behind to be opened.
+	staging := dir + ".restore"
+	_ = os.RemoveAll(staging)
+	if err := datastore.RestoreSnapshot(file, staging); err != nil {
+		_ = os.RemoveAll(staging)
+		return false, err
+	}
+	_ = os.Remove(dir)
+	if err := os.Rename(staging, dir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
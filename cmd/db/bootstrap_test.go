@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+func TestBootstrap(t *testing.T) {
+	source := newTestDb(t)
+	if err := source.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := source.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	CreateDirIfNotExist(dir)
+	dbOptions = datastore.Options{SegmentSize: 1024}
+	var err error
+	db, err = datastore.Open(dir, dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = db
+	t.Cleanup(func() { db.Close() })
+
+	truncated := snapshot.Bytes()[:snapshot.Len()/2]
+	if err := bootstrap(bytes.NewReader(truncated), dir); !errors.Is(err, datastore.ErrChecksumMismatch) {
+		t.Fatalf("Expected a truncated snapshot to be refused, got %v", err)
+	}
+
+	if err := bootstrap(bytes.NewReader(snapshot.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("a"); err != nil || value != "1" {
+		t.Errorf("Expected the snapshot to be served, got %q (err: %v)", value, err)
+	}
+	if !ready.Load() {
+		t.Error("Expected the node to be ready after the bootstrap")
+	}
+	if err := bootstrap(bytes.NewReader(snapshot.Bytes()), dir); !errors.Is(err, errNotEmpty) {
+		t.Errorf("Expected a node with data to be refused, got %v", err)
+	}
+}
+
+func TestRestoreAtStartup(t *testing.T) {
+	source := newTestDb(t)
+	if err := source.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	var snapshot bytes.Buffer
+	if err := source.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.tar")
+	if err := os.WriteFile(path, snapshot.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(t.TempDir(), "truncated.tar")
+	if err := os.WriteFile(truncated, snapshot.Bytes()[:snapshot.Len()/2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	CreateDirIfNotExist(dir)
+	if _, err := restoreAtStartup(truncated, dir); !errors.Is(err, datastore.ErrChecksumMismatch) {
+		t.Fatalf("Expected a truncated snapshot to be refused, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("Expected a failed restore to leave the directory empty, got %v", entries)
+	}
+
+	if restored, err := restoreAtStartup(path, dir); !restored || err != nil {
+		t.Fatalf("Expected the snapshot to be restored, got %t, %v", restored, err)
+	}
+	restored, err := datastore.Open(dir, datastore.Options{SegmentSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if value, err := restored.Get("a"); err != nil || value != "1" {
+		t.Errorf("Expected a to be restored, got %q, %v", value, err)
+	}
+
+	if again, err := restoreAtStartup(path, dir); again || err != nil {
+		t.Errorf("Expected a directory with data to be left alone, got %t, %v", again, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+// errOverBudget is returned for a read the storage did not answer within
+// the budget.
+var errOverBudget = errors.New("storage read over budget")
+
+// readBudget bounds how long a GET waits for the storage, so a slow read,
+// from a cold segment or a slow upstream, answers 503 instead of hanging
+// the caller. The read itself can't be interrupted and goes on in the
+// background; it fills the value cache, or the local copy in cache mode,
+// so the retry is fast.
+type readBudget struct {
+	limit time.Duration
+}
+
+// newReadBudget returns nil, no budget, for a non-positive limit.
+func newReadBudget(limit time.Duration) *readBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &readBudget{limit: limit}
+}
+
+// getRecord reads key from s, giving up after the budget.
+func (b *readBudget) getRecord(ctx context.Context, s store, key string) (datastore.Record, error) {
+	if b == nil {
+		return getRecord(ctx, s, key)
+	}
+	type result struct {
+		record datastore.Record
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		record, err := getRecord(ctx, s, key)
+		done <- result{record, err}
+	}()
+	timer := time.NewTimer(b.limit)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.record, r.err
+	case <-timer.C:
+		return datastore.Record{}, errOverBudget
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+// slowStore answers reads once release is closed.
+type slowStore struct {
+	store
+	release chan struct{}
+}
+
+func (s slowStore) GetRecord(key string) (datastore.Record, error) {
+	<-s.release
+	return datastore.Record{Value: "value", Version: 1}, nil
+}
+
+func TestDbGetHandler_Budget(t *testing.T) {
+	release := make(chan struct{})
+	storage = slowStore{release: release}
+	getBudget = newReadBudget(10 * time.Millisecond)
+	defer func() { getBudget = nil }()
+
+	get := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/db/key", nil)
+		req.SetPathValue("key", "key")
+		dbGetHandler(rw, req)
+		return rw
+	}
+	if rw := get(); rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a slow read to answer 503 with Retry-After, got %d %v", rw.Code, rw.Header())
+	}
+
+	close(release)
+	if rw := get(); rw.Code != http.StatusOK {
+		t.Errorf("Expected a read within the budget to answer, got %d", rw.Code)
+	}
+
+	if newReadBudget(0) != nil {
+		t.Error("Expected no budget without a limit")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+const defaultCacheTTL = time.Minute
+
+// store is the key-value interface served by the HTTP handlers.
+type store interface {
+	GetRecord(key string) (datastore.Record, error)
+	// MultiGetRecords returns the records of the keys that exist.
+	MultiGetRecords(keys []string) (map[string]datastore.Record, error)
+	PutWithOptions(key, value string, opts datastore.WriteOptions) (uint64, error)
+	// PutBatch stores all entries atomically.
+	PutBatch(entries []datastore.Entry) error
+	DeleteWithOptions(key string, opts datastore.DeleteOptions) error
+	// Durability returns the durability a write requesting d gets.
+	Durability(d datastore.Durability) datastore.Durability
+}
+
+// cacheStore turns the local database into a read-through/write-through cache
+// for an upstream db node. Local copies are considered fresh for ttl after
+// they were fetched or written; expiry is tracked in memory, so after a
+// restart every key is revalidated against the upstream on first access.
+// The copies expire from the database ttl after they turn stale, serving
+// reads meanwhile if the upstream is down. Versions reported by the cache are
+// the upstream ones.
+type cacheStore struct {
+	db       *datastore.Db
+	upstream *dbclient.Client
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	lastPurge time.Time
+}
+
+type cacheEntry struct {
+	expiresAt time.Time
+	version   uint64
+}
+
+func newCacheStore(db *datastore.Db, upstream string, ttl time.Duration) *cacheStore {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	return &cacheStore{
+		db:        db,
+		upstream:  dbclient.New(upstream),
+		ttl:       ttl,
+		entries:   make(map[string]cacheEntry),
+		lastPurge: time.Now(),
+	}
+}
+
+// copyTTL returns the TTL of a local copy of a record written with ttl, if
+// any: the record expires from the cache no later than upstream.
+func (c *cacheStore) copyTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < 2*c.ttl {
+		return ttl
+	}
+	return 2 * c.ttl
+}
+
+func (c *cacheStore) GetRecord(key string) (datastore.Record, error) {
+	local, localErr := c.db.Get(key)
+	cached, fresh := c.lookup(key)
+	if localErr == nil && fresh {
+		return datastore.Record{Value: local, Version: cached.version}, nil
+	}
+
+	record, err := c.upstream.Get(key)
+	if errors.Is(err, dbclient.ErrNotFound) {
+		// The key was deleted upstream, the copy must not be served again.
+		if localErr == nil {
+			if err := c.db.Delete(key); err != nil {
+				return datastore.Record{}, err
+			}
+		}
+		c.forget(key)
+		return datastore.Record{}, datastore.ErrNotFound
+	}
+	if err != nil {
+		// Serve the stale copy rather than failing while the upstream is down.
+		if localErr == nil {
+			return datastore.Record{Value: local, Version: cached.version}, nil
+		}
+		return datastore.Record{}, err
+	}
+
+	if _, err := c.db.PutWithOptions(key, record.Value, datastore.WriteOptions{TTL: c.copyTTL(0)}); err != nil {
+		return datastore.Record{}, err
+	}
+	c.touch(key, record.Version)
+	return datastore.Record{Value: record.Value, Version: record.Version}, nil
+}
+
+// MultiGetRecords reads the keys one by one, since each may need to be
+// revalidated against the upstream.
+func (c *cacheStore) MultiGetRecords(keys []string) (map[string]datastore.Record, error) {
+	records := make(map[string]datastore.Record, len(keys))
+	for _, key := range keys {
+		record, err := c.GetRecord(key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records[key] = record
+	}
+	return records, nil
+}
+
+func (c *cacheStore) PutWithOptions(key, value string, opts datastore.WriteOptions) (uint64, error) {
+	version, err := c.upstream.PutWithOptions(key, value, dbclient.PutOptions{
+		Tags:            opts.Tags,
+		ExpectedVersion: opts.ExpectedVersion,
+		Durability:      string(opts.Durability),
+		TTL:             opts.TTL,
+	})
+	if errors.Is(err, dbclient.ErrVersionConflict) {
+		return 0, datastore.ErrVersionConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := c.db.PutWithOptions(key, value, datastore.WriteOptions{Tags: opts.Tags, Durability: opts.Durability, TTL: c.copyTTL(opts.TTL)}); err != nil {
+		return 0, err
+	}
+	c.touch(key, version)
+	return version, nil
+}
+
+// PutBatch writes the batch to the upstream first. The upstream does not
+// report the new versions, so the keys are revalidated on their next read.
+func (c *cacheStore) PutBatch(entries []datastore.Entry) error {
+	batch := make([]dbclient.BatchEntry, len(entries))
+	for i, e := range entries {
+		batch[i] = dbclient.BatchEntry{Key: e.Key, Value: e.Value, Tags: e.Tags, TTL: e.TTL}
+	}
+	if err := c.upstream.PutBatch(context.Background(), batch); err != nil {
+		return err
+	}
+
+	copies := make([]datastore.Entry, len(entries))
+	for i, e := range entries {
+		copies[i] = e
+		copies[i].TTL = c.copyTTL(e.TTL)
+	}
+	if err := c.db.PutBatch(copies); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		c.forget(e.Key)
+	}
+	return nil
+}
+
+func (c *cacheStore) DeleteWithOptions(key string, opts datastore.DeleteOptions) error {
+	if err := c.upstream.Delete(key); err != nil {
+		return err
+	}
+
+	if err := c.db.DeleteWithOptions(key, opts); err != nil {
+		return err
+	}
+	c.forget(key)
+	return nil
+}
+
+// Durability is the one of the local copy. The upstream is asked for the
+// same durability, but only reports it in its responses.
+func (c *cacheStore) Durability(d datastore.Durability) datastore.Durability {
+	return c.db.Durability(d)
+}
+
+func (c *cacheStore) lookup(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached := c.entries[key]
+	return cached, time.Now().Before(cached.expiresAt)
+}
+
+// touch marks the copy of key fresh. Entries stale for a ttl, whose copies
+// expired from the database, are purged every ttl.
+func (c *cacheStore) touch(key string, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPurge) > c.ttl {
+		for k, cached := range c.entries {
+			if now.Sub(cached.expiresAt) > c.ttl {
+				delete(c.entries, k)
+			}
+		}
+		c.lastPurge = now
+	}
+	c.entries[key] = cacheEntry{
+		expiresAt: now.Add(c.ttl),
+		version:   version,
+	}
+}
+
+func (c *cacheStore) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
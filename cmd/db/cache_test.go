@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUpstream struct {
+	mu    sync.Mutex
+	data  map[string]string
+	reads int
+}
+
+func (u *fakeUpstream) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := r.URL.Path[len("/db/"):]
+	if r.Method == http.MethodPost {
+		var body putRequest
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		u.data[key] = *body.Value
+		_ = json.NewEncoder(rw).Encode(recordResponse{Key: key, Value: *body.Value, Version: 7})
+		return
+	}
+
+	u.reads++
+	value, ok := u.data[key]
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(rw).Encode(recordResponse{Key: key, Value: value, Version: 3})
+}
+
+func newTestDb(t *testing.T) *datastore.Db {
+	dir, err := os.MkdirTemp("", "test-db-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := datastore.NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestCacheStore(t *testing.T) {
+	upstream := &fakeUpstream{data: map[string]string{"remote": "value"}}
+	server := httptest.NewServer(upstream)
+	defer server.Close()
+
+	cache := newCacheStore(newTestDb(t), server.URL, 50*time.Millisecond)
+
+	record, err := cache.GetRecord("remote")
+	assert.Nil(t, err)
+	assert.Equal(t, datastore.Record{Value: "value", Version: 3}, record)
+
+	_, _ = cache.GetRecord("remote")
+	assert.Equal(t, 1, upstream.reads, "fresh local copy must not hit the upstream")
+
+	time.Sleep(60 * time.Millisecond)
+	_, _ = cache.GetRecord("remote")
+	assert.Equal(t, 2, upstream.reads, "expired copy must be revalidated")
+
+	_, err = cache.GetRecord("missing")
+	assert.Equal(t, datastore.ErrNotFound, err)
+
+	version, err := cache.PutWithOptions("local", "written", datastore.WriteOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), version, "versions come from the upstream")
+	assert.Equal(t, "written", upstream.data["local"])
+	record, err = cache.GetRecord("local")
+	assert.Nil(t, err)
+	assert.Equal(t, datastore.Record{Value: "written", Version: 7}, record)
+
+	upstream.mu.Lock()
+	delete(upstream.data, "local")
+	upstream.mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.GetRecord("local")
+	assert.Equal(t, datastore.ErrNotFound, err, "keys deleted upstream are missing")
+	_, err = cache.db.Get("local")
+	assert.Equal(t, datastore.ErrNotFound, err, "copies of keys deleted upstream are deleted")
+	assert.NotContains(t, cache.entries, "local")
+
+	_, _ = cache.GetRecord("remote")
+	server.Close()
+	time.Sleep(60 * time.Millisecond)
+	record, err = cache.GetRecord("remote")
+	assert.Nil(t, err, "stale copy must be served while the upstream is down")
+	assert.Equal(t, "value", record.Value)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = cache.GetRecord("remote")
+	assert.NotNil(t, err, "copies expire a ttl after turning stale")
+	cache.touch("other", 1)
+	assert.Len(t, cache.entries, 1, "entries of expired copies are purged")
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Fault injection knobs, mirroring the app server configuration.
+const (
+	confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
+	confErrorPercent     = "CONF_ERROR_PERCENT"
+	confDiskFull         = "CONF_DISK_FULL"
+)
+
+type chaosSettings struct {
+	ResponseDelaySec float64 `json:"response_delay_sec"`
+	ErrorPercent     int     `json:"error_percent"`
+	DiskFull         bool    `json:"disk_full"`
+}
+
+// chaos injects artificial latency and failures into the data API so retry
+// and failover logic of the upper tiers can be exercised end to end.
+type chaos struct {
+	mu       sync.RWMutex
+	settings chaosSettings
+}
+
+func newChaosFromEnv() *chaos {
+	c := new(chaos)
+	c.settings.ResponseDelaySec, _ = strconv.ParseFloat(os.Getenv(confResponseDelaySec), 64)
+	c.settings.ErrorPercent, _ = strconv.Atoi(os.Getenv(confErrorPercent))
+	c.settings.DiskFull = os.Getenv(confDiskFull) == "true"
+	return c
+}
+
+func (c *chaos) current() chaosSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.settings
+}
+
+// Wrap applies the configured faults before passing the request to next.
+func (c *chaos) Wrap(next http.Handler) http.Handler {
+	return c.wrap(next, false)
+}
+
+// WrapWrite works like Wrap for a route writing to the database, which a
+// full disk refuses too. Reads keep working whatever their method.
+func (c *chaos) WrapWrite(next http.Handler) http.Handler {
+	return c.wrap(next, true)
+}
+
+func (c *chaos) wrap(next http.Handler, write bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		settings := c.current()
+
+		if settings.ResponseDelaySec > 0 {
+			select {
+			case <-time.After(time.Duration(settings.ResponseDelaySec * float64(time.Second))):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if settings.ErrorPercent > 0 && rand.Intn(100) < settings.ErrorPercent {
+			http.Error(rw, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		if settings.DiskFull && write {
+			http.Error(rw, "no space left on device", http.StatusInsufficientStorage)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ServeHTTP exposes the settings on the admin API: GET returns them, POST
+// replaces them with the JSON body.
+func (c *chaos) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var settings chaosSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.settings = settings
+		c.mu.Unlock()
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(c.current())
+}
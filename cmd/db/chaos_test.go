@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaos(t *testing.T) {
+	c := new(chaos)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})
+	handler, writes := c.Wrap(ok), c.WrapWrite(ok)
+	serve := func(method string) int {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, "/db/key", nil))
+		return rw.Code
+	}
+	write := func(method string) int {
+		rw := httptest.NewRecorder()
+		writes.ServeHTTP(rw, httptest.NewRequest(method, "/db/key", nil))
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet))
+
+	admin := httptest.NewRecorder()
+	c.ServeHTTP(admin, httptest.NewRequest(http.MethodPost, "/db-admin/chaos",
+		strings.NewReader(`{"disk_full": true, "response_delay_sec": 0.05}`)))
+	assert.Equal(t, http.StatusOK, admin.Code)
+
+	start := time.Now()
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, http.StatusInsufficientStorage, write(http.MethodPost))
+	assert.Equal(t, http.StatusInsufficientStorage, write(http.MethodDelete))
+	// Reads sent as POST, like _mget, are not writes.
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost))
+
+	c.settings = chaosSettings{ErrorPercent: 100}
+	assert.Equal(t, http.StatusInternalServerError, serve(http.MethodGet))
+}
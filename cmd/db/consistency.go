@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+// replicaOf describes the node as a replica, whose data may lag behind the
+// primary taking the writes. It is nil on a primary, which is always fresh
+// enough.
+type replicaOf struct {
+	// primary is the base URL stale reads are redirected to, empty when
+	// unknown and they are answered 425 Too Early.
+	primary string
+}
+
+var replica *replicaOf
+
+// newReplicaOf returns nil, a primary, unless the node is a replica of
+// primary or marked as one.
+func newReplicaOf(primary string, marked bool) *replicaOf {
+	if primary == "" && !marked {
+		return nil
+	}
+	return &replicaOf{primary: strings.TrimSuffix(primary, "/")}
+}
+
+// sequencedStore is implemented by stores counting their writes with a
+// commit sequence: the database, not the cache of an upstream, whose copies
+// are as old as whenever they were fetched.
+type sequencedStore interface {
+	Sequence() uint64
+}
+
+// storageSequence returns the commit sequence the storage has applied,
+// zero when it has none.
+func storageSequence() uint64 {
+	if sequenced, ok := storage.(sequencedStore); ok {
+		return sequenced.Sequence()
+	}
+	return 0
+}
+
+// setSequence sets the consistency token of a response: the commit
+// sequence the node had applied when it answered, so at least that of a
+// write answered. The sequence counts every write of the node, and a
+// replica copying its segments reaches it too, so a read presenting the
+// token sees the write, or something newer, wherever it lands.
+func setSequence(responseWriter http.ResponseWriter) {
+	if sequence := storageSequence(); sequence > 0 {
+		responseWriter.Header().Set(httptools.SequenceHeader, strconv.FormatUint(sequence, 10))
+	}
+}
+
+// fresh tells whether the node has applied the minimum sequence of the
+// request. Otherwise it sends the reader to the primary, or answers 425 for
+// it to retry elsewhere.
+func (r *replicaOf) fresh(responseWriter http.ResponseWriter, req *http.Request) bool {
+	minSequence := httptools.MinSequence(req.Context())
+	if r == nil || minSequence == 0 || storageSequence() >= minSequence {
+		return true
+	}
+	if r.primary != "" {
+		http.Redirect(responseWriter, req, r.primary+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return false
+	}
+	http.Error(responseWriter, "Replica behind "+httptools.MinSequenceHeader, http.StatusTooEarly)
+	return false
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+func TestDbGetHandler_MinSequence(t *testing.T) {
+	storage = newTestDb(t)
+	defer func() { replica = nil }()
+
+	post := func(key string) string {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/db/"+key, strings.NewReader(`{"value":"1"}`))
+		req.SetPathValue("key", key)
+		dbPostHandler(rw, req)
+		return rw.Header().Get(httptools.SequenceHeader)
+	}
+	get := func(key, minSequence string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/db/"+key, nil)
+		req.Header.Set(httptools.MinSequenceHeader, minSequence)
+		req.SetPathValue("key", key)
+		httptools.WithMinSequence(http.HandlerFunc(dbGetHandler)).ServeHTTP(rw, req)
+		return rw
+	}
+
+	if sequence := post("a"); sequence != "1" {
+		t.Fatalf("Expected the write to return sequence 1, got %q", sequence)
+	}
+	if rw := get("a", "2"); rw.Code != http.StatusOK {
+		t.Errorf("Expected the primary to serve any sequence, got %d", rw.Code)
+	}
+
+	replica = newReplicaOf("", true)
+	if rw := get("a", "1"); rw.Code != http.StatusOK {
+		t.Errorf("Expected a fresh enough replica to serve, got %d", rw.Code)
+	}
+	if rw := get("a", "2"); rw.Code != http.StatusTooEarly {
+		t.Errorf("Expected a stale replica to answer 425, got %d", rw.Code)
+	}
+	if rw := get("b", "1"); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected a fresh enough replica to tell a key is missing, got %d", rw.Code)
+	}
+	// The sequence counts the writes of every key.
+	if sequence := post("c"); sequence != "2" {
+		t.Fatalf("Expected the write to return sequence 2, got %q", sequence)
+	}
+	if rw := get("a", "2"); rw.Code != http.StatusOK || rw.Header().Get(httptools.SequenceHeader) != "2" {
+		t.Errorf("Expected a replica past the sequence to serve, got %d", rw.Code)
+	}
+	if rw := get("a", "3"); rw.Code != http.StatusTooEarly {
+		t.Errorf("Expected a stale replica to answer 425, got %d", rw.Code)
+	}
+	if rw := get("a", "soon"); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid sequence to be rejected, got %d", rw.Code)
+	}
+
+	replica = newReplicaOf("http://primary:8083/", false)
+	rw := get("a", "3")
+	if location := rw.Header().Get("Location"); rw.Code != http.StatusTemporaryRedirect || location != "http://primary:8083/db/a" {
+		t.Errorf("Expected a redirect to the primary, got %d %q", rw.Code, location)
+	}
+
+	if newReplicaOf("", false) != nil {
+		t.Error("Expected a node without a primary to be one")
+	}
+}
+
+func TestDbBatchHandler_Sequence(t *testing.T) {
+	storage = newTestDb(t)
+	defer func() { replica = nil }()
+
+	rw := httptest.NewRecorder()
+	dbBatchHandler(rw, httptest.NewRequest(http.MethodPost, "/db/_batch", strings.NewReader(`{"entries":[{"key":"a","value":"1"},{"key":"b","value":"2"}]}`)))
+	sequence := rw.Header().Get(httptools.SequenceHeader)
+	if rw.Code != http.StatusNoContent || sequence != "2" {
+		t.Fatalf("Expected the batch to return sequence 2, got %d %q", rw.Code, sequence)
+	}
+
+	// A replica reads the batched writes once it applied the sequence.
+	replica = newReplicaOf("", true)
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/db/b", nil)
+	req.Header.Set(httptools.MinSequenceHeader, sequence)
+	req.SetPathValue("key", "b")
+	httptools.WithMinSequence(http.HandlerFunc(dbGetHandler)).ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the batched write to be read at its sequence, got %d", rw.Code)
+	}
+}
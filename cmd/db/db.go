@@ -1,50 +1,427 @@
 package main
 
 import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
-	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
+	"github.com/QuantumGurus/Lab4-KPI/signal"
 )
 
+const idempotencyTTL = 10 * time.Minute
+
+// dataDir is where the node keeps its database.
+const dataDir = "db_data"
+
 var db *datastore.Db
+var storage store
+
+// getBudget bounds the storage reads of GETs, nil when they wait as long as
+// they take.
+var getBudget *readBudget
+
+// dbOptions are the options the database was opened with.
+var dbOptions datastore.Options
+
+// ready is set once the node finished its startup work and can take traffic.
+var ready atomic.Bool
 
 func main() {
-	var err error
+	// DB_PROFILE_DIR and DB_PROFILE_DURATION set where and for how long
+	// profiles are captured on SIGUSR1.
+	profileDir := os.Getenv("DB_PROFILE_DIR")
+	if profileDir == "" {
+		profileDir = os.TempDir()
+	}
+	profileDuration, _ := time.ParseDuration(os.Getenv("DB_PROFILE_DURATION"))
+	signal.ProfileOnSignal(profileDir, profileDuration)
 
-	CreateDirIfNotExist("db_data")
-	db, err = datastore.NewDatabase("db_data", 1024*1024)
+	CreateDirIfNotExist(dataDir)
+	// DB_RESTORE_SNAPSHOT is a snapshot file, from GET /db-admin/snapshot,
+	// the data directory is filled with when it is empty.
+	if path := os.Getenv("DB_RESTORE_SNAPSHOT"); path != "" {
+		restored, err := restoreAtStartup(path, dataDir)
+		if err != nil {
+			log.Fatalf("Failed to restore the snapshot %s: %s", path, err)
+		}
+		if restored {
+			log.Printf("Restored the database from the snapshot %s", path)
+		}
+	}
+	deadRatio, _ := strconv.ParseFloat(os.Getenv("DB_COMPACTION_DEAD_RATIO"), 64)
+	compactionSegments, _ := strconv.Atoi(os.Getenv("DB_COMPACTION_SEGMENTS"))
+	tierFanout, _ := strconv.Atoi(os.Getenv("DB_COMPACTION_TIER_FANOUT"))
+	compactionRate, _ := strconv.ParseInt(os.Getenv("DB_COMPACTION_RATE"), 10, 64)
+	cacheSize, _ := strconv.Atoi(os.Getenv("DB_CACHE_SIZE"))
+	dedupMinSize, _ := strconv.Atoi(os.Getenv("DB_DEDUP_MIN_SIZE"))
+	memoryLimit, _ := strconv.ParseInt(os.Getenv("DB_MEMORY_LIMIT"), 10, 64)
+	cacheMaxBytes, _ := strconv.ParseInt(os.Getenv("DB_CACHE_MAX_BYTES"), 10, 64)
+	writeLimits, err := parseWriteLimits(os.Getenv("DB_WRITE_LIMITS"))
 	if err != nil {
-		log.Fatalf("Failed to create database: %v", err)
+		log.Fatalf("Invalid DB_WRITE_LIMITS: %v", err)
+	}
+	retention, err := datastore.ParseRetentionRules(os.Getenv("DB_RETENTION"))
+	if err != nil {
+		log.Fatalf("Invalid DB_RETENTION: %v", err)
+	}
+	keyHasher, err := parseKeyHasher(os.Getenv("DB_KEY_HASH"), os.Getenv("DB_HASH_SEED"))
+	if err != nil {
+		log.Fatalf("Invalid key hash: %v", err)
+	}
+	dbOptions = datastore.Options{
+		SegmentSize:          1024 * 1024,
+		ArchiveDir:           os.Getenv("DB_ARCHIVE_DIR"),
+		CompactionSegments:   compactionSegments,
+		CompactionTierFanout: tierFanout,
+		CompactionDeadRatio:  deadRatio,
+		CompactionRate:       compactionRate,
+		CacheSize:            cacheSize,
+		TrackAccess:          true,
+		WriteLimits:          writeLimits,
+		Retention:            retention,
+		WAL:                  os.Getenv("DB_WAL") == "true",
+		DedupValues:          os.Getenv("DB_DEDUP") == "true",
+		DedupMinSize:         dedupMinSize,
+		SyncDirectories:      os.Getenv("DB_SYNC_DIRS") == "true",
+		CompressMetadata:     os.Getenv("DB_COMPRESS_METADATA") == "true",
+		ValueDictionary:      os.Getenv("DB_VALUE_DICTIONARY") == "true",
+		MemoryLimit:          memoryLimit,
+		CacheMaxBytes:        cacheMaxBytes,
+		KeyHasher:            keyHasher,
 	}
-
-	http.HandleFunc("GET /db/{key}", dbGetHandler)
-	http.HandleFunc("POST /db/{key}", dbPostHandler)
 
 	port := os.Getenv("DB_PORT")
 	if port == "" {
 		port = "8080"
 	}
+	// The data port answers with the recovery progress on /health/startup
+	// and 503 otherwise until the database is open.
+	// DB_TRACE logs a span for every data request and the storage
+	// operations it causes, joining the trace of its traceparent header.
+	var tracer *logTracer
+	if os.Getenv("DB_TRACE") == "true" {
+		tracer = newLogTracer(os.Stderr)
+		dbOptions.Tracer = tracer
+	}
+	boot := newStartup(time.Now)
+	dbOptions.OnRecoveryProgress = boot.report
+	go serveData(port, boot)
+
+	db, err = datastore.Open(dataDir, dbOptions)
+	if err != nil {
+		log.Fatalf("Failed to create database: %v", err)
+	}
+	for _, repair := range db.Repairs() {
+		log.Printf("Repaired segment %s (recovered %d of %d bytes): %s",
+			repair.Segment, repair.RecoveredBytes, repair.FileSize, repair.Action)
+	}
+
+	// DB_RETENTION_SWEEP is how often keys past their retention are
+	// deleted, every minute if not set.
+	sweepInterval, err := time.ParseDuration(os.Getenv("DB_RETENTION_SWEEP"))
+	if err != nil || sweepInterval <= 0 {
+		sweepInterval = time.Minute
+	}
+	go sweepRetention(sweepInterval)
+
+	// DB_TTL_SWEEP is how often expired keys are replaced with tombstones,
+	// publishing their expiry to watchers, every minute if not set.
+	ttlSweepInterval, err := time.ParseDuration(os.Getenv("DB_TTL_SWEEP"))
+	if err != nil || ttlSweepInterval <= 0 {
+		ttlSweepInterval = time.Minute
+	}
+	go sweepExpired(ttlSweepInterval)
+
+	// DB_SNAPSHOT_INTERVAL adds a snapshot to the DB_ARCHIVE_DIR archive
+	// that often, so restores replay only the segments sealed since.
+	snapshotInterval, _ := time.ParseDuration(os.Getenv("DB_SNAPSHOT_INTERVAL"))
+	if snapshotInterval > 0 && dbOptions.ArchiveDir != "" {
+		go archiveSnapshots(snapshotInterval)
+	}
+
+	if os.Getenv("DB_WARMUP") == "true" {
+		go func() {
+			loaded, err := db.WarmUp()
+			if err != nil {
+				log.Printf("Cache warm-up failed: %v", err)
+			}
+			log.Printf("Cache warm-up loaded %d hot keys", loaded)
+			ready.Store(true)
+		}()
+	} else {
+		ready.Store(true)
+	}
 
+	// DB_GET_BUDGET bounds how long a GET waits for the storage.
+	getBudgetLimit, _ := time.ParseDuration(os.Getenv("DB_GET_BUDGET"))
+	getBudget = newReadBudget(getBudgetLimit)
+
+	storage = db
+	if upstream := os.Getenv("DB_CACHE_UPSTREAM"); upstream != "" {
+		ttl, _ := time.ParseDuration(os.Getenv("DB_CACHE_TTL"))
+		storage = newCacheStore(db, upstream, ttl)
+		log.Printf("Cache mode enabled, upstream %s", upstream)
+	}
+	// A replica, a cache of an upstream included, sends the reads it is
+	// too stale for to DB_PRIMARY_URL, the upstream by default.
+	primary := os.Getenv("DB_PRIMARY_URL")
+	if primary == "" {
+		primary = os.Getenv("DB_CACHE_UPSTREAM")
+	}
+	replica = newReplicaOf(primary, os.Getenv("DB_REPLICA") == "true")
+
+	faults := newChaosFromEnv()
+	readOnly, err := loadReadOnly(dataDir)
+	if err != nil {
+		log.Fatalf("Failed to read the read-only marker: %v", err)
+	}
+	if settings := readOnly.current(); settings.Enabled {
+		log.Printf("Starting read-only: %s", settings.Reason)
+	}
+
+	idempotency := httptools.NewIdempotencyStore(idempotencyTTL)
+
+	// DB_MAX_CONCURRENT caps the data requests processed at once so a burst
+	// queues up in the clients instead of in the datastore workers.
+	maxConcurrent, _ := strconv.Atoi(os.Getenv("DB_MAX_CONCURRENT"))
+	concurrency := ratelimit.NewConcurrency(maxConcurrent)
+	limits := new(ratelimit.Metrics)
+	limit := func(next http.HandlerFunc) http.Handler {
+		if maxConcurrent <= 0 {
+			return next
+		}
+		return ratelimit.Wrap(next, concurrency, ratelimit.Global, limits)
+	}
+	sched := newSchedulerFromEnv()
+	read := func(next http.HandlerFunc) http.Handler { return sched.Wrap(classRead, limit(next)) }
+	write := func(next http.HandlerFunc) http.Handler { return sched.Wrap(classWrite, limit(next)) }
+	bulk := func(next http.HandlerFunc) http.Handler { return sched.Wrap(classBulk, limit(next)) }
+
+	data := http.NewServeMux()
+	data.HandleFunc("/health", healthHandler)
+	data.Handle("GET /db", faults.Wrap(bulk(dbListHandler)))
+	data.Handle("GET /db/{key}", faults.Wrap(read(dbGetHandler)))
+	data.Handle("POST /db/_mget", faults.Wrap(read(dbMGetHandler)))
+	data.HandleFunc("GET /db/_watch", dbWatchHandler)
+	data.Handle("POST /db/_batch", faults.WrapWrite(readOnly.Wrap(idempotency.Wrap(write(dbBatchHandler)))))
+	data.Handle("POST /db/{key}", faults.WrapWrite(readOnly.Wrap(idempotency.Wrap(write(dbPostHandler)))))
+	data.Handle("DELETE /db/{key}", faults.WrapWrite(readOnly.Wrap(idempotency.Wrap(write(dbDeleteHandler)))))
+	// Advisory locks are kept by this node, also in cache mode.
+	data.Handle("GET /db/{key}/lock", faults.Wrap(read(dbGetLockHandler)))
+	data.Handle("POST /db/{key}/lock", faults.Wrap(idempotency.Wrap(write(dbLockHandler))))
+	data.Handle("DELETE /db/{key}/lock", faults.Wrap(write(dbUnlockHandler)))
+	data.Handle("POST /streams/{stream}", faults.WrapWrite(readOnly.Wrap(idempotency.Wrap(write(dbAppendHandler)))))
+	data.Handle("GET /streams/{stream}/groups/{group}", faults.Wrap(read(dbConsumeHandler)))
+	data.Handle("POST /streams/{stream}/groups/{group}/ack", faults.WrapWrite(readOnly.Wrap(write(dbAckHandler))))
+
+	bandwidth, _ := strconv.Atoi(os.Getenv("DB_SEGMENT_BANDWIDTH"))
+	segmentBandwidth = newBandwidthLimiter(bandwidth)
+
+	// DB_ADMIN_TOKEN, when set, must be presented as a bearer token to use
+	// the admin API.
+	admin := adminAuth(os.Getenv("DB_ADMIN_TOKEN"), newAdminMux(faults, limits, readOnly, sched))
+
+	// DB_ADMIN_ADDR moves the admin API to its own listener, for example
+	// "127.0.0.1:9090", so only the data port has to be reachable by the
+	// app servers. Without it both share the data port.
+	if adminAddr := os.Getenv("DB_ADMIN_ADDR"); adminAddr != "" {
+		log.Printf("Starting DB admin server on %s", adminAddr)
+		go func() {
+			log.Fatal(http.ListenAndServe(adminAddr, httptools.WithDeadline(admin)))
+		}()
+	} else {
+		data.Handle("/db-admin/", admin)
+	}
+
+	var handler http.Handler = drain.Wrap(data)
+	if tracer != nil {
+		handler = tracer.Wrap(handler)
+	}
+	boot.finish(httptools.WithDeadline(httptools.WithMinSequence(handler)))
+
+	// SIGTERM or POST /db-admin/drain drain the node: new requests get 503
+	// while those in flight have DB_DRAIN_GRACE, 30s if not set, to finish
+	// before the database is closed.
+	drainGrace, err := time.ParseDuration(os.Getenv("DB_DRAIN_GRACE"))
+	if err != nil || drainGrace <= 0 {
+		drainGrace = 30 * time.Second
+	}
+	go func() {
+		signal.WaitForTerminationSignal()
+		drain.request()
+	}()
+	<-drain.requested
+	log.Printf("Draining, waiting up to %s for the requests in flight", drainGrace)
+	drain.run(drainGrace)
+	if err := db.Close(); err != nil {
+		log.Fatalf("Failed to close the database: %s", err)
+	}
+	log.Println("Drained, database closed")
+}
+
+// serveData listens on the data port.
+func serveData(port string, handler http.Handler) {
+	// DB_CLIENT_CA turns on mutual TLS on the data port: clients must show a
+	// certificate signed by it, and with DB_ALLOWED_CLIENTS one naming an
+	// allowed identity, so other containers can't use the db directly.
+	server := &http.Server{Addr: ":" + port, Handler: handler}
+	if clientCA := os.Getenv("DB_CLIENT_CA"); clientCA != "" {
+		clientCAs, err := httptools.LoadCertPool(clientCA)
+		if err != nil {
+			log.Fatalf("Failed to load the client CA: %s", err)
+		}
+		server.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+		var allowed []string
+		for _, identity := range strings.Split(os.Getenv("DB_ALLOWED_CLIENTS"), ",") {
+			if identity = strings.TrimSpace(identity); identity != "" {
+				allowed = append(allowed, identity)
+			}
+		}
+		server.Handler = clientAuth(allowed, server.Handler)
+		log.Printf("Starting DB server with mutual TLS on port %s", port)
+		log.Fatal(server.ListenAndServeTLS(os.Getenv("DB_TLS_CERT"), os.Getenv("DB_TLS_KEY")))
+	}
 	log.Printf("Starting DB server on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	log.Fatal(server.ListenAndServe())
+}
+
+// newAdminMux routes the admin and metrics API. Work reading or writing
+// whole segments runs in the bulk class of sched. Routes changing the data
+// are refused while the node is read-only.
+func newAdminMux(faults *chaos, limits *ratelimit.Metrics, readOnly *readOnly, sched *scheduler) *http.ServeMux {
+	bulk := func(next http.HandlerFunc) http.Handler { return sched.Wrap(classBulk, next) }
+	admin := http.NewServeMux()
+	admin.HandleFunc("/health", healthHandler)
+	admin.Handle("/db-admin/chaos", faults)
+	admin.Handle("/db-admin/read-only", readOnly)
+	admin.HandleFunc("GET /db-admin/stats", dbStatsHandler)
+	admin.HandleFunc("GET /db-admin/metrics", dbMetricsHandler)
+	admin.Handle("GET /db-admin/compaction", bulk(dbCompactionEstimateHandler))
+	admin.HandleFunc("GET /db-admin/hot-keys", dbHotKeysHandler)
+	admin.Handle("GET /db-admin/rate-limits", limits)
+	admin.Handle("GET /db-admin/scheduler", sched)
+	admin.Handle("GET /db-admin/index", bulk(dbIndexHandler))
+	admin.Handle("POST /db-admin/reindex", readOnly.Wrap(bulk(dbReindexHandler)))
+	admin.HandleFunc("GET /db-admin/write-limits", dbWriteLimitsHandler)
+	admin.HandleFunc("POST /db-admin/write-limits", dbSetWriteLimitHandler)
+	admin.HandleFunc("GET /db-admin/retention", dbRetentionHandler)
+	admin.HandleFunc("POST /db-admin/retention", dbSetRetentionHandler)
+	admin.Handle("POST /db-admin/retention/sweep", readOnly.Wrap(bulk(dbSweepRetentionHandler)))
+	admin.Handle("POST /db-admin/ttl/sweep", readOnly.Wrap(bulk(dbSweepExpiredHandler)))
+	admin.HandleFunc("GET /db-admin/segments", dbSegmentsHandler)
+	admin.Handle("GET /db-admin/segments/{name}", bulk(dbSegmentHandler))
+	admin.HandleFunc("GET /db-admin/segments/{name}/hint", dbSegmentHintHandler)
+	admin.Handle("POST /db-admin/segments/import", readOnly.Wrap(bulk(dbImportSegmentHandler)))
+	admin.Handle("GET /db-admin/snapshot", bulk(dbSnapshotHandler))
+	admin.Handle("GET /db-admin/export", bulk(dbExportHandler))
+	admin.Handle("POST /db-admin/import", readOnly.Wrap(bulk(dbImportHandler)))
+	admin.Handle("POST /db-admin/bootstrap", readOnly.Wrap(bulk(dbBootstrapHandler)))
+	admin.HandleFunc("POST /db-admin/drain", dbDrainHandler)
+	return admin
+}
+
+// adminAuth lets only requests carrying the bearer token through, except
+// health checks. An empty token disables the check.
+func adminAuth(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			responseWriter.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(responseWriter, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(responseWriter, req)
+	})
+}
+
+// clientAuth lets only requests from clients whose certificate names one
+// of the allowed identities through, by common name or URI SAN such as
+// "spiffe://lab4/server", except health checks. No identities allow every
+// client with a verified certificate.
+func clientAuth(allowed []string, next http.Handler) http.Handler {
+	if len(allowed) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" && !slices.ContainsFunc(httptools.PeerIdentities(req.TLS), func(identity string) bool {
+			return slices.Contains(allowed, identity)
+		}) {
+			http.Error(responseWriter, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(responseWriter, req)
+	})
+}
+
+func healthHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "text/plain")
+	if drain.isDraining() {
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = responseWriter.Write([]byte("DRAINING"))
+	} else if ready.Load() {
+		responseWriter.WriteHeader(http.StatusOK)
+		_, _ = responseWriter.Write([]byte("OK"))
+	} else {
+		responseWriter.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = responseWriter.Write([]byte("WARMING UP"))
+	}
 }
 
 func dbGetHandler(responseWriter http.ResponseWriter, req *http.Request) {
 	key := req.PathValue("key")
-	value, err := db.Get(key)
+	format, err := httptools.ParseResponseFormat(req)
 	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !replica.fresh(responseWriter, req) {
+		return
+	}
+	// Taken before the read, the sequence is one the record is as new as.
+	setSequence(responseWriter)
+	record, err := getBudget.getRecord(req.Context(), storage, key)
+	if err == errOverBudget {
+		responseWriter.Header().Set("Retry-After", "1")
+		http.Error(responseWriter, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, datastore.ErrNotFound) {
 		responseWriter.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// A corrupted record is not a missing one: the key exists and the read
+	// failed.
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	response := map[string]string{"key": key, "value": value}
-
-	encodingErr := json.NewEncoder(responseWriter).Encode(response)
-	if encodingErr != nil {
-		responseWriter.WriteHeader(http.StatusInternalServerError)
+	response := httptools.ResponseRecord{Key: key, Value: record.Value, Version: record.Version}
+	if expiresAt := record.ExpiresAt(); !expiresAt.IsZero() {
+		response.TTL = time.Until(expiresAt)
 	}
+
+	_ = format.Write(responseWriter, req, response)
 }
 
 func CreateDirIfNotExist(dir string) {
@@ -56,23 +433,486 @@ func CreateDirIfNotExist(dir string) {
 	}
 }
 
+type putRequest struct {
+	Value *string  `json:"value"`
+	Tags  []string `json:"tags,omitempty"`
+	// Version is the expected current version for optimistic locking.
+	Version *uint64 `json:"version,omitempty"`
+	// TTLMillis makes the key expire that many milliseconds after the write.
+	TTLMillis int64 `json:"ttl_ms,omitempty"`
+}
+
+type recordResponse struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	// Durability is the semantics a write was acknowledged with.
+	Durability datastore.Durability `json:"durability,omitempty"`
+}
+
+// durabilityHeader reports the durability of a write, also for deletes
+// which have no response body.
+const durabilityHeader = "X-Durability"
+
+// writeDurability reads the durability query parameter of a write. "sync"
+// acknowledges the write once it is on disk, "async" once it is applied in
+// memory; without it the database default applies. The applied semantics
+// are set in the durability header.
+func writeDurability(responseWriter http.ResponseWriter, req *http.Request) (datastore.Durability, bool) {
+	durability, err := datastore.ParseDurability(req.URL.Query().Get("durability"))
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	responseWriter.Header().Set(durabilityHeader, string(storage.Durability(durability)))
+	return durability, true
+}
+
+// rawBody tells whether a write carries the value bytes alone, as
+// application/octet-stream, instead of a JSON request.
+func rawBody(req *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return mediaType == "application/octet-stream"
+}
+
+// dbPostHandler stores a JSON put request, or a binary value sent raw. A raw
+// write is answered 204 with the version in the version header, as its
+// value doesn't fit a JSON response.
 func dbPostHandler(responseWriter http.ResponseWriter, req *http.Request) {
 	key := req.PathValue("key")
-	var request map[string]string
+	var request putRequest
 
-	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+	durability, ok := writeDurability(responseWriter, req)
+	if !ok {
+		return
+	}
+	raw := rawBody(req)
+	if raw {
+		value, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		request.Value = new(string)
+		*request.Value = string(value)
+	} else if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
 		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	value, isFieldPresent := request["value"]
-	if !isFieldPresent {
+	if request.Value == nil {
 		http.Error(responseWriter, "Value is missing", http.StatusBadRequest)
 		return
 	}
 
-	putErr := db.Put(key, value)
+	version, putErr := putRecord(req.Context(), storage, key, *request.Value, datastore.WriteOptions{
+		Tags:            request.Tags,
+		ExpectedVersion: request.Version,
+		Durability:      durability,
+		TTL:             time.Duration(request.TTLMillis) * time.Millisecond,
+	})
+	if putErr == datastore.ErrVersionConflict {
+		http.Error(responseWriter, putErr.Error(), http.StatusConflict)
+		return
+	}
+	if putErr == datastore.ErrBadTTL {
+		http.Error(responseWriter, putErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if putErr == datastore.ErrThrottled {
+		http.Error(responseWriter, putErr.Error(), http.StatusTooManyRequests)
+		return
+	}
 	if putErr != nil {
 		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setSequence(responseWriter)
+	if raw {
+		responseWriter.Header().Set(httptools.VersionHeader, strconv.FormatUint(version, 10))
+		responseWriter.WriteHeader(http.StatusNoContent)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(recordResponse{Key: key, Value: *request.Value, Version: version, Durability: storage.Durability(durability)})
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Records []recordResponse `json:"records"`
+}
+
+func dbMGetHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request mgetRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	records, err := storage.MultiGetRecords(request.Keys)
+	if req.Context().Err() != nil {
+		// The caller has given up, there is no one to answer to.
+		responseWriter.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := mgetResponse{Records: []recordResponse{}}
+	for _, key := range request.Keys {
+		if record, found := records[key]; found {
+			response.Records = append(response.Records, recordResponse{Key: key, Value: record.Value, Version: record.Version})
+		}
+	}
+
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(response)
+}
+
+type batchRequest struct {
+	Entries []batchEntry `json:"entries"`
+}
+
+type batchEntry struct {
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	Tags      []string `json:"tags,omitempty"`
+	TTLMillis int64    `json:"ttl_ms,omitempty"`
+}
+
+// dbBatchHandler stores all entries of the request in one atomic write. The
+// new versions are not reported, so it answers 204.
+func dbBatchHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request batchRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]datastore.Entry, len(request.Entries))
+	for i, e := range request.Entries {
+		entries[i] = datastore.Entry{
+			Key:   e.Key,
+			Value: e.Value,
+			Tags:  e.Tags,
+			TTL:   time.Duration(e.TTLMillis) * time.Millisecond,
+		}
+	}
+	err := storage.PutBatch(entries)
+	if err == datastore.ErrBadTTL {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == datastore.ErrThrottled {
+		http.Error(responseWriter, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	setSequence(responseWriter)
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func dbDeleteHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	key := req.PathValue("key")
+
+	durability, ok := writeDurability(responseWriter, req)
+	if !ok {
+		return
+	}
+	err := deleteRecord(req.Context(), storage, key, datastore.DeleteOptions{Durability: durability})
+	if err == datastore.ErrThrottled {
+		http.Error(responseWriter, err.Error(), http.StatusTooManyRequests)
+	} else if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+	} else {
+		setSequence(responseWriter)
+	}
+}
+
+func dbStatsHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(db.Stats())
+}
+
+// dbExportHandler streams the live records as NDJSON, or CSV with
+// format=csv.
+func dbExportHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	format := datastore.ExportNDJSON
+	if value := req.URL.Query().Get("format"); value != "" {
+		var err error
+		if format, err = datastore.ParseExportFormat(value); err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	contentType := "application/x-ndjson"
+	if format == datastore.ExportCSV {
+		contentType = "text/csv"
+	}
+	responseWriter.Header().Set("content-type", contentType)
+	if err := db.Export(limitBandwidth(responseWriter), format); err != nil {
+		// The status is sent already, the client sees the export cut short.
+		log.Printf("Failed to export the records: %s", err)
+	}
+}
+
+type importResponse struct {
+	Imported int    `json:"imported"`
+	Error    string `json:"error,omitempty"`
+}
+
+// dbImportHandler loads the records in the request body, NDJSON or CSV
+// with format=csv as GET /db-admin/export writes them, in large batches.
+// A failed import reports the records stored before the failure.
+func dbImportHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	format := datastore.ExportNDJSON
+	if value := req.URL.Query().Get("format"); value != "" {
+		var err error
+		if format, err = datastore.ParseExportFormat(value); err != nil {
+			http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	imported, err := db.Import(req.Body, format)
+	response := importResponse{Imported: imported}
+	status := http.StatusOK
+	switch {
+	case err == nil:
+	case errors.Is(err, datastore.ErrBadImport):
+		status = http.StatusBadRequest
+	case err == datastore.ErrThrottled:
+		status = http.StatusTooManyRequests
+	default:
+		log.Printf("Import failed after %d records: %s", imported, err)
+		status = http.StatusInternalServerError
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	// The records imported before a failure stay written.
+	if imported > 0 {
+		setSequence(responseWriter)
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	responseWriter.WriteHeader(status)
+	_ = json.NewEncoder(responseWriter).Encode(response)
+}
+
+// dbCompactionEstimateHandler reports what a compaction would merge and
+// reclaim, so operators can tell whether one is worth running.
+func dbCompactionEstimateHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(db.EstimateCompaction())
+}
+
+type indexResponse struct {
+	datastore.IndexSummary
+	Entries []datastore.IndexEntry `json:"entries,omitempty"`
+}
+
+// dbIndexHandler summarizes the in-memory index. With full=true it also
+// lists every entry, as long as the index is small.
+func dbIndexHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	response := indexResponse{IndexSummary: db.IndexSummary()}
+	if req.URL.Query().Get("full") == "true" {
+		entries, err := db.DumpIndex()
+		if err == datastore.ErrIndexTooLarge {
+			http.Error(responseWriter, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			responseWriter.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response.Entries = entries
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(response)
+}
+
+// dbReindexHandler rebuilds the index from the segment files.
+func dbReindexHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	result, err := db.Reindex()
+	if err != nil {
+		log.Printf("Reindex failed: %s", err)
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Reindexed %d keys in %d segments, %d entries changed", result.Keys, result.Segments, result.Changed)
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(result)
+}
+
+// dbListHandler lists the keys carrying a tag, or otherwise a page of keys
+// with a prefix.
+func dbListHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var response any
+	if tag := query.Get("tag"); tag != "" {
+		response = map[string]any{"tag": tag, "keys": db.FindByTag(tag)}
+	} else {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		response = db.Keys(query.Get("prefix"), query.Get("after"), limit)
+	}
+
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(response)
+}
+
+func dbHotKeysHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	n, err := strconv.Atoi(req.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(db.HotKeys(n))
+}
+
+func dbWriteLimitsHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(db.WriteLimits())
+}
+
+func dbSetWriteLimitHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var limit datastore.WriteLimit
+	if err := json.NewDecoder(req.Body).Decode(&limit); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetWriteLimit(limit); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dbWriteLimitsHandler(responseWriter, req)
+}
+
+func dbRetentionHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(db.RetentionRules())
+}
+
+func dbSetRetentionHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var rule datastore.RetentionRule
+	if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := db.SetRetention(rule); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dbRetentionHandler(responseWriter, req)
+}
+
+func dbSweepRetentionHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	swept, err := db.SweepRetention()
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(map[string]int{"swept": swept})
+}
+
+// sweepRetention deletes keys past their retention every interval. Rules
+// set at run time are picked up by the next sweep.
+func sweepRetention(interval time.Duration) {
+	for range time.Tick(interval) {
+		swept, err := db.SweepRetention()
+		if err != nil {
+			log.Printf("Retention sweep failed: %v", err)
+		}
+		if swept > 0 {
+			log.Printf("Retention sweep deleted %d keys", swept)
+		}
+	}
+}
+
+func dbSweepExpiredHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	swept, err := db.SweepExpired()
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(map[string]int{"swept": swept})
+}
+
+// sweepExpired replaces expired keys with tombstones every interval.
+func sweepExpired(interval time.Duration) {
+	for range time.Tick(interval) {
+		swept, err := db.SweepExpired()
+		if err != nil {
+			log.Printf("TTL sweep failed: %v", err)
+		}
+		if swept > 0 {
+			log.Printf("TTL sweep expired %d keys", swept)
+		}
+	}
+}
+
+// archiveSnapshots adds a snapshot to the archive every interval.
+func archiveSnapshots(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := db.ArchiveSnapshot(); err != nil {
+			log.Printf("Archive snapshot failed: %v", err)
+		}
+	}
+}
+
+// parseKeyHasher selects the key hash: "siphash", the default, keyed with
+// seed given as 32 hex digits or a random one, or "fnv".
+func parseKeyHasher(kind, seed string) (datastore.KeyHasher, error) {
+	switch kind {
+	case "fnv":
+		return datastore.FNVHasher{}, nil
+	case "", "siphash":
+		if seed == "" {
+			return datastore.RandomSipHasher(), nil
+		}
+		key, err := hex.DecodeString(seed)
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("seed must be 32 hex digits")
+		}
+		return datastore.NewSipHasher([16]byte(key)), nil
+	}
+	return nil, fmt.Errorf("unknown key hash %q", kind)
+}
+
+// parseWriteLimits reads limits in the "prefix=rate,prefix=rate" form, e.g.
+// "sessions/*=1000,reports/*=10".
+func parseWriteLimits(spec string) ([]datastore.WriteLimit, error) {
+	var limits []datastore.WriteLimit
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, rate, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("missing rate in %q", item)
+		}
+		value, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad rate in %q: %w", item, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, fmt.Errorf("bad rate in %q", item)
+		}
+		limits = append(limits, datastore.WriteLimit{Prefix: prefix, Rate: value})
 	}
+	return limits, nil
 }
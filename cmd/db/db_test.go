@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
+)
+
+func TestParseWriteLimits(t *testing.T) {
+	limits, err := parseWriteLimits("sessions/*=1000, reports/=2.5,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []datastore.WriteLimit{
+		{Prefix: "sessions/*", Rate: 1000},
+		{Prefix: "reports/", Rate: 2.5},
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Errorf("Unexpected limits %+v", limits)
+	}
+
+	for _, spec := range []string{"sessions/*", "sessions/*=fast", "sessions/*=NaN", "sessions/*=Inf"} {
+		if _, err := parseWriteLimits(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestParseKeyHasher(t *testing.T) {
+	seed := "000102030405060708090a0b0c0d0e0f"
+	hasher, err := parseKeyHasher("", seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := parseKeyHasher("siphash", seed)
+	if hasher.HashKey("key") != other.HashKey("key") {
+		t.Error("Expected the same seed to hash keys alike")
+	}
+	if hasher, _ := parseKeyHasher("fnv", ""); hasher != (datastore.FNVHasher{}) {
+		t.Errorf("Expected the fnv hash, got %T", hasher)
+	}
+
+	for _, spec := range [][2]string{{"md5", ""}, {"siphash", "0102"}, {"", seed + "00"}} {
+		if _, err := parseKeyHasher(spec[0], spec[1]); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
+
+func TestDbMGetHandler(t *testing.T) {
+	storage = newTestDb(t)
+	_ = storage.(*datastore.Db).Put("a", "1")
+	_ = storage.(*datastore.Db).Put("b", "2")
+
+	rw := httptest.NewRecorder()
+	dbMGetHandler(rw, httptest.NewRequest(http.MethodPost, "/db/_mget", strings.NewReader(`{"keys":["b","missing","a"]}`)))
+
+	var response mgetResponse
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	expected := []recordResponse{{Key: "b", Value: "2", Version: 1}, {Key: "a", Value: "1", Version: 1}}
+	if !reflect.DeepEqual(response.Records, expected) {
+		t.Errorf("Unexpected records %+v", response.Records)
+	}
+}
+
+func TestDbBatchHandler(t *testing.T) {
+	storage = newTestDb(t)
+
+	post := func(body string) int {
+		rw := httptest.NewRecorder()
+		dbBatchHandler(rw, httptest.NewRequest(http.MethodPost, "/db/_batch", strings.NewReader(body)))
+		return rw.Code
+	}
+	if code := post(`{"entries":[{"key":"a","value":"1"},{"key":"b","value":"2","ttl_ms":-1}]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative ttl, got %d", code)
+	}
+	if _, err := storage.GetRecord("a"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the rejected batch to store nothing, got %v", err)
+	}
+	if code := post(`{"entries":[{"key":"a","value":"1"},{"key":"b","value":"2"}]}`); code != http.StatusNoContent {
+		t.Fatalf("Expected the batch to be stored, got %d", code)
+	}
+	records, _ := storage.MultiGetRecords([]string{"a", "b"})
+	if records["a"].Value != "1" || records["b"].Value != "2" {
+		t.Errorf("Unexpected records %+v", records)
+	}
+}
+
+func TestDbPostHandler_TTL(t *testing.T) {
+	storage = newTestDb(t)
+
+	post := func(body string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/db/a", strings.NewReader(body))
+		req.SetPathValue("key", "a")
+		dbPostHandler(rw, req)
+		return rw.Code
+	}
+	if code := post(`{"value":"1","ttl_ms":-1}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative ttl, got %d", code)
+	}
+	if code := post(`{"value":"1","ttl_ms":1}`); code != http.StatusOK {
+		t.Fatalf("Expected the write with a ttl to succeed, got %d", code)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := storage.GetRecord("a"); err != datastore.ErrNotFound {
+		t.Errorf("Expected the key to expire, got %v", err)
+	}
+}
+
+func TestDbGetHandler_Corrupted(t *testing.T) {
+	fsys := datastore.NewMemFilesystem()
+	db, err := datastore.Open("db", datastore.Options{SegmentSize: 1024, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	storage = db
+	_ = db.Put("a", "value1")
+
+	// Flip a bit of the value in the segment file.
+	files, _ := fsys.ReadDir("db")
+	for _, file := range files {
+		path := "db/" + file.Name()
+		data, _ := fsys.ReadFile(path)
+		if i := bytes.Index(data, []byte("value1")); i >= 0 {
+			data[i] ^= 0x01
+			_ = fsys.WriteFile(path, data, 0o600)
+		}
+	}
+
+	get := func(key string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/db/"+key, nil)
+		req.SetPathValue("key", key)
+		dbGetHandler(rw, req)
+		return rw.Code
+	}
+	if code := get("a"); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 for the corrupted record, got %d", code)
+	}
+	if code := get("missing"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing key, got %d", code)
+	}
+}
+
+func TestDbGetHandler_Envelope(t *testing.T) {
+	storage = newTestDb(t)
+	_, _ = storage.PutWithOptions("a", "1", datastore.WriteOptions{TTL: time.Hour})
+
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", accept)
+		req.SetPathValue("key", "a")
+		dbGetHandler(rw, req)
+		return rw
+	}
+	if rw := get("/db/a", ""); rw.Body.String() != `{"key":"a","value":"1","version":1}`+"\n" {
+		t.Errorf("Expected the record envelope by default, got %s", rw.Body)
+	}
+	if rw := get("/db/a?envelope=bare", ""); rw.Body.String() != `"1"`+"\n" {
+		t.Errorf("Expected the bare value, got %s", rw.Body)
+	}
+	var response struct {
+		Data map[string]string `json:"data"`
+		Meta map[string]any    `json:"meta"`
+	}
+	rw := get("/db/a", `application/json; profile="data camel"`)
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := response.Meta["ttlMs"].(float64); response.Data["value"] != "1" || response.Meta["version"] != float64(1) || ttl <= 0 || ttl > 3600000 {
+		t.Errorf("Unexpected data envelope %+v", response)
+	}
+	if rw := get("/db/a?envelope=full", ""); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown envelope, got %d", rw.Code)
+	}
+}
+
+func TestDbPostHandler_Durability(t *testing.T) {
+	storage = newTestDb(t)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/db/a?durability=async", strings.NewReader(`{"value":"1"}`))
+	req.SetPathValue("key", "a")
+	dbPostHandler(rw, req)
+	var response recordResponse
+	if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Durability != datastore.DurabilityAsync || rw.Header().Get(durabilityHeader) != "async" {
+		t.Errorf("Unexpected durability %q, header %q", response.Durability, rw.Header().Get(durabilityHeader))
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/db/a", nil)
+	req.SetPathValue("key", "a")
+	dbDeleteHandler(rw, req)
+	if rw.Code != http.StatusOK || rw.Header().Get(durabilityHeader) != "async" {
+		t.Errorf("Unexpected delete response %d, durability %q", rw.Code, rw.Header().Get(durabilityHeader))
+	}
+
+	rw = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/db/a?durability=never", strings.NewReader(`{"value":"1"}`))
+	req.SetPathValue("key", "a")
+	dbPostHandler(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown durability, got %d", rw.Code)
+	}
+}
+
+func TestDbHandlers_Bytes(t *testing.T) {
+	storage = newTestDb(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /db/{key}", dbGetHandler)
+	mux.HandleFunc("POST /db/{key}", dbPostHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := dbclient.New(server.URL)
+	value := []byte{0xff, 0x00, 0xc3, 0x28, '"', '\\', '\n'}
+	version, err := client.PutBytes(context.Background(), "blob", value)
+	if err != nil || version != 1 {
+		t.Fatalf("Expected version 1, got %d, %v", version, err)
+	}
+	got, err := client.GetBytes(context.Background(), "blob")
+	if err != nil || !bytes.Equal(got, value) {
+		t.Errorf("Expected %x back, got %x, %v", value, got, err)
+	}
+	if stored, _ := storage.GetRecord("blob"); stored.Value != string(value) {
+		t.Errorf("Expected the raw bytes to be stored, got %q", stored.Value)
+	}
+	if _, err := client.GetBytes(context.Background(), "missing"); err != dbclient.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDbIndexHandlers(t *testing.T) {
+	db = newTestDb(t)
+	_ = db.Put("a", "1")
+	_ = db.Delete("a")
+
+	rw := httptest.NewRecorder()
+	dbIndexHandler(rw, httptest.NewRequest(http.MethodGet, "/db-admin/index?full=true", nil))
+	var index indexResponse
+	if err := json.NewDecoder(rw.Body).Decode(&index); err != nil {
+		t.Fatal(err)
+	}
+	if index.Keys != 1 || len(index.Entries) != 1 || !index.Entries[0].Deleted {
+		t.Errorf("Unexpected index %+v", index)
+	}
+
+	rw = httptest.NewRecorder()
+	dbReindexHandler(rw, httptest.NewRequest(http.MethodPost, "/db-admin/reindex", nil))
+	var result datastore.ReindexResult
+	if err := json.NewDecoder(rw.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || result.Keys != 1 || result.Changed != 0 {
+		t.Errorf("Unexpected reindex result %d %+v", rw.Code, result)
+	}
+}
+
+func TestNewAdminMux(t *testing.T) {
+	db = newTestDb(t)
+	ready.Store(true)
+	defer ready.Store(false)
+	admin := newAdminMux(new(chaos), new(ratelimit.Metrics), new(readOnly), newScheduler([classCount]int{}, 0))
+
+	for _, target := range []string{"/db-admin/stats", "/db-admin/index", "/db-admin/rate-limits", "/health"} {
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+		if rw.Code != http.StatusOK {
+			t.Errorf("GET %s = %d", target, rw.Code)
+		}
+	}
+	rw := httptest.NewRecorder()
+	admin.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/db/key", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("The data API must not be served on the admin listener, got %d", rw.Code)
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	db = newTestDb(t)
+	ready.Store(true)
+	defer ready.Store(false)
+	admin := adminAuth("secret", newAdminMux(new(chaos), new(ratelimit.Metrics), new(readOnly), newScheduler([classCount]int{}, 0)))
+
+	send := func(target, authorization string) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		admin.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := send("/db-admin/segments", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a token, got %d", code)
+	}
+	if code := send("/db-admin/segments", "Bearer wrong"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", code)
+	}
+	if code := send("/db-admin/segments", "Bearer secret"); code != http.StatusOK {
+		t.Errorf("Expected 200 with the token, got %d", code)
+	}
+	if code := send("/health", ""); code != http.StatusOK {
+		t.Errorf("Health checks must not need the token, got %d", code)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainHeader marks the responses of a draining node: the 503 refusing a
+// new request, and the trailer of a streamed response the grace period cut
+// short, so the client knows to resume on another node.
+const drainHeader = "X-Db-Draining"
+
+var errDraining = errors.New("server draining")
+
+// drainer shuts the node down softly: it stops taking requests, gives
+// those in flight, long scans and exports included, a grace period to
+// finish, then cuts the rest so the database can be closed. Health checks
+// answer 503 from the start of the drain, which takes the node out of the
+// rotation of its clients.
+type drainer struct {
+	requested   chan struct{}
+	requestOnce sync.Once
+
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+
+	// expired is done once the grace period is over.
+	expired context.Context
+	expire  context.CancelFunc
+}
+
+func newDrainer() *drainer {
+	expired, expire := context.WithCancel(context.Background())
+	return &drainer{requested: make(chan struct{}), expired: expired, expire: expire}
+}
+
+// drain is the drainer of the node.
+var drain = newDrainer()
+
+// request starts the drain; the requests arriving from now on are refused.
+func (d *drainer) request() {
+	d.requestOnce.Do(func() {
+		d.mu.Lock()
+		d.draining = true
+		d.mu.Unlock()
+		close(d.requested)
+	})
+}
+
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// run waits up to grace for the requests in flight, then cuts those left
+// and waits for them to return.
+func (d *drainer) run(grace time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+	}
+	log.Printf("Drain grace period of %s over, cutting the requests left", grace)
+	d.expire()
+	<-done
+}
+
+// Wrap refuses requests once the drain started and tracks the others;
+// health checks always pass. When the grace period is over the context of
+// the requests left is canceled and their writes fail, with the drain
+// header set as a trailer.
+func (d *drainer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		d.mu.Lock()
+		if d.draining {
+			d.mu.Unlock()
+			rw.Header().Set(drainHeader, "true")
+			rw.Header().Set("Connection", "close")
+			http.Error(rw, errDraining.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		d.inFlight.Add(1)
+		d.mu.Unlock()
+		defer d.inFlight.Done()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		stop := context.AfterFunc(d.expired, cancel)
+		defer stop()
+		next.ServeHTTP(&drainWriter{ResponseWriter: rw, expired: d.expired}, r.WithContext(ctx))
+	})
+}
+
+// drainWriter fails the writes of a response once the grace period is
+// over.
+type drainWriter struct {
+	http.ResponseWriter
+	expired context.Context
+}
+
+func (w *drainWriter) Write(p []byte) (int, error) {
+	if w.expired.Err() != nil {
+		w.Header().Set(http.TrailerPrefix+drainHeader, "cut")
+		return 0, errDraining
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *drainWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// dbDrainHandler starts the drain, after which the node closes the
+// database and exits.
+func dbDrainHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	drain.request()
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainer(t *testing.T) {
+	d := newDrainer()
+	started := make(chan struct{})
+	server := httptest.NewServer(d.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+		// A long scan streaming its results until it is cut.
+		_, _ = rw.Write([]byte("first\n"))
+		_ = http.NewResponseController(rw).Flush()
+		close(started)
+		<-r.Context().Done()
+		if _, err := rw.Write([]byte("second\n")); err != errDraining {
+			t.Errorf("Expected the write after the grace period to fail, got %v", err)
+		}
+	})))
+	defer server.Close()
+
+	scan := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(server.URL + "/db")
+		if err != nil {
+			t.Error(err)
+			close(scan)
+			return
+		}
+		scan <- resp
+	}()
+	<-started
+
+	d.request()
+	resp, err := http.Get(server.URL + "/db/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get(drainHeader) != "true" {
+		t.Errorf("Expected new requests to be refused, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp, err := http.Get(server.URL + "/health"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected health checks to pass the drainer, got %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	start := time.Now()
+	d.run(20 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the scan to get the grace period, it was cut after %s", elapsed)
+	}
+	resp = <-scan
+	if resp == nil {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "first\n" || resp.Trailer.Get(drainHeader) != "cut" {
+		t.Errorf("Expected the scan cut with the drain trailer, got %q, trailer %v", body, resp.Trailer)
+	}
+
+	// Without requests in flight the drain is over at once.
+	idle := newDrainer()
+	idle.request()
+	start = time.Now()
+	idle.run(time.Minute)
+	if time.Since(start) > time.Second {
+		t.Error("Expected an idle drain not to wait for the grace period")
+	}
+}
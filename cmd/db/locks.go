@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+type lockRequest struct {
+	TTLMillis int64  `json:"ttl_ms"`
+	Owner     string `json:"owner,omitempty"`
+	// Token renews the lock held with it.
+	Token uint64 `json:"token,omitempty"`
+}
+
+// dbLockHandler acquires or renews the advisory lock of a key. A lock held
+// by someone else is answered with 423, a renewal of a lost lock with 409.
+func dbLockHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request lockRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	lock, err := db.LockWithOptions(req.PathValue("key"), datastore.LockOptions{
+		TTL:   time.Duration(request.TTLMillis) * time.Millisecond,
+		Owner: request.Owner,
+		Token: request.Token,
+	})
+	switch err {
+	case nil:
+	case datastore.ErrLocked:
+		http.Error(responseWriter, err.Error(), http.StatusLocked)
+		return
+	case datastore.ErrLockNotHeld:
+		http.Error(responseWriter, err.Error(), http.StatusConflict)
+		return
+	case datastore.ErrBadLockTTL:
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(lock)
+}
+
+// dbGetLockHandler returns the lock held on a key, 404 when it is free.
+func dbGetLockHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	lock, err := db.GetLock(req.PathValue("key"))
+	if err == datastore.ErrNotFound {
+		responseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(lock)
+}
+
+// dbUnlockHandler releases the lock of a key acquired with the token
+// query parameter. Expired or taken over locks are answered with 409.
+func dbUnlockHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	token, err := strconv.ParseUint(req.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		http.Error(responseWriter, "Invalid token", http.StatusBadRequest)
+		return
+	}
+	if err := db.Unlock(req.PathValue("key"), token); err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusConflict)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+func TestLockHandlers(t *testing.T) {
+	db = newTestDb(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /db/{key}/lock", dbLockHandler)
+	mux.HandleFunc("DELETE /db/{key}/lock", dbUnlockHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := dbclient.New(server.URL)
+	ctx := context.Background()
+	lock, err := client.Lock(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.Key != "job" || lock.Token == 0 || !lock.ExpiresAt.After(time.Now()) {
+		t.Errorf("Unexpected lock %+v", lock)
+	}
+	if _, err := client.Lock(ctx, "job", time.Minute); !errors.Is(err, dbclient.ErrLocked) {
+		t.Errorf("Expected the held lock to be refused, got %v", err)
+	}
+	if _, err := client.Lock(ctx, "other", 0); err == nil {
+		t.Error("Expected a zero ttl to be refused")
+	}
+
+	stale := lock
+	stale.Token--
+	if err := client.Unlock(ctx, stale); !errors.Is(err, dbclient.ErrLockNotHeld) {
+		t.Errorf("Expected a stale token to be refused, got %v", err)
+	}
+	if err := client.Unlock(ctx, lock); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Lock(ctx, "job", time.Minute); err != nil {
+		t.Errorf("Expected the released lock to be free, got %v", err)
+	}
+}
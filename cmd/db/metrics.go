@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+// writeMetrics writes the IO and compaction counters of stats in the
+// Prometheus text format.
+func writeMetrics(w io.Writer, stats datastore.Stats) {
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("db_logical_bytes_written_total", "counter", "Key and value bytes of the writes accepted.", stats.IO.LogicalBytesWritten)
+	metric("db_disk_bytes_written_total", "counter", "Bytes written to the database files.", stats.IO.DiskBytesWritten)
+	metric("db_disk_bytes_read_total", "counter", "Bytes read from the database files.", stats.IO.DiskBytesRead)
+	metric("db_write_amplification", "gauge", "Disk bytes written per logical byte written.", stats.IO.WriteAmplification)
+	metric("db_cache_read_bytes_total", "counter", "Value bytes of reads served from the value cache.", stats.IO.CacheReadBytes)
+	metric("db_segment_read_bytes_total", "counter", "Value bytes of reads served from the segments.", stats.IO.SegmentReadBytes)
+	metric("db_fsyncs_total", "counter", "Files and directories flushed to disk.", stats.IO.Fsyncs)
+	metric("db_compactions_total", "counter", "Compactions that replaced segments.", stats.Compaction.Runs)
+	metric("db_compaction_bytes_rewritten_total", "counter", "Bytes written by compactions.", stats.Compaction.BytesRewritten)
+	metric("db_compaction_bytes_reclaimed_total", "counter", "Bytes compactions freed.", stats.Compaction.BytesReclaimed)
+	metric("db_live_bytes", "gauge", "Segment bytes holding current values.", stats.LiveBytes)
+	metric("db_dead_bytes", "gauge", "Segment bytes of overwritten records and tombstones.", stats.DeadBytes)
+}
+
+// dbMetricsHandler serves the storage counters to Prometheus.
+func dbMetricsHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	responseWriter.Header().Set("content-type", "text/plain; version=0.0.4")
+	writeMetrics(responseWriter, db.Stats())
+}
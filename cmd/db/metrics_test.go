@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var out bytes.Buffer
+	stats := datastore.Stats{IO: datastore.IOStats{LogicalBytesWritten: 100, DiskBytesWritten: 250, WriteAmplification: 2.5, Fsyncs: 3}}
+	writeMetrics(&out, stats)
+	for _, line := range []string{
+		"# TYPE db_disk_bytes_written_total counter\ndb_disk_bytes_written_total 250\n",
+		"db_write_amplification 2.5\n",
+		"db_fsyncs_total 3\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in the metrics:\n%s", line, out.String())
+		}
+	}
+}
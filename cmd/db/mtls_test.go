@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+// issueCert signs a certificate with the CA, or self-signs it if ca is nil.
+func issueCert(t *testing.T, template *x509.Certificate, ca *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, signer := template, any(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientAuth(t *testing.T) {
+	db = newTestDb(t)
+	storage = db
+	ca := issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientCert := func(name string, uris ...*url.URL) tls.Certificate {
+		return issueCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			URIs:        uris,
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, &ca)
+	}
+	spiffeID, _ := url.Parse("spiffe://lab4/server")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /db/{key}", dbGetHandler)
+	mux.HandleFunc("POST /db/{key}", dbPostHandler)
+	mux.HandleFunc("/health", healthHandler)
+	server := httptest.NewUnstartedServer(clientAuth([]string{"spiffe://lab4/server", "dbctl"}, mux))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{issueCert(t, &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "db"},
+			DNSNames:    []string{"db"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, &ca)},
+		ClientCAs:  roots,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	clientFor := func(certs ...tls.Certificate) *dbclient.Client {
+		client := dbclient.New(server.URL)
+		client.SetTLSConfig(&tls.Config{Certificates: certs, RootCAs: roots, ServerName: "db"})
+		return client
+	}
+
+	for name, cert := range map[string]tls.Certificate{
+		"SPIFFE ID":   clientCert("server-1", spiffeID),
+		"common name": clientCert("dbctl"),
+	} {
+		client := clientFor(cert)
+		if _, err := client.Put("key", "value"); err != nil {
+			t.Fatalf("Expected the client with an allowed %s to write, got %v", name, err)
+		}
+		if record, err := client.Get("key"); err != nil || record.Value != "value" {
+			t.Errorf("Expected the client with an allowed %s to read, got %+v, %v", name, record, err)
+		}
+	}
+
+	intruder := clientFor(clientCert("intruder"))
+	if _, err := intruder.Get("key"); err == nil {
+		t.Error("Expected a client with an unknown identity to be refused")
+	}
+	ready.Store(true)
+	defer ready.Store(false)
+	intruderHTTP := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates: []tls.Certificate{clientCert("intruder")}, RootCAs: roots, ServerName: "db",
+	}}}
+	if resp, err := intruderHTTP.Get(server.URL + "/health"); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected health checks to pass for any verified client, got %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, err := clientFor().Get("key"); err == nil {
+		t.Error("Expected a client without a certificate to be refused")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// readOnlyFileName marks a data directory whose node starts read-only.
+const readOnlyFileName = "read-only"
+
+type readOnlySettings struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// readOnly rejects writes to the data API while enabled, for example during
+// a backup or a migration, or on a follower that must never take writes.
+// The setting is kept in a marker file, so it survives a restart. Advisory
+// locks are not stored data and stay available.
+type readOnly struct {
+	path string
+
+	mu       sync.RWMutex
+	settings readOnlySettings
+}
+
+// loadReadOnly reads the setting from the marker file in dir, if any.
+func loadReadOnly(dir string) (*readOnly, error) {
+	r := &readOnly{path: filepath.Join(dir, readOnlyFileName)}
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.settings.Enabled = true
+	r.settings.Reason = string(data)
+	return r, nil
+}
+
+func (r *readOnly) current() readOnlySettings {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.settings
+}
+
+// set writes or removes the marker file and then applies the setting.
+func (r *readOnly) set(settings readOnlySettings) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if settings.Enabled {
+		tmpPath := r.path + ".tmp"
+		if err := os.WriteFile(tmpPath, []byte(settings.Reason), 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmpPath, r.path); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	r.settings = settings
+	return nil
+}
+
+// Wrap answers writes with 503 and the reason while the node is read-only.
+func (r *readOnly) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if settings := r.current(); settings.Enabled {
+			message := "read-only"
+			if settings.Reason != "" {
+				message += ": " + settings.Reason
+			}
+			http.Error(rw, message, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// ServeHTTP exposes the setting on the admin API: GET returns it, POST
+// replaces it with the JSON body.
+func (r *readOnly) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var settings readOnlySettings
+		if err := json.NewDecoder(req.Body).Decode(&settings); err != nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !settings.Enabled {
+			settings.Reason = ""
+		}
+		if err := r.set(settings); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(r.current())
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	r, err := loadReadOnly(dir)
+	require.NoError(t, err)
+	handler := r.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	write := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db/key", nil))
+		return rw
+	}
+	toggle := func(body string) int {
+		rw := httptest.NewRecorder()
+		r.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/db-admin/read-only", strings.NewReader(body)))
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, write().Code)
+
+	assert.Equal(t, http.StatusOK, toggle(`{"enabled": true, "reason": "backup"}`))
+	rw := write()
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "backup")
+
+	// The setting survives a restart.
+	restarted, err := loadReadOnly(dir)
+	require.NoError(t, err)
+	assert.Equal(t, readOnlySettings{Enabled: true, Reason: "backup"}, restarted.current())
+
+	assert.Equal(t, http.StatusOK, toggle(`{"enabled": false}`))
+	assert.Equal(t, http.StatusOK, write().Code)
+	restarted, err = loadReadOnly(dir)
+	require.NoError(t, err)
+	assert.False(t, restarted.current().Enabled)
+
+	assert.Equal(t, http.StatusBadRequest, toggle(`enabled`))
+}
+
+func TestReadOnly_AdminRoutes(t *testing.T) {
+	r, err := loadReadOnly(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, r.set(readOnlySettings{Enabled: true}))
+	admin := newAdminMux(new(chaos), new(ratelimit.Metrics), r, newScheduler([classCount]int{}, 0))
+
+	for _, path := range []string{"/db-admin/import", "/db-admin/segments/import", "/db-admin/bootstrap", "/db-admin/retention/sweep", "/db-admin/reindex"} {
+		rw := httptest.NewRecorder()
+		admin.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code, path)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// requestClass groups requests sharing a concurrency budget.
+type requestClass int
+
+const (
+	// classRead is point reads, which clients wait on.
+	classRead requestClass = iota
+	// classWrite is writes, deletes, stream appends and acks.
+	classWrite
+	// classBulk is key listings and admin work reading or writing whole
+	// segments: snapshots, transfers, imports, reindexing and compaction
+	// estimates.
+	classBulk
+	classCount
+)
+
+var requestClassNames = [classCount]string{"read", "write", "bulk"}
+
+// scheduler runs the requests of every class within a budget of its own,
+// so bulk work cannot take the slots point reads need, however much of it
+// arrives. Requests over the budget of their class wait in its queue in
+// arrival order; once the queue is full they are rejected with 503.
+type scheduler struct {
+	classes [classCount]*classQueue
+}
+
+// classQueue admits up to cap(slots) requests at once. A nil slots channel
+// means the class is unlimited.
+type classQueue struct {
+	slots     chan struct{}
+	maxQueued int64
+
+	queued   atomic.Int64
+	inFlight atomic.Int64
+	served   atomic.Int64
+	rejected atomic.Int64
+}
+
+// schedulerStats is the state of a class queue.
+type schedulerStats struct {
+	Budget   int   `json:"budget"`
+	InFlight int64 `json:"in_flight"`
+	Queued   int64 `json:"queued"`
+	Served   int64 `json:"served"`
+	Rejected int64 `json:"rejected"`
+}
+
+// newScheduler gives every class the budget listed for it, zero or less
+// meaning unlimited. maxQueued caps the requests waiting per class, zero or
+// less meaning a queue as long as the budget.
+func newScheduler(budgets [classCount]int, maxQueued int) *scheduler {
+	s := &scheduler{}
+	for class, budget := range budgets {
+		queue := &classQueue{}
+		if budget > 0 {
+			queue.slots = make(chan struct{}, budget)
+			queue.maxQueued = int64(budget)
+			if maxQueued > 0 {
+				queue.maxQueued = int64(maxQueued)
+			}
+		}
+		s.classes[class] = queue
+	}
+	return s
+}
+
+// newSchedulerFromEnv reads the budgets of the classes from DB_READ_BUDGET,
+// DB_WRITE_BUDGET and DB_BULK_BUDGET and the queue length per class from
+// DB_QUEUE_LENGTH. Classes without a budget are unlimited.
+func newSchedulerFromEnv() *scheduler {
+	var budgets [classCount]int
+	budgets[classRead], _ = strconv.Atoi(os.Getenv("DB_READ_BUDGET"))
+	budgets[classWrite], _ = strconv.Atoi(os.Getenv("DB_WRITE_BUDGET"))
+	budgets[classBulk], _ = strconv.Atoi(os.Getenv("DB_BULK_BUDGET"))
+	maxQueued, _ := strconv.Atoi(os.Getenv("DB_QUEUE_LENGTH"))
+	return newScheduler(budgets, maxQueued)
+}
+
+// Wrap runs next as a request of class once the class has a free slot. A
+// client giving up while queued leaves the queue.
+func (s *scheduler) Wrap(class requestClass, next http.Handler) http.Handler {
+	queue := s.classes[class]
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if queue.slots != nil {
+			select {
+			case queue.slots <- struct{}{}:
+			default:
+				if queue.queued.Add(1) > queue.maxQueued {
+					queue.queued.Add(-1)
+					queue.rejected.Add(1)
+					rw.Header().Set("Retry-After", "1")
+					http.Error(rw, "Too many queued "+requestClassNames[class]+" requests", http.StatusServiceUnavailable)
+					return
+				}
+				select {
+				case queue.slots <- struct{}{}:
+					queue.queued.Add(-1)
+				case <-r.Context().Done():
+					queue.queued.Add(-1)
+					queue.rejected.Add(1)
+					return
+				}
+			}
+			defer func() { <-queue.slots }()
+		}
+		queue.inFlight.Add(1)
+		defer queue.inFlight.Add(-1)
+		queue.served.Add(1)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (s *scheduler) stats() map[string]schedulerStats {
+	stats := make(map[string]schedulerStats, classCount)
+	for class, queue := range s.classes {
+		stats[requestClassNames[class]] = schedulerStats{
+			Budget:   cap(queue.slots),
+			InFlight: queue.inFlight.Load(),
+			Queued:   queue.queued.Load(),
+			Served:   queue.served.Load(),
+			Rejected: queue.rejected.Load(),
+		}
+	}
+	return stats
+}
+
+// ServeHTTP reports the classes on the admin API.
+func (s *scheduler) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(s.stats())
+}
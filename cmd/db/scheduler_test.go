@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	sched := newScheduler([classCount]int{classBulk: 1}, 1)
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	bulk := sched.Wrap(classBulk, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	read := sched.Wrap(classRead, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	serve := func(h http.Handler, req *http.Request) chan int {
+		code := make(chan int, 1)
+		go func() {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			code <- rw.Code
+		}()
+		return code
+	}
+	waitFor := func(what string, cond func() bool) {
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s: %+v", what, sched.stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first := serve(bulk, httptest.NewRequest(http.MethodGet, "/db", nil))
+	<-started
+	second := serve(bulk, httptest.NewRequest(http.MethodGet, "/db", nil))
+	waitFor("the queued request", func() bool { return sched.stats()["bulk"].Queued == 1 })
+
+	// Point reads have a budget of their own.
+	if code := <-serve(read, httptest.NewRequest(http.MethodGet, "/db/key", nil)); code != http.StatusOK {
+		t.Errorf("Expected a read beside the bulk work, got %d", code)
+	}
+	// The queue of the class is full.
+	if code := <-serve(bulk, httptest.NewRequest(http.MethodGet, "/db", nil)); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 over the queue length, got %d", code)
+	}
+
+	close(release)
+	if <-first != http.StatusOK || <-second != http.StatusOK {
+		t.Error("Expected the running and the queued requests to complete")
+	}
+	stats := sched.stats()["bulk"]
+	if stats.Budget != 1 || stats.Served != 2 || stats.Rejected != 1 || stats.Queued != 0 || stats.InFlight != 0 {
+		t.Errorf("Unexpected bulk stats %+v", stats)
+	}
+	if stats := sched.stats()["read"]; stats.Budget != 0 || stats.Served != 1 {
+		t.Errorf("Unexpected read stats %+v", stats)
+	}
+}
+
+func TestScheduler_ClientGivesUp(t *testing.T) {
+	sched := newScheduler([classCount]int{classWrite: 1}, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	write := sched.Wrap(classWrite, http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		close(started)
+		<-release
+	}))
+	go write.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/db/key", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	write.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/db/key", nil).WithContext(ctx))
+	close(release)
+	if stats := sched.stats()["write"]; stats.Queued != 0 || stats.Rejected != 1 {
+		t.Errorf("Expected the request to leave the queue, got %+v", stats)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+// importDir keeps partially received segments so interrupted imports resume.
+const importDir = "db_import"
+
+// transferChunk is the most written to a client between two bandwidth
+// reservations.
+const transferChunk = 32 << 10
+
+// segmentBandwidth caps the bytes per second sent by all segment and hint
+// transfers together. DB_SEGMENT_BANDWIDTH sets it; it is unlimited if nil.
+var segmentBandwidth *bandwidthLimiter
+
+// bandwidthLimiter paces writes to a rate shared by all its writers.
+type bandwidthLimiter struct {
+	rate float64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newBandwidthLimiter(bytesPerSecond int) *bandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: float64(bytesPerSecond)}
+}
+
+// reserve books n bytes and returns how long to wait before sending them.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return wait
+}
+
+// throttledWriter sends through its limiter.
+type throttledWriter struct {
+	http.ResponseWriter
+	limiter *bandwidthLimiter
+}
+
+func (w throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), transferChunk)]
+		time.Sleep(w.limiter.reserve(len(chunk)))
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+func limitBandwidth(responseWriter http.ResponseWriter) http.ResponseWriter {
+	if segmentBandwidth == nil {
+		return responseWriter
+	}
+	return throttledWriter{ResponseWriter: responseWriter, limiter: segmentBandwidth}
+}
+
+func dbSegmentsHandler(responseWriter http.ResponseWriter, _ *http.Request) {
+	segments, err := db.SealedSegments()
+	if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(segments)
+}
+
+// dbSegmentHandler streams a sealed segment. Range requests resume a
+// transfer; the checksum always covers the whole segment.
+func dbSegmentHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	file, info, err := db.OpenSealedSegment(req.PathValue("name"))
+	if err == datastore.ErrNotFound {
+		responseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	responseWriter.Header().Set(dbclient.SegmentChecksumHeader, info.Checksum)
+	responseWriter.Header().Set(dbclient.SegmentSizeHeader, strconv.FormatInt(info.Size, 10))
+	responseWriter.Header().Set("content-type", "application/octet-stream")
+	http.ServeContent(limitBandwidth(responseWriter), req, info.Name, time.Time{}, file)
+}
+
+// dbSegmentHintHandler serves the hint of a sealed segment, its index as
+// JSON lines, with its own checksum. Range requests are supported too.
+func dbSegmentHintHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	hint, checksum, err := db.SegmentHint(req.PathValue("name"))
+	if err == datastore.ErrNotFound {
+		responseWriter.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set(dbclient.SegmentChecksumHeader, checksum)
+	responseWriter.Header().Set(dbclient.SegmentSizeHeader, strconv.Itoa(len(hint)))
+	responseWriter.Header().Set("content-type", "application/x-ndjson")
+	http.ServeContent(limitBandwidth(responseWriter), req, req.PathValue("name")+".hint", time.Time{}, bytes.NewReader(hint))
+}
+
+type importRequest struct {
+	// From is the base URL of the admin API of the node to copy the segment
+	// from, which is on DB_ADMIN_ADDR when that is set.
+	From string `json:"from"`
+	Name string `json:"name"`
+}
+
+// dbImportSegmentHandler copies a sealed segment from another node and
+// registers it after verifying its checksum.
+func dbImportSegmentHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request importRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.From == "" || request.Name == "" {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	info, err := importSegment(req, request)
+	if errors.Is(err, datastore.ErrChecksumMismatch) {
+		http.Error(responseWriter, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to import segment %s from %s: %s", request.Name, request.From, err)
+		http.Error(responseWriter, err.Error(), http.StatusBadGateway)
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(info)
+}
+
+func importSegment(req *http.Request, request importRequest) (dbclient.SegmentInfo, error) {
+	CreateDirIfNotExist(importDir)
+	stagedPath := filepath.Join(importDir, filepath.Base(request.Name)+".part")
+	staged, err := os.OpenFile(stagedPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return dbclient.SegmentInfo{}, err
+	}
+	defer staged.Close()
+	received, err := staged.Seek(0, io.SeekEnd)
+	if err != nil {
+		return dbclient.SegmentInfo{}, err
+	}
+
+	source := dbclient.New(request.From)
+	// Nodes of a cluster share the admin token.
+	source.SetAdminToken(os.Getenv("DB_ADMIN_TOKEN"))
+	info, err := source.DownloadSegment(req.Context(), request.Name, received, staged)
+	if err != nil {
+		return info, err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return info, err
+	}
+
+	err = db.ImportSegment(staged, datastore.SegmentInfo{Name: info.Name, Size: info.Size, Checksum: info.Checksum})
+	if err == nil || errors.Is(err, datastore.ErrChecksumMismatch) {
+		// Corrupted data must not be resumed.
+		_ = os.Remove(stagedPath)
+	}
+	return info, err
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	if newBandwidthLimiter(0) != nil {
+		t.Errorf("Expected no limiter without a rate")
+	}
+
+	limiter := newBandwidthLimiter(1000)
+	if wait := limiter.reserve(500); wait != 0 {
+		t.Errorf("Expected the first reservation to pass, waited %s", wait)
+	}
+	// The first 500 bytes take half a second at 1000 bytes per second.
+	if wait := limiter.reserve(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Unexpected wait %s", wait)
+	}
+
+	segmentBandwidth = newBandwidthLimiter(1_000_000)
+	defer func() { segmentBandwidth = nil }()
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	body := strings.Repeat("x", 200_000)
+	if n, err := limitBandwidth(rw).Write([]byte(body)); err != nil || n != len(body) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	// Every chunk but the first waits for the ones before it.
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("200kB at 1MB/s sent in %s", elapsed)
+	}
+	if rw.Body.String() != body {
+		t.Errorf("Body changed by the limiter")
+	}
+	if rw.Code != http.StatusOK {
+		t.Errorf("Unexpected status %d", rw.Code)
+	}
+}
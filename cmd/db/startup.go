@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+// startupLogInterval spaces out the progress lines logged while recovering.
+const startupLogInterval = 5 * time.Second
+
+// startupStatus is the answer of /health/startup.
+type startupStatus struct {
+	Recovering bool                       `json:"recovering"`
+	Progress   datastore.RecoveryProgress `json:"progress"`
+	ElapsedMs  int64                      `json:"elapsed_ms"`
+	// EtaMs extrapolates the bytes recovered so far, zero until some are.
+	EtaMs int64 `json:"eta_ms,omitempty"`
+}
+
+// startup serves the node while the database recovers. It answers
+// /health/startup with the recovery progress, 503 until recovery is done,
+// and every other request with 503, so orchestration and people can tell a
+// slow recovery from a hung one. Once finished it hands requests to the
+// node handler.
+type startup struct {
+	started time.Time
+	now     func() time.Time
+
+	mu       sync.Mutex
+	progress datastore.RecoveryProgress
+	logged   time.Time
+
+	next atomic.Pointer[http.Handler]
+}
+
+func newStartup(now func() time.Time) *startup {
+	return &startup{started: now(), now: now}
+}
+
+// report records the progress, the OnRecoveryProgress of the database.
+func (s *startup) report(progress datastore.RecoveryProgress) {
+	s.mu.Lock()
+	s.progress = progress
+	logNow := s.now().Sub(s.logged) >= startupLogInterval || progress.SegmentsDone == progress.Segments
+	if logNow {
+		s.logged = s.now()
+	}
+	s.mu.Unlock()
+	if logNow {
+		status := s.status()
+		log.Printf("Recovered %d of %d segments, %d of %d bytes, ETA %s",
+			progress.SegmentsDone, progress.Segments, progress.BytesDone, progress.Bytes,
+			time.Duration(status.EtaMs)*time.Millisecond)
+	}
+}
+
+func (s *startup) status() startupStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := s.now().Sub(s.started)
+	status := startupStatus{
+		Recovering: s.next.Load() == nil,
+		Progress:   s.progress,
+		ElapsedMs:  elapsed.Milliseconds(),
+	}
+	if done := s.progress.BytesDone; status.Recovering && done > 0 {
+		remaining := s.progress.Bytes - done
+		status.EtaMs = (elapsed * time.Duration(remaining) / time.Duration(done)).Milliseconds()
+	}
+	return status
+}
+
+// finish sends requests to next from now on.
+func (s *startup) finish(next http.Handler) {
+	s.next.Store(&next)
+}
+
+func (s *startup) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health/startup" {
+		status := s.status()
+		rw.Header().Set("content-type", "application/json")
+		if status.Recovering {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(rw).Encode(status)
+		return
+	}
+	next := s.next.Load()
+	if next == nil {
+		rw.Header().Set("Retry-After", "5")
+		http.Error(rw, "Recovering", http.StatusServiceUnavailable)
+		return
+	}
+	(*next).ServeHTTP(rw, r)
+}
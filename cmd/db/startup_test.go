@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+func TestStartup(t *testing.T) {
+	now := time.Unix(1000, 0)
+	boot := newStartup(func() time.Time { return now })
+
+	get := func(path string) (int, startupStatus) {
+		rw := httptest.NewRecorder()
+		boot.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		var status startupStatus
+		_ = json.NewDecoder(rw.Body).Decode(&status)
+		return rw.Code, status
+	}
+
+	boot.report(datastore.RecoveryProgress{Segments: 4, Bytes: 400})
+	now = now.Add(10 * time.Second)
+	boot.report(datastore.RecoveryProgress{Segments: 4, SegmentsDone: 1, Bytes: 400, BytesDone: 100})
+	code, status := get("/health/startup")
+	if code != http.StatusServiceUnavailable || !status.Recovering || status.Progress.SegmentsDone != 1 {
+		t.Errorf("Expected the recovery in progress, got %d %+v", code, status)
+	}
+	// A quarter took 10s, the rest takes 30s more.
+	if status.ElapsedMs != 10000 || status.EtaMs != 30000 {
+		t.Errorf("Unexpected timing %+v", status)
+	}
+	if code, _ := get("/db/key"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected data requests to be refused while recovering, got %d", code)
+	}
+
+	boot.finish(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+	if code, status := get("/health/startup"); code != http.StatusOK || status.Recovering || status.EtaMs != 0 {
+		t.Errorf("Expected the recovery to be done, got %d %+v", code, status)
+	}
+	if code, _ := get("/db/key"); code != http.StatusTeapot {
+		t.Errorf("Expected requests to reach the node, got %d", code)
+	}
+}
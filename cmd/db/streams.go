@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+type appendRequest struct {
+	Payload *string `json:"payload"`
+}
+
+type appendResponse struct {
+	Stream string `json:"stream"`
+	Seq    uint64 `json:"seq"`
+}
+
+type consumeResponse struct {
+	Messages []datastore.Message `json:"messages"`
+	// Committed is the offset the group acknowledged so far.
+	Committed uint64 `json:"committed"`
+}
+
+type ackRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+// dbAppendHandler appends a message to a stream.
+func dbAppendHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request appendRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil || request.Payload == nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	stream := req.PathValue("stream")
+	seq, err := db.Append(stream, *request.Payload)
+	if !streamOK(responseWriter, err) {
+		return
+	}
+	setSequence(responseWriter)
+	responseWriter.Header().Set("content-type", "application/json")
+	responseWriter.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(responseWriter).Encode(appendResponse{Stream: stream, Seq: seq})
+}
+
+// dbConsumeHandler returns the next messages of a stream for a consumer
+// group, or the ones from the "from" query parameter on.
+func dbConsumeHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var from uint64
+	if value := query.Get("from"); value != "" {
+		var err error
+		if from, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(responseWriter, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	stream, group := req.PathValue("stream"), req.PathValue("group")
+	messages, err := db.Consume(stream, group, from, limit)
+	if !streamOK(responseWriter, err) {
+		return
+	}
+	committed, err := db.CommittedOffset(stream, group)
+	if !streamOK(responseWriter, err) {
+		return
+	}
+	responseWriter.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(responseWriter).Encode(consumeResponse{Messages: messages, Committed: committed})
+}
+
+// dbAckHandler commits the offset of a consumer group.
+func dbAckHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	var request ackRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(responseWriter, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	err := db.Ack(req.PathValue("stream"), req.PathValue("group"), request.Seq)
+	if !streamOK(responseWriter, err) {
+		return
+	}
+	setSequence(responseWriter)
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+// streamOK answers a failed stream operation and reports whether it
+// succeeded.
+func streamOK(responseWriter http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return true
+	case datastore.ErrBadStreamName:
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+	case datastore.ErrThrottled:
+		http.Error(responseWriter, err.Error(), http.StatusTooManyRequests)
+	default:
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+	}
+	return false
+}
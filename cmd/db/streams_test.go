@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+func TestStreamHandlers(t *testing.T) {
+	db = newTestDb(t)
+	storage = db
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /streams/{stream}", dbAppendHandler)
+	mux.HandleFunc("GET /streams/{stream}/groups/{group}", dbConsumeHandler)
+	mux.HandleFunc("POST /streams/{stream}/groups/{group}/ack", dbAckHandler)
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rw
+	}
+	consume := func(target string) consumeResponse {
+		var response consumeResponse
+		rw := serve(http.MethodGet, target, "")
+		if err := json.NewDecoder(rw.Body).Decode(&response); err != nil {
+			t.Fatalf("Unexpected consume response %d: %v", rw.Code, err)
+		}
+		return response
+	}
+
+	for _, payload := range []string{"a", "b"} {
+		rw := serve(http.MethodPost, "/streams/events", `{"payload":"`+payload+`"}`)
+		if rw.Code != http.StatusCreated {
+			t.Fatalf("Append failed with %d", rw.Code)
+		}
+		if rw.Header().Get(httptools.SequenceHeader) == "" {
+			t.Errorf("Expected the append to return its sequence")
+		}
+	}
+	if rw := serve(http.MethodPost, "/streams/events", `{}`); rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected a missing payload to be refused, got %d", rw.Code)
+	}
+
+	response := consume("/streams/events/groups/mail")
+	expected := []datastore.Message{{Seq: 1, Payload: "a"}, {Seq: 2, Payload: "b"}}
+	if !reflect.DeepEqual(response.Messages, expected) || response.Committed != 0 {
+		t.Errorf("Unexpected response %+v", response)
+	}
+
+	if rw := serve(http.MethodPost, "/streams/events/groups/mail/ack", `{"seq":1}`); rw.Code != http.StatusNoContent {
+		t.Fatalf("Ack failed with %d", rw.Code)
+	}
+	response = consume("/streams/events/groups/mail")
+	if !reflect.DeepEqual(response.Messages, expected[1:]) || response.Committed != 1 {
+		t.Errorf("Unexpected response after the ack %+v", response)
+	}
+	if response := consume("/streams/events/groups/mail?from=1&limit=1"); !reflect.DeepEqual(response.Messages, expected[:1]) {
+		t.Errorf("Unexpected replay %+v", response.Messages)
+	}
+}
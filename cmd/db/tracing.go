@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+// traceparentHeader carries the W3C trace context of a request.
+const traceparentHeader = "traceparent"
+
+// spanContext identifies a span across processes.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func (sc spanContext) traceparent() string {
+	return "00-" + hex.EncodeToString(sc.traceID[:]) + "-" + hex.EncodeToString(sc.spanID[:]) + "-01"
+}
+
+// parseTraceparent reads a version 00 traceparent header.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.traceID != [16]byte{} && sc.spanID != [8]byte{}
+}
+
+type spanKey struct{}
+
+// logTracer writes every finished span as a JSON line, with the trace and
+// parent ids that let a collector assemble the traces. Requests join the
+// trace of their traceparent header, and the storage operations they cause
+// become children of their span.
+type logTracer struct {
+	now func() time.Time
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newLogTracer(out io.Writer) *logTracer {
+	return &logTracer{now: time.Now, out: out}
+}
+
+// spanRecord is the line written for a finished span.
+type spanRecord struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Name       string         `json:"name"`
+	Start      time.Time      `json:"start"`
+	DurationMs float64        `json:"duration_ms"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type logSpan struct {
+	tracer *logTracer
+	record spanRecord
+
+	mu sync.Mutex
+}
+
+// Start starts a span, a child of the span in ctx if there is one.
+func (t *logTracer) Start(ctx context.Context, name string) (context.Context, datastore.Span) {
+	var sc spanContext
+	parent, hasParent := ctx.Value(spanKey{}).(spanContext)
+	if hasParent {
+		sc.traceID = parent.traceID
+	} else {
+		_, _ = rand.Read(sc.traceID[:])
+	}
+	_, _ = rand.Read(sc.spanID[:])
+	span := &logSpan{tracer: t, record: spanRecord{
+		TraceID: hex.EncodeToString(sc.traceID[:]),
+		SpanID:  hex.EncodeToString(sc.spanID[:]),
+		Name:    name,
+		Start:   t.now(),
+	}}
+	if hasParent {
+		span.record.ParentID = hex.EncodeToString(parent.spanID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, sc), span
+}
+
+func (s *logSpan) SetAttribute(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.record.Attributes == nil {
+		s.record.Attributes = make(map[string]any)
+	}
+	s.record.Attributes[key] = value
+}
+
+func (s *logSpan) End(err error) {
+	s.mu.Lock()
+	record := s.record
+	s.mu.Unlock()
+	record.DurationMs = float64(s.tracer.now().Sub(record.Start).Microseconds()) / 1000
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, _ := json.Marshal(record)
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	_, _ = s.tracer.out.Write(append(line, '\n'))
+}
+
+// Wrap traces every request in a span joining the trace of its
+// traceparent header, which the response carries back with the span id.
+func (t *logTracer) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			ctx = context.WithValue(ctx, spanKey{}, remote)
+		}
+		ctx, span := t.Start(ctx, "http "+r.Method)
+		span.SetAttribute("path", r.URL.Path)
+		rw.Header().Set(traceparentHeader, ctx.Value(spanKey{}).(spanContext).traceparent())
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		span.SetAttribute("status", recorder.status)
+		span.End(nil)
+	})
+}
+
+// statusRecorder remembers the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// tracedStore is implemented by stores tracing their reads and writes in
+// the span of a context: the database, not the cache of an upstream.
+type tracedStore interface {
+	GetRecordContext(ctx context.Context, key string) (datastore.Record, error)
+	PutContext(ctx context.Context, key, value string, opts datastore.WriteOptions) (uint64, error)
+	DeleteContext(ctx context.Context, key string, opts datastore.DeleteOptions) (uint64, error)
+}
+
+func getRecord(ctx context.Context, s store, key string) (datastore.Record, error) {
+	if traced, ok := s.(tracedStore); ok {
+		return traced.GetRecordContext(ctx, key)
+	}
+	return s.GetRecord(key)
+}
+
+func putRecord(ctx context.Context, s store, key, value string, opts datastore.WriteOptions) (uint64, error) {
+	if traced, ok := s.(tracedStore); ok {
+		return traced.PutContext(ctx, key, value, opts)
+	}
+	return s.PutWithOptions(key, value, opts)
+}
+
+func deleteRecord(ctx context.Context, s store, key string, opts datastore.DeleteOptions) error {
+	if traced, ok := s.(tracedStore); ok {
+		_, err := traced.DeleteContext(ctx, key, opts)
+		return err
+	}
+	return s.DeleteWithOptions(key, opts)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || sc.traceparent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the header to round trip, got %v %q", ok, sc.traceparent())
+	}
+	for _, value := range []string{"", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-xyz-00f067aa0ba902b7-01"} {
+		if _, ok := parseTraceparent(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	var out bytes.Buffer
+	tracer := newLogTracer(&out)
+	handler := tracer.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, span := tracer.Start(r.Context(), "datastore.Get")
+		span.SetAttribute("key", "k")
+		span.End(errors.New("not found"))
+		rw.WriteHeader(http.StatusNotFound)
+	}))
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/db/k", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(rw, req)
+
+	var spans []spanRecord
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var span spanRecord
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, span)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("Expected the storage and request spans, got %+v", spans)
+	}
+	child, server := spans[0], spans[1]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the request to join the remote trace, got %+v", server)
+	}
+	if child.TraceID != server.TraceID || child.ParentID != server.SpanID {
+		t.Errorf("Expected the storage span under the request, got %+v", child)
+	}
+	if child.Error != "not found" || child.Attributes["key"] != "k" || server.Attributes["status"] != float64(http.StatusNotFound) {
+		t.Errorf("Unexpected attributes %+v, %+v", child, server)
+	}
+	if header := rw.Header().Get(traceparentHeader); !strings.Contains(header, server.TraceID+"-"+server.SpanID) {
+		t.Errorf("Expected the response to carry the request span, got %q", header)
+	}
+}
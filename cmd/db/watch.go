@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// watchEnd is the last line of a change stream, telling why it ended when
+// the server ended it.
+type watchEnd struct {
+	Error string `json:"error"`
+}
+
+// dbWatchHandler streams the changes of the keys starting with the prefix
+// query parameter as NDJSON, one datastore.Change per line, until the
+// client goes away. A watcher falling behind gets an error line and has to
+// read the keys again before watching anew. A drain ends the stream with an
+// error line too, so the client watches on another node instead of holding
+// the drain up for its whole grace period.
+func dbWatchHandler(responseWriter http.ResponseWriter, req *http.Request) {
+	watcher := db.Watch(req.URL.Query().Get("prefix"))
+	defer watcher.Close()
+
+	responseWriter.Header().Set("content-type", "application/x-ndjson")
+	responseWriter.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(responseWriter)
+	if err := flusher.Flush(); err != nil {
+		return
+	}
+
+	encoder := json.NewEncoder(responseWriter)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-drain.requested:
+			_ = encoder.Encode(watchEnd{Error: errDraining.Error()})
+			return
+		case change, open := <-watcher.Changes():
+			if !open {
+				if err := watcher.Err(); err != nil {
+					_ = encoder.Encode(watchEnd{Error: err.Error()})
+				}
+				return
+			}
+			if err := encoder.Encode(change); err != nil {
+				return
+			}
+			// Changes queued meanwhile go out with this one.
+			if len(watcher.Changes()) == 0 {
+				_ = flusher.Flush()
+			}
+		}
+	}
+}
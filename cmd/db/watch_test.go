@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+)
+
+func TestDbWatchHandler(t *testing.T) {
+	db = newTestDb(t)
+	drain = newDrainer()
+	defer func() { drain = newDrainer() }()
+	// Streams go through the drain wrapper like on the data listener.
+	server := httptest.NewServer(drain.Wrap(http.HandlerFunc(dbWatchHandler)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/db/_watch?prefix=users/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("content-type") != "application/x-ndjson" {
+		t.Errorf("Unexpected content type %q", resp.Header.Get("content-type"))
+	}
+
+	// The headers are flushed once the watcher is registered.
+	_ = db.Put("orders/1", "ignored")
+	_ = db.Put("users/1", "a")
+	_ = db.Delete("users/1")
+	_ = db.PutWithTTL("users/2", "b", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if swept, err := db.SweepExpired(); err != nil || swept != 1 {
+		t.Fatalf("Expected the expired key swept, got %d, %v", swept, err)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	for _, expected := range []datastore.Change{
+		{Type: datastore.ChangePut, Key: "users/1", Value: "a", Version: 1},
+		{Type: datastore.ChangeDelete, Key: "users/1", Version: 2},
+		{Type: datastore.ChangePut, Key: "users/2", Value: "b", Version: 1},
+		{Type: datastore.ChangeExpired, Key: "users/2", Version: 2},
+	} {
+		if !lines.Scan() {
+			t.Fatalf("Stream ended early: %v", lines.Err())
+		}
+		var change datastore.Change
+		if err := json.Unmarshal(lines.Bytes(), &change); err != nil {
+			t.Fatal(err)
+		}
+		if change != expected {
+			t.Errorf("Expected %+v, got %+v", expected, change)
+		}
+	}
+
+	// A drain ends the stream instead of waiting for the grace period.
+	drain.request()
+	if !lines.Scan() {
+		t.Fatalf("Stream ended without a reason: %v", lines.Err())
+	}
+	var end watchEnd
+	if err := json.Unmarshal(lines.Bytes(), &end); err != nil || end.Error != errDraining.Error() {
+		t.Errorf("Expected the drain as the end of the stream, got %s", lines.Bytes())
+	}
+	if lines.Scan() {
+		t.Errorf("Unexpected line after the end %s", lines.Bytes())
+	}
+}
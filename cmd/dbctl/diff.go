@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+const archivePrefix = "archive:"
+
+var errDiverged = errors.New("databases differ")
+
+// source is one side of a diff: a db node, a stopped database directory or
+// a backup archive.
+type source interface {
+	// keys returns a page of keys after the cursor in lexical order and the
+	// cursor of the next page, empty after the last one.
+	keys(prefix, after string, limit int) ([]string, string, error)
+	// values reads the keys, leaving out the ones deleted meanwhile.
+	values(keys []string) (map[string]string, error)
+	Close() error
+}
+
+type endpointSource struct {
+	client *dbclient.Client
+}
+
+func (s endpointSource) keys(prefix, after string, limit int) ([]string, string, error) {
+	page, err := s.client.Keys(context.Background(), prefix, after, limit)
+	return page.Keys, page.Next, err
+}
+
+func (s endpointSource) values(keys []string) (map[string]string, error) {
+	records, err := s.client.MGet(context.Background(), keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(records))
+	for _, record := range records {
+		values[record.Key] = record.Value
+	}
+	return values, nil
+}
+
+func (s endpointSource) Close() error {
+	return nil
+}
+
+type dbSource struct {
+	db *datastore.Db
+	// cleanup removes a database restored for the diff.
+	cleanup func()
+}
+
+func (s dbSource) keys(prefix, after string, limit int) ([]string, string, error) {
+	page := s.db.Keys(prefix, after, limit)
+	return page.Keys, page.Next, nil
+}
+
+func (s dbSource) values(keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := s.db.Get(key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+func (s dbSource) Close() error {
+	err := s.db.Close()
+	if s.cleanup != nil {
+		s.cleanup()
+	}
+	return err
+}
+
+// openSource opens an http(s) URL as a db node, "archive:<dir>" as the
+// latest state of a backup archive and anything else as a database
+// directory.
+func openSource(spec string) (source, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return endpointSource{client: dbclient.New(spec)}, nil
+	}
+
+	if archiveDir, ok := strings.CutPrefix(spec, archivePrefix); ok {
+		dir, err := os.MkdirTemp("", "dbctl-diff")
+		if err != nil {
+			return nil, err
+		}
+		cleanup := func() { os.RemoveAll(dir) }
+		if err := datastore.RestoreToTimestamp(archiveDir, dir, time.Now()); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("can't restore %s: %w", archiveDir, err)
+		}
+		db, err := datastore.NewDatabase(dir, 1024*1024)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return dbSource{db: db, cleanup: cleanup}, nil
+	}
+
+	// The compared database is left exactly as it was.
+	db, err := datastore.Open(spec, datastore.Options{SegmentSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	return dbSource{db: db}, nil
+}
+
+// keyStream reads the keys of a source page by page.
+type keyStream struct {
+	source   source
+	prefix   string
+	pageSize int
+	page     []string
+	next     string
+	done     bool
+}
+
+// peek returns the current key, or false at the end.
+func (s *keyStream) peek() (string, bool, error) {
+	for len(s.page) == 0 {
+		if s.done {
+			return "", false, nil
+		}
+		keys, next, err := s.source.keys(s.prefix, s.next, s.pageSize)
+		if err != nil {
+			return "", false, err
+		}
+		s.page, s.next, s.done = keys, next, next == ""
+	}
+	return s.page[0], true, nil
+}
+
+func (s *keyStream) pop() {
+	s.page = s.page[1:]
+}
+
+type diffOptions struct {
+	Prefix   string
+	PageSize int
+	// Hashes adds value hashes to the differing keys.
+	Hashes bool
+}
+
+type diffSummary struct {
+	Compared  int
+	Missing   int
+	Extra     int
+	Differing int
+}
+
+func (s diffSummary) diverged() bool {
+	return s.Missing+s.Extra+s.Differing > 0
+}
+
+// runDiff streams the keys of both sources in order and writes a line for
+// every key missing from b, extra in b or with a different value.
+func runDiff(a, b source, opts diffOptions, out io.Writer) (diffSummary, error) {
+	var summary diffSummary
+	streamA := &keyStream{source: a, prefix: opts.Prefix, pageSize: opts.PageSize}
+	streamB := &keyStream{source: b, prefix: opts.Prefix, pageSize: opts.PageSize}
+
+	// Keys on both sides are compared by value a batch at a time.
+	var common []string
+	compare := func() error {
+		if len(common) == 0 {
+			return nil
+		}
+		valuesA, err := a.values(common)
+		if err != nil {
+			return err
+		}
+		valuesB, err := b.values(common)
+		if err != nil {
+			return err
+		}
+		for _, key := range common {
+			valueA, inA := valuesA[key]
+			valueB, inB := valuesB[key]
+			switch {
+			case inA && !inB:
+				summary.Missing++
+				fmt.Fprintf(out, "missing %s\n", key)
+			case !inA && inB:
+				summary.Extra++
+				fmt.Fprintf(out, "extra %s\n", key)
+			case valueA != valueB:
+				summary.Differing++
+				if opts.Hashes {
+					fmt.Fprintf(out, "differs %s a=%s b=%s\n", key, valueHash(valueA), valueHash(valueB))
+				} else {
+					fmt.Fprintf(out, "differs %s\n", key)
+				}
+			}
+		}
+		common = common[:0]
+		return nil
+	}
+
+	for {
+		keyA, okA, err := streamA.peek()
+		if err != nil {
+			return summary, err
+		}
+		keyB, okB, err := streamB.peek()
+		if err != nil {
+			return summary, err
+		}
+		if !okA && !okB {
+			break
+		}
+		summary.Compared++
+		switch {
+		case okA && (!okB || keyA < keyB):
+			summary.Missing++
+			fmt.Fprintf(out, "missing %s\n", keyA)
+			streamA.pop()
+		case okB && (!okA || keyB < keyA):
+			summary.Extra++
+			fmt.Fprintf(out, "extra %s\n", keyB)
+			streamB.pop()
+		default:
+			common = append(common, keyA)
+			streamA.pop()
+			streamB.pop()
+			if len(common) >= opts.PageSize {
+				if err := compare(); err != nil {
+					return summary, err
+				}
+			}
+		}
+	}
+	return summary, compare()
+}
+
+func valueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+func diff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only compare keys with this prefix")
+	pageSize := flags.Int("page-size", 500, "keys read from each side per request")
+	hashes := flags.Bool("hashes", false, "print value hashes of differing keys")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 2 || *pageSize <= 0 {
+		return fmt.Errorf("diff requires two databases")
+	}
+	a, err := openSource(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	b, err := openSource(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	summary, err := runDiff(a, b, diffOptions{Prefix: *prefix, PageSize: *pageSize, Hashes: *hashes}, os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Compared %d keys: %d missing, %d extra, %d differing\n",
+		summary.Compared, summary.Missing, summary.Extra, summary.Differing)
+	if summary.diverged() {
+		return errDiverged
+	}
+	return nil
+}
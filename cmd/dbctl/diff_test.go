@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestDb(t *testing.T, values map[string]string) dbSource {
+	db, err := datastore.NewDatabase(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	for key, value := range values {
+		require.NoError(t, db.Put(key, value))
+	}
+	return dbSource{db: db}
+}
+
+func TestRunDiff(t *testing.T) {
+	a := openTestDb(t, map[string]string{"k1": "v1", "k2": "v2", "k3": "v3", "k5": "v5"})
+	b := openTestDb(t, map[string]string{"k1": "v1", "k3": "changed", "k4": "v4", "k5": "v5"})
+
+	var out bytes.Buffer
+	summary, err := runDiff(a, b, diffOptions{PageSize: 2}, &out)
+	require.NoError(t, err)
+	// Values are compared in batches, so their lines may come later.
+	assert.ElementsMatch(t, []string{"missing k2", "extra k4", "differs k3"}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+	assert.Equal(t, diffSummary{Compared: 5, Missing: 1, Extra: 1, Differing: 1}, summary)
+	assert.True(t, summary.diverged())
+
+	out.Reset()
+	summary, err = runDiff(a, b, diffOptions{Prefix: "k3", PageSize: 2, Hashes: true}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, "differs k3 a="+valueHash("v3")+" b="+valueHash("changed")+"\n", out.String())
+	assert.Equal(t, 1, summary.Differing)
+
+	out.Reset()
+	summary, err = runDiff(a, a, diffOptions{PageSize: 3}, &out)
+	require.NoError(t, err)
+	assert.Empty(t, out.String())
+	assert.False(t, summary.diverged())
+}
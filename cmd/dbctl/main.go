@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+const usage = `Usage: dbctl <command> [flags]
+
+Commands:
+  restore --archive <dir> --to <RFC3339 time> <target dir>
+        rebuild the database state as of the given time from archived segments
+  keys [--prefix <prefix>] <db dir>
+        print the live keys of a stopped database without reading values
+  diff [--prefix <prefix>] [--hashes] <a> <b>
+        compare two databases, each a db URL, a stopped database directory or
+        archive:<dir>, and exit 1 if keys are missing, extra or differ in b
+  compaction [--token <admin token>] [--tier-fanout <n>] [--retention <rules>] <db>
+        estimate what a compaction of a db URL or a stopped database
+        directory would merge and reclaim, without compacting; a directory
+        is estimated with the given tier fanout and "prefix=age,..." rules
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "restore":
+		err = restore(os.Args[2:])
+	case "keys":
+		err = keys(os.Args[2:])
+	case "diff":
+		err = diff(os.Args[2:])
+	case "compaction":
+		err = compaction(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	archiveDir := flags.String("archive", "db_archive", "directory with archived segments")
+	to := flags.String("to", "", "point in time to restore to (RFC3339)")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 || *to == "" {
+		return fmt.Errorf("restore requires --to and a target directory")
+	}
+	until, err := time.Parse(time.RFC3339Nano, *to)
+	if err != nil {
+		return fmt.Errorf("invalid --to value: %w", err)
+	}
+
+	if err := datastore.RestoreToTimestamp(*archiveDir, flags.Arg(0), until); err != nil {
+		return err
+	}
+	log.Printf("Restored database as of %s into %s", until.Format(time.RFC3339Nano), flags.Arg(0))
+	return nil
+}
+
+func keys(args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only list keys with this prefix")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("keys requires a database directory")
+	}
+	db, err := datastore.Open(flags.Arg(0), datastore.Options{SegmentSize: 1024 * 1024, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, key := range db.Keys(*prefix, "", 0).Keys {
+		fmt.Println(key)
+	}
+	return nil
+}
+
+func compaction(args []string) error {
+	flags := flag.NewFlagSet("compaction", flag.ExitOnError)
+	token := flags.String("token", "", "bearer token of the db admin API")
+	tierFanout := flags.Int("tier-fanout", 0, "compaction tier fanout of a database directory")
+	retention := flags.String("retention", "", "retention rules of a database directory, e.g. logs/=720h")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("compaction requires a db URL or a database directory")
+	}
+	var estimate dbclient.CompactionEstimate
+	if spec := flags.Arg(0); strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		client := dbclient.New(spec)
+		client.SetAdminToken(*token)
+		var err error
+		if estimate, err = client.EstimateCompaction(context.Background()); err != nil {
+			return err
+		}
+	} else {
+		rules, err := datastore.ParseRetentionRules(*retention)
+		if err != nil {
+			return fmt.Errorf("invalid --retention value: %w", err)
+		}
+		db, err := datastore.Open(spec, datastore.Options{
+			SegmentSize:          1024 * 1024,
+			CompactionTierFanout: *tierFanout,
+			Retention:            rules,
+			ReadOnly:             true,
+		})
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		local := db.EstimateCompaction()
+		estimate = dbclient.CompactionEstimate(local)
+	}
+
+	if len(estimate.Segments) == 0 {
+		fmt.Println("Nothing to compact: there are no sealed segments")
+		return nil
+	}
+	fmt.Printf("Segments:  %s\n", strings.Join(estimate.Segments, ", "))
+	fmt.Printf("Input:     %d bytes\n", estimate.InputBytes)
+	fmt.Printf("Output:    %d bytes in %d records\n", estimate.OutputBytes, estimate.Records)
+	fmt.Printf("Reclaimed: %d bytes, %d deleted, expired or outlived keys dropped\n", estimate.ReclaimedBytes, estimate.DroppedKeys)
+	return nil
+}
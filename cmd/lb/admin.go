@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// adminAuth lets only requests carrying token as a bearer token through.
+// The routes it guards change what the whole site serves and share the
+// public listener, so without a token they refuse every request.
+func adminAuth(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(rw, "admin routes are disabled without -admin-token", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// handleAdmin registers a state changing admin route behind the request
+// filter and the admin token.
+func handleAdmin(h *http.ServeMux, pattern string, filter *requestFilter, token string, next http.Handler) {
+	h.Handle(pattern, filter.Wrap(adminAuth(token, next)))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminAuth(t *testing.T) {
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+	send := func(h http.Handler, authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/lb-admin/maintenance", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, send(adminAuth("", next), ""), "no token configured")
+	assert.Equal(t, http.StatusForbidden, send(adminAuth("", next), "Bearer "), "no token configured")
+
+	h := adminAuth("secret", next)
+	assert.Equal(t, http.StatusUnauthorized, send(h, ""))
+	assert.Equal(t, http.StatusUnauthorized, send(h, "Bearer wrong"))
+	assert.Equal(t, http.StatusOK, send(h, "Bearer secret"))
+}
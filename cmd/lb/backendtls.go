@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+// backendTLSPool configures mutual TLS to a pool of backends: the balancer
+// shows them its client certificate and only accepts their certificates if
+// they are signed by the CA and carry the expected SAN.
+type backendTLSPool struct {
+	Backends []string `json:"backends"`
+	CertFile string   `json:"cert"`
+	KeyFile  string   `json:"key"`
+	CAFile   string   `json:"ca"`
+	// ServerName is the SAN backend certificates are verified against
+	// instead of the backend address, so a pool can share one certificate.
+	ServerName string `json:"server_name"`
+}
+
+// loadBackendTLS reads a JSON list of pools from path and returns a client
+// for every backend they list.
+func loadBackendTLS(path string) (map[string]*http.Client, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pools []backendTLSPool
+	if err := json.Unmarshal(data, &pools); err != nil {
+		return nil, fmt.Errorf("bad backend TLS config: %w", err)
+	}
+
+	clients := make(map[string]*http.Client)
+	for i, pool := range pools {
+		config, err := httptools.ClientTLSConfig(pool.CertFile, pool.KeyFile, pool.CAFile, pool.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("backend TLS pool %d: %w", i, err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		client := &http.Client{Transport: transport}
+		for _, backend := range pool.Backends {
+			if _, found := clients[backend]; found {
+				return nil, fmt.Errorf("backend %s is in more than one TLS pool", backend)
+			}
+			clients[backend] = client
+		}
+	}
+	return clients, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a certificate for the SAN and writes it with its key to dir.
+func (ca testCA) issue(t *testing.T, dir, san string, usage x509.ExtKeyUsage) (tls.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: san},
+		DNSNames:     []string{san},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile := filepath.Join(dir, san+".crt"), filepath.Join(dir, san+".key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	return pair, certFile, keyFile
+}
+
+func (ca testCA) write(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	return path
+}
+
+func TestBackendTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.write(t, dir)
+	serverCert, _, _ := ca.issue(t, dir, "server.internal", x509.ExtKeyUsageServerAuth)
+	_, clientCertFile, clientKeyFile := ca.issue(t, dir, "balancer.internal", x509.ExtKeyUsageClientAuth)
+
+	var clientName string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		clientName = r.TLS.PeerCertificates[0].Subject.CommonName
+		rw.Write([]byte("ok"))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+	dst := strings.TrimPrefix(backend.URL, "https://")
+
+	loadPools := func(serverName string) {
+		t.Helper()
+		config, err := json.Marshal([]backendTLSPool{{
+			Backends:   []string{dst},
+			CertFile:   clientCertFile,
+			KeyFile:    clientKeyFile,
+			CAFile:     caFile,
+			ServerName: serverName,
+		}})
+		require.NoError(t, err)
+		path := filepath.Join(dir, "backends.json")
+		require.NoError(t, os.WriteFile(path, config, 0o600))
+		clients, err := loadBackendTLS(path)
+		require.NoError(t, err)
+		tlsClients = clients
+	}
+	defer func() { tlsClients = make(map[string]*http.Client) }()
+
+	t.Run("client certificate and SAN verified", func(t *testing.T) {
+		loadPools("server.internal")
+		rw := httptest.NewRecorder()
+		assert.Nil(t, forward(dst, rw, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "ok", rw.Body.String())
+		assert.Equal(t, "balancer.internal", clientName)
+		assert.True(t, health(dst))
+	})
+
+	t.Run("unexpected SAN", func(t *testing.T) {
+		loadPools("db.internal")
+		rw := httptest.NewRecorder()
+		assert.NotNil(t, forward(dst, rw, httptest.NewRequest(http.MethodGet, "/api/v1/some-data", nil)))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+		assert.False(t, health(dst))
+	})
+
+	t.Run("without a client certificate", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool, ServerName: "server.internal"}}}
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		assert.NotNil(t, err)
+	})
+}
+
+func TestLoadBackendTLS_BackendInTwoPools(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := ca.write(t, dir)
+	_, certFile, keyFile := ca.issue(t, dir, "balancer.internal", x509.ExtKeyUsageClientAuth)
+	pool := backendTLSPool{Backends: []string{"server1:8080"}, CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+	config, err := json.Marshal([]backendTLSPool{pool, pool})
+	require.NoError(t, err)
+	path := filepath.Join(dir, "backends.json")
+	require.NoError(t, os.WriteFile(path, config, 0o600))
+
+	_, err = loadBackendTLS(path)
+	assert.ErrorContains(t, err, "more than one TLS pool")
+}
@@ -2,24 +2,66 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"runtime"
 	"sync"
 	"time"
 
 	"github.com/QuantumGurus/Lab4-KPI/httptools"
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
 	"github.com/QuantumGurus/Lab4-KPI/signal"
 )
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
-	https      = flag.Bool("https", false, "whether backends support HTTPs")
+	https      = flag.Bool("https", false, "whether backends support HTTPs; gRPC backends need it to be reached over HTTP/2")
+	tlsCert    = flag.String("tls-cert", "", "certificate file to serve TLS with, which also serves HTTP/2 and gRPC clients")
+	tlsKey     = flag.String("tls-key", "", "private key file of the TLS certificate")
+	backendTLS = flag.String("backend-tls", "", "JSON file of backend pools reached over mutual TLS, each with its client cert, key, CA and expected server SAN")
+	strategy   = flag.String("strategy", "least-traffic", "backend selection strategy: least-traffic, ewma (lowest response time) or composite (weighted error rate, latency and outstanding bytes)")
+
+	scoreWeightsFlag = flag.String("score-weights", "errors=1,latency=1,bytes=1", "comma separated weights of the composite strategy: errors, latency and bytes")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	dedupWindow  = flag.Duration("dedup-window", 5*time.Second, "how long a write response is shared with retries carrying the same Idempotency-Key")
+
+	allowIPs       = flag.String("allow-ips", "", "comma separated client IPs or CIDR ranges allowed to connect; empty allows all")
+	denyIPs        = flag.String("deny-ips", "", "comma separated client IPs or CIDR ranges to reject")
+	blockPaths     = flag.String("block-paths", "", "comma separated regular expressions of request paths to reject")
+	maxQueryLength = flag.Int("max-query-length", 0, "maximum query string length in bytes; 0 means unlimited")
+	allowedMethods = flag.String("allowed-methods", "", "comma separated HTTP methods to accept; empty accepts all")
+
+	rateLimit      = flag.Float64("rate-limit", 0, "requests per second allowed per client IP, with bursts of as many; 0 means unlimited")
+	maxConcurrent  = flag.Int("max-concurrent", 0, "maximum number of requests proxied at once; 0 means unlimited")
+	maxClientConns = flag.Int("max-client-conns", 0, "maximum connections open at once per client IP; requests on connections above it get 429 and the connection closed; 0 means unlimited")
+
+	maintenancePage = flag.String("maintenance-page", "", "file served with 503 on routes under maintenance; a JSON error is used if empty")
+	errorPageFiles  = flag.String("error-pages", "", "comma separated prefix=file templates replacing 502/503/504 bodies on routes starting with prefix")
+	retryAfter      = flag.Duration("error-retry-after", 5*time.Second, "Retry-After hint of 502/503/504 responses")
+
+	latencySLO        = flag.Duration("latency-slo", 0, "p99 latency objective; above it low priority requests are shed with 503s, 0 disables shedding")
+	shedStep          = flag.Int("shed-step", 10, "percentage of low priority traffic shed more, or less, every second the p99 is above, or below, the SLO")
+	lowPriorityRoutes = flag.String("low-priority-routes", "", "comma separated path prefixes of the traffic shed first")
+	lowPriorityKeys   = flag.String("low-priority-keys", "", "comma separated X-Api-Key values of the traffic shed first")
+
+	sticky    = flag.Bool("sticky", false, "pin every client to one backend with a cookie, moving it when the backend turns unhealthy")
+	stickyTTL = flag.Duration("sticky-ttl", time.Hour, "lifetime of the sticky session cookie")
+
+	bluePoolServers  = flag.String("blue-pool", "", "comma separated backends of the blue pool; with -green-pool it replaces the default pool")
+	greenPoolServers = flag.String("green-pool", "", "comma separated backends of the green pool")
+	livePool         = flag.String("live-pool", bluePool, "pool taking traffic at startup, blue or green; switched with POST /lb-admin/pools")
+
+	adminToken = flag.String("admin-token", "", "bearer token the state changing /lb-admin routes require; without it they are refused")
+
+	profileDir      = flag.String("profile-dir", os.TempDir(), "directory CPU and heap profiles captured on SIGUSR1 are written to")
+	profileDuration = flag.Duration("profile-duration", signal.DefaultProfileDuration, "how long the CPU profile captured on SIGUSR1 runs")
 )
 
 var (
@@ -29,8 +71,17 @@ var (
 		"server2:8080",
 		"server3:8080",
 	}
-	traffic = make(map[string]int)
-	mu      sync.Mutex
+	traffic   = make(map[string]int)
+	unhealthy = make(map[string]bool)
+	latency   = newLatencyTracker()
+	composite = newCompositeScorer(defaultScoreWeights)
+	mu        sync.Mutex
+
+	// unixClients reuse connections to "unix:" backends, keyed by socket path.
+	unixClients = make(map[string]*http.Client)
+	// tlsClients reach the backends of the -backend-tls pools over mutual
+	// TLS, keyed by backend.
+	tlsClients = make(map[string]*http.Client)
 )
 
 func scheme() string {
@@ -40,29 +91,80 @@ func scheme() string {
 	return "http"
 }
 
+// backendClient returns the client and URL scheme and host to reach dst.
+// Backends listed as "unix:<path>" are same-host servers listening on a unix
+// domain socket.
+func backendClient(dst string) (*http.Client, string, string) {
+	if client, found := tlsClients[dst]; found {
+		return client, "https", dst
+	}
+	socketPath, ok := httptools.SocketPath(dst)
+	if !ok {
+		return http.DefaultClient, scheme(), dst
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	client, found := unixClients[socketPath]
+	if !found {
+		client = &http.Client{Transport: httptools.UnixTransport(socketPath)}
+		unixClients[socketPath] = client
+	}
+	return client, "http", "unix"
+}
+
 func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, scheme, host := backendClient(dst)
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+		fmt.Sprintf("%s://%s/health", scheme, host), nil)
+	resp, err := client.Do(req)
 	if err != nil {
 		return false
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return false
 	}
 	return true
 }
 
+// checkHealth takes the server out of rotation while its health check fails.
+func checkHealth(server string) {
+	healthy := health(server)
+	mu.Lock()
+	defer mu.Unlock()
+	if healthy {
+		delete(unhealthy, server)
+	} else {
+		unhealthy[server] = true
+	}
+}
+
+// forwardContext bounds a forwarded request by the request timeout. gRPC
+// calls may stream for longer and end at the deadline their client sent.
+func forwardContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if !isGRPC(r) {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	if callTimeout, ok := grpcTimeout(r); ok {
+		return context.WithTimeout(r.Context(), callTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
 func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+	ctx, cancel := forwardContext(r)
+	defer cancel()
+	client, scheme, host := backendClient(dst)
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
+	fwdRequest.URL.Host = host
+	fwdRequest.URL.Scheme = scheme
+	fwdRequest.Host = host
+	httptools.SetTimeout(fwdRequest)
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	resp, err := client.Do(fwdRequest)
 	if err == nil {
 		for k, values := range resp.Header {
 			for _, value := range values {
@@ -75,7 +177,13 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 		log.Println("fwd", resp.StatusCode, resp.Request.URL)
 		rw.WriteHeader(resp.StatusCode)
 		defer resp.Body.Close()
-		bytes, err := io.Copy(rw, resp.Body)
+		var bytes int64
+		if isGRPC(r) {
+			bytes, err = copyStream(rw, resp.Body)
+			copyTrailers(rw, resp)
+		} else {
+			bytes, err = io.Copy(rw, resp.Body)
+		}
 		if err != nil {
 			log.Printf("Failed to write response: %s", err)
 		}
@@ -85,6 +193,10 @@ func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
 		return nil
 	} else {
 		log.Printf("Failed to get response from %s: %s", dst, err)
+		if isGRPC(r) {
+			writeGRPCError(rw, "backend unavailable")
+			return err
+		}
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		return err
 	}
@@ -96,7 +208,10 @@ func getLeastTrafficServer() string {
 
 	var minTraffic int = -1
 	var selectedServer string
-	for _, server := range serversPool {
+	for _, server := range liveServers() {
+		if unhealthy[server] {
+			continue
+		}
 		if traffic[server] < minTraffic || minTraffic == -1 {
 			selectedServer = server
 			minTraffic = traffic[server]
@@ -105,33 +220,173 @@ func getLeastTrafficServer() string {
 	return selectedServer
 }
 
+// pickServer chooses a healthy backend with the balancing strategy.
+func pickServer() string {
+	switch *strategy {
+	case "ewma":
+		return getLowestLatencyServer()
+	case "composite":
+		return getBestScoredServer()
+	}
+	return getLeastTrafficServer()
+}
+
+func balance(rw http.ResponseWriter, r *http.Request) {
+	var server string
+	if *sticky {
+		server = stickyServer(rw, r)
+	} else {
+		server = pickServer()
+	}
+	if server == "" {
+		if isGRPC(r) {
+			writeGRPCError(rw, "no available servers")
+			return
+		}
+		http.Error(rw, "No available servers", http.StatusServiceUnavailable)
+		return
+	}
+	switch *strategy {
+	case "ewma":
+		done := latency.start(server)
+		defer done()
+	case "composite":
+		w, done := composite.start(server, rw, r)
+		done(forward(server, w, r))
+		return
+	}
+	forward(server, rw, r)
+}
+
 func main() {
 	flag.Parse()
+	signal.ProfileOnSignal(*profileDir, *profileDuration)
+	switch *strategy {
+	case "least-traffic", "ewma":
+	case "composite":
+		weights, err := parseScoreWeights(*scoreWeightsFlag)
+		if err != nil {
+			log.Fatalf("Invalid score weights: %s", err)
+		}
+		composite = newCompositeScorer(weights)
+	default:
+		log.Fatalf("Unknown balancing strategy %q", *strategy)
+	}
+	if *backendTLS != "" {
+		clients, err := loadBackendTLS(*backendTLS)
+		if err != nil {
+			log.Fatalf("Failed to load the backend TLS config: %s", err)
+		}
+		tlsClients = clients
+	}
+
+	if *bluePoolServers != "" || *greenPoolServers != "" {
+		blue, green := splitList(*bluePoolServers), splitList(*greenPoolServers)
+		if len(blue) == 0 || len(green) == 0 {
+			log.Fatal("Both -blue-pool and -green-pool are required for blue/green deployments")
+		}
+		var err error
+		if pools, err = newPoolSwitch(blue, green, *livePool); err != nil {
+			log.Fatalf("Invalid -live-pool: %s", err)
+		}
+		serversPool = append(blue, green...)
+	}
 
 	for _, server := range serversPool {
 		traffic[server] = 0
 		go func(server string) {
 			for range time.Tick(10 * time.Second) {
-				if !health(server) {
-					mu.Lock()
-					traffic[server] = -1
-					mu.Unlock()
-				}
+				checkHealth(server)
 			}
 		}(server)
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		server := getLeastTrafficServer()
-		if server != "" {
-			forward(server, rw, r)
-		} else {
-			http.Error(rw, "No available servers", http.StatusServiceUnavailable)
-		}
-	}))
+	filter, err := newRequestFilter(filterConfig{
+		AllowIPs:       splitList(*allowIPs),
+		DenyIPs:        splitList(*denyIPs),
+		BlockPaths:     splitList(*blockPaths),
+		MaxQueryLength: *maxQueryLength,
+		AllowedMethods: splitList(*allowedMethods),
+	})
+	if err != nil {
+		log.Fatalf("Invalid request filter: %s", err)
+	}
+
+	maintenance, err := newMaintenanceMode(*maintenancePage)
+	if err != nil {
+		log.Fatalf("Failed to load the maintenance page: %s", err)
+	}
+
+	pages, err := newErrorPages(splitList(*errorPageFiles), *retryAfter)
+	if err != nil {
+		log.Fatalf("Failed to load the error pages: %s", err)
+	}
+
+	// Retries of an in-flight write are attached to the original upstream
+	// response instead of being sent to the backends again.
+	dedup := httptools.NewIdempotencyStore(*dedupWindow)
+	shedder := newLoadShedder(shedConfig{
+		SLO:               *latencySLO,
+		Step:              *shedStep,
+		Interval:          time.Second,
+		LowPriorityRoutes: splitList(*lowPriorityRoutes),
+		LowPriorityKeys:   splitList(*lowPriorityKeys),
+	})
+	handler := httptools.WithDeadline(dedup.Wrap(http.HandlerFunc(balance)))
+	if *latencySLO > 0 {
+		go shedder.run()
+		handler = shedder.Wrap(handler)
+	}
+	handler = pages.Wrap(handler)
+	concurrencyLimits, rateLimits := new(ratelimit.Metrics), new(ratelimit.Metrics)
+	if *maxConcurrent > 0 {
+		handler = ratelimit.Wrap(handler, ratelimit.NewConcurrency(*maxConcurrent), ratelimit.Global, concurrencyLimits)
+	}
+	if *rateLimit > 0 {
+		handler = ratelimit.Wrap(handler, ratelimit.NewTokenBucket(*rateLimit, max(*rateLimit, 1), nil), ratelimit.ByIP, rateLimits)
+	}
+
+	h := http.NewServeMux()
+	h.Handle("GET /lb-admin/metrics", filter)
+	h.Handle("GET /lb-admin/rate-limits", rateLimits)
+	h.Handle("GET /lb-admin/concurrency-limits", concurrencyLimits)
+	h.Handle("GET /lb-admin/maintenance", maintenance)
+	// Admin routes changing what the site serves share the public
+	// listener, so they pass the request filter and need the admin token.
+	handleAdmin(h, "POST /lb-admin/maintenance", filter, *adminToken, maintenance)
+	h.Handle("GET /lb-admin/load-shedding", shedder)
+	// The runtime variables, memstats included, let soak tests spot leaks.
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+	h.Handle("GET /lb-admin/vars", expvar.Handler())
+	if pools != nil {
+		h.Handle("GET /lb-admin/pools", pools)
+		handleAdmin(h, "POST /lb-admin/pools", filter, *adminToken, pools)
+	}
+	h.Handle("/", filter.Wrap(maintenance.Wrap(handler)))
+	var frontendHandler http.Handler = h
+	var conns *connLimiter
+	if *maxClientConns > 0 {
+		conns = newConnLimiter(*maxClientConns)
+		h.Handle("GET /lb-admin/connection-limits", conns)
+		frontendHandler = conns.Wrap(h)
+	}
+	var frontend httptools.Server
+	if *tlsCert != "" {
+		frontend = httptools.CreateTLSServer(*port, frontendHandler, *tlsCert, *tlsKey)
+	} else {
+		frontend = httptools.CreateServer(*port, frontendHandler)
+	}
+	if conns != nil {
+		httptools.TrackConnections(frontend, conns)
+	}
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("Balancing strategy: %s", *strategy)
+	log.Printf("Sticky sessions enabled: %t", *sticky)
+	if pools != nil {
+		log.Printf("Blue/green pools enabled, live pool: %s", *livePool)
+	}
 	frontend.Start()
 	signal.WaitForTerminationSignal()
 }
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/QuantumGurus/Lab4-KPI/balancertest"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,3 +42,135 @@ func TestForward(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "OK", rw.Body.String())
 }
+
+func TestForward_PropagatesTimeout(t *testing.T) {
+	var budget string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		budget = req.Header.Get(httptools.TimeoutHeader)
+	}))
+	defer server.Close()
+
+	rw := httptest.NewRecorder()
+	assert.Nil(t, forward(server.URL[7:], rw, httptest.NewRequest("GET", "/", nil)))
+	ms, err := strconv.Atoi(budget)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, ms, int(timeout.Milliseconds()))
+	assert.Greater(t, ms, 0)
+
+	// A client budget shorter than the balancer timeout wins.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(httptools.TimeoutHeader, "500")
+	httptools.WithDeadline(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_ = forward(server.URL[7:], rw, r)
+	})).ServeHTTP(rw, req)
+	ms, _ = strconv.Atoi(budget)
+	assert.LessOrEqual(t, ms, 500)
+}
+
+func TestForward_UnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("unix", filepath.Join(dir, "app.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("OK over " + listener.Addr().Network()))
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	dst := httptools.UnixAddrPrefix + listener.Addr().String()
+	rw := httptest.NewRecorder()
+	assert.Nil(t, forward(dst, rw, httptest.NewRequest("GET", "/", nil)))
+	assert.Equal(t, "OK over unix", rw.Body.String())
+	assert.True(t, health(dst), "health checks use the socket too")
+}
+
+func TestDeduplicateRetriedWrites(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	serversPool = []string{server.URL[7:]}
+	traffic = map[string]int{server.URL[7:]: 0}
+
+	handler := httptools.NewIdempotencyStore(time.Second).Wrap(http.HandlerFunc(balance))
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "/api/v1/some-data", nil)
+			req.Header.Set(httptools.IdempotencyKeyHeader, "retry-1")
+			handler.ServeHTTP(rw, req)
+			codes[i] = rw.Code
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, []int{http.StatusCreated, http.StatusCreated}, codes)
+}
+
+func TestBalancer_HealthChecking(t *testing.T) {
+	backends := balancertest.NewPool(t, 3)
+	backends[1].Health(true, false, true)
+	serversPool = balancertest.Addrs(backends)
+	traffic = map[string]int{}
+	unhealthy = map[string]bool{}
+
+	for _, server := range serversPool {
+		checkHealth(server)
+	}
+	handler := http.HandlerFunc(balance)
+	for _, status := range balancertest.SendN(handler, 9, "/api/v1/some-data") {
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Equal(t, 3, backends[1].Requests())
+
+	for _, server := range serversPool {
+		checkHealth(server)
+	}
+	balancertest.SendN(handler, 6, "/api/v1/some-data")
+	assert.Equal(t, 3, backends[1].Requests(), "failing backend must be out of rotation")
+	assert.Equal(t, 12, backends[0].Requests()+backends[2].Requests())
+	assert.Equal(t, 2, backends[1].HealthChecks())
+
+	for _, server := range serversPool {
+		checkHealth(server)
+	}
+	balancertest.SendN(handler, 1, "/api/v1/some-data")
+	assert.Equal(t, 4, backends[1].Requests(), "recovered backend must be back in rotation")
+}
+
+func TestBalancer_UpstreamFailures(t *testing.T) {
+	defer func(d time.Duration) { timeout = d }(timeout)
+	timeout = 100 * time.Millisecond
+
+	backend := balancertest.NewBackend(t).Script(
+		balancertest.Fail(http.StatusInternalServerError),
+		balancertest.Slow(2*timeout),
+		balancertest.OK(),
+	)
+	serversPool = []string{backend.Addr()}
+	traffic = map[string]int{}
+	unhealthy = map[string]bool{}
+
+	handler := http.HandlerFunc(balance)
+	assert.Equal(t, http.StatusInternalServerError, balancertest.Send(handler, "GET", "/").Code)
+	assert.Equal(t, http.StatusServiceUnavailable, balancertest.Send(handler, "GET", "/").Code)
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/").Code)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Names of the blue/green backend pools.
+const (
+	bluePool  = "blue"
+	greenPool = "green"
+)
+
+// pools switches traffic between the blue and green pools, nil unless
+// both are configured.
+var pools *poolSwitch
+
+// poolState is the live pool and, while traffic is ramped over to the
+// other pool, the ramp window.
+type poolState struct {
+	Live      string    `json:"live"`
+	Target    string    `json:"target,omitempty"`
+	RampStart time.Time `json:"ramp_start,omitempty"`
+	RampEnd   time.Time `json:"ramp_end,omitempty"`
+}
+
+// poolSwitchRequest is the body of a switch: the pool to make live and,
+// for a gradual switch, how long to ramp its share of traffic up for.
+type poolSwitchRequest struct {
+	Live string `json:"live"`
+	Ramp string `json:"ramp,omitempty"`
+}
+
+// poolSwitchStatus is the state reported by the admin endpoint.
+type poolSwitchStatus struct {
+	poolState
+	// TargetShare is the share of new requests going to the target pool.
+	TargetShare float64             `json:"target_share,omitempty"`
+	Pools       map[string][]string `json:"pools"`
+}
+
+// poolSwitch sends new requests to the live pool. A switch replaces the
+// live pool at once, or ramps the share of the other pool up linearly and
+// makes it live when the ramp ends. Both pools are health checked all the
+// time, so the idle one is known to be ready before the cutover.
+type poolSwitch struct {
+	pools map[string][]string
+	now   func() time.Time
+	// random returns a number in [0, 1) spreading requests during a ramp.
+	random func() float64
+
+	mu    sync.Mutex
+	state poolState
+}
+
+func newPoolSwitch(blue, green []string, live string) (*poolSwitch, error) {
+	s := &poolSwitch{
+		pools:  map[string][]string{bluePool: blue, greenPool: green},
+		now:    time.Now,
+		random: rand.Float64,
+		state:  poolState{Live: live},
+	}
+	if _, found := s.pools[live]; !found {
+		return nil, fmt.Errorf("unknown pool %q", live)
+	}
+	return s, nil
+}
+
+// current returns the state, settling a ramp that has ended, with the
+// share of requests the target pool gets.
+func (s *poolSwitch) current() (poolState, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state.Target == "" {
+		return s.state, 0
+	}
+	now := s.now()
+	if !now.Before(s.state.RampEnd) {
+		s.state = poolState{Live: s.state.Target}
+		return s.state, 0
+	}
+	share := float64(now.Sub(s.state.RampStart)) / float64(s.state.RampEnd.Sub(s.state.RampStart))
+	return s.state, share
+}
+
+// pick returns the pool a new request goes to.
+func (s *poolSwitch) pick() []string {
+	state, share := s.current()
+	if state.Target != "" && s.random() < share {
+		return s.pools[state.Target]
+	}
+	return s.pools[state.Live]
+}
+
+// serving returns the backends of the pools taking traffic.
+func (s *poolSwitch) serving() []string {
+	state, _ := s.current()
+	if state.Target == "" {
+		return s.pools[state.Live]
+	}
+	return slices.Concat(s.pools[state.Live], s.pools[state.Target])
+}
+
+// ServeHTTP reports the pools on GET and switches the live pool on POST.
+func (s *poolSwitch) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var request poolSwitchRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.switchTo(request); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	state, share := s.current()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(poolSwitchStatus{poolState: state, TargetShare: share, Pools: s.pools})
+}
+
+func (s *poolSwitch) switchTo(request poolSwitchRequest) error {
+	if _, found := s.pools[request.Live]; !found {
+		return fmt.Errorf("unknown pool %q", request.Live)
+	}
+	var ramp time.Duration
+	if request.Ramp != "" {
+		var err error
+		if ramp, err = time.ParseDuration(request.Ramp); err != nil || ramp < 0 {
+			return fmt.Errorf("invalid ramp %q", request.Ramp)
+		}
+	}
+
+	state, _ := s.current()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ramp == 0 || request.Live == state.Live {
+		// Switching back to the live pool cancels a ramp away from it.
+		s.state = poolState{Live: request.Live}
+		return nil
+	}
+	now := s.now()
+	s.state = poolState{Live: state.Live, Target: request.Live, RampStart: now, RampEnd: now.Add(ramp)}
+	return nil
+}
+
+// liveServers returns the backends a new request may go to.
+func liveServers() []string {
+	if pools == nil {
+		return serversPool
+	}
+	return pools.pick()
+}
+
+// servingServers returns the backends of the pools taking traffic, which
+// keep the clients pinned to them.
+func servingServers() []string {
+	if pools == nil {
+		return serversPool
+	}
+	return pools.serving()
+}
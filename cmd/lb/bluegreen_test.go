@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPools(t *testing.T, now *time.Time, random *float64) *poolSwitch {
+	s, err := newPoolSwitch([]string{"blue1:8080", "blue2:8080"}, []string{"green1:8080"}, bluePool)
+	require.NoError(t, err)
+	s.now = func() time.Time { return *now }
+	s.random = func() float64 { return *random }
+	return s
+}
+
+func switchPools(t *testing.T, s *poolSwitch, body string) (int, poolSwitchStatus) {
+	rw := httptest.NewRecorder()
+	s.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/lb-admin/pools", strings.NewReader(body)))
+	var status poolSwitchStatus
+	if rw.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rw.Body).Decode(&status))
+	}
+	return rw.Code, status
+}
+
+func TestPoolSwitch_Cutover(t *testing.T) {
+	now, random := time.Unix(0, 0), 0.0
+	s := newTestPools(t, &now, &random)
+	assert.Equal(t, []string{"blue1:8080", "blue2:8080"}, s.pick())
+
+	code, status := switchPools(t, s, `{"live": "green"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, greenPool, status.Live)
+	assert.Equal(t, []string{"green1:8080"}, s.pick())
+	assert.Equal(t, []string{"green1:8080"}, s.serving())
+
+	code, _ = switchPools(t, s, `{"live": "purple"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = switchPools(t, s, `{"live": "blue", "ramp": "soon"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestPoolSwitch_Ramp(t *testing.T) {
+	now, random := time.Unix(0, 0), 0.3
+	s := newTestPools(t, &now, &random)
+
+	code, status := switchPools(t, s, `{"live": "green", "ramp": "100s"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, bluePool, status.Live)
+	assert.Equal(t, greenPool, status.Target)
+
+	// A quarter into the ramp a quarter of the requests go to green.
+	now = now.Add(25 * time.Second)
+	assert.Equal(t, []string{"blue1:8080", "blue2:8080"}, s.pick())
+	random = 0.2
+	assert.Equal(t, []string{"green1:8080"}, s.pick())
+	assert.Len(t, s.serving(), 3)
+
+	now = now.Add(75 * time.Second)
+	random = 0.99
+	assert.Equal(t, []string{"green1:8080"}, s.pick())
+	state, share := s.current()
+	assert.Equal(t, poolState{Live: greenPool}, state)
+	assert.Zero(t, share)
+
+	// Switching back to the live pool cancels a ramp.
+	switchPools(t, s, `{"live": "blue", "ramp": "1m"}`)
+	_, status = switchPools(t, s, `{"live": "green"}`)
+	assert.Equal(t, poolState{Live: greenPool}, status.poolState)
+}
+
+func TestPoolSwitch_Balancing(t *testing.T) {
+	now, random := time.Unix(0, 0), 0.0
+	s := newTestPools(t, &now, &random)
+	pools, serversPool = s, append(s.pools[bluePool], s.pools[greenPool]...)
+	traffic = map[string]int{"blue1:8080": 100, "blue2:8080": 100, "green1:8080": 0}
+	unhealthy = make(map[string]bool)
+	defer func() { pools = nil }()
+
+	assert.Equal(t, "blue1:8080", getLeastTrafficServer())
+
+	// Clients pinned to blue move once green is live.
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: stickyCookie, Value: backendID("blue1:8080")})
+	switchPools(t, s, `{"live": "green"}`)
+	assert.Equal(t, "green1:8080", stickyServer(rw, req))
+	assert.Equal(t, "green1:8080", getLeastTrafficServer())
+}
+
+func TestPoolSwitch_AdminRoute(t *testing.T) {
+	now, random := time.Unix(0, 0), 0.0
+	s := newTestPools(t, &now, &random)
+	filter, err := newRequestFilter(filterConfig{})
+	require.NoError(t, err)
+	h := http.NewServeMux()
+	handleAdmin(h, "POST /lb-admin/pools", filter, "secret", s)
+
+	post := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/lb-admin/pools", strings.NewReader(`{"live": "green"}`))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, []string{"blue1:8080", "blue2:8080"}, s.pick(), "an unauthenticated switch moves no traffic")
+	assert.Equal(t, http.StatusOK, post("Bearer secret"))
+	assert.Equal(t, []string{"green1:8080"}, s.pick())
+}
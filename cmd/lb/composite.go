@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scoreWeights are the weights of the dimensions of the composite score.
+type scoreWeights struct {
+	errors  float64
+	latency float64
+	bytes   float64
+}
+
+var defaultScoreWeights = scoreWeights{errors: 1, latency: 1, bytes: 1}
+
+// parseScoreWeights parses comma separated name=weight items, the names
+// being errors, latency and bytes. Missing names keep their default weight.
+func parseScoreWeights(value string) (scoreWeights, error) {
+	weights := defaultScoreWeights
+	for _, item := range splitList(value) {
+		name, raw, ok := strings.Cut(item, "=")
+		if !ok {
+			return weights, fmt.Errorf("score weight %q is not name=weight", item)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || weight < 0 {
+			return weights, fmt.Errorf("score weight %q is not a non-negative number", item)
+		}
+		switch strings.TrimSpace(name) {
+		case "errors":
+			weights.errors = weight
+		case "latency":
+			weights.latency = weight
+		case "bytes":
+			weights.bytes = weight
+		default:
+			return weights, fmt.Errorf("unknown score weight %q, expected errors, latency or bytes", name)
+		}
+	}
+	if weights == (scoreWeights{}) {
+		return weights, fmt.Errorf("score weights are all zero")
+	}
+	return weights, nil
+}
+
+// compositeScorer blends the recent error rate, the EWMA latency and the
+// outstanding bytes of every backend into a single score.
+type compositeScorer struct {
+	mu       sync.Mutex
+	weights  scoreWeights
+	backends map[string]*backendScore
+	intn     func(n int) int
+}
+
+type backendScore struct {
+	// errorRate is the moving average of failed responses, from 0 to 1.
+	errorRate float64
+	latency   time.Duration
+	// outstanding counts the request and response bytes of the requests in
+	// flight.
+	outstanding int64
+}
+
+func newCompositeScorer(weights scoreWeights) *compositeScorer {
+	return &compositeScorer{weights: weights, backends: make(map[string]*backendScore), intn: rand.Intn}
+}
+
+// score is the weighted sum of the error rate and of the latency and
+// outstanding bytes relative to the largest among servers, so every
+// dimension ranges from 0 to 1. Servers without samples score zero so they
+// are tried right away.
+func (s *compositeScorer) score(server string, maxLatency time.Duration, maxBytes int64) float64 {
+	b, ok := s.backends[server]
+	if !ok {
+		return 0
+	}
+	score := s.weights.errors * b.errorRate
+	if maxLatency > 0 {
+		score += s.weights.latency * float64(b.latency) / float64(maxLatency)
+	}
+	if maxBytes > 0 {
+		score += s.weights.bytes * float64(b.outstanding) / float64(maxBytes)
+	}
+	return score
+}
+
+// pick chooses the better scoring of two random candidates, like the
+// latency tracker.
+func (s *compositeScorer) pick(servers []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch len(servers) {
+	case 0:
+		return ""
+	case 1:
+		return servers[0]
+	}
+	var maxLatency time.Duration
+	var maxBytes int64
+	for _, server := range servers {
+		if b, ok := s.backends[server]; ok {
+			maxLatency = max(maxLatency, b.latency)
+			maxBytes = max(maxBytes, b.outstanding)
+		}
+	}
+	i := s.intn(len(servers))
+	j := s.intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	if s.score(servers[j], maxLatency, maxBytes) < s.score(servers[i], maxLatency, maxBytes) {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+func (s *compositeScorer) backend(server string) *backendScore {
+	b, ok := s.backends[server]
+	if !ok {
+		b = &backendScore{}
+		s.backends[server] = b
+	}
+	return b
+}
+
+// start counts the request body of a request to the server as outstanding.
+// The returned writer counts the response bytes as they are copied, and
+// done records the latency and the outcome of the request.
+func (s *compositeScorer) start(server string, rw http.ResponseWriter, r *http.Request) (*scoreWriter, func(err error)) {
+	s.mu.Lock()
+	b := s.backend(server)
+	requestBytes := max(r.ContentLength, 0)
+	b.outstanding += requestBytes
+	s.mu.Unlock()
+
+	w := &scoreWriter{ResponseWriter: rw, scorer: s, backend: b}
+	started := time.Now()
+	return w, func(err error) {
+		elapsed := time.Since(started)
+		failed := 0.0
+		if err != nil || w.status >= http.StatusInternalServerError {
+			failed = 1
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		b.outstanding -= requestBytes + w.written
+		b.errorRate = ewmaAlpha*failed + (1-ewmaAlpha)*b.errorRate
+		if b.latency == 0 {
+			b.latency = elapsed
+		} else {
+			b.latency = time.Duration(ewmaAlpha*float64(elapsed) + (1-ewmaAlpha)*float64(b.latency))
+		}
+	}
+}
+
+// scoreWriter records the status and counts the bytes of a response while
+// it is forwarded.
+type scoreWriter struct {
+	http.ResponseWriter
+	scorer  *compositeScorer
+	backend *backendScore
+	status  int
+	written int64
+}
+
+func (w *scoreWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *scoreWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.scorer.mu.Lock()
+	w.written += int64(n)
+	w.backend.outstanding += int64(n)
+	w.scorer.mu.Unlock()
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *scoreWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// getBestScoredServer picks a healthy server by its composite score.
+func getBestScoredServer() string {
+	mu.Lock()
+	servers := liveServers()
+	healthy := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !unhealthy[server] {
+			healthy = append(healthy, server)
+		}
+	}
+	mu.Unlock()
+	return composite.pick(healthy)
+}
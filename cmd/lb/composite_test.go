@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScoreWeights(t *testing.T) {
+	weights, err := parseScoreWeights("errors=5, latency=0.5")
+	assert.Nil(t, err)
+	assert.Equal(t, scoreWeights{errors: 5, latency: 0.5, bytes: 1}, weights)
+
+	weights, err = parseScoreWeights("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultScoreWeights, weights)
+
+	for _, value := range []string{"errors", "errors=-1", "cpu=1", "errors=0,latency=0,bytes=0"} {
+		_, err := parseScoreWeights(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestCompositeScorer_Pick(t *testing.T) {
+	scorer := newCompositeScorer(scoreWeights{errors: 2, latency: 1, bytes: 1})
+	servers := []string{"a", "b", "c"}
+	scorer.backends["a"] = &backendScore{latency: 10 * time.Millisecond}
+	scorer.backends["b"] = &backendScore{latency: 5 * time.Millisecond, errorRate: 0.5}
+	scorer.backends["c"] = &backendScore{latency: 5 * time.Millisecond, outstanding: 1000}
+
+	choose := func(i, j int) string {
+		calls := []int{i, j}
+		scorer.intn = func(int) int {
+			n := calls[0]
+			calls = calls[1:]
+			return n
+		}
+		return scorer.pick(servers)
+	}
+	// a scores 1, b 0.5+1 for its errors, c 0.5+1 for its outstanding bytes.
+	assert.Equal(t, "a", choose(0, 0), "errors make b worse than a")
+	assert.Equal(t, "a", choose(2, 0), "outstanding bytes make c worse than a")
+
+	scorer.weights = scoreWeights{latency: 1}
+	assert.Equal(t, "b", choose(0, 0), "only the latency counts")
+
+	scorer.intn = func(int) int { return 0 }
+	assert.Equal(t, "d", scorer.pick([]string{"d"}))
+	assert.Equal(t, "", scorer.pick(nil))
+}
+
+func TestCompositeScorer_Start(t *testing.T) {
+	scorer := newCompositeScorer(defaultScoreWeights)
+	r := httptest.NewRequest(http.MethodPut, "/db/key", strings.NewReader("12345"))
+	w, done := scorer.start("a", httptest.NewRecorder(), r)
+	assert.Equal(t, int64(5), scorer.backends["a"].outstanding)
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("abc"))
+	assert.Equal(t, int64(8), scorer.backends["a"].outstanding)
+	done(nil)
+	assert.Equal(t, int64(0), scorer.backends["a"].outstanding)
+	assert.Equal(t, 0.0, scorer.backends["a"].errorRate)
+	assert.NotZero(t, scorer.backends["a"].latency)
+
+	w, done = scorer.start("a", httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusInternalServerError)
+	done(nil)
+	assert.InDelta(t, ewmaAlpha, scorer.backends["a"].errorRate, 1e-9, "server errors count as failures")
+
+	_, done = scorer.start("a", httptest.NewRecorder(), r)
+	done(errors.New("connection refused"))
+	assert.Greater(t, scorer.backends["a"].errorRate, ewmaAlpha, "failed requests raise the error rate")
+}
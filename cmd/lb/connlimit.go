@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
+)
+
+// connLimiter limits the connections a client IP keeps open at once, so a
+// single misbehaving client can't use up the file descriptors of the
+// balancer. The kernel has accepted a connection over the limit already;
+// every request on it is answered with 429 and the connection closed.
+type connLimiter struct {
+	limiter *ratelimit.Concurrency
+
+	mu sync.Mutex
+	// releases hold the slots of the connections within the limit.
+	releases map[net.Conn]func()
+	rejected atomic.Int64
+}
+
+func newConnLimiter(limit int) *connLimiter {
+	return &connLimiter{limiter: ratelimit.NewConcurrency(limit), releases: make(map[net.Conn]func())}
+}
+
+type overConnLimitKey struct{}
+
+// ConnContext takes a slot of the client of c, or marks the connection over
+// the limit.
+func (l *connLimiter) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	release, ok := l.limiter.Acquire(connIP(c))
+	if !ok {
+		l.rejected.Add(1)
+		return context.WithValue(ctx, overConnLimitKey{}, true)
+	}
+	l.mu.Lock()
+	l.releases[c] = release
+	l.mu.Unlock()
+	return ctx
+}
+
+// ConnState gives the slot of a connection back once it is closed.
+func (l *connLimiter) ConnState(c net.Conn, state http.ConnState) {
+	if state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	l.mu.Lock()
+	release := l.releases[c]
+	delete(l.releases, c)
+	l.mu.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+func connIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Wrap answers the requests of connections over the limit with 429 and
+// closes them.
+func (l *connLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if over, _ := r.Context().Value(overConnLimitKey{}).(bool); over {
+			rw.Header().Set("Connection", "close")
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+type connLimitStats struct {
+	Open     int   `json:"open"`
+	Rejected int64 `json:"rejected"`
+}
+
+// ServeHTTP reports the connections open within the limit and the number
+// rejected.
+func (l *connLimiter) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	l.mu.Lock()
+	stats := connLimitStats{Open: len(l.releases), Rejected: l.rejected.Load()}
+	l.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(stats)
+}
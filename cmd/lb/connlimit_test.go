@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	conns := newConnLimiter(1)
+	server := httptest.NewUnstartedServer(conns.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	})))
+	server.Config.ConnContext = conns.ConnContext
+	server.Config.ConnState = conns.ConnState
+	server.Start()
+	defer server.Close()
+
+	get := func(conn net.Conn) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	first := dial()
+	if resp := get(first); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the first connection to be served, got %d", resp.StatusCode)
+	}
+	second := dial()
+	defer second.Close()
+	if resp := get(second); resp.StatusCode != http.StatusTooManyRequests || !resp.Close {
+		t.Errorf("Expected 429 closing the second connection, got %d, close %t", resp.StatusCode, resp.Close)
+	}
+
+	// The slot of a closed connection is given back.
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn := dial()
+		resp := get(conn)
+		conn.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a new connection to be served once the first closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rejected := conns.rejected.Load(); rejected < 1 {
+		t.Errorf("Expected the rejected connections to be counted, got %d", rejected)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// validRequestID limits client supplied request IDs to values that are safe
+// to log and to render into error pages.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// errorPageData is available to error page templates.
+type errorPageData struct {
+	Status     int    `json:"status"`
+	Error      string `json:"error"`
+	RequestID  string `json:"request_id"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+type errorPage struct {
+	prefix      string
+	template    *template.Template
+	contentType string
+}
+
+// errorPages replaces the bodies of 502, 503 and 504 responses, which come
+// from unreachable or failing upstreams, with a JSON error or the template
+// configured for the longest matching route prefix.
+type errorPages struct {
+	pages      []errorPage
+	retryAfter time.Duration
+}
+
+// newErrorPages loads the templates listed as "prefix=file" items. The
+// content type of a page is derived from the file extension.
+func newErrorPages(items []string, retryAfter time.Duration) (*errorPages, error) {
+	p := &errorPages{retryAfter: retryAfter}
+	for _, item := range items {
+		prefix, path, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid error page %q, expected prefix=file", item)
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(path).Parse(string(text))
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		p.pages = append(p.pages, errorPage{prefix: prefix, template: tmpl, contentType: contentType})
+	}
+	sort.Slice(p.pages, func(i, j int) bool {
+		return len(p.pages[i].prefix) > len(p.pages[j].prefix)
+	})
+	return p, nil
+}
+
+func (p *errorPages) page(path string) *errorPage {
+	for i := range p.pages {
+		if strings.HasPrefix(path, p.pages[i].prefix) {
+			return &p.pages[i]
+		}
+	}
+	return nil
+}
+
+// Wrap tags every request with a request ID, passed to the upstream and
+// returned to the client, and rewrites gateway errors of next.
+func (p *errorPages) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		rw.Header().Set(requestIDHeader, id)
+
+		writer := &errorPageWriter{ResponseWriter: rw, pages: p, page: p.page(r.URL.Path), requestID: id}
+		next.ServeHTTP(writer, r)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isGatewayError(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// errorPageWriter swallows the original body of a gateway error and writes
+// the configured error page instead.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages     *errorPages
+	page      *errorPage
+	requestID string
+
+	wroteHeader bool
+	rewritten   bool
+}
+
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if !isGatewayError(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.rewritten = true
+
+	retryAfter := int(w.pages.retryAfter.Seconds())
+	data := errorPageData{
+		Status:     status,
+		Error:      http.StatusText(status),
+		RequestID:  w.requestID,
+		RetryAfter: retryAfter,
+	}
+	var body bytes.Buffer
+	contentType := "application/json"
+	if w.page == nil || w.page.template.Execute(&body, data) != nil {
+		body.Reset()
+		_ = json.NewEncoder(&body).Encode(data)
+	} else {
+		contentType = w.page.contentType
+	}
+
+	header := w.Header()
+	for _, name := range []string{"Content-Length", "Content-Encoding", "X-Content-Type-Options"} {
+		header.Del(name)
+	}
+	header.Set("Content-Type", contentType)
+	if retryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	w.ResponseWriter.WriteHeader(status)
+	_, _ = w.ResponseWriter.Write(body.Bytes())
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.rewritten {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
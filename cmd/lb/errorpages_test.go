@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/balancertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorPages(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "error.html")
+	assert.Nil(t, os.WriteFile(page, []byte("<p>{{.Status}} {{.Error}}, request {{.RequestID}}</p>"), 0o600))
+	pages, err := newErrorPages([]string{"/site/=" + page}, 5*time.Second)
+	assert.Nil(t, err)
+
+	var upstreamID string
+	handler := pages.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(requestIDHeader)
+		switch r.URL.Query().Get("status") {
+		case "502":
+			rw.Header().Set("Content-Length", "99")
+			http.Error(rw, "proxy error: dial tcp: connection refused", http.StatusBadGateway)
+		case "404":
+			http.Error(rw, "not found", http.StatusNotFound)
+		default:
+			_, _ = rw.Write([]byte("OK"))
+		}
+	}))
+
+	rw := balancertest.Send(handler, "GET", "/api/v1/some-data?status=502")
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "5", rw.Header().Get("Retry-After"))
+	assert.Empty(t, rw.Header().Get("Content-Length"))
+	id := rw.Header().Get(requestIDHeader)
+	assert.Len(t, id, 16)
+	assert.Equal(t, id, upstreamID, "the upstream sees the same request ID")
+	assert.JSONEq(t, `{"status": 502, "error": "Bad Gateway", "request_id": "`+id+`", "retry_after": 5}`, rw.Body.String())
+
+	r := httptest.NewRequest("GET", "/site/index?status=502", nil)
+	r.Header.Set(requestIDHeader, "abc-123")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "<p>502 Bad Gateway, request abc-123</p>", rw.Body.String())
+
+	r = httptest.NewRequest("GET", "/site/index?status=502", nil)
+	r.Header.Set(requestIDHeader, "<script>")
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+	assert.NotContains(t, rw.Body.String(), "<script>", "invalid request IDs are replaced")
+
+	rw = balancertest.Send(handler, "GET", "/api/v1/some-data?status=404")
+	assert.Equal(t, "not found\n", rw.Body.String(), "other errors are passed through")
+	rw = balancertest.Send(handler, "GET", "/api/v1/some-data")
+	assert.Equal(t, "OK", rw.Body.String())
+}
+
+func TestNewErrorPages_Invalid(t *testing.T) {
+	_, err := newErrorPages([]string{"/api/"}, 0)
+	assert.NotNil(t, err)
+	_, err = newErrorPages([]string{"/api/=" + filepath.Join(t.TempDir(), "missing.json")}, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ewmaAlpha is the weight of the newest latency sample.
+const ewmaAlpha = 0.3
+
+// latencyTracker keeps an exponentially weighted moving average of the
+// response latency of every backend together with its outstanding requests.
+type latencyTracker struct {
+	mu       sync.Mutex
+	backends map[string]*backendLoad
+	intn     func(n int) int
+}
+
+type backendLoad struct {
+	ewma        time.Duration
+	outstanding int
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{backends: make(map[string]*backendLoad), intn: rand.Intn}
+}
+
+// score estimates how long a new request to the server would take. Servers
+// without samples score zero so they are tried right away.
+func (t *latencyTracker) score(server string) float64 {
+	load, ok := t.backends[server]
+	if !ok {
+		return 0
+	}
+	return float64(load.ewma) * float64(load.outstanding+1)
+}
+
+// pick chooses the better of two random candidates ("power of two choices"),
+// which avoids sending every request to the single best-looking server.
+func (t *latencyTracker) pick(servers []string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch len(servers) {
+	case 0:
+		return ""
+	case 1:
+		return servers[0]
+	}
+	i := t.intn(len(servers))
+	j := t.intn(len(servers) - 1)
+	if j >= i {
+		j++
+	}
+	if t.score(servers[j]) < t.score(servers[i]) {
+		return servers[j]
+	}
+	return servers[i]
+}
+
+// start marks a request to the server as outstanding. The returned function
+// records its latency once the response is received.
+func (t *latencyTracker) start(server string) func() {
+	t.mu.Lock()
+	load, ok := t.backends[server]
+	if !ok {
+		load = &backendLoad{}
+		t.backends[server] = load
+	}
+	load.outstanding++
+	t.mu.Unlock()
+
+	started := time.Now()
+	return func() {
+		elapsed := time.Since(started)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		load.outstanding--
+		if load.ewma == 0 {
+			load.ewma = elapsed
+		} else {
+			load.ewma = time.Duration(ewmaAlpha*float64(elapsed) + (1-ewmaAlpha)*float64(load.ewma))
+		}
+	}
+}
+
+// getLowestLatencyServer picks a healthy server by its EWMA latency.
+func getLowestLatencyServer() string {
+	mu.Lock()
+	servers := liveServers()
+	healthy := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if !unhealthy[server] {
+			healthy = append(healthy, server)
+		}
+	}
+	mu.Unlock()
+	return latency.pick(healthy)
+}
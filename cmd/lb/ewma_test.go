@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/balancertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyTracker_Pick(t *testing.T) {
+	tracker := newLatencyTracker()
+	servers := []string{"a", "b", "c"}
+	tracker.backends["a"] = &backendLoad{ewma: 10 * time.Millisecond}
+	tracker.backends["b"] = &backendLoad{ewma: 50 * time.Millisecond}
+	tracker.backends["c"] = &backendLoad{ewma: 5 * time.Millisecond, outstanding: 3}
+
+	// The two candidates are servers[i] and servers[j], j skipping i.
+	choose := func(i, j int) string {
+		calls := []int{i, j}
+		tracker.intn = func(int) int {
+			n := calls[0]
+			calls = calls[1:]
+			return n
+		}
+		return tracker.pick(servers)
+	}
+	assert.Equal(t, "a", choose(0, 0), "a beats b")
+	assert.Equal(t, "a", choose(1, 0), "a beats b")
+	assert.Equal(t, "a", choose(2, 0), "outstanding requests make c slower than a")
+	assert.Equal(t, "c", choose(2, 1), "c beats b")
+
+	tracker.intn = func(int) int { return 0 }
+	assert.Equal(t, "d", tracker.pick([]string{"d"}))
+	assert.Equal(t, "", tracker.pick(nil))
+}
+
+func TestLatencyTracker_Start(t *testing.T) {
+	tracker := newLatencyTracker()
+	done := tracker.start("a")
+	assert.Equal(t, 1, tracker.backends["a"].outstanding)
+	time.Sleep(10 * time.Millisecond)
+	done()
+	assert.Equal(t, 0, tracker.backends["a"].outstanding)
+	first := tracker.backends["a"].ewma
+	assert.GreaterOrEqual(t, first, 10*time.Millisecond)
+
+	tracker.start("a")()
+	assert.Less(t, tracker.backends["a"].ewma, first, "fast responses lower the average")
+}
+
+func TestBalancer_EWMA(t *testing.T) {
+	defer func(s string) { *strategy = s }(*strategy)
+	*strategy = "ewma"
+
+	fast := balancertest.NewBackend(t)
+	slow := balancertest.NewBackend(t).Script(balancertest.Slow(20 * time.Millisecond))
+	backends := []*balancertest.Backend{fast, slow}
+	serversPool = balancertest.Addrs(backends)
+	unhealthy = map[string]bool{}
+	latency = newLatencyTracker()
+
+	for _, status := range balancertest.SendN(http.HandlerFunc(balance), 40, "/") {
+		assert.Equal(t, http.StatusOK, status)
+	}
+	assert.Greater(t, fast.Requests(), 30, "distribution %v", balancertest.Distribution(backends))
+	assert.Positive(t, slow.Requests(), "every backend is probed")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// filterConfig lists the rules requests must pass before they are proxied.
+// Empty fields disable the corresponding rule.
+type filterConfig struct {
+	// AllowIPs and DenyIPs are client IPs or CIDR ranges. Denied clients are
+	// rejected even if they are also allowed.
+	AllowIPs []string
+	DenyIPs  []string
+	// BlockPaths are regular expressions matched against the request path.
+	BlockPaths     []string
+	MaxQueryLength int
+	AllowedMethods []string
+}
+
+// requestFilter rejects requests breaking the configured rules and counts
+// them by the rule that blocked them.
+type requestFilter struct {
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+	blockPaths []*regexp.Regexp
+	maxQuery   int
+	methods    map[string]bool
+
+	mu      sync.Mutex
+	blocked map[string]int64
+}
+
+func newRequestFilter(config filterConfig) (*requestFilter, error) {
+	f := &requestFilter{maxQuery: config.MaxQueryLength, blocked: make(map[string]int64)}
+	var err error
+	if f.allow, err = parseNets(config.AllowIPs); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseNets(config.DenyIPs); err != nil {
+		return nil, err
+	}
+	for _, pattern := range config.BlockPaths {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+		}
+		f.blockPaths = append(f.blockPaths, re)
+	}
+	if len(config.AllowedMethods) > 0 {
+		f.methods = make(map[string]bool)
+		for _, method := range config.AllowedMethods {
+			f.methods[strings.ToUpper(method)] = true
+		}
+	}
+	return f, nil
+}
+
+// parseNets parses IPs and CIDR ranges. A single IP is a range of one.
+func parseNets(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", value)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", value, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns the rule blocking the request and the status to answer it
+// with, or an empty rule if the request may pass.
+func (f *requestFilter) check(r *http.Request) (string, int) {
+	// The balancer is the edge of the system, so the connection address is
+	// the client; forwarding headers are set by the client and not trusted.
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if len(f.allow) > 0 || len(f.deny) > 0 {
+		if ip == nil || containsIP(f.deny, ip) || (len(f.allow) > 0 && !containsIP(f.allow, ip)) {
+			return "ip", http.StatusForbidden
+		}
+	}
+	if f.methods != nil && !f.methods[r.Method] {
+		return "method", http.StatusMethodNotAllowed
+	}
+	if f.maxQuery > 0 && len(r.URL.RawQuery) > f.maxQuery {
+		return "query", http.StatusRequestURITooLong
+	}
+	for _, re := range f.blockPaths {
+		if re.MatchString(r.URL.Path) {
+			return "path", http.StatusForbidden
+		}
+	}
+	return "", 0
+}
+
+// Wrap passes only the requests accepted by the filter to next.
+func (f *requestFilter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rule, status := f.check(r)
+		if rule == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		f.mu.Lock()
+		f.blocked[rule]++
+		f.mu.Unlock()
+		http.Error(rw, http.StatusText(status), status)
+	})
+}
+
+// filterMetrics is the JSON body of the metrics endpoint.
+type filterMetrics struct {
+	Blocked map[string]int64 `json:"blocked"`
+}
+
+// ServeHTTP reports the number of blocked requests per rule.
+func (f *requestFilter) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	f.mu.Lock()
+	metrics := filterMetrics{Blocked: make(map[string]int64, len(f.blocked))}
+	for rule, count := range f.blocked {
+		metrics.Blocked[rule] = count
+	}
+	f.mu.Unlock()
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(metrics)
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestFilter(t *testing.T) {
+	filter, err := newRequestFilter(filterConfig{
+		AllowIPs:       []string{"10.0.0.0/8", "192.168.1.5"},
+		DenyIPs:        []string{"10.0.0.13"},
+		BlockPaths:     []string{`^/db-admin/`, `\.\./`},
+		MaxQueryLength: 20,
+		AllowedMethods: []string{"get", "POST"},
+	})
+	assert.Nil(t, err)
+	handler := filter.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		name, method, remote, target string
+		status                       int
+	}{
+		{"allowed range", "GET", "10.1.2.3:4000", "/api/v1/some-data", http.StatusOK},
+		{"allowed ip", "POST", "192.168.1.5:4000", "/api/v1/some-data", http.StatusOK},
+		{"not allowed", "GET", "192.168.1.6:4000", "/", http.StatusForbidden},
+		{"denied", "GET", "10.0.0.13:4000", "/", http.StatusForbidden},
+		{"method", "DELETE", "10.1.2.3:4000", "/", http.StatusMethodNotAllowed},
+		{"query", "GET", "10.1.2.3:4000", "/?key=" + strings.Repeat("x", 20), http.StatusRequestURITooLong},
+		{"path", "GET", "10.1.2.3:4000", "/db-admin/stats", http.StatusForbidden},
+		{"traversal", "GET", "10.1.2.3:4000", "/static/../secret", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, nil)
+			r.RemoteAddr = tc.remote
+			r.Header.Set("X-Forwarded-For", "10.1.2.3")
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, r)
+			assert.Equal(t, tc.status, rw.Code)
+		})
+	}
+
+	rw := httptest.NewRecorder()
+	filter.ServeHTTP(rw, httptest.NewRequest("GET", "/lb-admin/metrics", nil))
+	var metrics filterMetrics
+	assert.Nil(t, json.NewDecoder(rw.Body).Decode(&metrics))
+	assert.Equal(t, map[string]int64{"ip": 2, "method": 1, "query": 1, "path": 2}, metrics.Blocked)
+}
+
+func TestNewRequestFilter_Invalid(t *testing.T) {
+	_, err := newRequestFilter(filterConfig{DenyIPs: []string{"10.0.0.0/33"}})
+	assert.NotNil(t, err)
+	_, err = newRequestFilter(filterConfig{AllowIPs: []string{"localhost"}})
+	assert.NotNil(t, err)
+	_, err = newRequestFilter(filterConfig{BlockPaths: []string{"("}})
+	assert.NotNil(t, err)
+
+	filter, err := newRequestFilter(filterConfig{})
+	assert.Nil(t, err)
+	rule, _ := filter.check(httptest.NewRequest("PATCH", "/?"+strings.Repeat("x", 5000), nil))
+	assert.Empty(t, rule, "an empty config accepts everything")
+}
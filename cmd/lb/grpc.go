@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcUnavailable is the gRPC status code of a request no backend could
+// serve.
+const grpcUnavailable = "14"
+
+// isGRPC reports whether r is a gRPC call. Every call is a stream of its
+// own, so balancing per request spreads the streams of one connection over
+// the backends.
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTimeoutUnits are the units of the grpc-timeout header.
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// grpcTimeout returns the deadline a gRPC client set for its call with the
+// grpc-timeout header, an integer of at most 8 digits and a unit.
+func grpcTimeout(r *http.Request) (time.Duration, bool) {
+	value := r.Header.Get("Grpc-Timeout")
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// writeGRPCError fails a gRPC call the way gRPC clients expect: status 200
+// with the error in the grpc-status and grpc-message headers.
+func writeGRPCError(rw http.ResponseWriter, message string) {
+	rw.Header().Set("Content-Type", "application/grpc")
+	rw.Header().Set("Grpc-Status", grpcUnavailable)
+	rw.Header().Set("Grpc-Message", message)
+	rw.WriteHeader(http.StatusOK)
+}
+
+// copyStream copies a streamed response body, flushing after every read so
+// messages reach the client as soon as the backend sends them.
+func copyStream(rw http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher := http.NewResponseController(rw)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			m, writeErr := rw.Write(buf[:n])
+			written += int64(m)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			_ = flusher.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// copyTrailers passes on the trailers of a fully read response, where gRPC
+// sends the status of the call.
+func copyTrailers(rw http.ResponseWriter, resp *http.Response) {
+	for k, values := range resp.Trailer {
+		for _, value := range values {
+			rw.Header().Add(http.TrailerPrefix+k, value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForward_GRPC(t *testing.T) {
+	var proto string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("message"))
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	defaultClient, httpsBackends := http.DefaultClient, *https
+	http.DefaultClient, *https = backend.Client(), true
+	defer func() { http.DefaultClient, *https = defaultClient, httpsBackends }()
+
+	req := httptest.NewRequest(http.MethodPost, "/db.Store/Get", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	rw := httptest.NewRecorder()
+	assert.Nil(t, forward(strings.TrimPrefix(backend.URL, "https://"), rw, req))
+
+	resp := rw.Result()
+	assert.Equal(t, "HTTP/2.0", proto)
+	assert.Equal(t, "message", rw.Body.String())
+	assert.True(t, rw.Flushed)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestForward_GRPCUnavailable(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	dst := strings.TrimPrefix(backend.URL, "http://")
+	backend.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/db.Store/Get", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	rw := httptest.NewRecorder()
+	assert.NotNil(t, forward(dst, rw, req))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, grpcUnavailable, rw.Header().Get("Grpc-Status"))
+}
+
+func TestForward_GRPCStreamOutlivesTimeout(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.WriteHeader(http.StatusOK)
+		// A server stream sending messages for longer than the timeout.
+		for i := 0; i < 4; i++ {
+			rw.Write([]byte("message"))
+			http.NewResponseController(rw).Flush()
+			time.Sleep(timeout / 2)
+		}
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	defaultClient, httpsBackends, defaultTimeout := http.DefaultClient, *https, timeout
+	http.DefaultClient, *https, timeout = backend.Client(), true, 50*time.Millisecond
+	defer func() { http.DefaultClient, *https, timeout = defaultClient, httpsBackends, defaultTimeout }()
+
+	req := httptest.NewRequest(http.MethodPost, "/db.Store/Watch", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	rw := httptest.NewRecorder()
+	assert.Nil(t, forward(strings.TrimPrefix(backend.URL, "https://"), rw, req))
+	assert.Equal(t, strings.Repeat("message", 4), rw.Body.String())
+	assert.Equal(t, "0", rw.Result().Trailer.Get("Grpc-Status"))
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	for header, expected := range map[string]time.Duration{
+		"100m": 100 * time.Millisecond,
+		"2S":   2 * time.Second,
+		"1H":   time.Hour,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/db.Store/Get", nil)
+		req.Header.Set("Grpc-Timeout", header)
+		callTimeout, ok := grpcTimeout(req)
+		assert.True(t, ok, header)
+		assert.Equal(t, expected, callTimeout, header)
+	}
+	for _, header := range []string{"", "5", "10x", "123456789S"} {
+		req := httptest.NewRequest(http.MethodPost, "/db.Store/Get", nil)
+		req.Header.Set("Grpc-Timeout", header)
+		_, ok := grpcTimeout(req)
+		assert.False(t, ok, header)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultMaintenanceMessage = "The service is down for maintenance"
+
+// maintenanceState is the JSON body of the maintenance admin endpoint.
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+	// Routes are the path prefixes answered with the maintenance response.
+	// No routes means every proxied route.
+	Routes  []string `json:"routes,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+// maintenanceMode answers the selected routes with 503 instead of proxying
+// them while it is enabled. Health checks always pass through.
+type maintenanceMode struct {
+	// page, when set, replaces the default JSON response body.
+	page        []byte
+	contentType string
+
+	mu    sync.Mutex
+	state maintenanceState
+}
+
+// newMaintenanceMode creates a disabled maintenance mode responding with the
+// contents of pagePath, or with a JSON error if pagePath is empty.
+func newMaintenanceMode(pagePath string) (*maintenanceMode, error) {
+	m := &maintenanceMode{}
+	if pagePath == "" {
+		return m, nil
+	}
+	page, err := os.ReadFile(pagePath)
+	if err != nil {
+		return nil, err
+	}
+	m.page = page
+	m.contentType = mime.TypeByExtension(filepath.Ext(pagePath))
+	if m.contentType == "" {
+		m.contentType = "text/html; charset=utf-8"
+	}
+	return m, nil
+}
+
+func (m *maintenanceMode) current() maintenanceState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+func (m *maintenanceMode) covers(state maintenanceState, path string) bool {
+	if !state.Enabled || path == "/health" {
+		return false
+	}
+	if len(state.Routes) == 0 {
+		return true
+	}
+	for _, route := range state.Routes {
+		if strings.HasPrefix(path, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap passes requests to next unless they are on a route under maintenance.
+func (m *maintenanceMode) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		state := m.current()
+		if !m.covers(state, r.URL.Path) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		if m.page != nil {
+			rw.Header().Set("Content-Type", m.contentType)
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = rw.Write(m.page)
+			return
+		}
+		message := state.Message
+		if message == "" {
+			message = defaultMaintenanceMessage
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(rw).Encode(map[string]string{"error": "maintenance", "message": message})
+	})
+}
+
+// ServeHTTP reports the maintenance state on GET and replaces it on POST.
+func (m *maintenanceMode) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.state = state
+		m.mu.Unlock()
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(m.current())
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/balancertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	maintenance, err := newMaintenanceMode("")
+	assert.Nil(t, err)
+	handler := maintenance.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	setState := func(body string) {
+		rw := httptest.NewRecorder()
+		maintenance.ServeHTTP(rw, httptest.NewRequest("POST", "/lb-admin/maintenance", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rw.Code)
+	}
+
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/api/v1/some-data").Code)
+
+	setState(`{"enabled": true, "routes": ["/api/v1/some-data"], "message": "Migrating the db"}`)
+	rw := balancertest.Send(handler, "POST", "/api/v1/some-data")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"error": "maintenance", "message": "Migrating the db"}`, rw.Body.String())
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/report").Code, "other routes stay up")
+
+	setState(`{"enabled": true}`)
+	assert.Equal(t, http.StatusServiceUnavailable, balancertest.Send(handler, "GET", "/report").Code)
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/health").Code)
+
+	rw = balancertest.Send(maintenance, "GET", "/lb-admin/maintenance")
+	assert.JSONEq(t, `{"enabled": true}`, rw.Body.String())
+
+	setState(`{"enabled": false}`)
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/report").Code)
+}
+
+func TestMaintenanceMode_Page(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	assert.Nil(t, os.WriteFile(page, []byte("<h1>Back soon</h1>"), 0o600))
+
+	maintenance, err := newMaintenanceMode(page)
+	assert.Nil(t, err)
+	maintenance.state = maintenanceState{Enabled: true}
+
+	rw := balancertest.Send(maintenance.Wrap(http.NotFoundHandler()), "GET", "/")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "<h1>Back soon</h1>", rw.Body.String())
+
+	_, err = newMaintenanceMode(filepath.Join(t.TempDir(), "missing.html"))
+	assert.NotNil(t, err)
+}
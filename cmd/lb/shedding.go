@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sheddingSamples is how many recent request latencies the p99 is taken
+// over.
+const sheddingSamples = 1000
+
+// shedConfig configures load shedding. A zero SLO disables it.
+type shedConfig struct {
+	SLO time.Duration
+	// Step is how many percent of the low priority traffic more, or less,
+	// are shed after every Interval the p99 is above, or below, the SLO.
+	Step     int
+	Interval time.Duration
+	// LowPriorityRoutes are path prefixes and LowPriorityKeys values of the
+	// X-Api-Key header of the traffic shed first.
+	LowPriorityRoutes []string
+	LowPriorityKeys   []string
+}
+
+// loadShedder protects interactive traffic during overload. It tracks the
+// p99 latency of proxied requests and, while it breaches the SLO, rejects a
+// growing share of low priority requests with 503 until latency recovers.
+type loadShedder struct {
+	config shedConfig
+	keys   map[string]bool
+	// random returns a number in [0, 100), replaced in tests.
+	random func() int
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	p99       time.Duration
+	percent   int
+	shed      int64
+}
+
+// shedMetrics is the JSON body of the load shedding admin endpoint.
+type shedMetrics struct {
+	SLOMillis   int64 `json:"slo_ms"`
+	P99Millis   int64 `json:"p99_ms"`
+	ShedPercent int   `json:"shed_percent"`
+	Shed        int64 `json:"shed"`
+}
+
+func newLoadShedder(config shedConfig) *loadShedder {
+	s := &loadShedder{
+		config: config,
+		keys:   make(map[string]bool),
+		random: func() int { return rand.Intn(100) },
+	}
+	for _, key := range config.LowPriorityKeys {
+		s.keys[key] = true
+	}
+	return s
+}
+
+// run adjusts the shed percentage every interval.
+func (s *loadShedder) run() {
+	for range time.Tick(s.config.Interval) {
+		s.adjust()
+	}
+}
+
+// adjust compares the current p99 with the SLO and moves the shed
+// percentage one step towards what it calls for.
+func (s *loadShedder) adjust() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sorted := slices.Clone(s.latencies)
+	slices.Sort(sorted)
+	s.p99 = 0
+	if len(sorted) > 0 {
+		s.p99 = sorted[len(sorted)*99/100]
+	}
+
+	previous := s.percent
+	if s.p99 > s.config.SLO {
+		s.percent = min(s.percent+s.config.Step, 100)
+	} else {
+		s.percent = max(s.percent-s.config.Step, 0)
+	}
+	if s.percent != previous {
+		log.Printf("p99 latency %s against an SLO of %s, shedding %d%% of low priority traffic", s.p99, s.config.SLO, s.percent)
+	}
+}
+
+func (s *loadShedder) lowPriority(r *http.Request) bool {
+	if s.keys[r.Header.Get("X-Api-Key")] {
+		return true
+	}
+	for _, prefix := range s.config.LowPriorityRoutes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *loadShedder) record(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.latencies) < sheddingSamples {
+		s.latencies = append(s.latencies, latency)
+		return
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % sheddingSamples
+}
+
+// shouldShed decides whether a low priority request is rejected.
+func (s *loadShedder) shouldShed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.percent == 0 || s.random() >= s.percent {
+		return false
+	}
+	s.shed++
+	return true
+}
+
+// Wrap sheds requests and records the latency of the proxied ones.
+func (s *loadShedder) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if s.lowPriority(r) && s.shouldShed() {
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(rw, r)
+		s.record(time.Since(start))
+	})
+}
+
+func (s *loadShedder) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	metrics := shedMetrics{
+		SLOMillis:   s.config.SLO.Milliseconds(),
+		P99Millis:   s.p99.Milliseconds(),
+		ShedPercent: s.percent,
+		Shed:        s.shed,
+	}
+	s.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(metrics)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/balancertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadShedder(t *testing.T) {
+	shedder := newLoadShedder(shedConfig{
+		SLO:               100 * time.Millisecond,
+		Step:              50,
+		LowPriorityRoutes: []string{"/api/v1/some-data/_mget"},
+		LowPriorityKeys:   []string{"batch-key"},
+	})
+	roll := 0
+	shedder.random = func() int { return roll }
+	handler := shedder.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	for i := 0; i < 100; i++ {
+		shedder.record(10 * time.Millisecond)
+	}
+	shedder.adjust()
+	assert.Equal(t, 0, shedder.percent)
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "POST", "/api/v1/some-data/_mget").Code)
+
+	// A slow tail breaches the SLO.
+	for i := 0; i < 5; i++ {
+		shedder.record(time.Second)
+	}
+	shedder.adjust()
+	assert.Equal(t, time.Second, shedder.p99)
+	assert.Equal(t, 50, shedder.percent)
+
+	rw := balancertest.Send(handler, "POST", "/api/v1/some-data/_mget")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "GET", "/api/v1/some-data").Code, "interactive traffic is never shed")
+
+	roll = 60
+	assert.Equal(t, http.StatusOK, balancertest.Send(handler, "POST", "/api/v1/some-data/_mget").Code, "only the shed share is rejected")
+
+	shedder.adjust()
+	assert.Equal(t, 100, shedder.percent)
+
+	// Latency recovers once the slow requests leave the window.
+	for i := 0; i < sheddingSamples; i++ {
+		shedder.record(10 * time.Millisecond)
+	}
+	shedder.adjust()
+	shedder.adjust()
+	assert.Equal(t, 0, shedder.percent)
+	assert.Equal(t, int64(1), shedder.shed)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+)
+
+// stickyCookie pins a client to the backend it names. It holds a hash of
+// the backend address rather than the address itself.
+const stickyCookie = "lb-backend"
+
+func backendID(server string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(server))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// pinnedServer returns the backend named by the sticky cookie of r, if it
+// is still in a pool taking traffic.
+func pinnedServer(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(stickyCookie)
+	if err != nil {
+		return "", false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, server := range servingServers() {
+		if backendID(server) == cookie.Value {
+			return server, true
+		}
+	}
+	return "", false
+}
+
+// stickyServer keeps a client on its pinned backend while that one is
+// healthy. Clients without a pin, or whose backend failed or left the
+// pool, are pinned to a backend chosen by the balancing strategy.
+func stickyServer(rw http.ResponseWriter, r *http.Request) string {
+	pinned, found := pinnedServer(r)
+	if found {
+		mu.Lock()
+		healthy := !unhealthy[pinned]
+		mu.Unlock()
+		if healthy {
+			return pinned
+		}
+	}
+
+	server := pickServer()
+	if server == "" {
+		return ""
+	}
+	if _, err := r.Cookie(stickyCookie); err == nil {
+		from := pinned
+		if !found {
+			from = "a backend no longer in the pool"
+		}
+		log.Printf("Moving session of %s from %s to %s", r.RemoteAddr, from, server)
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     stickyCookie,
+		Value:    backendID(server),
+		Path:     "/",
+		MaxAge:   int(stickyTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return server
+}
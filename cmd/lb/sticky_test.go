@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStickyServer(t *testing.T) {
+	serversPool = []string{"server1:8080", "server2:8080"}
+	traffic = map[string]int{"server1:8080": 0, "server2:8080": 100}
+	unhealthy = make(map[string]bool)
+	defer func() { unhealthy = make(map[string]bool) }()
+
+	send := func(cookie *http.Cookie) (string, *http.Cookie) {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		server := stickyServer(rw, req)
+		cookies := rw.Result().Cookies()
+		if len(cookies) == 0 {
+			return server, nil
+		}
+		return server, cookies[0]
+	}
+
+	server, cookie := send(nil)
+	assert.Equal(t, "server1:8080", server)
+	assert.NotNil(t, cookie)
+	assert.Equal(t, backendID("server1:8080"), cookie.Value)
+
+	// The pin holds even when another backend has less traffic.
+	traffic["server1:8080"] = 500
+	server, updated := send(cookie)
+	assert.Equal(t, "server1:8080", server)
+	assert.Nil(t, updated)
+
+	// A failed backend hands its sessions over and the cookie follows.
+	unhealthy["server1:8080"] = true
+	server, updated = send(cookie)
+	assert.Equal(t, "server2:8080", server)
+	assert.NotNil(t, updated)
+	assert.Equal(t, backendID("server2:8080"), updated.Value)
+
+	// So does a backend that left the pool.
+	server, updated = send(&http.Cookie{Name: stickyCookie, Value: backendID("server9:8080")})
+	assert.Equal(t, "server2:8080", server)
+	assert.NotNil(t, updated)
+}
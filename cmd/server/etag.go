@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+// recordETag is the strong ETag of a record. The version changes with
+// every write and never repeats, also for a deleted and re-created key.
+func recordETag(record dbclient.Record) string {
+	return fmt.Sprintf(`"%d"`, record.Version)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. The
+// comparison is weak, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readCacheControl is the Cache-Control of record reads. With no max age
+// caches keep the record but revalidate it with the ETag every time.
+func readCacheControl(maxAge int) string {
+	if maxAge <= 0 {
+		return "no-cache"
+	}
+	return fmt.Sprintf("max-age=%d", maxAge)
+}
+
+// defaultFormat is the format of reads asking for none.
+var defaultFormat = httptools.ResponseFormat{Envelope: httptools.EnvelopeRecord, Naming: httptools.SnakeCase}
+
+// writeRecord answers a read of record in format, or 304 when the client
+// holds the current version already. Other formats than the default have
+// ETags of their own, as they are other representations of the record.
+func writeRecord(rw http.ResponseWriter, r *http.Request, format httptools.ResponseFormat, record dbclient.Record, cacheControl string) {
+	etag := recordETag(record)
+	if format != defaultFormat {
+		etag = fmt.Sprintf(`%s-%s-%s"`, strings.TrimSuffix(etag, `"`), format.Envelope, format.Naming)
+	}
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Cache-Control", cacheControl)
+	rw.Header().Set("Vary", "Accept")
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	_ = format.Write(rw, r, httptools.ResponseRecord{Key: record.Key, Value: record.Value, Version: record.Version})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+func TestWriteRecord_ETag(t *testing.T) {
+	record := dbclient.Record{Key: "a", Value: "1", Version: 3}
+	etag := recordETag(record)
+
+	read := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=a", nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rw := httptest.NewRecorder()
+		writeRecord(rw, r, defaultFormat, record, readCacheControl(0))
+		return rw
+	}
+
+	rw := read("")
+	if rw.Code != http.StatusOK || rw.Header().Get("ETag") != etag || rw.Body.Len() == 0 {
+		t.Fatalf("Unexpected response %d, ETag %q", rw.Code, rw.Header().Get("ETag"))
+	}
+	if cc := rw.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+
+	for _, match := range []string{etag, `"other", W/` + etag, "*"} {
+		if rw := read(match); rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+			t.Errorf("Expected 304 for If-None-Match %s, got %d", match, rw.Code)
+		}
+	}
+	if rw := read(`"other"`); rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a stale ETag, got %d", rw.Code)
+	}
+
+	if recordETag(dbclient.Record{Key: "a", Value: "2", Version: 4}) == etag {
+		t.Error("Expected different versions to get different ETags")
+	}
+	if cc := readCacheControl(60); cc != "max-age=60" {
+		t.Errorf("Unexpected Cache-Control %q", cc)
+	}
+
+	rw = httptest.NewRecorder()
+	writeRecord(rw, httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=a", nil),
+		httptools.ResponseFormat{Envelope: httptools.EnvelopeBare, Naming: httptools.SnakeCase}, record, readCacheControl(0))
+	if rw.Body.String() != "\"1\"\n" || rw.Header().Get("ETag") == etag || rw.Header().Get("Vary") != "Accept" {
+		t.Errorf("Expected the bare value with an ETag of its own, got %q, %v", rw.Body.String(), rw.Header())
+	}
+}
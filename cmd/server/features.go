@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+// featureKeyPrefix is the reserved db key prefix persisted flags are kept
+// under, one key per flag holding "on" or "off".
+const featureKeyPrefix = "_features/"
+
+// reservedKey reports whether clients are kept from writing key.
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, featureKeyPrefix) || strings.HasPrefix(key, reportKeyPrefix)
+}
+
+// flagStore persists feature flags, a db client in production.
+type flagStore interface {
+	Get(key string) (dbclient.Record, error)
+	Put(key, value string) (uint64, error)
+}
+
+// Get and Put make a shardSet the flag store, routing flag keys like any
+// other key.
+func (s shardSet) Get(key string) (dbclient.Record, error) {
+	return s.forKey(key).client.Get(key)
+}
+
+func (s shardSet) Put(key, value string) (uint64, error) {
+	return s.forKey(key).client.Put(key, value)
+}
+
+// featureFlags switches endpoints on and off at runtime. Flags are named
+// after the operation IDs of the API and all start enabled. The defaults
+// can be changed with FEATURE_FLAGS ("putSomeData=off,mgetSomeData=off"),
+// persisted values override them and the admin endpoint changes them.
+type featureFlags struct {
+	store flagStore
+
+	mu      sync.RWMutex
+	enabled map[string]bool
+}
+
+type featureUpdate struct {
+	Name    string `json:"name"`
+	Enabled *bool  `json:"enabled"`
+}
+
+func newFeatureFlags(api apiSpec, defaults string, store flagStore) (*featureFlags, error) {
+	f := &featureFlags{store: store, enabled: make(map[string]bool, len(api))}
+	for _, op := range api {
+		f.enabled[op.ID] = true
+	}
+	for _, spec := range strings.Split(defaults, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(spec, "=")
+		enabled, err := parseFlagValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad flag %q: %w", spec, err)
+		}
+		if _, known := f.enabled[name]; !known {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		f.enabled[name] = enabled
+	}
+	return f, nil
+}
+
+func parseFlagValue(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, errors.New(`value must be "on" or "off"`)
+}
+
+func flagValue(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// load reads the persisted flags. Flags never persisted keep their value.
+func (f *featureFlags) load() error {
+	if f.store == nil {
+		return nil
+	}
+	for _, name := range f.names() {
+		record, err := f.store.Get(featureKeyPrefix + name)
+		if errors.Is(err, dbclient.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		enabled, err := parseFlagValue(record.Value)
+		if err != nil {
+			log.Printf("Ignoring persisted flag %s: %s", name, err)
+			continue
+		}
+		f.mu.Lock()
+		f.enabled[name] = enabled
+		f.mu.Unlock()
+	}
+	return nil
+}
+
+// refresh reloads the persisted flags every interval, so changes made
+// through another server apply here too.
+func (f *featureFlags) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := f.load(); err != nil {
+			log.Printf("Failed to refresh feature flags: %s", err)
+		}
+	}
+}
+
+func (f *featureFlags) names() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.enabled))
+	for name := range f.enabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *featureFlags) isEnabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled[name]
+}
+
+// set changes a flag and persists it when there is a store.
+func (f *featureFlags) set(name string, enabled bool) error {
+	f.mu.Lock()
+	if _, known := f.enabled[name]; !known {
+		f.mu.Unlock()
+		return fmt.Errorf("unknown flag %q", name)
+	}
+	f.enabled[name] = enabled
+	f.mu.Unlock()
+
+	if f.store == nil {
+		return nil
+	}
+	_, err := f.store.Put(featureKeyPrefix+name, flagValue(enabled))
+	return err
+}
+
+// gate serves next only while the flag of op is enabled, otherwise it
+// answers 503.
+func (f *featureFlags) gate(op *operation, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !f.isEnabled(op.ID) {
+			http.Error(rw, "Endpoint disabled", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// ServeHTTP lists the flags on GET and changes one on POST.
+func (f *featureFlags) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var update featureUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.Enabled == nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !f.isKnown(update.Name) {
+			http.Error(rw, fmt.Sprintf("Unknown flag %q", update.Name), http.StatusNotFound)
+			return
+		}
+		if err := f.set(update.Name, *update.Enabled); err != nil {
+			// The flag applies here but did not reach the other servers.
+			log.Printf("Failed to persist feature flag %s: %s", update.Name, err)
+			http.Error(rw, "Failed to persist the flag", http.StatusBadGateway)
+			return
+		}
+		log.Printf("Feature flag %s set to %s", update.Name, flagValue(*update.Enabled))
+	}
+
+	f.mu.RLock()
+	flags := make(map[string]bool, len(f.enabled))
+	for name, enabled := range f.enabled {
+		flags[name] = enabled
+	}
+	f.mu.RUnlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(flags)
+}
+
+func (f *featureFlags) isKnown(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, known := f.enabled[name]
+	return known
+}
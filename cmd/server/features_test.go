@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+type memFlagStore map[string]string
+
+func (m memFlagStore) Get(key string) (dbclient.Record, error) {
+	value, found := m[key]
+	if !found {
+		return dbclient.Record{}, dbclient.ErrNotFound
+	}
+	return dbclient.Record{Key: key, Value: value, Version: 1}, nil
+}
+
+func (m memFlagStore) Put(key, value string) (uint64, error) {
+	m[key] = value
+	return 1, nil
+}
+
+func TestFeatureFlags(t *testing.T) {
+	if _, err := newFeatureFlags(serverAPI, "search=off", nil); err == nil {
+		t.Errorf("Expected an error for an unknown flag")
+	}
+	if _, err := newFeatureFlags(serverAPI, "putSomeData=maybe", nil); err == nil {
+		t.Errorf("Expected an error for a bad value")
+	}
+
+	store := memFlagStore{featureKeyPrefix + "deleteSomeData": "off"}
+	features, err := newFeatureFlags(serverAPI, "mgetSomeData=off", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := features.load(); err != nil {
+		t.Fatal(err)
+	}
+	if features.isEnabled("mgetSomeData") || features.isEnabled("deleteSomeData") || !features.isEnabled("getSomeData") {
+		t.Errorf("Unexpected flags %v", features.enabled)
+	}
+
+	handler := features.gate(getSomeData, http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {}))
+	send := func() int {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/some-data?key=a", nil))
+		return rw.Code
+	}
+	if code := send(); code != http.StatusOK {
+		t.Errorf("Expected the enabled endpoint to be served, got %d", code)
+	}
+
+	rw := httptest.NewRecorder()
+	features.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/feature-flags", strings.NewReader(`{"name":"getSomeData","enabled":false}`)))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"getSomeData":false`) {
+		t.Errorf("Unexpected response %d %s", rw.Code, rw.Body)
+	}
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the disabled endpoint to answer 503, got %d", code)
+	}
+	if store[featureKeyPrefix+"getSomeData"] != "off" {
+		t.Errorf("Flag was not persisted: %v", store)
+	}
+
+	rw = httptest.NewRecorder()
+	features.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/feature-flags", strings.NewReader(`{"name":"search","enabled":true}`)))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown flag, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// instanceHeader names the server instance that answered, so clients
+// behind the balancer can tell the instances apart.
+const instanceHeader = "X-Server-Instance"
+
+// instanceInfo describes this server instance.
+type instanceInfo struct {
+	ID string `json:"id"`
+	// ReadCacheTTLMillis is how long the instance may serve a value
+	// overwritten through another instance, zero without a read cache.
+	ReadCacheTTLMillis int64 `json:"read_cache_ttl_ms"`
+}
+
+func newInstanceInfo(id string, readCacheTTL time.Duration) instanceInfo {
+	return instanceInfo{ID: id, ReadCacheTTLMillis: max(readCacheTTL, 0).Milliseconds()}
+}
+
+// ServeHTTP reports the instance.
+func (info instanceInfo) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(info)
+}
+
+// Wrap names the instance on every response of next.
+func (info instanceInfo) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set(instanceHeader, info.ID)
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceInfo(t *testing.T) {
+	instance := newInstanceInfo("server1-42", 1500*time.Millisecond)
+	handler := instance.Wrap(instance)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/instance", nil))
+	assert.Equal(t, "server1-42", rw.Header().Get(instanceHeader))
+	var info instanceInfo
+	require.NoError(t, json.NewDecoder(rw.Body).Decode(&info))
+	assert.Equal(t, instanceInfo{ID: "server1-42", ReadCacheTTLMillis: 1500}, info)
+
+	assert.Zero(t, newInstanceInfo("id", -time.Second).ReadCacheTTLMillis)
+}
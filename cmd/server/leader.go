@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+// leaderKey is the lock the servers campaign for to run singleton jobs.
+const leaderKey = "_leader/server"
+
+const seedKey = "QuantumGurus"
+
+// runAsLeader campaigns for the leadership among the servers for good and
+// runs job whenever this server leads. job must return once its context
+// is cancelled, after which the server campaigns again.
+func runAsLeader(elector *dbclient.LeaderElector, job func(ctx context.Context)) {
+	for {
+		leading, err := elector.Campaign(context.Background())
+		if err != nil {
+			log.Printf("Leader campaign failed: %s", err)
+			continue
+		}
+		log.Println("Leading the servers")
+		job(leading)
+		log.Println("Lost the leadership")
+	}
+}
+
+// seedDaily writes the current date under the seed key right away and
+// then once a day.
+func seedDaily(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if _, err := shards.forKey(seedKey).client.PutContext(ctx, seedKey, getCurrentDate(), dbclient.PutOptions{}); err != nil {
+			log.Printf("Failed to seed the database: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// candidateID names this server in elections.
+func candidateID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
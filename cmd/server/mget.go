@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+const (
+	mgetMaxKeys  = 1000
+	mgetDeadline = 2 * time.Second
+)
+
+type dbShard struct {
+	addr   string
+	client *dbclient.Client
+}
+
+// shardSet spreads keys over db shards by key hash.
+type shardSet []dbShard
+
+// newShardSet parses a comma separated list of shards. A shard is the URL of
+// its leader optionally followed by "|"-separated read replica URLs.
+func newShardSet(addrs string) shardSet {
+	var shards shardSet
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			nodes := strings.Split(addr, "|")
+			shards = append(shards, dbShard{addr: nodes[0], client: dbclient.New(nodes[0], nodes[1:]...)})
+		}
+	}
+	return shards
+}
+
+// setTLSConfig makes the clients of every shard use mutual TLS.
+func (s shardSet) setTLSConfig(config *tls.Config) {
+	for _, shard := range s {
+		shard.client.SetTLSConfig(config)
+	}
+}
+
+// ServeHTTP reports the endpoint metrics of every shard.
+func (s shardSet) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	stats := make(map[string][]dbclient.EndpointStats, len(s))
+	for _, shard := range s {
+		stats[shard.addr] = shard.client.Stats()
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(stats)
+}
+
+func (s shardSet) forKey(key string) dbShard {
+	return s[s.index(key)]
+}
+
+func (s shardSet) index(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s)))
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Records []dbclient.Record `json:"records"`
+	Missing []string          `json:"missing"`
+	Failed  []mgetFailure     `json:"failed,omitempty"`
+}
+
+// mgetFailure lists the keys that could not be read because their shard
+// failed or did not answer before the deadline.
+type mgetFailure struct {
+	Shard string   `json:"shard"`
+	Keys  []string `json:"keys"`
+	Error string   `json:"error"`
+}
+
+// multiGetter serves batch reads. Keys are grouped by shard and every shard
+// is queried in parallel; the whole request is bounded by deadline.
+type multiGetter struct {
+	shards   shardSet
+	deadline time.Duration
+}
+
+func (m multiGetter) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var request mgetRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(rw, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(request.Keys) > mgetMaxKeys {
+		http.Error(rw, "Too many keys", http.StatusBadRequest)
+		return
+	}
+
+	groups := make(map[int][]string)
+	seen := make(map[string]bool)
+	for _, key := range request.Keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		shard := m.shards.index(key)
+		groups[shard] = append(groups[shard], key)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), m.deadline)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		found    = make(map[string]dbclient.Record)
+		response = mgetResponse{Records: []dbclient.Record{}, Missing: []string{}}
+	)
+	for shard, keys := range groups {
+		wg.Add(1)
+		go func(shard dbShard, keys []string) {
+			defer wg.Done()
+			records, err := shard.client.MGet(ctx, keys)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				response.Failed = append(response.Failed, mgetFailure{Shard: shard.addr, Keys: keys, Error: err.Error()})
+				return
+			}
+			for _, record := range records {
+				found[record.Key] = record
+			}
+		}(m.shards[shard], keys)
+	}
+	wg.Wait()
+
+	failed := make(map[string]bool)
+	for _, failure := range response.Failed {
+		for _, key := range failure.Keys {
+			failed[key] = true
+		}
+	}
+	listed := make(map[string]bool)
+	for _, key := range request.Keys {
+		if listed[key] || failed[key] {
+			continue
+		}
+		listed[key] = true
+		if record, ok := found[key]; ok {
+			response.Records = append(response.Records, record)
+		} else {
+			response.Missing = append(response.Missing, key)
+		}
+	}
+
+	status := http.StatusOK
+	if len(response.Failed) > 0 && len(response.Failed) == len(groups) {
+		status = http.StatusBadGateway
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(response)
+}
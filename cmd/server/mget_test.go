@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+)
+
+func fakeShard(t *testing.T, values map[string]string, delay time.Duration) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		var request mgetRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		records := []dbclient.Record{}
+		for _, key := range request.Keys {
+			if value, ok := values[key]; ok {
+				records = append(records, dbclient.Record{Key: key, Value: value, Version: 1})
+			}
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]any{"records": records})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestMultiGetter(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	fast := fakeShard(t, values, 0)
+	slow := fakeShard(t, values, time.Second)
+
+	mget := func(shards shardSet, body string) (int, mgetResponse) {
+		handler := multiGetter{shards: shards, deadline: 200 * time.Millisecond}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodPost, "/api/v1/some-data/_mget", strings.NewReader(body)))
+		var response mgetResponse
+		_ = json.NewDecoder(rw.Body).Decode(&response)
+		return rw.Code, response
+	}
+
+	status, response := mget(newShardSet(fast.URL+","+fast.URL), `{"keys":["c","a","x","a","b"]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Unexpected status %d", status)
+	}
+	if len(response.Records) != 3 || response.Records[0].Key != "c" || response.Records[1].Key != "a" || response.Records[2].Key != "b" {
+		t.Errorf("Unexpected records %+v", response.Records)
+	}
+	if len(response.Missing) != 1 || response.Missing[0] != "x" || len(response.Failed) != 0 {
+		t.Errorf("Unexpected missing %v or failed %v", response.Missing, response.Failed)
+	}
+
+	shards := newShardSet(fast.URL + "," + slow.URL)
+	keys := []string{"a", "b", "c", "d"}
+	slowKeys := 0
+	for _, key := range keys {
+		if shards.forKey(key).addr == slow.URL {
+			slowKeys++
+		}
+	}
+	if slowKeys == 0 || slowKeys == len(keys) {
+		t.Fatal("Test keys must be spread over both shards")
+	}
+
+	start := time.Now()
+	status, response = mget(shards, `{"keys":["a","b","c","d"]}`)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Deadline was not honored, took %s", elapsed)
+	}
+	if status != http.StatusOK || len(response.Failed) != 1 || response.Failed[0].Shard != slow.URL {
+		t.Fatalf("Expected a partial failure of the slow shard, got %d %+v", status, response.Failed)
+	}
+	if len(response.Records)+len(response.Failed[0].Keys) != len(keys) {
+		t.Errorf("Unexpected partial result %+v", response)
+	}
+
+	if status, _ := mget(newShardSet(slow.URL), `{"keys":["a"]}`); status != http.StatusBadGateway {
+		t.Errorf("Expected 502 when every shard failed, got %d", status)
+	}
+}
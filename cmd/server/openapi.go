@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// apiMaxBodySize bounds the request bodies read for validation.
+const apiMaxBodySize = 1 << 20
+
+// schema is the subset of JSON Schema the API is described with. Zero
+// values of the limits mean no limit.
+type schema struct {
+	Type                 string             `json:"type"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+	MaxItems             int                `json:"maxItems,omitempty"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *schema `json:"schema"`
+}
+
+type apiResponse struct {
+	Description string
+	Schema      *schema
+}
+
+// operation describes one endpoint. Requests are validated against its
+// parameters and body schema before they reach the handler.
+type operation struct {
+	Method    string
+	Path      string
+	ID        string
+	Summary   string
+	Params    []parameter
+	Body      *schema
+	Responses map[int]apiResponse
+}
+
+// violation is one way a request does not match the API.
+type violation struct {
+	Field   string `json:"field"`
+	In      string `json:"in"`
+	Message string `json:"message"`
+}
+
+type validationErrorResponse struct {
+	Error      string      `json:"error"`
+	Violations []violation `json:"violations"`
+}
+
+// noExtraFields closes object schemas to undescribed fields.
+var noExtraFields = false
+
+var (
+	keySchema    = &schema{Type: "string", MinLength: 1}
+	recordSchema = &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"key":     {Type: "string"},
+			"value":   {Type: "string"},
+			"version": {Type: "integer"},
+		},
+	}
+	keyParam = parameter{Name: "key", In: "query", Required: true, Schema: keySchema}
+	badInput = apiResponse{Description: "The request does not match the API", Schema: &schema{
+		Type: "object",
+		Properties: map[string]*schema{
+			"error": {Type: "string"},
+			"violations": {Type: "array", Items: &schema{
+				Type: "object",
+				Properties: map[string]*schema{
+					"field":   {Type: "string"},
+					"in":      {Type: "string"},
+					"message": {Type: "string"},
+				},
+			}},
+		},
+	}}
+)
+
+var (
+	getSomeData = &operation{
+		Method:  http.MethodGet,
+		Path:    "/api/v1/some-data",
+		ID:      "getSomeData",
+		Summary: "Read the record of a key",
+		Params: []parameter{keyParam, {
+			Name:        "If-None-Match",
+			In:          "header",
+			Description: "ETags of cached records; a match is answered with 304",
+			Schema:      &schema{Type: "string"},
+		}, {
+			Name:        "envelope",
+			In:          "query",
+			Description: "record (default) for {key,value,version}, bare for the value alone, data for {data,meta}; also an Accept profile",
+			Schema:      &schema{Type: "string"},
+		}, {
+			Name:        "naming",
+			In:          "query",
+			Description: "snake (default) or camel case names of multi-word fields; also an Accept profile",
+			Schema:      &schema{Type: "string"},
+		}, {
+			Name:        "X-Min-Sequence",
+			In:          "header",
+			Description: "X-Sequence of a write the answer must be at least as new as, for reading your writes",
+			Schema:      &schema{Type: "string"},
+		}},
+		Responses: map[int]apiResponse{
+			http.StatusOK:          {Description: "The record, with its ETag", Schema: recordSchema},
+			http.StatusNotModified: {Description: "The cached record is current"},
+			http.StatusBadRequest:  badInput,
+			http.StatusNotFound:    {Description: "The key does not exist"},
+		},
+	}
+	putSomeData = &operation{
+		Method:  http.MethodPost,
+		Path:    "/api/v1/some-data",
+		ID:      "putSomeData",
+		Summary: "Store a value under a key",
+		Body: &schema{
+			Type:                 "object",
+			Required:             []string{"key", "value"},
+			AdditionalProperties: &noExtraFields,
+			Properties: map[string]*schema{
+				"key":     keySchema,
+				"value":   {Type: "string"},
+				"version": {Type: "integer", Description: "Expected current version for optimistic locking"},
+			},
+		},
+		Responses: map[int]apiResponse{
+			http.StatusCreated:    {Description: "The stored record, with the commit sequence of its node as X-Sequence", Schema: recordSchema},
+			http.StatusBadRequest: badInput,
+			http.StatusForbidden:  {Description: "The key is reserved"},
+			http.StatusConflict:   {Description: "The key does not have the expected version"},
+			http.StatusBadGateway: {Description: "The database failed"},
+		},
+	}
+	deleteSomeData = &operation{
+		Method:  http.MethodDelete,
+		Path:    "/api/v1/some-data",
+		ID:      "deleteSomeData",
+		Summary: "Delete a key",
+		Params:  []parameter{keyParam},
+		Responses: map[int]apiResponse{
+			http.StatusNoContent:  {Description: "The key is deleted"},
+			http.StatusBadRequest: badInput,
+			http.StatusForbidden:  {Description: "The key is reserved"},
+			http.StatusBadGateway: {Description: "The database failed"},
+		},
+	}
+	mgetSomeData = &operation{
+		Method:  http.MethodPost,
+		Path:    "/api/v1/some-data/_mget",
+		ID:      "mgetSomeData",
+		Summary: "Read the records of several keys",
+		Body: &schema{
+			Type:                 "object",
+			Required:             []string{"keys"},
+			AdditionalProperties: &noExtraFields,
+			Properties: map[string]*schema{
+				"keys": {Type: "array", Items: &schema{Type: "string"}, MaxItems: mgetMaxKeys},
+			},
+		},
+		Responses: map[int]apiResponse{
+			http.StatusOK: {Description: "The records found, missing keys and failed shards", Schema: &schema{
+				Type: "object",
+				Properties: map[string]*schema{
+					"records": {Type: "array", Items: recordSchema},
+					"missing": {Type: "array", Items: &schema{Type: "string"}},
+					"failed": {Type: "array", Items: &schema{
+						Type: "object",
+						Properties: map[string]*schema{
+							"shard": {Type: "string"},
+							"keys":  {Type: "array", Items: &schema{Type: "string"}},
+							"error": {Type: "string"},
+						},
+					}},
+				},
+			}},
+			http.StatusBadRequest: badInput,
+			http.StatusBadGateway: {Description: "Every shard failed"},
+		},
+	}
+)
+
+// apiSpec is the described part of the API. It serves its OpenAPI document.
+type apiSpec []*operation
+
+var serverAPI = apiSpec{getSomeData, putSomeData, deleteSomeData, mgetSomeData}
+
+func (op *operation) route() string {
+	return op.Method + " " + op.Path
+}
+
+// wrap validates requests before passing them to next. Invalid requests
+// get a 400 listing every violation.
+func (op *operation) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		violations := op.validateParams(r)
+		if op.Body != nil {
+			data, err := io.ReadAll(io.LimitReader(r.Body, apiMaxBodySize+1))
+			if err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			violations = append(violations, op.validateBody(data)...)
+			r.Body = io.NopCloser(bytes.NewReader(data))
+		}
+		if len(violations) > 0 {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(rw).Encode(validationErrorResponse{Error: "invalid request", Violations: violations})
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (op *operation) validateParams(r *http.Request) []violation {
+	var violations []violation
+	query := r.URL.Query()
+	for _, param := range op.Params {
+		value, found := query.Get(param.Name), query.Has(param.Name)
+		if param.In == "header" {
+			value = r.Header.Get(param.Name)
+			found = value != ""
+		}
+		if !found {
+			if param.Required {
+				violations = append(violations, violation{Field: param.Name, In: param.In, Message: "is required"})
+			}
+			continue
+		}
+		// Parameters are strings, the only type used for them.
+		if message := param.Schema.checkString(value); message != "" {
+			violations = append(violations, violation{Field: param.Name, In: param.In, Message: message})
+		}
+	}
+	return violations
+}
+
+func (op *operation) validateBody(data []byte) []violation {
+	if len(data) > apiMaxBodySize {
+		return []violation{{In: "body", Message: fmt.Sprintf("is larger than %d bytes", apiMaxBodySize)}}
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return []violation{{In: "body", Message: "is not valid JSON"}}
+	}
+	return op.Body.validate(value, "")
+}
+
+// validate checks value decoded from JSON against the schema. field is the
+// dotted path of value, empty for the whole body.
+func (s *schema) validate(value any, field string) []violation {
+	fail := func(message string) []violation {
+		return []violation{{Field: field, In: "body", Message: message}}
+	}
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fail("must be an object")
+		}
+		var violations []violation
+		for _, name := range s.Required {
+			if _, found := object[name]; !found {
+				violations = append(violations, violation{Field: joinField(field, name), In: "body", Message: "is required"})
+			}
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					violations = append(violations, violation{Field: joinField(field, name), In: "body", Message: "is not allowed"})
+				}
+				continue
+			}
+			violations = append(violations, property.validate(object[name], joinField(field, name))...)
+		}
+		return violations
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fail("must be an array")
+		}
+		if s.MaxItems > 0 && len(items) > s.MaxItems {
+			return fail(fmt.Sprintf("must have at most %d items", s.MaxItems))
+		}
+		var violations []violation
+		for i, item := range items {
+			violations = append(violations, s.Items.validate(item, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return violations
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return fail("must be a string")
+		}
+		if message := s.checkString(text); message != "" {
+			return fail(message)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) || number < 0 {
+			return fail("must be a non-negative integer")
+		}
+	}
+	return nil
+}
+
+func (s *schema) checkString(text string) string {
+	if len(text) < s.MinLength {
+		if s.MinLength == 1 {
+			return "must not be empty"
+		}
+		return fmt.Sprintf("must be at least %d characters long", s.MinLength)
+	}
+	return ""
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// document builds the OpenAPI 3 description of the operations.
+func (s apiSpec) document() map[string]any {
+	paths := make(map[string]map[string]any)
+	for _, op := range s {
+		responses := make(map[string]any, len(op.Responses))
+		for status, response := range op.Responses {
+			description := map[string]any{"description": response.Description}
+			if response.Schema != nil {
+				description["content"] = jsonContent(response.Schema)
+			}
+			responses[fmt.Sprint(status)] = description
+		}
+		doc := map[string]any{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses":   responses,
+		}
+		if len(op.Params) > 0 {
+			doc["parameters"] = op.Params
+		}
+		if op.Body != nil {
+			doc["requestBody"] = map[string]any{"required": true, "content": jsonContent(op.Body)}
+		}
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = doc
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "Lab4 server API", "version": "1"},
+		"paths":   paths,
+	}
+}
+
+func jsonContent(s *schema) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": s}}
+}
+
+func (s apiSpec) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(s.document())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOperation_Validation(t *testing.T) {
+	reached := false
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		reached = true
+		var request putRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Key != "a" {
+			t.Errorf("Body not passed on: %+v, %v", request, err)
+		}
+	})
+
+	send := func(op *operation, method, target, body string) (*httptest.ResponseRecorder, validationErrorResponse) {
+		reached = false
+		rw := httptest.NewRecorder()
+		op.wrap(ok).ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var response validationErrorResponse
+		if rw.Code == http.StatusBadRequest {
+			_ = json.NewDecoder(rw.Body).Decode(&response)
+		}
+		return rw, response
+	}
+
+	rw, _ := send(putSomeData, http.MethodPost, "/api/v1/some-data", `{"key":"a","value":"1","version":2}`)
+	if rw.Code != http.StatusOK || !reached {
+		t.Errorf("Valid request rejected with %d", rw.Code)
+	}
+
+	_, response := send(putSomeData, http.MethodPost, "/api/v1/some-data", `{"key":"","version":1.5,"extra":true}`)
+	expected := []violation{
+		{Field: "value", In: "body", Message: "is required"},
+		{Field: "extra", In: "body", Message: "is not allowed"},
+		{Field: "key", In: "body", Message: "must not be empty"},
+		{Field: "version", In: "body", Message: "must be a non-negative integer"},
+	}
+	if reached || !reflect.DeepEqual(response.Violations, expected) {
+		t.Errorf("Unexpected violations %+v", response.Violations)
+	}
+
+	_, response = send(putSomeData, http.MethodPost, "/api/v1/some-data", `{"key":`)
+	if len(response.Violations) != 1 || response.Violations[0].Message != "is not valid JSON" {
+		t.Errorf("Unexpected violations %+v", response.Violations)
+	}
+
+	_, response = send(getSomeData, http.MethodGet, "/api/v1/some-data", "")
+	if len(response.Violations) != 1 || response.Violations[0] != (violation{Field: "key", In: "query", Message: "is required"}) {
+		t.Errorf("Unexpected violations %+v", response.Violations)
+	}
+
+	_, response = send(mgetSomeData, http.MethodPost, "/api/v1/some-data/_mget", `{"keys":["a",1]}`)
+	if len(response.Violations) != 1 || response.Violations[0].Field != "keys[1]" {
+		t.Errorf("Unexpected violations %+v", response.Violations)
+	}
+}
+
+func TestAPISpec(t *testing.T) {
+	rw := httptest.NewRecorder()
+	serverAPI.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil))
+
+	var doc struct {
+		OpenAPI string                               `json:"openapi"`
+		Paths   map[string]map[string]map[string]any `json:"paths"`
+	}
+	if err := json.NewDecoder(rw.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI == "" || len(doc.Paths["/api/v1/some-data"]) != 3 || doc.Paths["/api/v1/some-data/_mget"]["post"] == nil {
+		t.Errorf("Unexpected spec %+v", doc)
+	}
+	if id := doc.Paths["/api/v1/some-data"]["delete"]["operationId"]; id != "deleteSomeData" {
+		t.Errorf("Unexpected operation id %v", id)
+	}
+}
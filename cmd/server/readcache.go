@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+// refreshWindow is the last share of an entry lifetime in which it is
+// refreshed in the background. Each entry starts at a random point of it.
+const refreshWindow = 0.2
+
+const refreshTimeout = 2 * time.Second
+
+// readCache keeps records read from the db for ttl; with no ttl it passes
+// reads on. Once an entry nears its expiry it is still served while a
+// single background read refreshes it, so hot keys don't wait on the db.
+// The refresh point is jittered per entry, so keys cached together and
+// other servers don't all refresh at once. Writes through this server
+// update the cache; writes through other servers are seen after at most
+// ttl.
+type readCache struct {
+	fetch   func(ctx context.Context, key string) (dbclient.Record, error)
+	ttl     time.Duration
+	maxSize int
+	now     func() time.Time
+	// jitter returns a number in [0, 1) placing the refresh point.
+	jitter func() float64
+
+	mu      sync.Mutex
+	entries map[string]*cachedRead
+	stats   readCacheStats
+}
+
+type cachedRead struct {
+	record     dbclient.Record
+	refreshAt  time.Time
+	expiresAt  time.Time
+	refreshing bool
+}
+
+type readCacheStats struct {
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	StaleHits int64 `json:"stale_hits"`
+	Misses    int64 `json:"misses"`
+	Refreshes int64 `json:"refreshes"`
+}
+
+func newReadCache(fetch func(ctx context.Context, key string) (dbclient.Record, error), ttl time.Duration, maxSize int) *readCache {
+	return &readCache{
+		fetch:   fetch,
+		ttl:     ttl,
+		maxSize: maxSize,
+		now:     time.Now,
+		jitter:  rand.Float64,
+		entries: make(map[string]*cachedRead),
+	}
+}
+
+// get returns the cached record of key, reading it from the db when it is
+// not cached, expired or read before the sequence ctx asks for.
+func (c *readCache) get(ctx context.Context, key string) (dbclient.Record, error) {
+	if c.ttl <= 0 {
+		return c.fetch(ctx, key)
+	}
+	now := c.now()
+	c.mu.Lock()
+	entry, found := c.entries[key]
+	if found && now.Before(entry.expiresAt) && entry.record.Sequence >= httptools.MinSequence(ctx) {
+		if !now.Before(entry.refreshAt) {
+			c.stats.StaleHits++
+			if !entry.refreshing {
+				entry.refreshing = true
+				c.stats.Refreshes++
+				go c.refresh(key, entry)
+			}
+		} else {
+			c.stats.Hits++
+		}
+		record := entry.record
+		c.mu.Unlock()
+		return record, nil
+	}
+	c.stats.Misses++
+	c.mu.Unlock()
+
+	record, err := c.fetch(ctx, key)
+	if err != nil {
+		if errors.Is(err, dbclient.ErrNotFound) {
+			c.forget(key)
+		}
+		return record, err
+	}
+	c.store(key, record, nil)
+	return record, nil
+}
+
+// refresh reads the record of a stale entry again.
+func (c *readCache) refresh(key string, entry *cachedRead) {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	record, err := c.fetch(ctx, key)
+
+	c.mu.Lock()
+	entry.refreshing = false
+	if c.entries[key] == entry && errors.Is(err, dbclient.ErrNotFound) {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	if err == nil {
+		c.store(key, record, entry)
+	}
+}
+
+// store caches a record. A refresh passes the entry it refreshes and is
+// dropped if a write replaced or removed that entry meanwhile.
+func (c *readCache) store(key string, record dbclient.Record, refreshed *cachedRead) {
+	if c.ttl <= 0 {
+		return
+	}
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	current, found := c.entries[key]
+	if refreshed != nil && current != refreshed {
+		return
+	}
+	if found && current.record.Version > record.Version {
+		return
+	}
+	if !found && len(c.entries) >= c.maxSize {
+		c.dropExpired(now)
+		if len(c.entries) >= c.maxSize {
+			return
+		}
+	}
+	c.entries[key] = &cachedRead{
+		record:    record,
+		refreshAt: now.Add(time.Duration(float64(c.ttl) * (1 - refreshWindow*c.jitter()))),
+		expiresAt: now.Add(c.ttl),
+	}
+}
+
+// forget drops the cached record of a key deleted or missing in the db.
+func (c *readCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *readCache) dropExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// ServeHTTP reports the cache statistics.
+func (c *readCache) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	c.mu.Lock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	c.mu.Unlock()
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(stats)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+// fakeDb serves records to a read cache, counting reads. Reads block while
+// gate is set.
+type fakeDb struct {
+	mu      sync.Mutex
+	records map[string]dbclient.Record
+	reads   int
+	gate    chan struct{}
+	done    chan struct{}
+}
+
+func (f *fakeDb) fetch(_ context.Context, key string) (dbclient.Record, error) {
+	f.mu.Lock()
+	f.reads++
+	record, found := f.records[key]
+	gate, done := f.gate, f.done
+	f.mu.Unlock()
+	if gate != nil {
+		<-gate
+		defer func() { done <- struct{}{} }()
+	}
+	if !found {
+		return dbclient.Record{}, dbclient.ErrNotFound
+	}
+	return record, nil
+}
+
+func (f *fakeDb) set(key, value string, version uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[key] = dbclient.Record{Key: key, Value: value, Version: version}
+}
+
+func newTestReadCache(db *fakeDb, now *time.Time) *readCache {
+	cache := newReadCache(db.fetch, 10*time.Second, 2)
+	cache.now = func() time.Time { return *now }
+	cache.jitter = func() float64 { return 0.5 }
+	return cache
+}
+
+func TestReadCache_StaleWhileRevalidate(t *testing.T) {
+	db := &fakeDb{records: make(map[string]dbclient.Record)}
+	db.set("key", "v1", 1)
+	now := time.Unix(0, 0)
+	cache := newTestReadCache(db, &now)
+	ctx := context.Background()
+
+	if record, err := cache.get(ctx, "key"); err != nil || record.Value != "v1" {
+		t.Fatalf("Expected v1, got %+v, %v", record, err)
+	}
+	now = now.Add(5 * time.Second)
+	if record, _ := cache.get(ctx, "key"); record.Value != "v1" || db.reads != 1 {
+		t.Fatalf("Expected a cached v1 without a db read, got %+v after %d reads", record, db.reads)
+	}
+
+	// Past the jittered refresh point, 9s into the 10s ttl, the stale value
+	// is served at once and refreshed by a single background read.
+	db.set("key", "v2", 2)
+	db.gate, db.done = make(chan struct{}), make(chan struct{})
+	now = now.Add(4 * time.Second)
+	for i := 0; i < 3; i++ {
+		if record, _ := cache.get(ctx, "key"); record.Value != "v1" {
+			t.Fatalf("Expected the stale v1 while refreshing, got %+v", record)
+		}
+	}
+	stale := cache.entries["key"]
+	close(db.gate)
+	<-db.done
+	db.mu.Lock()
+	db.gate = nil
+	db.mu.Unlock()
+	// The refreshed record is stored right after the read returns.
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		cache.mu.Lock()
+		refreshed := cache.entries["key"] != stale
+		cache.mu.Unlock()
+		if refreshed {
+			break
+		}
+	}
+	if db.reads != 2 {
+		t.Errorf("Expected one refresh for concurrent stale reads, got %d db reads", db.reads)
+	}
+	if record, _ := cache.get(ctx, "key"); record.Value != "v2" {
+		t.Errorf("Expected the refreshed v2, got %+v", record)
+	}
+	if cache.stats.StaleHits != 3 || cache.stats.Refreshes != 1 {
+		t.Errorf("Unexpected stats %+v", cache.stats)
+	}
+
+	// An entry not read before its expiry is read again in the foreground.
+	now = now.Add(11 * time.Second)
+	db.set("key", "v3", 3)
+	if record, _ := cache.get(ctx, "key"); record.Value != "v3" {
+		t.Errorf("Expected v3 after the expiry, got %+v", record)
+	}
+}
+
+func TestReadCache_Writes(t *testing.T) {
+	db := &fakeDb{records: make(map[string]dbclient.Record)}
+	db.set("key", "v1", 1)
+	now := time.Unix(0, 0)
+	cache := newTestReadCache(db, &now)
+	ctx := context.Background()
+
+	_, _ = cache.get(ctx, "key")
+	cache.store("key", dbclient.Record{Key: "key", Value: "v2", Version: 2}, nil)
+	if record, _ := cache.get(ctx, "key"); record.Value != "v2" {
+		t.Errorf("Expected the written v2, got %+v", record)
+	}
+
+	// A refresh that read an older version doesn't replace a newer write.
+	entry := cache.entries["key"]
+	cache.store("key", dbclient.Record{Key: "key", Value: "v1", Version: 1}, entry)
+	if record, _ := cache.get(ctx, "key"); record.Value != "v2" {
+		t.Errorf("Expected the newer v2 to stay, got %+v", record)
+	}
+
+	cache.forget("key")
+	cache.store("key", dbclient.Record{Key: "key", Value: "v2", Version: 2}, entry)
+	if _, found := cache.entries["key"]; found {
+		t.Error("Expected a refresh of a deleted key to be dropped")
+	}
+
+	// The cache holds at most maxSize records.
+	db.set("other", "value", 1)
+	db.set("third", "value", 1)
+	for _, key := range []string{"key", "other", "third"} {
+		_, _ = cache.get(ctx, key)
+	}
+	if len(cache.entries) != 2 {
+		t.Errorf("Expected 2 cached records, got %d", len(cache.entries))
+	}
+}
+
+func TestReadCache_Disabled(t *testing.T) {
+	db := &fakeDb{records: make(map[string]dbclient.Record)}
+	db.set("key", "value", 1)
+	cache := newReadCache(db.fetch, 0, 10)
+	for i := 0; i < 2; i++ {
+		_, _ = cache.get(context.Background(), "key")
+	}
+	if db.reads != 2 || len(cache.entries) != 0 {
+		t.Errorf("Expected every read to go to the db, got %d reads and %d entries", db.reads, len(cache.entries))
+	}
+}
+
+func TestReadCache_MinSequence(t *testing.T) {
+	db := &fakeDb{records: make(map[string]dbclient.Record)}
+	db.records["key"] = dbclient.Record{Key: "key", Value: "v1", Version: 1, Sequence: 5}
+	now := time.Unix(0, 0)
+	cache := newTestReadCache(db, &now)
+
+	_, _ = cache.get(context.Background(), "key")
+	db.records["key"] = dbclient.Record{Key: "key", Value: "v2", Version: 2, Sequence: 9}
+	if record, _ := cache.get(httptools.ContextWithMinSequence(context.Background(), 5), "key"); record.Value != "v1" || db.reads != 1 {
+		t.Errorf("Expected a fresh enough entry to be served, got %+v after %d reads", record, db.reads)
+	}
+	if record, _ := cache.get(httptools.ContextWithMinSequence(context.Background(), 6), "key"); record.Value != "v2" || db.reads != 2 {
+		t.Errorf("Expected an older entry to be read again, got %+v after %d reads", record, db.reads)
+	}
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
 )
 
 const reportMaxLen = 100
@@ -30,3 +36,168 @@ func (r Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
 	rw.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(rw).Encode(r)
 }
+
+// reportKeyPrefix is the reserved db key prefix endpoint counters are
+// persisted under, one key per instance and interval, e.g.
+// _reports/server1-7/2024-05-01T12:00:00Z.
+const reportKeyPrefix = "_reports/"
+
+// endpointCounters counts the requests served per API endpoint since the
+// last snapshot.
+type endpointCounters struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newEndpointCounters() *endpointCounters {
+	return &endpointCounters{counts: make(map[string]int64)}
+}
+
+// Wrap counts the requests of next under the endpoint name.
+func (c *endpointCounters) Wrap(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		c.counts[name]++
+		c.mu.Unlock()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// take returns the counts and starts over.
+func (c *endpointCounters) take() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.counts
+	c.counts = make(map[string]int64)
+	return counts
+}
+
+// restore adds back counts that could not be persisted.
+func (c *endpointCounters) restore(counts map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, n := range counts {
+		c.counts[name] += n
+	}
+}
+
+// reportSnapshot is the value of a report key: the requests an instance
+// served per endpoint during the interval ending at At.
+type reportSnapshot struct {
+	Instance  string           `json:"instance"`
+	At        time.Time        `json:"at"`
+	Endpoints map[string]int64 `json:"endpoints"`
+}
+
+// persistReports writes the counters of the instance into the db every
+// interval until ctx is done. Keys expire after ttl. Intervals without
+// requests are not written; counts that fail to be written are carried
+// over to the next interval.
+func persistReports(ctx context.Context, shards shardSet, counters *endpointCounters, instance string, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := persistReport(ctx, shards, counters, instance, now, ttl); err != nil {
+				log.Printf("Failed to persist the report: %s", err)
+			}
+		}
+	}
+}
+
+func persistReport(ctx context.Context, shards shardSet, counters *endpointCounters, instance string, now time.Time, ttl time.Duration) error {
+	counts := counters.take()
+	if len(counts) == 0 {
+		return nil
+	}
+	snapshot := reportSnapshot{Instance: instance, At: now.UTC().Truncate(time.Second), Endpoints: counts}
+	value, _ := json.Marshal(snapshot)
+	key := reportKeyPrefix + instance + "/" + snapshot.At.Format(time.RFC3339)
+	if _, err := shards.forKey(key).client.PutContext(ctx, key, string(value), dbclient.PutOptions{TTL: ttl}); err != nil {
+		counters.restore(counts)
+		return err
+	}
+	return nil
+}
+
+// reportAggregate sums the persisted counters per instance and in total.
+type reportAggregate struct {
+	Since     time.Time                   `json:"since,omitempty"`
+	Instances map[string]map[string]int64 `json:"instances"`
+	Total     map[string]int64            `json:"total"`
+}
+
+// reportAggregator serves the counters persisted by every server instance,
+// read from all shards. The since query parameter, a duration like 1h,
+// leaves out older intervals.
+type reportAggregator struct {
+	shards shardSet
+	now    func() time.Time
+}
+
+func (a reportAggregator) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		age, err := time.ParseDuration(value)
+		if err != nil || age <= 0 {
+			http.Error(rw, "Invalid since duration", http.StatusBadRequest)
+			return
+		}
+		since = a.now().Add(-age)
+	}
+	aggregate, err := a.aggregate(r.Context(), since)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(rw).Encode(aggregate)
+}
+
+func (a reportAggregator) aggregate(ctx context.Context, since time.Time) (reportAggregate, error) {
+	aggregate := reportAggregate{
+		Since:     since,
+		Instances: make(map[string]map[string]int64),
+		Total:     make(map[string]int64),
+	}
+	// Report keys are spread over the shards like any other key.
+	for _, shard := range a.shards {
+		var after string
+		for {
+			page, err := shard.client.Keys(ctx, reportKeyPrefix, after, 100)
+			if err != nil {
+				return aggregate, fmt.Errorf("listing reports on %s: %w", shard.addr, err)
+			}
+			if len(page.Keys) == 0 {
+				break
+			}
+			records, err := shard.client.MGet(ctx, page.Keys)
+			if err != nil {
+				return aggregate, fmt.Errorf("reading reports on %s: %w", shard.addr, err)
+			}
+			for _, record := range records {
+				var snapshot reportSnapshot
+				if json.Unmarshal([]byte(record.Value), &snapshot) != nil || snapshot.At.Before(since) {
+					continue
+				}
+				counts := aggregate.Instances[snapshot.Instance]
+				if counts == nil {
+					counts = make(map[string]int64)
+					aggregate.Instances[snapshot.Instance] = counts
+				}
+				for name, n := range snapshot.Endpoints {
+					counts[name] += n
+					aggregate.Total[name] += n
+				}
+			}
+			if page.Next == "" {
+				break
+			}
+			after = page.Next
+		}
+	}
+	return aggregate, nil
+}
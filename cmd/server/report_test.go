@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
 )
 
 func TestReport_Process(t *testing.T) {
@@ -33,3 +42,126 @@ func TestReport_Process(t *testing.T) {
 		t.Errorf("Unexpectd error length: %d", len(r["test-len"]))
 	}
 }
+
+// fakeReportDb stores values written to it and serves key listings and batch
+// reads like a db node.
+func fakeReportDb(t *testing.T) *httptest.Server {
+	var mu sync.Mutex
+	values := make(map[string]string)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /db/_mget", func(rw http.ResponseWriter, r *http.Request) {
+		var request mgetRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		records := []dbclient.Record{}
+		for _, key := range request.Keys {
+			if value, ok := values[key]; ok {
+				records = append(records, dbclient.Record{Key: key, Value: value, Version: 1})
+			}
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]any{"records": records})
+	})
+	mux.HandleFunc("POST /db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Value string `json:"value"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		values[r.PathValue("key")] = request.Value
+		_ = json.NewEncoder(rw).Encode(dbclient.Record{Key: r.PathValue("key"), Value: request.Value, Version: 1})
+	})
+	mux.HandleFunc("GET /db", func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys := []string{}
+		for key := range values {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		_ = json.NewEncoder(rw).Encode(dbclient.KeyPage{Keys: keys})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPersistedReports(t *testing.T) {
+	shards := newShardSet(fakeReportDb(t).URL + "," + fakeReportDb(t).URL)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	counters := newEndpointCounters()
+	handler := counters.Wrap("getSomeData", http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	serve := func(n int) {
+		for i := 0; i < n; i++ {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	}
+
+	serve(3)
+	if err := persistReport(ctx, shards, counters, "server1", now, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	serve(2)
+	if err := persistReport(ctx, shards, counters, "server1", now.Add(time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// An idle interval writes nothing.
+	if err := persistReport(ctx, shards, counters, "server1", now.Add(2*time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	other := newEndpointCounters()
+	other.restore(map[string]int64{"getSomeData": 1, "putSomeData": 4})
+	if err := persistReport(ctx, shards, other, "server2", now.Add(time.Minute), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregator := reportAggregator{shards: shards, now: func() time.Time { return now.Add(2 * time.Minute) }}
+	get := func(query string) reportAggregate {
+		rw := httptest.NewRecorder()
+		aggregator.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/report/all"+query, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Unexpected status %d", rw.Code)
+		}
+		var aggregate reportAggregate
+		_ = json.NewDecoder(rw.Body).Decode(&aggregate)
+		return aggregate
+	}
+
+	aggregate := get("")
+	expected := map[string]map[string]int64{
+		"server1": {"getSomeData": 5},
+		"server2": {"getSomeData": 1, "putSomeData": 4},
+	}
+	if !reflect.DeepEqual(aggregate.Instances, expected) {
+		t.Errorf("Unexpected instances %v", aggregate.Instances)
+	}
+	if !reflect.DeepEqual(aggregate.Total, map[string]int64{"getSomeData": 6, "putSomeData": 4}) {
+		t.Errorf("Unexpected total %v", aggregate.Total)
+	}
+
+	// The first interval of server1 is older than a minute.
+	if recent := get("?since=1m"); recent.Total["getSomeData"] != 3 {
+		t.Errorf("Expected only the recent intervals, got %v", recent.Total)
+	}
+}
+
+func TestPersistReport_KeepsCountsOnFailure(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	counters := newEndpointCounters()
+	counters.restore(map[string]int64{"getSomeData": 2})
+	if err := persistReport(context.Background(), newShardSet(down.URL), counters, "server1", time.Now(), time.Hour); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if counts := counters.take(); counts["getSomeData"] != 2 {
+		t.Errorf("Expected the counts to be kept for the next interval, got %v", counts)
+	}
+}
@@ -1,28 +1,116 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
-	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/QuantumGurus/Lab4-KPI/dbclient"
 	"github.com/QuantumGurus/Lab4-KPI/httptools"
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
 	"github.com/QuantumGurus/Lab4-KPI/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port   = flag.Int("port", 8080, "server port")
+	socket = flag.String("socket", "", "unix domain socket to listen on instead of the port, for running next to the balancer")
+
+	tlsCert  = flag.String("tls-cert", "", "certificate file to serve TLS with")
+	tlsKey   = flag.String("tls-key", "", "private key file of the TLS certificate")
+	clientCA = flag.String("client-ca", "", "CA file client certificates must be signed by; set to only accept clients with one, like the balancer")
+
+	rateLimit = flag.Int("rate-limit", 0, "requests per second allowed per API key (X-Api-Key header) or client address; 0 means unlimited")
+
+	persistFeatures = flag.Bool("persist-features", false, "keep feature flags in the db so every server shares them")
+	featuresRefresh = flag.Duration("features-refresh", 30*time.Second, "how often persisted feature flags are reloaded")
+
+	leaderTTL = flag.Duration("leader-ttl", 15*time.Second, "lease of the server elected to run singleton jobs; a failed leader is replaced after it")
+
+	cacheMaxAge = flag.Int("cache-max-age", 0, "seconds balancer caches and browsers may reuse a record without revalidating its ETag")
+
+	readCacheTTL  = flag.Duration("read-cache-ttl", 0, "how long records read from the db are cached, refreshed in the background near expiry; 0 disables the cache")
+	readCacheSize = flag.Int("read-cache-size", 10000, "maximum number of records in the read cache")
+
+	reportInterval = flag.Duration("report-interval", 0, "how often the requests served per endpoint are written to the db for GET /report/all; 0 disables it")
+	reportTTL      = flag.Duration("report-ttl", 24*time.Hour, "how long the endpoint counters written to the db are kept")
+
+	profileDir      = flag.String("profile-dir", os.TempDir(), "directory CPU and heap profiles captured on SIGUSR1 are written to")
+	profileDuration = flag.Duration("profile-duration", signal.DefaultProfileDuration, "how long the CPU profile captured on SIGUSR1 runs")
+)
+
+const apiKeyHeader = "X-Api-Key"
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
+const idempotencyTTL = 10 * time.Minute
+
+const confFeatureFlags = "FEATURE_FLAGS"
+
+// shards are the db nodes, listed in DB_SHARDS separated by commas. Read
+// replicas of a shard follow its leader separated by "|".
+var shards = newShardSet(envOrDefault("DB_SHARDS", "http://db:8080"))
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	// Version is the expected current version for optimistic locking.
+	Version *uint64 `json:"version,omitempty"`
+}
+
 func main() {
-	setDBKeyValuePair("QuantumGurus", getCurrentDate())
+	flag.Parse()
+	signal.ProfileOnSignal(*profileDir, *profileDuration)
+
+	// DB_TLS_CERT, DB_TLS_KEY and DB_TLS_CA are the client certificate and
+	// CA of mutual TLS to db nodes started with DB_CLIENT_CA;
+	// DB_TLS_SERVER_NAME is the SAN their certificates are checked for.
+	if cert := os.Getenv("DB_TLS_CERT"); cert != "" {
+		config, err := httptools.ClientTLSConfig(cert, os.Getenv("DB_TLS_KEY"), os.Getenv("DB_TLS_CA"), os.Getenv("DB_TLS_SERVER_NAME"))
+		if err != nil {
+			log.Fatalf("Failed to load the db client certificate: %s", err)
+		}
+		shards.setTLSConfig(config)
+	}
+
+	instance := newInstanceInfo(candidateID(), *readCacheTTL)
+
+	// Only the elected leader among the servers writes the daily seed.
+	elector := dbclient.NewLeaderElector(shards.forKey(leaderKey).client, leaderKey, instance.ID, *leaderTTL)
+	go runAsLeader(elector, seedDaily)
+
+	var store flagStore
+	if *persistFeatures {
+		store = shards
+	}
+	features, err := newFeatureFlags(serverAPI, os.Getenv(confFeatureFlags), store)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", confFeatureFlags, err)
+	}
+	if err := features.load(); err != nil {
+		log.Printf("Failed to load feature flags: %s", err)
+	}
+	if store != nil {
+		go features.refresh(*featuresRefresh)
+	}
+
+	counters := newEndpointCounters()
+	if *reportInterval > 0 {
+		go persistReports(context.Background(), shards, counters, instance.ID, *reportInterval, *reportTTL)
+	}
 
 	h := new(http.ServeMux)
+	// handle routes an API operation, counted, validated and behind its
+	// feature flag.
+	handle := func(op *operation, handler http.Handler) {
+		h.Handle(op.route(), counters.Wrap(op.ID, features.gate(op, op.wrap(handler))))
+	}
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
 		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
@@ -36,69 +124,132 @@ func main() {
 
 	report := make(Report)
 
-	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
+	reads := newReadCache(func(ctx context.Context, key string) (dbclient.Record, error) {
+		return shards.forKey(key).client.GetContext(ctx, key)
+	}, *readCacheTTL, *readCacheSize)
+
+	h.Handle("GET /api/v1/openapi.json", serverAPI)
+
+	handle(getSomeData, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query()
 
 		key := query.Get("key")
-		value, err := getDBValueByKey(key)
+		format, err := httptools.ParseResponseFormat(r)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record, err := reads.get(r.Context(), key)
 		if err != nil {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
+		writeRecord(rw, r, format, record, readCacheControl(*cacheMaxAge))
+	}))
 
-		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(
-			map[string]string{"key": key, "value": value},
-		)
-	})
-
-	h.Handle("/report", report)
+	idempotency := httptools.NewIdempotencyStore(idempotencyTTL)
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
-}
-
-func setDBKeyValuePair(key, value string) {
-	dbSetEndpoint := fmt.Sprintf("http://db:8080/db/%s", key)
+	handle(putSomeData, idempotency.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var request putRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(rw, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if reservedKey(request.Key) {
+			http.Error(rw, "Reserved key", http.StatusForbidden)
+			return
+		}
 
-	requestMapping := map[string]string{"value": value}
-	requestJSON, _ := json.Marshal(requestMapping)
+		stored, err := shards.forKey(request.Key).client.PutRecord(r.Context(), request.Key, request.Value, dbclient.PutOptions{
+			ExpectedVersion: request.Version,
+		})
+		if errors.Is(err, dbclient.ErrVersionConflict) {
+			http.Error(rw, "Version conflict", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
 
-	req, _ := http.NewRequest("POST", dbSetEndpoint, bytes.NewBuffer(requestJSON))
-	req.Header.Set("Content-Type", "application/json")
+		record := dbclient.Record{Key: request.Key, Value: request.Value, Version: stored.Version, Sequence: stored.Sequence}
+		reads.store(request.Key, record, nil)
+		setSequence(rw, stored.Sequence)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("ETag", recordETag(record))
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(rw).Encode(record)
+	})))
 
-	resp, _ := http.DefaultClient.Do(req)
-	defer resp.Body.Close()
-}
+	handle(deleteSomeData, idempotency.Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if reservedKey(key) {
+			http.Error(rw, "Reserved key", http.StatusForbidden)
+			return
+		}
+		sequence, err := shards.forKey(key).client.DeleteSequence(r.Context(), key)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		reads.forget(key)
+		setSequence(rw, sequence)
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.WriteHeader(http.StatusNoContent)
+	})))
 
-func getDBValueByKey(key string) (string, error) {
-	dbGetEndpoint := fmt.Sprintf("http://db:8080/db/%s", key)
+	handle(mgetSomeData, multiGetter{shards: shards, deadline: mgetDeadline})
 
-	req, _ := http.NewRequest("GET", dbGetEndpoint, bytes.NewBuffer(nil))
-	resp, respErr := http.DefaultClient.Do(req)
+	h.Handle("GET /db-endpoints", shards)
+	h.Handle("GET /read-cache", reads)
+	h.Handle("GET /instance", instance)
+	limits := new(ratelimit.Metrics)
+	h.Handle("GET /rate-limits", limits)
+	h.Handle("/report", report)
+	h.Handle("GET /report/all", reportAggregator{shards: shards, now: time.Now})
+	h.Handle("GET /feature-flags", features)
+	h.Handle("POST /feature-flags", features)
 
-	if respErr != nil {
-		return "", respErr
+	// The balancer passes on its remaining timeout; db calls are bounded by
+	// what is left of it.
+	handler := httptools.WithDeadline(httptools.WithMinSequence(h))
+	if *rateLimit > 0 {
+		limiter := ratelimit.NewSlidingWindow(*rateLimit, time.Second, nil)
+		handler = ratelimit.Wrap(handler, limiter, ratelimit.ByHeader(apiKeyHeader), limits)
 	}
-
-	defer resp.Body.Close()
-
-	var responseKVPair map[string]string
-
-	err := json.NewDecoder(resp.Body).Decode(&responseKVPair)
-
-	if err != nil {
-		return "", err
+	handler = instance.Wrap(handler)
+	var server httptools.Server
+	switch {
+	case *socket != "":
+		server = httptools.CreateUnixServer(*socket, handler)
+	case *clientCA != "":
+		if server, err = httptools.CreateMTLSServer(*port, handler, *tlsCert, *tlsKey, *clientCA); err != nil {
+			log.Fatalf("Failed to load the client CA: %s", err)
+		}
+	case *tlsCert != "":
+		server = httptools.CreateTLSServer(*port, handler, *tlsCert, *tlsKey)
+	default:
+		server = httptools.CreateServer(*port, handler)
 	}
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
 
-	value, isFieldPresent := responseKVPair["value"]
-	if !isFieldPresent {
-		return "", errors.New("value not found in response")
+// setSequence passes the commit sequence of a write on to the client. It
+// is that of the shard of the key: reading a key of another shard with it
+// is answered by the leader of that shard, fresh but without a replica.
+func setSequence(rw http.ResponseWriter, sequence uint64) {
+	if sequence > 0 {
+		rw.Header().Set(httptools.SequenceHeader, strconv.FormatUint(sequence, 10))
 	}
+}
 
-	return value, nil
+func envOrDefault(name, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
 }
 
 func getCurrentDate() string {
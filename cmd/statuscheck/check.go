@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxMetricsBody bounds the metrics responses included in the status.
+const maxMetricsBody = 64 << 10
+
+// probe is one endpoint polled on a node.
+type probe struct {
+	Name string
+	Path string
+	// Metrics probes include the JSON they return in the status. Their
+	// failure is reported without making the node unhealthy.
+	Metrics bool
+}
+
+// node is one instance of a service.
+type node struct {
+	Service string
+	Addr    string
+	Probes  []probe
+}
+
+type probeResult struct {
+	Name      string          `json:"name"`
+	URL       string          `json:"url"`
+	Status    int             `json:"status,omitempty"`
+	LatencyMs int64           `json:"latency_ms"`
+	Error     string          `json:"error,omitempty"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+type nodeStatus struct {
+	Service string        `json:"service"`
+	Addr    string        `json:"addr"`
+	Healthy bool          `json:"healthy"`
+	Probes  []probeResult `json:"probes"`
+}
+
+// status is the aggregated result of a round of checks.
+type status struct {
+	Healthy   bool         `json:"healthy"`
+	CheckedAt time.Time    `json:"checked_at"`
+	Nodes     []nodeStatus `json:"nodes"`
+	// Failures lists what made the status unhealthy, one line per probe.
+	Failures []string `json:"failures,omitempty"`
+}
+
+type checker struct {
+	client *http.Client
+	scheme string
+	nodes  []node
+}
+
+// check polls every probe of every node in parallel.
+func (c *checker) check(ctx context.Context) status {
+	result := status{Healthy: true, CheckedAt: time.Now(), Nodes: make([]nodeStatus, len(c.nodes))}
+	var wg sync.WaitGroup
+	for i, n := range c.nodes {
+		result.Nodes[i] = nodeStatus{Service: n.Service, Addr: n.Addr, Healthy: true, Probes: make([]probeResult, len(n.Probes))}
+		for j, p := range n.Probes {
+			wg.Add(1)
+			go func(i, j int, n node, p probe) {
+				defer wg.Done()
+				result.Nodes[i].Probes[j] = c.probe(ctx, n, p)
+			}(i, j, n, p)
+		}
+	}
+	wg.Wait()
+
+	for i, n := range c.nodes {
+		for j, p := range n.Probes {
+			res := result.Nodes[i].Probes[j]
+			if p.Metrics || (res.Error == "" && res.Status == http.StatusOK) {
+				continue
+			}
+			result.Nodes[i].Healthy = false
+			result.Healthy = false
+			detail := res.Error
+			if detail == "" {
+				detail = fmt.Sprintf("status %d", res.Status)
+			}
+			result.Failures = append(result.Failures, fmt.Sprintf("%s %s %s: %s", n.Service, n.Addr, p.Name, detail))
+		}
+	}
+	return result
+}
+
+func (c *checker) probe(ctx context.Context, n node, p probe) probeResult {
+	res := probeResult{Name: p.Name, URL: fmt.Sprintf("%s://%s%s", c.scheme, n.Addr, p.Path)}
+	start := time.Now()
+	defer func() { res.LatencyMs = time.Since(start).Milliseconds() }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, res.URL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMetricsBody+1))
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case resp.StatusCode != http.StatusOK:
+		res.Error = string(body)
+	case p.Metrics && len(body) <= maxMetricsBody && json.Valid(body):
+		res.Body = body
+	}
+	return res
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/db-admin/stats" {
+			_, _ = rw.Write([]byte(`{"keys":3}`))
+			return
+		}
+		_, _ = rw.Write([]byte("OK"))
+	}))
+	defer healthy.Close()
+	warming := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("WARMING UP"))
+	}))
+	defer warming.Close()
+	addr := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	c := &checker{client: http.DefaultClient, scheme: "http", nodes: []node{
+		{Service: "db", Addr: addr(healthy), Probes: []probe{
+			{Name: "ready", Path: "/health"},
+			{Name: "stats", Path: "/db-admin/stats", Metrics: true},
+		}},
+		{Service: "server", Addr: addr(warming), Probes: []probe{
+			{Name: "health", Path: "/health"},
+			{Name: "db-endpoints", Path: "/db-endpoints", Metrics: true},
+		}},
+	}}
+
+	result := c.check(context.Background())
+	assert.False(t, result.Healthy)
+	assert.True(t, result.Nodes[0].Healthy)
+	assert.JSONEq(t, `{"keys":3}`, string(result.Nodes[0].Probes[1].Body))
+	assert.False(t, result.Nodes[1].Healthy)
+	assert.Equal(t, "WARMING UP", result.Nodes[1].Probes[0].Error)
+	assert.Equal(t, []string{"server " + addr(warming) + " health: WARMING UP"}, result.Failures)
+
+	warming.Close()
+	result = c.check(context.Background())
+	assert.NotEmpty(t, result.Nodes[1].Probes[0].Error, "unreachable nodes report the connection error")
+	assert.Zero(t, result.Nodes[1].Probes[0].Status)
+}
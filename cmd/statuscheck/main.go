@@ -0,0 +1,106 @@
+// Command statuscheck polls the health and metrics endpoints of the
+// balancer, the app servers and the db nodes and reports their aggregated
+// status as JSON. It exits with 1 if anything is unhealthy, or serves the
+// status at /status with -serve.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	balancer = flag.String("lb", "balancer:8090", "balancer address; empty skips it")
+	servers  = flag.String("servers", "server1:8080,server2:8080,server3:8080", "comma separated app server addresses")
+	dbNodes  = flag.String("db", "db:8080", "comma separated db node addresses")
+	dbAdmin  = flag.String("db-admin", "", "comma separated db admin addresses (DB_ADMIN_ADDR); the db addresses are used if empty")
+	https    = flag.Bool("https", false, "whether the services use HTTPs")
+	timeout  = flag.Duration("timeout", 3*time.Second, "timeout of a round of checks")
+	serve    = flag.String("serve", "", "address to serve the status on instead of printing it once")
+)
+
+func main() {
+	flag.Parse()
+	c := &checker{client: http.DefaultClient, scheme: "http", nodes: nodes()}
+	if *https {
+		c.scheme = "https"
+	}
+
+	if *serve == "" {
+		result := check(c)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(result)
+		if !result.Healthy {
+			os.Exit(1)
+		}
+		return
+	}
+
+	http.HandleFunc("GET /status", func(rw http.ResponseWriter, _ *http.Request) {
+		result := check(c)
+		rw.Header().Set("Content-Type", "application/json")
+		if !result.Healthy {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(rw).Encode(result)
+	})
+	log.Printf("Serving the aggregated status on %s", *serve)
+	log.Fatal(http.ListenAndServe(*serve, nil))
+}
+
+func check(c *checker) status {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	return c.check(ctx)
+}
+
+// nodes lists the probes of every configured node.
+func nodes() []node {
+	var result []node
+	if *balancer != "" {
+		result = append(result, node{Service: "lb", Addr: *balancer, Probes: []probe{
+			// The balancer proxies /health to a backend, so it passes only
+			// if the balancer can reach one.
+			{Name: "health", Path: "/health"},
+			{Name: "metrics", Path: "/lb-admin/metrics", Metrics: true},
+			{Name: "load-shedding", Path: "/lb-admin/load-shedding", Metrics: true},
+		}})
+	}
+	for _, addr := range splitList(*servers) {
+		result = append(result, node{Service: "server", Addr: addr, Probes: []probe{
+			{Name: "health", Path: "/health"},
+			{Name: "db-endpoints", Path: "/db-endpoints", Metrics: true},
+		}})
+	}
+	admins := splitList(*dbAdmin)
+	for i, addr := range splitList(*dbNodes) {
+		// The db reports 503 on /health while it warms up, so it doubles as
+		// the readiness check.
+		result = append(result, node{Service: "db", Addr: addr, Probes: []probe{{Name: "ready", Path: "/health"}}})
+		admin := addr
+		if i < len(admins) {
+			admin = admins[i]
+		}
+		result = append(result, node{Service: "db-admin", Addr: admin, Probes: []probe{
+			{Name: "stats", Path: "/db-admin/stats", Metrics: true},
+		}})
+	}
+	return result
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
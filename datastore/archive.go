@@ -0,0 +1,308 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The archive holds sealed segments named after their seal time, the
+// active segment as of the last Close under archiveOpenPrefix and, under
+// archiveSnapshotDir, snapshots named after the time they were taken.
+const (
+	archiveOpenPrefix  = "open"
+	archiveSnapshotDir = "snapshots"
+)
+
+type archivedSegment struct {
+	path     string
+	sealedAt int64
+}
+
+// archiveSegment copies a sealed segment into the archive directory under a
+// name prefixed with the seal time, replacing the copy Close made while it
+// was active.
+func (db *Db) archiveSegment(segmentPath string) error {
+	if db.archiveDir == "" {
+		return nil
+	}
+	name := fmt.Sprintf("%d-%s", db.clock.Now().UnixNano(), filepath.Base(segmentPath))
+	if err := db.copyToArchive(segmentPath, name); err != nil {
+		return err
+	}
+	err := db.fs.Remove(filepath.Join(db.archiveDir, archiveOpenPrefix+"-"+filepath.Base(segmentPath)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// archiveActive copies the active segment into the archive on Close, so
+// the writes since the last seal can be restored. The copy keeps one name
+// until the segment is sealed, each Close replacing it.
+func (db *Db) archiveActive() error {
+	if db.archiveDir == "" {
+		return nil
+	}
+	return db.copyToArchive(db.outPath, archiveOpenPrefix+"-"+filepath.Base(db.outPath))
+}
+
+// copyToArchive copies a segment and its blobs into the archive directory
+// under name.
+func (db *Db) copyToArchive(segmentPath, name string) error {
+	src, err := openFile(db.fs, segmentPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := filepath.Join(db.archiveDir, name+".tmp")
+	dst, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := db.archiveBlobs(segmentPath); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, filepath.Join(db.archiveDir, name)); err != nil {
+		return err
+	}
+	return db.syncDir(db.archiveDir)
+}
+
+// archiveBlobs copies the blobs referenced by a segment into the archive so
+// restored records can still be read.
+func (db *Db) archiveBlobs(segmentPath string) error {
+	if db.dedupMinSize == 0 && db.blobs.stats().Blobs == 0 {
+		return nil
+	}
+	src, err := openFile(db.fs, segmentPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = scanEntries(src, func(_ int64, data []byte) error {
+		var e entry
+		if err := e.Decode(data); err != nil {
+			return err
+		}
+		if e.blob == "" {
+			return nil
+		}
+		return copyBlob(db.fs, db.blobs.dir, filepath.Join(db.archiveDir, blobDirName), e.blob)
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func listArchivedSegments(archiveDir string) ([]archivedSegment, error) {
+	files, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []archivedSegment
+	for _, file := range files {
+		prefix, _, found := strings.Cut(file.Name(), "-")
+		if !found || strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		// The active segment is not sealed yet, its records are replayed
+		// after all others by their write time.
+		sealedAt := int64(math.MaxInt64)
+		if prefix != archiveOpenPrefix {
+			if sealedAt, err = strconv.ParseInt(prefix, 10, 64); err != nil {
+				continue
+			}
+		}
+		segments = append(segments, archivedSegment{
+			path:     filepath.Join(archiveDir, file.Name()),
+			sealedAt: sealedAt,
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].sealedAt < segments[j].sealedAt
+	})
+	return segments, nil
+}
+
+// ArchiveSnapshot adds a snapshot of the database to the archive. A restore
+// starts from the last snapshot taken before its point in time and replays
+// only the segments sealed since, so taking them periodically bounds the
+// replay.
+func (db *Db) ArchiveSnapshot() error {
+	if db.archiveDir == "" {
+		return fmt.Errorf("archiving is disabled")
+	}
+	dir := filepath.Join(db.archiveDir, archiveSnapshotDir)
+	if err := db.fs.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	name := strconv.FormatInt(db.clock.Now().UnixNano(), 10)
+	tmpPath := filepath.Join(dir, name+".tmp")
+	if err := db.Snapshot(tmpPath); err != nil {
+		_ = os.RemoveAll(tmpPath)
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	return db.syncDir(dir)
+}
+
+// latestSnapshot returns the directory of the last snapshot in archiveDir
+// taken at or before until and when it was taken, or an empty path.
+func latestSnapshot(archiveDir string, until int64) (string, int64, error) {
+	files, err := os.ReadDir(filepath.Join(archiveDir, archiveSnapshotDir))
+	if os.IsNotExist(err) {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	var latest string
+	var takenAt int64
+	for _, file := range files {
+		taken, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil || taken > until || taken < takenAt {
+			continue
+		}
+		latest, takenAt = filepath.Join(archiveDir, archiveSnapshotDir, file.Name()), taken
+	}
+	return latest, takenAt, nil
+}
+
+// RestoreToTimestamp rebuilds the database state as of t into the empty
+// directory dir from the last snapshot archived in archiveDir before t, if
+// any, and the segments archived since. Segments sealed before t are
+// replayed completely, later ones only up to records written at t.
+func RestoreToTimestamp(archiveDir, dir string, t time.Time) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("restore directory %s is not empty", dir)
+	}
+
+	archived, err := listArchivedSegments(archiveDir)
+	if err != nil {
+		return err
+	}
+
+	outPath := filepath.Join(dir, defaultFileName+"0")
+	out, err := os.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	until := t.UnixNano()
+	snapshot, takenAt, err := latestSnapshot(archiveDir, until)
+	if err != nil {
+		return err
+	}
+	if snapshot != "" {
+		m, err := (&Db{directory: snapshot, fs: OSFilesystem{}}).readManifest()
+		if err != nil {
+			return err
+		}
+		blobs := archivedBlobs{from: filepath.Join(snapshot, blobDirName), to: filepath.Join(dir, blobDirName)}
+		for _, name := range m.Segments {
+			segment := archivedSegment{path: filepath.Join(snapshot, name), sealedAt: takenAt}
+			if err := replayArchivedSegment(segment, until, out, blobs); err != nil {
+				return err
+			}
+		}
+	}
+	blobs := archivedBlobs{from: filepath.Join(archiveDir, blobDirName), to: filepath.Join(dir, blobDirName)}
+	for _, segment := range archived {
+		// Segments sealed before the snapshot are part of it.
+		if segment.sealedAt <= takenAt {
+			continue
+		}
+		if err := replayArchivedSegment(segment, until, out, blobs); err != nil {
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+
+	db := &Db{directory: dir, fs: OSFilesystem{}}
+	return db.writeManifest([]*Segment{{filePath: outPath}})
+}
+
+// archivedBlobs are the blob directories of the archive and of the restored
+// database.
+type archivedBlobs struct {
+	from, to string
+}
+
+func replayArchivedSegment(segment archivedSegment, until int64, out io.Writer, blobs archivedBlobs) error {
+	in, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	complete := segment.sealedAt <= until
+	// Restored records from many segments end up in one file, so values
+	// compressed with the dictionary of theirs are written expanded.
+	var dict []byte
+	_, err = scanEntries(in, func(_ int64, data []byte) error {
+		var e entry
+		if err := e.Decode(data); err != nil {
+			return err
+		}
+		if e.dictionary {
+			dict = []byte(e.value)
+			return nil
+		}
+		if e.compressed {
+			value, err := decompressValue(dict, e.value)
+			if err != nil {
+				return err
+			}
+			e.value, e.compressed = value, false
+			data = e.Encode()
+		}
+		if !complete && (e.timestamp == 0 || e.timestamp > until) {
+			return nil
+		}
+		if e.blob != "" {
+			if err := copyBlob(OSFilesystem{}, blobs.from, blobs.to, e.blob); err != nil {
+				return err
+			}
+		}
+		_, err := out.Write(data)
+		return err
+	})
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
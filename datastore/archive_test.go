@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreToTimestamp(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dataDir := filepath.Join(dir, "data")
+	archiveDir := filepath.Join(dir, "archive")
+	if err := os.Mkdir(dataDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	db, err := Open(dataDir, Options{SegmentSize: 60, ArchiveDir: archiveDir, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"1", "2", "3"} {
+		if err := db.Put(key, "good"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(10 * time.Millisecond)
+	restorePoint := clock.Now()
+	clock.Advance(10 * time.Millisecond)
+	for _, key := range []string{"1", "2", "3", "4"} {
+		if err := db.Put(key, "bad"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restore before bad writes", func(t *testing.T) {
+		restoreDir := filepath.Join(dir, "restored-before")
+		if err := RestoreToTimestamp(archiveDir, restoreDir, restorePoint); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDatabase(restoreDir, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for _, key := range []string{"1", "2", "3"} {
+			value, err := restored.Get(key)
+			if err != nil || value != "good" {
+				t.Errorf("Bad value for %s: expected good, got %s (err: %v)", key, value, err)
+			}
+		}
+		if _, err := restored.Get("4"); err != ErrNotFound {
+			t.Errorf("Expected key 4 to be missing, got err %v", err)
+		}
+	})
+
+	t.Run("restore latest state", func(t *testing.T) {
+		restoreDir := filepath.Join(dir, "restored-latest")
+		if err := RestoreToTimestamp(archiveDir, restoreDir, clock.Now()); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := NewDatabase(restoreDir, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+
+		for _, key := range []string{"1", "2", "3", "4"} {
+			value, err := restored.Get(key)
+			if err != nil || value != "bad" {
+				t.Errorf("Bad value for %s: expected bad, got %s (err: %v)", key, value, err)
+			}
+		}
+	})
+
+	t.Run("restore into non-empty directory", func(t *testing.T) {
+		if err := RestoreToTimestamp(archiveDir, dataDir, clock.Now()); err == nil {
+			t.Error("Expected an error when restoring over existing data")
+		}
+	})
+}
+
+func TestArchive_ActiveSegment(t *testing.T) {
+	dataDir, archiveDir := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	open := func() *Db {
+		db, err := Open(dataDir, Options{SegmentSize: 200, ArchiveDir: archiveDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	archived := func() []string {
+		files, _ := os.ReadDir(archiveDir)
+		var names []string
+		for _, file := range files {
+			if !file.IsDir() {
+				names = append(names, file.Name())
+			}
+		}
+		return names
+	}
+
+	// Every Close replaces the copy of the active segment.
+	for i := 0; i < 2; i++ {
+		db := open()
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names := archived(); len(names) != 1 || !strings.HasPrefix(names[0], archiveOpenPrefix+"-") {
+		t.Fatalf("Expected one copy of the active segment, got %v", names)
+	}
+
+	// Sealing it archives it for good.
+	db := open()
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	names := archived()
+	if len(names) != 1 || strings.HasPrefix(names[0], archiveOpenPrefix+"-") {
+		t.Errorf("Expected the sealed segment to replace the copy, got %v", names)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreToTimestamp_Snapshot(t *testing.T) {
+	dataDir, archiveDir := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	clock := NewFakeClock(time.Now())
+	db, err := Open(dataDir, Options{SegmentSize: 100, ArchiveDir: archiveDir, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "before")
+	}
+	clock.Advance(time.Millisecond)
+	if err := db.ArchiveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Millisecond)
+	_ = db.Put("key0", "after")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The segments sealed before the snapshot are not needed any more.
+	segments, err := listArchivedSegments(archiveDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, takenAt, err := latestSnapshot(archiveDir, clock.Now().UnixNano())
+	if err != nil || snapshot == "" {
+		t.Fatalf("Expected the snapshot to be archived, got %q, %v", snapshot, err)
+	}
+	removed := 0
+	for _, segment := range segments {
+		if segment.sealedAt <= takenAt {
+			_ = os.Remove(segment.path)
+			removed++
+		}
+	}
+	if removed == 0 {
+		t.Fatal("Expected segments to be sealed before the snapshot")
+	}
+
+	restoreDir := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreToTimestamp(archiveDir, restoreDir, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewDatabase(restoreDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i, expected := range []string{"after", "before", "before"} {
+		if value, err := restored.Get(fmt.Sprintf("key%d", i*4)); err != nil || value != expected {
+			t.Errorf("Expected key%d to be %s, got %q, %v", i*4, expected, value, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import "time"
+
+// Entry is a key written by PutBatch.
+type Entry struct {
+	Key   string
+	Value string
+	Tags  []string
+	// TTL is how long the key lives, zero if it never expires.
+	TTL time.Duration
+}
+
+// PutBatch stores all entries with a single write to the active segment.
+// Either every entry of the batch survives a crash or none does. A key
+// listed more than once ends with its last value.
+func (db *Db) PutBatch(entries []Entry) (err error) {
+	if len(entries) == 0 {
+		return nil
+	}
+	now := db.clock.Now()
+	batch := make([]entry, len(entries))
+	for i, e := range entries {
+		if err := validateTags(e.Tags); err != nil {
+			return err
+		}
+		if e.TTL < 0 {
+			return ErrBadTTL
+		}
+		batch[i] = entry{key: e.Key, value: e.Value, tags: e.Tags}
+		if e.TTL > 0 {
+			batch[i].expiresAt = now.Add(e.TTL).UnixNano()
+		}
+		// A shared timestamp keeps the batch whole in point in time restores.
+		batch[i].timestamp = db.writeTime(now)
+		batch[i].batchRemaining = uint64(len(entries) - 1 - i)
+	}
+
+	if db.history != nil {
+		call := db.history.begin()
+		defer func() {
+			if err != nil {
+				return
+			}
+			for _, e := range batch {
+				db.history.end(Operation{Kind: OpPut, Key: e.key, Value: e.value, Call: call})
+			}
+		}()
+	}
+	keys := make([]string, len(batch))
+	for i, e := range batch {
+		keys[i] = e.key
+	}
+	if !db.throttle.allow(keys...) {
+		return ErrThrottled
+	}
+
+	res := db.submit(EntryWithChan{
+		batch:      batch,
+		durability: db.Durability(DurabilityDefault),
+	})
+	if err := res.err; err != nil {
+		return err
+	}
+	for _, e := range batch {
+		db.io.logicalWritten.Add(int64(len(e.key) + len(e.value)))
+	}
+	return nil
+}
+
+// applyBatch appends the batch to the active segment as one write and
+// indexes it. Only the last index action is waited for, the index
+// processor applies them in order.
+func (db *Db) applyBatch(batch []entry) writeResult {
+	values := make([]string, len(batch))
+	versions := make(map[string]uint64, len(batch))
+	var length int64
+	for i := range batch {
+		e := &batch[i]
+		version, found := versions[e.key]
+		if found {
+			version++
+		} else {
+			var err error
+			if version, err = db.nextVersion(e.key, nil); err != nil {
+				return writeResult{err: err}
+			}
+		}
+		versions[e.key] = version
+		e.version = version
+		e.sequence = db.sequence.Add(1)
+
+		values[i] = e.value
+		if db.dedupMinSize > 0 && len(e.value) >= db.dedupMinSize {
+			hash, err := db.blobs.store(e.value)
+			if err != nil {
+				return writeResult{err: err}
+			}
+			e.blob, e.value = hash, ""
+		}
+		length += e.GetLength()
+	}
+
+	// The batch never spans segments, so a crash can only tear the tail of
+	// the active one.
+	fileInfo, err := db.out.Stat()
+	if err != nil {
+		return writeResult{err: err}
+	}
+	if fileInfo.Size()+length > db.segmentSize {
+		if err := db.CreateDataSegment(); err != nil {
+			return writeResult{err: err}
+		}
+	}
+	records := make([][]byte, len(batch))
+	data := make([]byte, 0, length)
+	for i := range batch {
+		records[i] = batch[i].Encode()
+		data = append(data, records[i]...)
+	}
+	offset := db.outOffset
+	if _, err := db.out.Write(data); err != nil {
+		return writeResult{err: err}
+	}
+	if db.wal != nil {
+		for _, record := range records {
+			db.wal.add(offset, record)
+			offset += int64(len(record))
+		}
+	}
+
+	applied := make(chan struct{})
+	for i, e := range batch {
+		action := IndexAction{
+			isInsert:  true,
+			recordKey: e.key,
+			offset:    int64(len(records[i])),
+			version:   e.version,
+			blob:      e.blob,
+			expiresAt: e.expiresAt,
+			writtenAt: e.timestamp,
+		}
+		if i == len(batch)-1 {
+			action.applied = applied
+		}
+		db.indexOps <- action
+	}
+	<-applied
+	for i := range batch {
+		db.tags.apply(&batch[i])
+		if db.cache != nil {
+			db.cache.update(batch[i].key, Record{Value: values[i], Version: batch[i].version, expiresAt: batch[i].expiresAt}, false)
+		}
+		db.changes.publish(changeOf(&batch[i], values[i]))
+	}
+	return writeResult{version: batch[len(batch)-1].version}
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDb_PutBatch(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 1024, CacheSize: 10, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("a", "old"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.PutBatch([]Entry{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2", Tags: []string{"batch"}},
+		{Key: "a", Value: "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, err := db.GetRecord("a"); err != nil || record.Value != "3" || record.Version != 3 {
+		t.Errorf("Expected the last value of a repeated key with version 3, got %+v, %v", record, err)
+	}
+	if value, err := db.Get("b"); err != nil || value != "2" {
+		t.Errorf("Expected b from the batch, got %q, %v", value, err)
+	}
+	if err := db.PutBatch([]Entry{{Key: "c", Value: "x", TTL: -1}}); err != ErrBadTTL {
+		t.Errorf("Expected ErrBadTTL for a negative ttl, got %v", err)
+	}
+	if _, err := db.Get("c"); err != ErrNotFound {
+		t.Errorf("Expected a rejected batch not to be written, got %v", err)
+	}
+}
+
+func TestDb_PutBatchTornWrite(t *testing.T) {
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("before", "value"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.PutBatch([]Entry{{Key: "k1", Value: "v1"}, {Key: "k2", Value: "v2"}, {Key: "k3", Value: "v3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	activePath := db.outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The crash leaves the first two records of the batch complete.
+	last := entry{key: "k3", value: "v3"}
+	f, err := fs.OpenFile(activePath, os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(fs.Size(activePath) - last.GetLength()); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected %s of the torn batch to be dropped, got %v", key, err)
+		}
+	}
+	if value, err := db.Get("before"); err != nil || value != "value" {
+		t.Errorf("Expected the record before the batch, got %q, %v", value, err)
+	}
+	if len(db.Repairs()) != 1 {
+		t.Errorf("Expected the torn batch to be repaired, got %+v", db.Repairs())
+	}
+	if err := db.Put("k1", "after"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("k1"); err != nil || value != "after" {
+		t.Errorf("Expected a write after the repair, got %q, %v", value, err)
+	}
+}
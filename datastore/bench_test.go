@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+const benchKeys = 1000
+
+func openBenchDb(b *testing.B, segmentSize int64) *Db {
+	db, err := NewDatabase(b.TempDir(), segmentSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+func fillBenchDb(b *testing.B, db *Db, keys int) {
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDb_Put(b *testing.B) {
+	db := openBenchDb(b, 10*1024*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%benchKeys), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDb_ConcurrentGet(b *testing.B) {
+	db := openBenchDb(b, 10*1024*1024)
+	fillBenchDb(b, db, benchKeys)
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := fmt.Sprintf("key%d", n.Add(1)%benchKeys)
+			if _, err := db.Get(key); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDb_Mixed runs one write per four reads from parallel clients.
+func BenchmarkDb_Mixed(b *testing.B) {
+	db := openBenchDb(b, 10*1024*1024)
+	fillBenchDb(b, db, benchKeys)
+	var n atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := n.Add(1)
+			key := fmt.Sprintf("key%d", i%benchKeys)
+			var err error
+			if i%5 == 0 {
+				err = db.Put(key, "value")
+			} else {
+				_, err = db.Get(key)
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_Recover(b *testing.B) {
+	db := openBenchDb(b, 64*1024)
+	fillBenchDb(b, db, 10*benchKeys)
+	db.compactions.Wait()
+	dir := db.directory
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recovered, err := NewDatabase(dir, 64*1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		recovered.Close()
+		b.StartTimer()
+	}
+}
+
+// BenchmarkDb_Compaction merges the sealed segments holding two generations
+// of every key.
+func BenchmarkDb_Compaction(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db := openBenchDb(b, 8*1024)
+		fillBenchDb(b, db, benchKeys)
+		fillBenchDb(b, db, benchKeys)
+		db.compactions.Wait()
+		b.StartTimer()
+
+		db.PerformOldSegmentsCompaction()
+		db.compactions.Wait()
+	}
+}
+
+// BenchmarkDb_Import loads benchKeys records per iteration, to compare
+// with as many calls of BenchmarkDb_Put.
+func BenchmarkDb_Import(b *testing.B) {
+	db := openBenchDb(b, 10*1024*1024)
+	var input bytes.Buffer
+	for i := 0; i < benchKeys; i++ {
+		fmt.Fprintf(&input, "{\"key\":\"key%d\",\"value\":\"value\"}\n", i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Import(bytes.NewReader(input.Bytes()), ExportNDJSON); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	blobDirName = "blobs"
+	// defaultDedupMinSize is the smallest value stored as a blob when
+	// Options.DedupMinSize is not set. Smaller values are cheaper inline.
+	defaultDedupMinSize = 128
+)
+
+var ErrMissingBlob = fmt.Errorf("record references a value missing from the blob store")
+
+// blobStore keeps deduplicated values in files named by the sha256 of their
+// content. Records of such values hold the hash instead of the value.
+//
+// Blobs are reference counted from the segment indexes: every indexed record
+// referencing a blob holds one reference. Counting happens once writes are
+// paused, after recovery and after every compaction, and blobs left without
+// references are deleted. In between, every stored value adds a reference.
+type blobStore struct {
+	fs   Filesystem
+	dir  string
+	sync bool
+	// syncDirs syncs the blob directory after blobs are added or removed,
+	// and its parent once after the directory is created.
+	syncDirs     bool
+	parentSynced bool
+
+	mu   sync.Mutex
+	refs map[string]int
+	// sizes of the referenced blobs, for the dedup statistics.
+	sizes map[string]int64
+}
+
+// DedupStats describes the deduplicated values.
+type DedupStats struct {
+	Blobs      int   `json:"blobs"`
+	References int   `json:"references"`
+	SavedBytes int64 `json:"saved_bytes"`
+}
+
+func newBlobStore(fsys Filesystem, directory string, sync, syncDirs bool) *blobStore {
+	return &blobStore{
+		fs:       fsys,
+		dir:      filepath.Join(directory, blobDirName),
+		sync:     sync,
+		syncDirs: syncDirs,
+		refs:     make(map[string]int),
+		sizes:    make(map[string]int64),
+	}
+}
+
+func blobHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *blobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+// store makes sure the blob of value exists and returns its hash. It must
+// run in the entry processor so it does not race with gc.
+func (b *blobStore) store(value string) (string, error) {
+	hash := blobHash(value)
+	if !b.exists(hash) {
+		if err := b.write(hash, value); err != nil {
+			return "", err
+		}
+	}
+
+	b.mu.Lock()
+	b.refs[hash]++
+	b.sizes[hash] = int64(len(value))
+	b.mu.Unlock()
+	return hash, nil
+}
+
+func (b *blobStore) write(hash, value string) error {
+	if err := b.fs.MkdirAll(b.dir, 0o755); err != nil {
+		return err
+	}
+
+	tmpPath := b.path(hash) + ".tmp"
+	file, err := b.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, value); err != nil {
+		file.Close()
+		return err
+	}
+	if b.sync {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := b.fs.Rename(tmpPath, b.path(hash)); err != nil {
+		return err
+	}
+	return b.syncDir()
+}
+
+func (b *blobStore) syncDir() error {
+	if !b.syncDirs {
+		return nil
+	}
+	if !b.parentSynced {
+		if err := b.fs.SyncDir(filepath.Dir(b.dir)); err != nil {
+			return err
+		}
+		b.parentSynced = true
+	}
+	return b.fs.SyncDir(b.dir)
+}
+
+func (b *blobStore) exists(hash string) bool {
+	file, err := openFile(b.fs, b.path(hash))
+	if err != nil {
+		return false
+	}
+	file.Close()
+	return true
+}
+
+func (b *blobStore) read(hash string) (string, error) {
+	data, err := b.fs.ReadFile(b.path(hash))
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrMissingBlob, hash)
+	}
+	return string(data), err
+}
+
+// gc recounts the references held by the segment indexes and deletes blobs
+// without any. Writes must be paused.
+func (b *blobStore) gc(segments []*Segment) error {
+	refs := make(map[string]int)
+	for _, segment := range segments {
+		segment.mu.Lock()
+		for _, pos := range segment.index {
+			if pos.blob != "" {
+				refs[pos.blob]++
+			}
+		}
+		segment.mu.Unlock()
+	}
+
+	files, err := b.fs.ReadDir(b.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sizes := make(map[string]int64, len(refs))
+	removed := false
+	for _, file := range files {
+		hash := file.Name()
+		if refs[hash] > 0 {
+			if info, err := file.Info(); err == nil {
+				sizes[hash] = info.Size()
+			}
+			continue
+		}
+		if err := b.fs.Remove(b.path(hash)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		if err := b.syncDir(); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	b.refs, b.sizes = refs, sizes
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *blobStore) stats() DedupStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var stats DedupStats
+	for hash, count := range b.refs {
+		stats.Blobs++
+		stats.References += count
+		stats.SavedBytes += int64(count-1) * b.sizes[hash]
+	}
+	return stats
+}
+
+// copyBlob copies the blob hash from one blob directory to another unless
+// it is there already.
+func copyBlob(fsys Filesystem, fromDir, toDir, hash string) error {
+	dst := filepath.Join(toDir, hash)
+	if file, err := openFile(fsys, dst); err == nil {
+		file.Close()
+		return nil
+	}
+	data, err := fsys.ReadFile(filepath.Join(fromDir, hash))
+	if err != nil {
+		return err
+	}
+	if err := fsys.MkdirAll(toDir, 0o755); err != nil {
+		return err
+	}
+	if err := fsys.WriteFile(dst+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return fsys.Rename(dst+".tmp", dst)
+}
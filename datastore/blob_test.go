@@ -0,0 +1,81 @@
+package datastore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_DedupValues(t *testing.T) {
+	fsys := NewMemFilesystem()
+	opts := Options{SegmentSize: 300, DedupValues: true, Filesystem: fsys}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("x", 200)
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil || value != large {
+			t.Fatalf("Unexpected value for key%d: %q, %v", i, value, err)
+		}
+	}
+
+	dedup := db.Stats().Dedup
+	if dedup == nil || dedup.Blobs != 1 || dedup.References != 3 || dedup.SavedBytes != 400 {
+		t.Fatalf("Unexpected dedup stats %+v", dedup)
+	}
+	entries, err := db.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if (entry.Key == "small") != (entry.Blob == "") {
+			t.Errorf("Unexpected blob for %s: %q", entry.Key, entry.Blob)
+		}
+	}
+	blobPath := filepath.Join("db", blobDirName, blobHash(large))
+	if fsys.Size(blobPath) != 200 {
+		t.Fatalf("Blob file not stored")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "replaced"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.compactions.Wait()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key0"); err != nil || value != "replaced" {
+		t.Fatalf("Unexpected value after reopen: %q, %v", value, err)
+	}
+	if fsys.Size(blobPath) != -1 {
+		t.Errorf("Unreferenced blob was not removed")
+	}
+	if dedup := db.Stats().Dedup; dedup.Blobs != 0 {
+		t.Errorf("Unexpected dedup stats after gc %+v", dedup)
+	}
+}
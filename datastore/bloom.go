@@ -0,0 +1,65 @@
+package datastore
+
+const (
+	// bloomBitsPerKey and bloomHashes give about 1% false positives.
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter tells the keys that are certainly not in a sealed segment, so
+// lookups skip it without taking its lock. It is built once the segment
+// index stops changing and never modified afterwards.
+type bloomFilter struct {
+	bits []uint64
+}
+
+// newBloomFilter builds the filter of the keys of index.
+func newBloomFilter(index hashIndex, hasher KeyHasher) *bloomFilter {
+	words := (len(index)*bloomBitsPerKey + 63) / 64
+	f := &bloomFilter{bits: make([]uint64, max(words, 1))}
+	for key := range index {
+		f.add(hasher.HashKey(key))
+	}
+	return f
+}
+
+// probe returns the i-th bit position of a key hash, derived by double
+// hashing.
+func (f *bloomFilter) probe(hash, i uint64) uint64 {
+	h1, h2 := hash&0xffffffff, hash>>32|1
+	return (h1 + i*h2) % (uint64(len(f.bits)) * 64)
+}
+
+func (f *bloomFilter) add(hash uint64) {
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := f.probe(hash, i)
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain reports false when the key of hash is certainly not indexed.
+func (f *bloomFilter) mayContain(hash uint64) bool {
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := f.probe(hash, i)
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seal builds the filter of a segment that takes no more writes. It is
+// called again whenever the index of a sealed segment is rebuilt.
+func (db *Db) seal(segment *Segment) {
+	segment.mu.Lock()
+	filter := newBloomFilter(segment.index, db.keyHasher)
+	segment.mu.Unlock()
+	segment.filter.Store(filter)
+}
+
+// mayContain reports false when key is certainly not in the segment. The
+// active segment has no filter and may contain any key.
+func (s *Segment) mayContain(hash uint64) bool {
+	filter := s.filter.Load()
+	return filter == nil || filter.mayContain(hash)
+}
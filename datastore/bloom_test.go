@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	hasher := RandomSipHasher()
+	index := make(hashIndex)
+	for i := 0; i < 1000; i++ {
+		index[fmt.Sprintf("key%d", i)] = recordPosition{}
+	}
+	filter := newBloomFilter(index, hasher)
+	for key := range index {
+		if !filter.mayContain(hasher.HashKey(key)) {
+			t.Fatalf("Expected %s to be in the filter", key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(hasher.HashKey(fmt.Sprintf("missing%d", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("Expected about 1%% false positives, got %d in 10000", falsePositives)
+	}
+
+	if empty := newBloomFilter(hashIndex{}, hasher); empty.mayContain(hasher.HashKey("key")) {
+		t.Error("Expected an empty filter to contain nothing")
+	}
+}
+
+func TestDb_SegmentFilters(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 200, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	check := func(when string) {
+		t.Helper()
+		segments := db.segmentList()
+		for i, segment := range segments {
+			if sealed := i < len(segments)-1; sealed != (segment.filter.Load() != nil) {
+				t.Errorf("%s: expected only sealed segments to have a filter, segment %d has %v", when, i, segment.filter.Load())
+			}
+		}
+		if value, err := db.Get("key0"); err != nil || value != "value" {
+			t.Errorf("%s: expected the oldest key to be found, got %q, %v", when, value, err)
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("%s: expected a miss, got %v", when, err)
+		}
+	}
+	check("after rotations")
+
+	if _, err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	check("after reindexing")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after reopening")
+}
@@ -0,0 +1,235 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const bucketsManifestFileName = "BUCKETS"
+
+var (
+	ErrBucketNotFound = errors.New("bucket not found")
+	ErrBadBucketName  = errors.New("bucket names are 1-64 characters of a-z, 0-9, '_' and '-'")
+	ErrBucketsClosed  = errors.New("buckets are closed")
+	bucketNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+)
+
+// Buckets is a set of independent databases sharing one directory. Every
+// bucket has its own active segment and writer goroutine, so writes to
+// different buckets do not queue behind each other.
+//
+// A shared manifest lists the buckets. Each bucket lives in a directory
+// stamped with the generation it was created in, which only grows, so a
+// bucket dropped and created again never picks up files of its old self.
+type Buckets struct {
+	directory string
+	opts      Options
+	fs        Filesystem
+
+	mu         sync.Mutex
+	generation uint64
+	dirs       map[string]string
+	dbs        map[string]*Db
+	closed     bool
+}
+
+type bucketsManifest struct {
+	Generation uint64 `json:"generation"`
+	// Buckets maps bucket names to their directories.
+	Buckets map[string]string `json:"buckets"`
+}
+
+// OpenBuckets opens the buckets stored in directory. Every bucket is opened
+// with opts; an ArchiveDir gets a subdirectory per bucket.
+func OpenBuckets(directory string, opts Options) (*Buckets, error) {
+	b := &Buckets{
+		directory: directory,
+		opts:      opts,
+		fs:        opts.Filesystem,
+		dirs:      make(map[string]string),
+		dbs:       make(map[string]*Db),
+	}
+	if b.fs == nil {
+		b.fs = OSFilesystem{}
+	}
+	if err := b.fs.MkdirAll(directory, 0o755); err != nil {
+		return nil, err
+	}
+
+	data, err := b.fs.ReadFile(filepath.Join(directory, bucketsManifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var m bucketsManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("bad buckets manifest: %w", err)
+		}
+		b.generation = m.Generation
+		for name, dir := range m.Buckets {
+			b.dirs[name] = dir
+		}
+	}
+
+	for name, dir := range b.dirs {
+		db, err := b.open(dir)
+		if err != nil {
+			b.Close()
+			return nil, fmt.Errorf("can't open bucket %s: %w", name, err)
+		}
+		b.dbs[name] = db
+	}
+	return b, nil
+}
+
+// Bucket returns the database of the bucket, creating the bucket first if
+// it does not exist. The database is closed by Close or Drop.
+func (b *Buckets) Bucket(name string) (*Db, error) {
+	if !bucketNamePattern.MatchString(name) {
+		return nil, ErrBadBucketName
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBucketsClosed
+	}
+	if db, found := b.dbs[name]; found {
+		return db, nil
+	}
+
+	generation := b.generation + 1
+	dir := fmt.Sprintf("%d-%s", generation, name)
+	db, err := b.open(dir)
+	if err != nil {
+		return nil, err
+	}
+	b.dirs[name] = dir
+	b.generation = generation
+	if err := b.writeManifest(); err != nil {
+		delete(b.dirs, name)
+		db.Close()
+		return nil, err
+	}
+	b.dbs[name] = db
+	return db, nil
+}
+
+// Lookup returns the database of an existing bucket.
+func (b *Buckets) Lookup(name string) (*Db, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	db, found := b.dbs[name]
+	if !found {
+		return nil, ErrBucketNotFound
+	}
+	return db, nil
+}
+
+// Names lists the buckets in lexical order.
+func (b *Buckets) Names() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.dbs))
+	for name := range b.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Drop closes the bucket and deletes its files. The bucket is removed from
+// the manifest first, so a crash midway leaves only unreferenced files.
+func (b *Buckets) Drop(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	db, found := b.dbs[name]
+	if !found {
+		return ErrBucketNotFound
+	}
+	dir := b.dirs[name]
+	delete(b.dirs, name)
+	if err := b.writeManifest(); err != nil {
+		b.dirs[name] = dir
+		return err
+	}
+	delete(b.dbs, name)
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return removeAll(b.fs, filepath.Join(b.directory, dir))
+}
+
+// Close closes every bucket.
+func (b *Buckets) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	var firstErr error
+	for name, db := range b.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("can't close bucket %s: %w", name, err)
+		}
+	}
+	return firstErr
+}
+
+func (b *Buckets) open(dir string) (*Db, error) {
+	opts := b.opts
+	opts.Filesystem = b.fs
+	if opts.ArchiveDir != "" {
+		opts.ArchiveDir = filepath.Join(opts.ArchiveDir, dir)
+	}
+	path := filepath.Join(b.directory, dir)
+	if err := b.fs.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	return Open(path, opts)
+}
+
+// writeManifest atomically replaces the buckets manifest. b.mu must be held.
+func (b *Buckets) writeManifest() error {
+	data, err := json.Marshal(bucketsManifest{Generation: b.generation, Buckets: b.dirs})
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(b.directory, bucketsManifestFileName)
+	tmpPath := manifestPath + ".tmp"
+	if err := writeSyncedFile(b.fs, tmpPath, data, b.opts.SyncDirectories); err != nil {
+		return err
+	}
+	if err := b.fs.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+	if !b.opts.SyncDirectories {
+		return nil
+	}
+	return b.fs.SyncDir(b.directory)
+}
+
+// removeAll deletes the directory of a database with its blob store. The
+// blob directory is emptied first, listings of the in-memory filesystem do
+// not include it.
+func removeAll(fsys Filesystem, dir string) error {
+	for _, path := range []string{filepath.Join(dir, blobDirName), dir} {
+		files, err := fsys.ReadDir(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, file := range files {
+			if err := fsys.Remove(filepath.Join(path, file.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := fsys.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	fsys := NewMemFilesystem()
+	opts := Options{SegmentSize: 200, Filesystem: fsys}
+	buckets, err := OpenBuckets("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buckets.Bucket("Bad/Name"); err != ErrBadBucketName {
+		t.Errorf("Expected ErrBadBucketName, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"users", "orders"} {
+		db, err := buckets.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(name string, db *Db) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), name); err != nil {
+					t.Error(err)
+				}
+			}
+		}(name, db)
+	}
+	wg.Wait()
+	if err := buckets.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	buckets, err = OpenBuckets("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buckets.Close()
+	if names := buckets.Names(); len(names) != 2 || names[0] != "orders" || names[1] != "users" {
+		t.Fatalf("Unexpected buckets %v", names)
+	}
+	for _, name := range []string{"users", "orders"} {
+		db, err := buckets.Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key7"); err != nil || value != name {
+			t.Errorf("Bad value in bucket %s: %q (err: %v)", name, value, err)
+		}
+	}
+
+	oldSegment := filepath.Join("db", buckets.dirs["users"], defaultFileName+"0")
+	if err := buckets.Drop("users"); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.Size(oldSegment) != -1 {
+		t.Errorf("Segment of the dropped bucket was not removed")
+	}
+	if _, err := buckets.Lookup("users"); err != ErrBucketNotFound {
+		t.Errorf("Expected ErrBucketNotFound, got %v", err)
+	}
+	db, err := buckets.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key7"); err != ErrNotFound {
+		t.Errorf("Recreated bucket sees old data: %v", err)
+	}
+	if dir := buckets.dirs["users"]; dir != "3-users" {
+		t.Errorf("Expected a new generation directory, got %s", dir)
+	}
+}
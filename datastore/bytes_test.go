@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDb_PutBytes(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 4096, DedupValues: true, DedupMinSize: 16, ValueDictionary: true, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string][]byte{
+		"zeros":   make([]byte, 64),
+		"invalid": {0xff, 0xfe, 0x00, 0xc3, 0x28, '\n', 0x80},
+		"empty":   {},
+	}
+	for key, value := range values {
+		if err := db.PutBytes(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db *Db) {
+		t.Helper()
+		for key, want := range values {
+			got, err := db.GetBytes(key)
+			if err != nil {
+				t.Fatalf("Cannot get %s: %s", key, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Expected %s to read back as %x, got %x", key, want, got)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open("db", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+
+	if _, err := db.GetBytes("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
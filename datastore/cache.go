@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"bufio"
+	"container/list"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const hotKeysFileName = "HOTKEYS"
+
+// valueCache is an LRU cache of recently read records.
+type valueCache struct {
+	capacity int
+	budget   *memoryAccountant
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	hits    int64
+	misses  int64
+	// bytes is the estimated size of the cached records, evictions the
+	// records dropped to stay within the memory budget.
+	bytes     int64
+	evictions int64
+}
+
+type cachedRecord struct {
+	key     string
+	record  Record
+	deleted bool
+}
+
+// CacheStats describes the value cache usage.
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func newValueCache(capacity int, budget *memoryAccountant) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		budget:   budget,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(key string) (cachedRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, found := c.entries[key]
+	if !found {
+		c.misses++
+		return cachedRecord{}, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(cachedRecord), true
+}
+
+// fill caches a record read from disk unless a newer write happened since
+// the read. isCurrent is checked under the cache lock; writers update the
+// index before the cache, so a racing write always wins.
+func (c *valueCache) fill(key string, record Record, isCurrent func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !isCurrent() {
+		return
+	}
+	c.set(cachedRecord{key: key, record: record})
+}
+
+// update replaces the cached record of a key that was just written.
+func (c *valueCache) update(key string, record Record, deleted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, found := c.entries[key]; !found {
+		return
+	}
+	c.set(cachedRecord{key: key, record: record, deleted: deleted})
+}
+
+func (c *valueCache) set(value cachedRecord) {
+	if element, found := c.entries[value.key]; found {
+		c.bytes += cacheEntryBytes(value) - cacheEntryBytes(element.Value.(cachedRecord))
+		element.Value = value
+		c.order.MoveToFront(element)
+	} else {
+		c.entries[value.key] = c.order.PushFront(value)
+		c.bytes += cacheEntryBytes(value)
+	}
+	for c.order.Len() > c.capacity {
+		c.removeOldest()
+	}
+	c.fitBudget()
+}
+
+// fitBudget evicts the least recently used records while the cache holds
+// more bytes than the memory limits leave it.
+func (c *valueCache) fitBudget() {
+	budget := c.budget.cacheBudget()
+	for c.bytes > budget && c.order.Len() > 0 {
+		c.removeOldest()
+		c.evictions++
+	}
+}
+
+func (c *valueCache) removeOldest() {
+	oldest := c.order.Back()
+	c.order.Remove(oldest)
+	cached := oldest.Value.(cachedRecord)
+	delete(c.entries, cached.key)
+	c.bytes -= cacheEntryBytes(cached)
+}
+
+// trim applies a budget lowered by grown indexes.
+func (c *valueCache) trim() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fitBudget()
+}
+
+// memory returns the estimated size of the cached records and the number
+// of records evicted to stay within the memory budget.
+func (c *valueCache) memory() (int64, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes, c.evictions
+}
+
+// clear drops every cached record.
+func (c *valueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+// keys returns cached keys from the most to the least recently used.
+func (c *valueCache) keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		if cached := element.Value.(cachedRecord); !cached.deleted {
+			keys = append(keys, cached.key)
+		}
+	}
+	return keys
+}
+
+func (c *valueCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: c.order.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// saveHotKeys persists the hottest keys according to the access statistics,
+// or the currently cached keys without them, so the next process can warm
+// its cache up.
+func (db *Db) saveHotKeys() error {
+	if db.cache == nil {
+		return nil
+	}
+
+	keys := db.cache.keys()
+	if db.access != nil {
+		keys = keys[:0]
+		for _, access := range db.HotKeys(db.cache.capacity) {
+			keys = append(keys, access.Key)
+		}
+	}
+
+	path := filepath.Join(db.directory, hotKeysFileName)
+	tmpPath := path + ".tmp"
+	data := strings.Join(keys, "\n")
+	if err := db.fs.WriteFile(tmpPath, []byte(data), 0o600); err != nil {
+		return err
+	}
+	return db.fs.Rename(tmpPath, path)
+}
+
+// WarmUp preloads the values of the keys that were hot when the database was
+// last closed into the value cache. It returns the number of loaded keys.
+func (db *Db) WarmUp() (int, error) {
+	if db.cache == nil {
+		return 0, nil
+	}
+
+	file, err := openFile(db.fs, filepath.Join(db.directory, hotKeysFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() && len(keys) < db.cache.capacity {
+		keys = append(keys, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// Load the hottest keys last so they end up as the most recently used.
+	loaded := 0
+	for i := len(keys) - 1; i >= 0; i-- {
+		if _, err := db.GetRecord(keys[i]); err == nil {
+			loaded++
+		}
+	}
+	return loaded, nil
+}
@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_ValueCache(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, Options{SegmentSize: 1024, CacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"1", "2", "3"} {
+		_ = db.Put(key, "v"+key)
+		_, _ = db.Get(key)
+	}
+	if keys := db.cache.keys(); !reflect.DeepEqual(keys, []string{"3", "2"}) {
+		t.Errorf("Unexpected cached keys %v", keys)
+	}
+
+	_, _ = db.Get("2")
+	_ = db.Put("2", "updated")
+	if value, err := db.Get("2"); err != nil || value != "updated" {
+		t.Errorf("Bad value returned expected updated, got %s (err: %v)", value, err)
+	}
+	_ = db.Delete("2")
+	if _, err := db.Get("2"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be missing, got err %v", err)
+	}
+	if stats := db.Stats().Cache; stats == nil || stats.Hits != 3 {
+		t.Errorf("Unexpected cache stats %+v", stats)
+	}
+
+	t.Run("warm up", func(t *testing.T) {
+		_, _ = db.Get("3")
+		_, _ = db.Get("1")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(dir, Options{SegmentSize: 1024, CacheSize: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := db.WarmUp()
+		if err != nil || loaded != 2 {
+			t.Errorf("Expected 2 warmed up keys, got %d (err: %v)", loaded, err)
+		}
+		if keys := db.cache.keys(); !reflect.DeepEqual(keys, []string{"1", "3"}) {
+			t.Errorf("Unexpected cached keys after warm up %v", keys)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// watchBuffer is the number of changes a watcher can fall behind by before
+// it is dropped.
+const watchBuffer = 256
+
+var ErrWatchLagged = fmt.Errorf("watcher fell behind the changes")
+
+// ChangeType tells how a change affected its key.
+type ChangeType string
+
+const (
+	ChangePut    ChangeType = "put"
+	ChangeDelete ChangeType = "delete"
+	// ChangeExpired removes a key whose time to live ran out, so
+	// subscribers can tell timeouts apart from deletes asked for by users.
+	ChangeExpired ChangeType = "expired"
+)
+
+// Change is a write applied to the database.
+type Change struct {
+	Type    ChangeType `json:"type"`
+	Key     string     `json:"key"`
+	Value   string     `json:"value,omitempty"`
+	Version uint64     `json:"version"`
+}
+
+// Watcher receives the changes of the keys starting with its prefix in the
+// order they were applied.
+type Watcher struct {
+	prefix  string
+	changes chan Change
+	feed    *changeFeed
+	err     error
+}
+
+// Changes returns the channel the changes are delivered on. It is closed
+// when the watcher is closed, when the database is, or when the watcher
+// fell behind; Err tells which.
+func (w *Watcher) Changes() <-chan Change {
+	return w.changes
+}
+
+// Err returns ErrWatchLagged once the watcher was dropped for not keeping
+// up with the changes, nil otherwise. Changes after the last one received
+// are lost then and the watcher has to read the keys again.
+func (w *Watcher) Err() error {
+	w.feed.mu.Lock()
+	defer w.feed.mu.Unlock()
+	return w.err
+}
+
+// Close stops the delivery of changes.
+func (w *Watcher) Close() {
+	w.feed.mu.Lock()
+	defer w.feed.mu.Unlock()
+	w.feed.remove(w, nil)
+}
+
+// changeFeed fans the applied writes out to the watchers. Delivery never
+// blocks the writer: a watcher with a full buffer is dropped.
+type changeFeed struct {
+	mu       sync.Mutex
+	watchers map[*Watcher]struct{}
+}
+
+func (f *changeFeed) watch(prefix string) *Watcher {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.watchers == nil {
+		f.watchers = make(map[*Watcher]struct{})
+	}
+	w := &Watcher{prefix: prefix, changes: make(chan Change, watchBuffer), feed: f}
+	f.watchers[w] = struct{}{}
+	return w
+}
+
+func (f *changeFeed) publish(c Change) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for w := range f.watchers {
+		if !strings.HasPrefix(c.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.changes <- c:
+		default:
+			f.remove(w, ErrWatchLagged)
+		}
+	}
+}
+
+// remove closes the changes of w, which must be locked.
+func (f *changeFeed) remove(w *Watcher, err error) {
+	if _, found := f.watchers[w]; !found {
+		return
+	}
+	delete(f.watchers, w)
+	w.err = err
+	close(w.changes)
+}
+
+func (f *changeFeed) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for w := range f.watchers {
+		f.remove(w, nil)
+	}
+}
+
+// changeOf describes the write of e, whose value is value.
+func changeOf(e *entry, value string) Change {
+	if e.deleted && e.expired {
+		return Change{Type: ChangeExpired, Key: e.key, Version: e.version}
+	}
+	if e.deleted {
+		return Change{Type: ChangeDelete, Key: e.key, Version: e.version}
+	}
+	return Change{Type: ChangePut, Key: e.key, Value: value, Version: e.version}
+}
+
+// Watch subscribes to the changes of the keys starting with prefix, all
+// keys for an empty prefix. Only changes applied after Watch returns are
+// delivered. The watcher must be closed when no longer needed.
+func (db *Db) Watch(prefix string) *Watcher {
+	return db.changes.watch(prefix)
+}
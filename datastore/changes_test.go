@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_ = db.Put("users/before", "not delivered")
+	watcher := db.Watch("users/")
+	_ = db.Put("users/1", "a")
+	_ = db.Put("orders/1", "ignored")
+	_ = db.Put("users/1", "b")
+	_ = db.Delete("users/1")
+	watcher.Close()
+	_ = db.Put("users/2", "after close")
+
+	var changes []Change
+	for c := range watcher.Changes() {
+		changes = append(changes, c)
+	}
+	expected := []Change{
+		{Type: ChangePut, Key: "users/1", Value: "a", Version: 1},
+		{Type: ChangePut, Key: "users/1", Value: "b", Version: 2},
+		{Type: ChangeDelete, Key: "users/1", Version: 3},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+	if err := watcher.Err(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	t.Run("lagging watcher", func(t *testing.T) {
+		lagging := db.Watch("")
+		for i := 0; i <= watchBuffer; i++ {
+			_ = db.Put("key", "value")
+		}
+		received := 0
+		for range lagging.Changes() {
+			received++
+		}
+		if received != watchBuffer || lagging.Err() != ErrWatchLagged {
+			t.Errorf("Expected %d changes and a lag error, got %d and %v", watchBuffer, received, lagging.Err())
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// compactor runs the background compactions in a single goroutine, one at
+// a time. Rotations only ask for a compaction; requests made while one is
+// running are served together by the next round, so a burst of rotations
+// doesn't queue up a merge per rotation.
+type compactor struct {
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu sync.Mutex
+	// full asks for a merge of all sealed segments; tier runs are always
+	// looked for with tiered compaction.
+	full bool
+	// waiting is the number of requests the next round serves, each
+	// counted in Db.compactions.
+	waiting int
+	// pending counts the compactions requested and not done yet, those of
+	// the next round, the running one and synchronous ones.
+	pending int
+	stats   CompactionStats
+}
+
+// CompactionStats describes the compactions run since the database was
+// opened.
+type CompactionStats struct {
+	// Runs is the number of compactions that replaced segments.
+	Runs int64 `json:"runs"`
+	// BytesRewritten is the size of the segments they wrote, BytesReclaimed
+	// the difference to the size of those they merged. The merged files
+	// are removed once no read uses them anymore.
+	BytesRewritten int64 `json:"bytes_rewritten"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+	// LastDuration is how long the last of them took.
+	LastDuration time.Duration `json:"last_duration"`
+	// InProgress tells whether a compaction is running or requested.
+	InProgress bool `json:"in_progress"`
+}
+
+// CompactionStats returns the compaction statistics. Once InProgress is
+// false, every compaction requested so far is done.
+func (db *Db) CompactionStats() CompactionStats {
+	c := db.compactor
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.InProgress = c.pending > 0
+	return stats
+}
+
+// compacted accounts a compaction that merged input bytes into output
+// bytes.
+func (c *compactor) compacted(input, output int64, elapsed time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Runs++
+	c.stats.BytesRewritten += output
+	c.stats.BytesReclaimed += input - output
+	c.stats.LastDuration = elapsed
+}
+
+// begin and done count a compaction requested outside the compactor
+// goroutine.
+func (c *compactor) begin() {
+	c.mu.Lock()
+	c.pending++
+	c.mu.Unlock()
+}
+
+func (c *compactor) done(n int) {
+	c.mu.Lock()
+	c.pending -= n
+	c.mu.Unlock()
+}
+
+func newCompactor() *compactor {
+	return &compactor{wake: make(chan struct{}, 1), stop: make(chan struct{})}
+}
+
+// scheduleCompaction asks the compactor for a round, merging all sealed
+// segments if full is set.
+func (db *Db) scheduleCompaction(full bool) {
+	db.compactions.Add(1)
+	c := db.compactor
+	c.mu.Lock()
+	c.full = c.full || full
+	c.waiting++
+	c.pending++
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// shutdown stops the compactor goroutine; Close may be called twice.
+func (c *compactor) shutdown() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// runCompactions serves compaction requests until Close.
+func (db *Db) runCompactions() {
+	c := db.compactor
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.wake:
+		}
+		c.mu.Lock()
+		full, waiting := c.full, c.waiting
+		c.full, c.waiting = false, 0
+		c.mu.Unlock()
+
+		ctx := context.Background()
+		if full {
+			_ = db.compact(ctx, db.GenerateNewFileName(), allSealed)
+		}
+		// A merged segment may complete a run of the next tier, which is
+		// merged right away. Every merge removes a segment, so it ends.
+		for db.tierFanout > 0 && db.hasTierRun() {
+			if err := db.compact(ctx, db.GenerateNewFileName(), db.tierRun); err != nil {
+				break
+			}
+		}
+		c.done(waiting)
+		for ; waiting > 0; waiting-- {
+			db.compactions.Done()
+		}
+	}
+}
+
+// ioPacer spreads the bytes written by a compaction to at most rate per
+// second, so it leaves disk bandwidth to foreground reads and writes.
+type ioPacer struct {
+	rate    float64
+	started time.Time
+	written int64
+}
+
+// newIOPacer returns nil, which never waits, for a non-positive rate.
+func newIOPacer(rate int64) *ioPacer {
+	if rate <= 0 {
+		return nil
+	}
+	return &ioPacer{rate: float64(rate), started: time.Now()}
+}
+
+// wrote accounts n bytes and waits until they fit the rate, or ctx is done.
+func (p *ioPacer) wrote(ctx context.Context, n int) error {
+	if p == nil {
+		return nil
+	}
+	p.written += int64(n)
+	ahead := time.Duration(float64(p.written)/p.rate*float64(time.Second)) - time.Since(p.started)
+	if ahead <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
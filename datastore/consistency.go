@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RepairEvent describes a segment fixed by the consistency check run when
+// the database is opened.
+type RepairEvent struct {
+	Segment string `json:"segment"`
+	// RecoveredBytes ends the last complete record of the segment.
+	RecoveredBytes int64     `json:"recovered_bytes"`
+	FileSize       int64     `json:"file_size"`
+	Action         string    `json:"action"`
+	Time           time.Time `json:"time"`
+}
+
+// RecoveryProgress tells how far Open got rebuilding the segment indexes.
+// Bytes count the segment files, whether they are scanned or their index
+// is loaded from a hint.
+type RecoveryProgress struct {
+	Segments     int   `json:"segments"`
+	SegmentsDone int   `json:"segments_done"`
+	Bytes        int64 `json:"bytes"`
+	BytesDone    int64 `json:"bytes_done"`
+	// Segment is the segment recovered last.
+	Segment string `json:"segment,omitempty"`
+}
+
+// checkSegment compares the recovered index of a segment with its file. An
+// index pointing past the end of the file is rebuilt by replaying the file
+// again. Bytes after the last complete record are a torn write; in the
+// active segment they would make new records land after the recorded
+// offset, so they are cut off.
+func (db *Db) checkSegment(segment *Segment, active bool) error {
+	file, err := openFile(db.fs, segment.filePath)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	if !segment.indexWithin(size) {
+		if err := db.replaySegment(segment); err != nil {
+			return err
+		}
+		db.recordRepair(segment, size, "index rebuilt from the segment file")
+	}
+	if size == segment.outOffset {
+		return nil
+	}
+	if !active {
+		db.recordRepair(segment, size, "trailing bytes of a sealed segment ignored")
+		return nil
+	}
+	if db.readOnly {
+		db.recordRepair(segment, size, "torn tail of the active segment ignored")
+		return nil
+	}
+
+	out, err := db.fs.OpenFile(segment.filePath, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := out.Truncate(segment.outOffset); err != nil {
+		return fmt.Errorf("truncating %s: %w", segment.filePath, err)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	db.recordRepair(segment, size, "torn tail of the active segment truncated")
+	return nil
+}
+
+func (s *Segment) indexWithin(size int64) bool {
+	if s.outOffset > size {
+		return false
+	}
+	for _, pos := range s.index {
+		if pos.offset+pos.size > size {
+			return false
+		}
+	}
+	return true
+}
+
+// replaySegment rebuilds the segment index from its file.
+func (db *Db) replaySegment(segment *Segment) error {
+	file, err := openFile(db.fs, segment.filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	segment.index = make(hashIndex)
+	offset, err := segment.recoverFile(file, nil)
+	segment.outOffset = offset
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return nil
+}
+
+func (db *Db) recordRepair(segment *Segment, fileSize int64, action string) {
+	db.repairs = append(db.repairs, RepairEvent{
+		Segment:        filepath.Base(segment.filePath),
+		RecoveredBytes: segment.outOffset,
+		FileSize:       fileSize,
+		Action:         action,
+		Time:           db.clock.Now(),
+	})
+}
+
+// Repairs lists the repairs made by the consistency check when the database
+// was opened.
+func (db *Db) Repairs() []RepairEvent {
+	return append([]RepairEvent(nil), db.repairs...)
+}
+
+// recoverFile recovers the segment from its file like recover. A record
+// failing its checksum at the end of the file was torn by a crash rather
+// than corrupted, and is reported like a record cut short, with
+// io.ErrUnexpectedEOF and the offset of the last complete record, so the
+// consistency check truncates it.
+func (s *Segment) recoverFile(file File, onEntry func(e *entry)) (int64, error) {
+	offset, err := s.recover(file, onEntry)
+	if !errors.Is(err, ErrCorrupted) {
+		return offset, err
+	}
+	torn, tailErr := tornTail(file, offset)
+	if tailErr != nil {
+		return offset, tailErr
+	}
+	if torn {
+		return offset, io.ErrUnexpectedEOF
+	}
+	return offset, err
+}
+
+// tornTail reports whether the records from offset to the end of file are
+// intact but for the last one, possibly followed by zeros where the file
+// grew before the data reached it.
+func tornTail(file File, offset int64) (bool, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return false, err
+	}
+	rest, err := io.ReadAll(file)
+	if err != nil {
+		return false, err
+	}
+	for len(rest) > 0 && !allZero(rest) {
+		if len(rest) < 4 {
+			return false, nil
+		}
+		size := int(binary.LittleEndian.Uint32(rest))
+		if size < 12 || size > len(rest) {
+			return false, nil
+		}
+		var e entry
+		if err := e.Decode(rest[:size]); err != nil {
+			return allZero(rest[size:]), nil
+		}
+		rest = rest[size:]
+	}
+	return true, nil
+}
+
+func allZero(data []byte) bool {
+	return len(bytes.TrimLeft(data, "\x00")) == 0
+}
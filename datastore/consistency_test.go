@@ -0,0 +1,328 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_RepairsTornTail(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-consistency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs := map[string]string{"key1": "value1", "key2": "value2"}
+	for k, v := range pairs {
+		if err := db.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	activePath := db.outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record header promising more bytes than were written.
+	torn := []byte{100, 0, 0, 0, 'k', 'e'}
+	f, err := os.OpenFile(activePath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(torn); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repairs := db.Repairs()
+	if len(repairs) != 1 || repairs[0].Segment != filepath.Base(activePath) ||
+		repairs[0].FileSize != repairs[0].RecoveredBytes+int64(len(torn)) {
+		t.Fatalf("Unexpected repairs %+v", repairs)
+	}
+	if len(db.Stats().Repairs) != 1 {
+		t.Error("Expected the repair in the stats")
+	}
+
+	pairs["key3"] = "value3"
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range pairs {
+		if value, err := db.Get(k); err != nil || value != v {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, value, err, v)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if repairs := db.Repairs(); len(repairs) != 0 {
+		t.Errorf("Expected a consistent database, got repairs %+v", repairs)
+	}
+	if value, err := db.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Write after the repair was lost: %q, %v", value, err)
+	}
+}
+
+func TestSegment_IndexWithin(t *testing.T) {
+	segment := &Segment{index: hashIndex{"a": {offset: 0, size: 10}, "b": {offset: 10, size: 5}}, outOffset: 15}
+	if !segment.indexWithin(15) {
+		t.Error("Expected the index to fit a 15 byte file")
+	}
+	if segment.indexWithin(14) {
+		t.Error("Expected a record past the end of the file to be detected")
+	}
+}
+
+func TestDb_RepairsTornHeader(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	activePath := db.outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fsys.OpenFile(activePath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{7, 0})
+	f.Close()
+
+	db, err = Open("db", Options{SegmentSize: 1024, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(db.Repairs()) != 1 {
+		t.Errorf("Expected one repair, got %+v", db.Repairs())
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestDb_DetectsCorruptedRecords(t *testing.T) {
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	path := db.outPath
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("value1"))
+	data[i] ^= 0x01
+	if err := fs.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("key1"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted reading the flipped value, got %v", err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Expected the intact record to be read, got %q, %v", value, err)
+	}
+	if _, err := db.MultiGet([]string{"key1"}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted from MultiGet, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the index snapshot of the clean close the segment is scanned.
+	_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+	if _, err := Open("db", Options{SegmentSize: 1024, Filesystem: fs}); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected recovery to fail with ErrCorrupted, got %v", err)
+	}
+}
+
+func TestDb_TruncatesTornChecksumTail(t *testing.T) {
+	for name, tear := range map[string]func(data []byte) []byte{
+		// The length made it to disk, part of the data did not.
+		"garbage last record": func(data []byte) []byte {
+			i := bytes.LastIndex(data, []byte("value2"))
+			copy(data[i:], "\xff\xff")
+			return data
+		},
+		// The file grew before the record was written.
+		"zero filled tail": func(data []byte) []byte {
+			return append(data, make([]byte, 64)...)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs := NewMemFilesystem()
+			db, err := Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = db.Put("key1", "value1")
+			_ = db.Put("key2", "value2")
+			path := db.outPath
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// A torn tail is left by a crash, which leaves no index snapshot.
+			_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+			data, err := fs.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.WriteFile(path, tear(bytes.Clone(data)), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if repairs := db.Repairs(); len(repairs) != 1 {
+				t.Errorf("Expected the torn tail to be truncated, got repairs %+v", repairs)
+			}
+			if value, err := db.Get("key1"); err != nil || value != "value1" {
+				t.Errorf("Expected the complete record to survive, got %q, %v", value, err)
+			}
+			if name == "garbage last record" {
+				if _, err := db.Get("key2"); err != ErrNotFound {
+					t.Errorf("Expected the torn record to be dropped, got %v", err)
+				}
+			}
+			if err := db.Put("key3", "value3"); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := db.Get("key3"); err != nil || value != "value3" {
+				t.Errorf("Expected writes after the repair, got %q, %v", value, err)
+			}
+		})
+	}
+}
+
+// failingRenameFS fails renames onto the file named fail.
+type failingRenameFS struct {
+	*MemFilesystem
+	fail string
+}
+
+func (f *failingRenameFS) Rename(oldpath, newpath string) error {
+	if f.fail != "" && filepath.Base(newpath) == f.fail {
+		return errors.New("injected rename failure")
+	}
+	return f.MemFilesystem.Rename(oldpath, newpath)
+}
+
+func TestDb_RotationWithoutManifest(t *testing.T) {
+	fs := &failingRenameFS{MemFilesystem: NewMemFilesystem()}
+	opts := Options{SegmentSize: 200, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	put := func() error {
+		key := fmt.Sprintf("key%d", len(written))
+		err := db.Put(key, "value")
+		if err == nil {
+			written = append(written, key)
+		}
+		return err
+	}
+
+	fs.fail = manifestFileName
+	for put() == nil {
+	}
+	if segments := db.segmentList(); len(segments) != 1 || segments[0].filePath != db.outPath {
+		t.Fatalf("Expected writes to stay in the listed segment, got %d segments", len(segments))
+	}
+	entries, _ := fs.ReadDir("db")
+	for _, entry := range entries {
+		if _, isSegment := segmentNumber(entry.Name()); isSegment && filepath.Join("db", entry.Name()) != db.outPath {
+			t.Errorf("Expected no unlisted segment file, found %s", entry.Name())
+		}
+	}
+
+	fs.fail = ""
+	if err := put(); err != nil {
+		t.Fatalf("Expected the rotation to succeed once the manifest can be written, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range written {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Expected %s to survive, got %v", key, err)
+		}
+	}
+}
+
+func TestDb_RecoveryProgress(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 200, CompactionSegments: -1, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(db.segmentList()) < 3; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []RecoveryProgress
+	opts.OnRecoveryProgress = func(p RecoveryProgress) {
+		reports = append(reports, p)
+	}
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if len(reports) != 4 {
+		t.Fatalf("Expected a report before and after every segment, got %+v", reports)
+	}
+	if first := reports[0]; first.Segments != 3 || first.SegmentsDone != 0 || first.BytesDone != 0 || first.Bytes == 0 {
+		t.Errorf("Unexpected first report %+v", first)
+	}
+	last := reports[len(reports)-1]
+	if last.SegmentsDone != 3 || last.BytesDone != last.Bytes || last.Segment != filepath.Base(db.outPath) {
+		t.Errorf("Unexpected last report %+v", last)
+	}
+}
@@ -1,12 +1,22 @@
 package datastore
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
-	"time"
+	"testing/iotest"
 )
 
 func TestDb_Put(t *testing.T) {
@@ -93,13 +103,17 @@ func TestDb_Put(t *testing.T) {
 }
 
 func TestDb_Segmentation(t *testing.T) {
-	tempDirectory, err := ioutil.TempDir("", "testDBDir")
-	if err != nil {
-		t.Fatal(err)
+	fsys := NewMemFilesystem()
+	// Every record carries its commit sequence, small enough here to take
+	// the same space in all of them.
+	size := func(key, value string, version uint64) int64 {
+		return (&entry{key: key, value: value, version: version, sequence: 1}).GetLength()
 	}
-	defer os.RemoveAll(tempDirectory)
 
-	dbInstance, err := NewDatabase(tempDirectory, 35)
+	// Two new records fit into a segment. The overwritten "2" carries its
+	// version, so it still fits after "3" but "4" does not.
+	segmentSize := 2*size("1", "val1", 1) + 4
+	dbInstance, err := Open("db", Options{SegmentSize: segmentSize, Filesystem: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -110,7 +124,7 @@ func TestDb_Segmentation(t *testing.T) {
 		dbInstance.Put("2", "val2")
 		dbInstance.Put("3", "val3")
 		dbInstance.Put("2", "val5")
-		actualSegmentCount := len(dbInstance.segments)
+		actualSegmentCount := len(dbInstance.segmentList())
 		expectedSegmentCount := 2
 		if actualSegmentCount != expectedSegmentCount {
 			t.Errorf("Segmentation error. Expected 2 segments, but got %d.", actualSegmentCount)
@@ -118,16 +132,19 @@ func TestDb_Segmentation(t *testing.T) {
 	})
 
 	t.Run("verify chunk initiation", func(t *testing.T) {
+		// Hold the compaction back to observe the segment list before it.
+		dbInstance.compactionMu.Lock()
 		dbInstance.Put("4", "val4")
-		initialSegmentCount := len(dbInstance.segments)
+		initialSegmentCount := len(dbInstance.segmentList())
 		expectedInitialCount := 3
+		dbInstance.compactionMu.Unlock()
 		if initialSegmentCount != expectedInitialCount {
 			t.Errorf("Segmentation error. Expected 3 segments, but got %d.", initialSegmentCount)
 		}
 
-		time.Sleep(2 * time.Second)
+		dbInstance.compactions.Wait()
 
-		finalSegmentCount := len(dbInstance.segments)
+		finalSegmentCount := len(dbInstance.segmentList())
 		expectedFinalCount := 2
 		if finalSegmentCount != expectedFinalCount {
 			t.Errorf("Segmentation error. Expected 2 segments after compaction, but got %d.", finalSegmentCount)
@@ -143,15 +160,8 @@ func TestDb_Segmentation(t *testing.T) {
 	})
 
 	t.Run("verify chunk file size", func(t *testing.T) {
-		file, err := os.Open(dbInstance.segments[0].filePath)
-		defer file.Close()
-
-		if err != nil {
-			t.Error(err)
-		}
-		fileInfo, _ := file.Stat()
-		actualSize := fileInfo.Size()
-		expectedSize := int64(51)
+		actualSize := fsys.Size(dbInstance.segmentList()[0].filePath)
+		expectedSize := size("1", "val1", 1) + size("3", "val3", 1) + size("2", "val5", 2)
 		if actualSize != expectedSize {
 			t.Errorf("Segmentation error. Expected size %d, but got %d", expectedSize, actualSize)
 		}
@@ -197,3 +207,509 @@ func TestDb_ConcurrentGets(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Get("1"); err != ErrNotFound {
+		t.Errorf("Expected deleted key to be missing, got err %v", err)
+	}
+	if value, err := db.Get("2"); err != nil || value != "v2" {
+		t.Errorf("Bad value returned expected v2, got %s (err: %v)", value, err)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDatabase(dir, 45)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("1"); err != ErrNotFound {
+			t.Errorf("Expected deleted key to stay missing after recovery, got err %v", err)
+		}
+	})
+}
+
+func TestDb_Versions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db-versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	absent := uint64(0)
+	version, err := db.PutWithOptions("key", "v1", WriteOptions{ExpectedVersion: &absent})
+	if err != nil || version != 1 {
+		t.Fatalf("Expected version 1, got %d (err: %v)", version, err)
+	}
+	if _, err := db.PutWithOptions("key", "v1", WriteOptions{ExpectedVersion: &absent}); err != ErrVersionConflict {
+		t.Errorf("Expected a version conflict for an existing key, got %v", err)
+	}
+
+	stale := uint64(1)
+	if version, err = db.PutWithOptions("key", "v2", WriteOptions{ExpectedVersion: &stale}); err != nil || version != 2 {
+		t.Fatalf("Expected version 2, got %d (err: %v)", version, err)
+	}
+	if _, err := db.PutWithOptions("key", "v3", WriteOptions{ExpectedVersion: &stale}); err != ErrVersionConflict {
+		t.Errorf("Expected a version conflict for a stale version, got %v", err)
+	}
+
+	_ = db.Delete("key")
+	if version, err = db.PutWithOptions("key", "v4", WriteOptions{ExpectedVersion: &absent}); err != nil || version != 4 {
+		t.Errorf("Expected version 4 after delete, got %d (err: %v)", version, err)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDatabase(dir, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := db.GetRecord("key")
+		if err != nil || record.Value != "v4" || record.Version != 4 {
+			t.Errorf("Unexpected record after recovery: %+v (err: %v)", record, err)
+		}
+	})
+}
+
+func TestDb_VersionsAfterCompaction(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 1024, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put("key", "v1")
+	_ = db.Put("key", "v2")
+	_ = db.Delete("key")
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stale := uint64(2)
+	if _, err := db.PutWithOptions("key", "v3", WriteOptions{ExpectedVersion: &stale}); err != ErrVersionConflict {
+		t.Errorf("Expected a version taken before the delete to conflict, got %v", err)
+	}
+	version, err := db.PutWithOptions("key", "v3", WriteOptions{})
+	if err != nil || version <= 3 {
+		t.Errorf("Expected a version after the dropped tombstone, got %d (err: %v)", version, err)
+	}
+
+	_ = db.Delete("key")
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = Open("db", opts); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if next, err := db.PutWithOptions("key", "v4", WriteOptions{}); err != nil || next <= version+1 {
+		t.Errorf("Expected versions to keep growing across a reopen, got %d after %d (err: %v)", next, version, err)
+	}
+}
+
+func TestDb_Compact(t *testing.T) {
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Compact(context.Background()); err != nil || len(db.segmentList()) != 1 {
+		t.Fatalf("Expected nothing to compact in a single segment, got %v", err)
+	}
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.Compact(ctx); err != context.Canceled {
+		t.Errorf("Expected the canceled compaction to fail, got %v", err)
+	}
+	if n := len(db.segmentList()); n != 4 {
+		t.Errorf("Expected the segments to be left alone, got %d", n)
+	}
+
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(db.segmentList()); n != 2 {
+		t.Errorf("Expected the sealed segments to be merged, got %d segments", n)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Expected key%d to survive the compaction, got %v", i, err)
+		}
+	}
+}
+
+func TestDb_CompactRemovesSegments(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(db.segmentList()) < 6; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i%3), fmt.Sprintf("value%d", i))
+	}
+	db.hintWrites.Wait()
+	segmentFiles := func() []string {
+		entries, err := fsys.ReadDir("db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			if _, ok := segmentNumber(strings.TrimSuffix(entry.Name(), hintSuffix)); ok {
+				names = append(names, entry.Name())
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	listed := func() []string {
+		var names []string
+		for i, segment := range db.segmentList() {
+			name := filepath.Base(segment.filePath)
+			names = append(names, name)
+			if i < len(db.segmentList())-1 {
+				names = append(names, name+hintSuffix)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	before := segmentFiles()
+
+	// A pinned list keeps the files of the merged segments.
+	_, release := db.pinSegments()
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if files := segmentFiles(); len(files) <= len(before) {
+		t.Errorf("Expected the merged segments to stay while pinned, got %v", files)
+	}
+	release()
+	if files, expected := segmentFiles(), listed(); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected only the listed segments and hints %v, got %v", expected, files)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Expected key%d to survive the compaction, got %v", i, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files a crash left behind after the manifest moved on are removed
+	// on open.
+	_ = fsys.WriteFile(filepath.Join("db", before[0]), []byte("stale"), 0o600)
+	db, err = Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if files, expected := segmentFiles(), listed(); !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected the stale segment to be removed on open, got %v", files)
+	}
+}
+
+// failingFS fails the writes to files opened once fail is set.
+type failingFS struct {
+	*MemFilesystem
+	fail atomic.Bool
+}
+
+type failingFile struct {
+	File
+}
+
+func (f *failingFile) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (fsys *failingFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := fsys.MemFilesystem.OpenFile(name, flag, perm)
+	if err != nil || !fsys.fail.Load() {
+		return file, err
+	}
+	return &failingFile{file}, nil
+}
+
+func TestDb_CompactFailure(t *testing.T) {
+	fsys := &failingFS{MemFilesystem: NewMemFilesystem()}
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i))
+	}
+
+	fsys.fail.Store(true)
+	if err := db.Compact(context.Background()); err == nil {
+		t.Fatal("Expected the compaction failing to write to return an error")
+	}
+	fsys.fail.Store(false)
+	if n := len(db.segmentList()); n != 4 {
+		t.Errorf("Expected the segments to be kept, got %d", n)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Expected key%d to survive the failed compaction, got %v", i, err)
+		}
+	}
+}
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(dir, Options{SegmentSize: 100, CompactionSegments: -1, WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(db.segmentList()) < 3; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A torn tail is left for the next read-write open to cut off.
+	segments, _ := filepath.Glob(filepath.Join(dir, defaultFileName+"*"))
+	sort.Strings(segments)
+	active, err := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = active.Write([]byte{0, 0, 1})
+	active.Close()
+
+	files := func() map[string]string {
+		contents := make(map[string]string)
+		_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				data, _ := os.ReadFile(path)
+				contents[path] = string(data)
+			}
+			return err
+		})
+		return contents
+	}
+	before := files()
+
+	db, err = Open(dir, Options{SegmentSize: 100, WAL: true, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key4"); err != nil {
+		t.Errorf("Expected reads to work, got %v", err)
+	}
+	if err := db.Put("key", "value"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := db.Compact(context.Background()); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected the compaction to fail with ErrReadOnly, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := files(); !reflect.DeepEqual(before, after) {
+		t.Error("Expected the read-only open to leave the files unchanged")
+	}
+
+	if _, err := Open(t.TempDir(), Options{ReadOnly: true}); err == nil {
+		t.Error("Expected a read-only open of an empty directory to fail")
+	}
+}
+
+// TestDb_CompactionWhileServing runs compactions while keys are written
+// and read; run with -race it checks the segment list swap.
+func TestDb_CompactionWhileServing(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 200, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", w)
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				value := fmt.Sprintf("value%d", i)
+				if err := db.Put(key, value); err != nil {
+					t.Errorf("Put %s: %v", key, err)
+					return
+				}
+				if got, err := db.Get(key); err != nil || got != value {
+					t.Errorf("Expected %s to be %q, got %q, %v", key, value, got, err)
+					return
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Compact(context.Background()); err != nil {
+			t.Error(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestDb_DeterministicCompaction(t *testing.T) {
+	compact := func() *Db {
+		db, err := Open("db", Options{SegmentSize: 120, Filesystem: NewMemFilesystem()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = db.Put("b", "v1")
+		_ = db.Put("a", "v1")
+		_ = db.Delete("b")
+		// The write rotating to the third segment starts the compaction.
+		// Writing stops right after it, as the compaction may shrink the
+		// segment list before it is looked at again.
+		for i, rotations, active := 0, 0, db.outPath; rotations < 2; i++ {
+			_ = db.Put(fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i))
+			if db.outPath != active {
+				rotations, active = rotations+1, db.outPath
+			}
+		}
+		db.compactions.Wait()
+		return db
+	}
+
+	db1 := compact()
+	defer db1.Close()
+	db2 := compact()
+	defer db2.Close()
+	sealed1, err := db1.SealedSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed2, err := db2.SealedSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed1) != 1 || len(sealed2) != 1 || sealed1[0].Checksum != sealed2[0].Checksum {
+		t.Fatalf("Expected identical compacted segments, got %+v and %+v", sealed1, sealed2)
+	}
+
+	file, _, err := db1.OpenSealedSegment(sealed1[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var keys []string
+	if _, err := scanEntries(file, func(_ int64, data []byte) error {
+		var e entry
+		err := e.Decode(data)
+		keys = append(keys, e.key)
+		return err
+	}); err != io.EOF {
+		t.Fatal(err)
+	}
+	if !sort.StringsAreSorted(keys) || len(keys) == 0 || keys[0] != "a" {
+		t.Errorf("Expected the surviving keys in order, got %v", keys)
+	}
+}
+
+func TestDb_RecoversLargeRecords(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 1 << 20, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records smaller than the read buffer, straddling its end and spanning
+	// several buffers.
+	sizes := []int{100, bufferSize - 50, bufferSize, 3*bufferSize + 7, 70000}
+	for i, size := range sizes {
+		if err := db.Put(fmt.Sprintf("key%d", i), strings.Repeat(string(rune('a'+i)), size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, size := range sizes {
+		value, err := db.Get(fmt.Sprintf("key%d", i))
+		if err != nil || value != strings.Repeat(string(rune('a'+i)), size) {
+			t.Errorf("Expected the %d byte value of key%d, got %d bytes, %v", size, i, len(value), err)
+		}
+	}
+}
+
+func TestScanEntries_Streams(t *testing.T) {
+	var data []byte
+	for i, size := range []int{10, 3 * bufferSize, 20} {
+		e := entry{key: fmt.Sprintf("key%d", i), value: strings.Repeat("v", size)}
+		data = append(data, e.Encode()...)
+	}
+	var keys []string
+	end, err := scanEntries(iotest.OneByteReader(bytes.NewReader(data)), func(_ int64, data []byte) error {
+		var e entry
+		err := e.Decode(data)
+		keys = append(keys, e.key)
+		return err
+	})
+	if err != io.EOF || end != int64(len(data)) || len(keys) != 3 {
+		t.Errorf("Expected 3 records read one byte at a time, got %v up to %d, %v", keys, end, err)
+	}
+
+	// A corrupted size claiming far more than the input holds ends the scan
+	// as a torn write.
+	torn := append(bytes.Clone(data), 0xff, 0xff, 0xff, 0x7f, 1, 2, 3)
+	if end, err := scanEntries(bytes.NewReader(torn), func(int64, []byte) error { return nil }); err != io.ErrUnexpectedEOF || end != int64(len(data)) {
+		t.Errorf("Expected a torn tail at %d, got %d, %v", len(data), end, err)
+	}
+}
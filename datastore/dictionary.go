@@ -0,0 +1,231 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Segments written by compaction with ValueDictionary on start with a
+// record holding a DEFLATE preset dictionary trained on a sample of their
+// values. Every value that comes out smaller compressed with it is stored
+// compressed, so small values repeating the same fields, like JSON
+// documents, compress well although each record is compressed alone. The
+// dictionary travels with the segment file, through transfers and archives.
+const (
+	// dictionaryMaxSize is the DEFLATE window, the most of a dictionary
+	// that can be referenced.
+	dictionaryMaxSize = 32 << 10
+	// dictionarySamples and dictionarySampleBytes bound the values read
+	// to train a dictionary; values over dictionaryMaxValue are not
+	// sampled.
+	dictionarySamples     = 4096
+	dictionarySampleBytes = 1 << 20
+	dictionaryMaxValue    = 4 << 10
+	// dictionaryKmer is the length of the substrings counted across
+	// samples, dictionaryChunk that of the pieces of samples the
+	// dictionary is made of.
+	dictionaryKmer  = 8
+	dictionaryChunk = 64
+)
+
+// trainDictionary builds a dictionary out of the chunks of samples covering
+// the substrings most samples share, greedily picking the chunk adding the
+// most uncovered ones. The best chunks end up last, closest to the data, as
+// DEFLATE encodes near matches shorter. It returns nil when the samples
+// share nothing.
+func trainDictionary(samples []string) []byte {
+	// How many samples every k-mer occurs in.
+	freq := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]struct{})
+		for i := 0; i+dictionaryKmer <= len(sample); i++ {
+			kmer := sample[i : i+dictionaryKmer]
+			if _, ok := seen[kmer]; !ok {
+				seen[kmer] = struct{}{}
+				freq[kmer]++
+			}
+		}
+	}
+
+	covered := make(map[string]struct{})
+	score := func(chunk string) int {
+		total := 0
+		for i := 0; i+dictionaryKmer <= len(chunk); i++ {
+			kmer := chunk[i : i+dictionaryKmer]
+			if _, ok := covered[kmer]; !ok && freq[kmer] > 1 {
+				total += freq[kmer]
+			}
+		}
+		return total
+	}
+	var chunks chunkHeap
+	for _, sample := range samples {
+		for i := 0; i < len(sample); i += dictionaryChunk {
+			chunk := sample[i:min(i+dictionaryChunk, len(sample))]
+			if s := score(chunk); s > 0 {
+				chunks = append(chunks, scoredChunk{chunk, s})
+			}
+		}
+	}
+	heap.Init(&chunks)
+
+	// Scores only drop as k-mers get covered, so a chunk whose rescored
+	// value still tops the heap is the best one.
+	var picked []string
+	size := 0
+	for chunks.Len() > 0 && size < dictionaryMaxSize {
+		best := heap.Pop(&chunks).(scoredChunk)
+		s := score(best.chunk)
+		if s == 0 {
+			continue
+		}
+		if chunks.Len() > 0 && s < chunks[0].score {
+			heap.Push(&chunks, scoredChunk{best.chunk, s})
+			continue
+		}
+		picked = append(picked, best.chunk)
+		size += len(best.chunk)
+		for i := 0; i+dictionaryKmer <= len(best.chunk); i++ {
+			covered[best.chunk[i:i+dictionaryKmer]] = struct{}{}
+		}
+	}
+	if len(picked) == 0 {
+		return nil
+	}
+	dict := make([]byte, 0, size)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict[max(len(dict)-dictionaryMaxSize, 0):]
+}
+
+type scoredChunk struct {
+	chunk string
+	score int
+}
+
+// chunkHeap orders chunks by descending score.
+type chunkHeap []scoredChunk
+
+func (h chunkHeap) Len() int           { return len(h) }
+func (h chunkHeap) Less(i, j int) bool { return h[i].score > h[j].score }
+func (h chunkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x any)        { *h = append(*h, x.(scoredChunk)) }
+func (h *chunkHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// valueCompressor compresses the values of the records of one segment with
+// its dictionary.
+type valueCompressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func newValueCompressor(dict []byte) (*valueCompressor, error) {
+	c := &valueCompressor{}
+	w, err := flate.NewWriterDict(&c.buf, flate.BestCompression, dict)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	return c, nil
+}
+
+// compress replaces the value of e with its compressed form when that is
+// smaller.
+func (c *valueCompressor) compress(e *entry) error {
+	if e.value == "" {
+		return nil
+	}
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	if _, err := io.WriteString(c.w, e.value); err != nil {
+		return err
+	}
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	if c.buf.Len() < len(e.value) {
+		e.value, e.compressed = c.buf.String(), true
+	}
+	return nil
+}
+
+// writeDictionary trains a dictionary on samples and writes its record to
+// w. It returns the compressor of the values following it and the bytes
+// written, or a nil compressor when compressing the samples would not even
+// save the size of the dictionary.
+func writeDictionary(w io.Writer, samples []string) (*valueCompressor, int64, error) {
+	dict := trainDictionary(samples)
+	if dict == nil {
+		return nil, 0, nil
+	}
+	compressor, err := newValueCompressor(dict)
+	if err != nil {
+		return nil, 0, err
+	}
+	saved := 0
+	for _, sample := range samples {
+		e := entry{value: sample}
+		if err := compressor.compress(&e); err != nil {
+			return nil, 0, err
+		}
+		saved += len(sample) - len(e.value)
+	}
+	if saved <= len(dict) {
+		return nil, 0, nil
+	}
+	record := entry{dictionary: true, value: string(dict)}
+	n, err := w.Write(record.Encode())
+	return compressor, int64(n), err
+}
+
+// decompressValue restores a value compressed with dict.
+func decompressValue(dict []byte, value string) (string, error) {
+	data, err := io.ReadAll(flate.NewReaderDict(strings.NewReader(value), dict))
+	if err != nil {
+		return "", fmt.Errorf("%w: compressed value: %v", ErrCorrupted, err)
+	}
+	return string(data), nil
+}
+
+// dictionary returns the dictionary of the segment, read from its first
+// record when a compressed value is first met.
+func (s *Segment) dictionary() ([]byte, error) {
+	s.dictOnce.Do(func() {
+		e, err := s.readRecord(0)
+		switch {
+		case err != nil:
+			s.dictErr = err
+		case !e.dictionary:
+			s.dictErr = fmt.Errorf("%w: compressed value in %s without a dictionary", ErrCorrupted, s.filePath)
+		default:
+			s.dict = []byte(e.value)
+		}
+	})
+	return s.dict, s.dictErr
+}
+
+// decompress restores the value of e if it is compressed.
+func (s *Segment) decompress(e *entry) error {
+	if !e.compressed {
+		return nil
+	}
+	dict, err := s.dictionary()
+	if err != nil {
+		return err
+	}
+	if e.value, err = decompressValue(dict, e.value); err != nil {
+		return err
+	}
+	e.compressed = false
+	return nil
+}
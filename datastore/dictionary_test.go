@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id":%d,"user":"user%d","status":"active","created_at":"2024-01-%02dT10:00:00Z","tags":["alpha","beta"]}`, i, i%97, i%28+1)
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var samples []string
+	for i := 0; i < 200; i++ {
+		samples = append(samples, jsonValue(i))
+	}
+	dict := trainDictionary(samples)
+	if len(dict) == 0 || len(dict) > dictionaryMaxSize {
+		t.Fatalf("Unexpected dictionary size %d", len(dict))
+	}
+
+	compressor, err := newValueCompressor(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := jsonValue(12345)
+	e := entry{value: value}
+	if err := compressor.compress(&e); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	w, _ := flate.NewWriter(&plain, flate.BestCompression)
+	_, _ = io.WriteString(w, value)
+	_ = w.Close()
+	if !e.compressed || len(e.value)*2 > plain.Len() {
+		t.Errorf("Expected the dictionary to at least halve the size, got %d bytes against %d without", len(e.value), plain.Len())
+	}
+	if restored, err := decompressValue(dict, e.value); err != nil || restored != value {
+		t.Errorf("Expected the value back, got %q, %v", restored, err)
+	}
+
+	if dict := trainDictionary([]string{"abcdefghij", "klmnopqrst"}); dict != nil {
+		t.Errorf("Expected no dictionary for unrelated samples, got %q", dict)
+	}
+}
+
+func TestDb_ValueDictionary(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 4096, CompactionSegments: -1, ValueDictionary: true, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const keys = 300
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), jsonValue(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.Put("raw", strings.Repeat("x", 10))
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	compacted := db.segmentList()[0]
+	if first, err := compacted.readRecord(0); err != nil || !first.dictionary {
+		t.Fatalf("Expected the compacted segment to start with its dictionary, got %+v, %v", first, err)
+	}
+	// Compaction copies the commit sequences of the records as they are,
+	// the rest is compared.
+	var input, sequences int64
+	for i := 0; i < keys; i++ {
+		e := &entry{key: fmt.Sprintf("key%d", i), value: jsonValue(i)}
+		plain := e.GetLength()
+		e.sequence = uint64(i + 1)
+		input += plain
+		sequences += e.GetLength() - plain
+	}
+	if (compacted.outOffset-sequences)*2 > input {
+		t.Errorf("Expected values to compress to less than half, got %d bytes for %d", compacted.outOffset-sequences, input)
+	}
+
+	check := func(db *Db, when string) {
+		t.Helper()
+		for _, i := range []int{0, 150, keys - 1} {
+			key := fmt.Sprintf("key%d", i)
+			if value, err := db.Get(key); err != nil || value != jsonValue(i) {
+				t.Errorf("%s: unexpected %s: %q, %v", when, key, value, err)
+			}
+		}
+		records, err := db.MultiGet([]string{"key1", "key2"})
+		if err != nil || records["key1"] != jsonValue(1) || records["key2"] != jsonValue(2) {
+			t.Errorf("%s: unexpected multi get %+v, %v", when, records, err)
+		}
+	}
+	check(db, "after compaction")
+
+	// Compacting again decompresses the values and trains a new dictionary.
+	_ = db.Put("key0", jsonValue(1000))
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.Get("key0"); value != jsonValue(1000) {
+		t.Errorf("Expected the newer value, got %q", value)
+	}
+	_ = db.Put("key0", jsonValue(0))
+	check(db, "after recompaction")
+
+	if _, err := db.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	check(db, "after reindexing")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db, "after reopening")
+}
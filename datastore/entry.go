@@ -3,75 +3,281 @@ package datastore
 import (
 	"bufio"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 )
 
+// Metadata field tags. Metadata is stored after the value as a sequence of
+// (tag, length, data) fields, so records written without metadata keep the
+// original layout.
+const (
+	metaTimestamp byte = 1
+	metaTombstone byte = 2
+	metaTags      byte = 3
+	metaVersion   byte = 4
+	metaBlob      byte = 5
+	metaExpiresAt byte = 6
+	metaBatch     byte = 7
+	metaChecksum  byte = 8
+	// metaDictionary marks the record holding the compression dictionary
+	// of its segment as value, metaCompressed a value compressed with it.
+	metaDictionary byte = 9
+	metaCompressed byte = 10
+	metaSequence   byte = 11
+	// metaExpiry marks a tombstone written for a key whose value expired.
+	metaExpiry byte = 12
+)
+
+const metaHeaderSize = 3
+
+// checksumFieldSize is the size of the metadata field closing every record
+// with the CRC-32C of the bytes before its checksum. Records written before
+// checksums were added have none and are read unverified.
+const checksumFieldSize = metaHeaderSize + 4
+
+// ErrCorrupted is returned for a record whose checksum does not match its
+// bytes or whose lengths do not fit it.
+var ErrCorrupted = errors.New("corrupted record")
+
 type entry struct {
 	key, value string
+
+	// timestamp is the write time in unix nanoseconds, zero when not recorded.
+	timestamp int64
+	// deleted marks a tombstone hiding older values of the key, expired
+	// one written by the expiry sweep instead of a delete.
+	deleted bool
+	expired bool
+	tags    []string
+	// version of the key written by this record. Version 1 is not stored.
+	version uint64
+	// blob is the hex sha256 of a deduplicated value kept in the blob store
+	// instead of the record, which then has an empty value.
+	blob string
+	// expiresAt is when the record expires in unix nanoseconds, zero if it
+	// never does.
+	expiresAt int64
+	// batchRemaining is the number of records of the same atomic batch
+	// written after this one. The last record of a batch has none.
+	batchRemaining uint64
+	// dictionary marks the record holding the dictionary of its segment
+	// instead of a key. compressed marks a value compressed with it.
+	dictionary bool
+	compressed bool
+	// sequence is the commit sequence of the write, zero in records
+	// written before there was one.
+	sequence uint64
 }
 
 func GetLength(key string, value string) int64 {
-	return int64(len(key) + len(value) + 12)
+	return int64(len(key) + len(value) + 12 + checksumFieldSize)
 }
 
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
-	size := kl + vl + 12
+	meta := e.encodeMeta()
+	size := kl + vl + 12 + len(meta) + checksumFieldSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
+	copy(res[kl+vl+12:], meta)
+	field := res[size-checksumFieldSize:]
+	field[0] = metaChecksum
+	binary.LittleEndian.PutUint16(field[1:], 4)
+	binary.LittleEndian.PutUint32(field[metaHeaderSize:], crc32.Checksum(res[:size-4], metadataCRCTable))
 	return res
 }
 
 func (e *entry) GetLength() int64 {
-	return GetLength(e.key, e.value)
+	return GetLength(e.key, e.value) + int64(len(e.encodeMeta()))
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+// Decode reads the record in input, verifying its checksum if it has one.
+// A record that fails the check, or whose lengths exceed input, is left
+// undecoded and ErrCorrupted is returned.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < 12 {
+		return fmt.Errorf("%w: %d bytes", ErrCorrupted, len(input))
+	}
+	kl := uint64(binary.LittleEndian.Uint32(input[4:]))
+	if kl+12 > uint64(len(input)) {
+		return fmt.Errorf("%w: key length %d exceeds the record", ErrCorrupted, kl)
+	}
+	vl := uint64(binary.LittleEndian.Uint32(input[kl+8:]))
+	if kl+vl+12 > uint64(len(input)) {
+		return fmt.Errorf("%w: value length %d exceeds the record", ErrCorrupted, vl)
+	}
+	meta := input[kl+12+vl:]
+	if err := verifyChecksum(input, meta); err != nil {
+		return err
+	}
+
 	keyBuf := make([]byte, kl)
 	copy(keyBuf, input[8:kl+8])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
 	valBuf := make([]byte, vl)
 	copy(valBuf, input[kl+12:kl+12+vl])
 	e.value = string(valBuf)
+
+	e.decodeMeta(meta)
+	return nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
-	if err != nil {
-		return "", err
+// verifyChecksum checks the record against the checksum field closing its
+// metadata, if there is one. Every tag this version writes is known, so an
+// unknown tag or bytes left over are damage too; a bit flipped in the tag of
+// the checksum field must not make the record pass as one without it.
+func verifyChecksum(input, meta []byte) error {
+	for len(meta) >= metaHeaderSize {
+		tag := meta[0]
+		fl := int(binary.LittleEndian.Uint16(meta[1:]))
+		if len(meta) < metaHeaderSize+fl {
+			return fmt.Errorf("%w: metadata field exceeds the record", ErrCorrupted)
+		}
+		if tag == 0 || tag > metaExpiry {
+			return fmt.Errorf("%w: unknown metadata tag %d", ErrCorrupted, tag)
+		}
+		if tag == metaChecksum {
+			if fl != 4 || len(meta) != checksumFieldSize {
+				return fmt.Errorf("%w: misplaced checksum", ErrCorrupted)
+			}
+			covered := len(input) - 4
+			if crc32.Checksum(input[:covered], metadataCRCTable) != binary.LittleEndian.Uint32(input[covered:]) {
+				return fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+			}
+			return nil
+		}
+		meta = meta[metaHeaderSize+fl:]
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
-	if err != nil {
-		return "", err
+	if len(meta) > 0 {
+		return fmt.Errorf("%w: trailing metadata bytes", ErrCorrupted)
 	}
+	return nil
+}
 
-	header, err = in.Peek(4)
-	if err != nil {
-		return "", err
+func (e *entry) encodeMeta() []byte {
+	var meta []byte
+	if e.timestamp != 0 {
+		meta = appendMetaField(meta, metaTimestamp, binary.LittleEndian.AppendUint64(nil, uint64(e.timestamp)))
+	}
+	if e.deleted {
+		meta = appendMetaField(meta, metaTombstone, nil)
 	}
-	valSize := int(binary.LittleEndian.Uint32(header))
-	_, err = in.Discard(4)
+	if len(e.tags) > 0 {
+		meta = appendMetaField(meta, metaTags, encodeTags(e.tags))
+	}
+	if e.version > 1 {
+		meta = appendMetaField(meta, metaVersion, binary.AppendUvarint(nil, e.version))
+	}
+	if e.blob != "" {
+		hash, _ := hex.DecodeString(e.blob)
+		meta = appendMetaField(meta, metaBlob, hash)
+	}
+	if e.expiresAt != 0 {
+		meta = appendMetaField(meta, metaExpiresAt, binary.LittleEndian.AppendUint64(nil, uint64(e.expiresAt)))
+	}
+	if e.batchRemaining > 0 {
+		meta = appendMetaField(meta, metaBatch, binary.AppendUvarint(nil, e.batchRemaining))
+	}
+	if e.dictionary {
+		meta = appendMetaField(meta, metaDictionary, nil)
+	}
+	if e.compressed {
+		meta = appendMetaField(meta, metaCompressed, nil)
+	}
+	if e.sequence > 0 {
+		meta = appendMetaField(meta, metaSequence, binary.AppendUvarint(nil, e.sequence))
+	}
+	if e.deleted && e.expired {
+		meta = appendMetaField(meta, metaExpiry, nil)
+	}
+	return meta
+}
+
+func (e *entry) decodeMeta(meta []byte) {
+	e.version = 1
+	for len(meta) >= metaHeaderSize {
+		tag := meta[0]
+		fl := int(binary.LittleEndian.Uint16(meta[1:]))
+		if len(meta) < metaHeaderSize+fl {
+			return
+		}
+		data := meta[metaHeaderSize : metaHeaderSize+fl]
+		switch tag {
+		case metaTimestamp:
+			if len(data) == 8 {
+				e.timestamp = int64(binary.LittleEndian.Uint64(data))
+			}
+		case metaTombstone:
+			e.deleted = true
+		case metaTags:
+			e.tags = decodeTags(data)
+		case metaVersion:
+			if version, n := binary.Uvarint(data); n > 0 {
+				e.version = version
+			}
+		case metaBlob:
+			e.blob = hex.EncodeToString(data)
+		case metaExpiresAt:
+			if len(data) == 8 {
+				e.expiresAt = int64(binary.LittleEndian.Uint64(data))
+			}
+		case metaBatch:
+			if remaining, n := binary.Uvarint(data); n > 0 {
+				e.batchRemaining = remaining
+			}
+		case metaDictionary:
+			e.dictionary = true
+		case metaCompressed:
+			e.compressed = true
+		case metaSequence:
+			if sequence, n := binary.Uvarint(data); n > 0 {
+				e.sequence = sequence
+			}
+		case metaExpiry:
+			e.expired = true
+		}
+		meta = meta[metaHeaderSize+fl:]
+	}
+}
+
+func appendMetaField(meta []byte, tag byte, data []byte) []byte {
+	meta = append(meta, tag)
+	meta = binary.LittleEndian.AppendUint16(meta, uint16(len(data)))
+	return append(meta, data...)
+}
+
+func readValue(in *bufio.Reader) (string, error) {
+	e, err := readEntry(in)
 	if err != nil {
 		return "", err
 	}
+	return e.value, nil
+}
 
-	data := make([]byte, valSize)
-	n, err := in.Read(data)
+func readEntry(in *bufio.Reader) (entry, error) {
+	var e entry
+	header, err := in.Peek(4)
 	if err != nil {
-		return "", err
+		return e, err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < 12 {
+		return e, fmt.Errorf("bad record size %d", size)
 	}
 
-	return string(data), nil
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return e, fmt.Errorf("can't read record bytes: %w", err)
+	}
+	err = e.Decode(data)
+	return e, err
 }
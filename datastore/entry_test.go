@@ -3,11 +3,13 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"recordKey", "value"}
+	e := entry{key: "recordKey", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "recordKey" {
 		t.Error("incorrect recordKey")
@@ -18,7 +20,7 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"recordKey", "test-value"}
+	e := entry{key: "recordKey", value: "test-value"}
 	data := e.Encode()
 	v, err := readValue(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -28,3 +30,32 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Got bat value [%s]", v)
 	}
 }
+
+func TestEntry_Checksum(t *testing.T) {
+	e := entry{key: "recordKey", value: "value", version: 3, tags: []string{"tag"}}
+	data := e.Encode()
+	if int64(len(data)) != e.GetLength() {
+		t.Errorf("Expected %d encoded bytes, got %d", e.GetLength(), len(data))
+	}
+
+	// Every flipped bit is caught, the lengths and the checksum included.
+	for i := range data {
+		corrupted := bytes.Clone(data)
+		corrupted[i] ^= 0x10
+		var decoded entry
+		if err := decoded.Decode(corrupted); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("Expected ErrCorrupted for a bit flipped in byte %d, got %v", i, err)
+		}
+	}
+	if _, err := readEntry(bufio.NewReader(bytes.NewReader(data[:len(data)-1]))); err == nil {
+		t.Error("Expected an error for a record cut short")
+	}
+
+	// Records written before checksums are read unverified.
+	legacy := data[:len(data)-checksumFieldSize]
+	binary.LittleEndian.PutUint32(legacy, uint32(len(legacy)))
+	var decoded entry
+	if err := decoded.Decode(legacy); err != nil || decoded.key != "recordKey" || decoded.version != 3 {
+		t.Errorf("Expected the record without a checksum to decode, got %+v, %v", decoded, err)
+	}
+}
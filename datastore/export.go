@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExportFormat is the encoding of an export.
+type ExportFormat string
+
+const (
+	// ExportNDJSON writes a {"key","value","version","encoding"} object per
+	// line.
+	ExportNDJSON ExportFormat = "ndjson"
+	// ExportCSV writes a key,value,version,encoding header and a row per
+	// record.
+	ExportCSV ExportFormat = "csv"
+)
+
+// exportBase64 is the encoding of the values an export can't carry as
+// text, invalid UTF-8, which JSON replaces, and carriage returns, which CSV
+// readers drop. Other values have no encoding.
+const exportBase64 = "base64"
+
+// ParseExportFormat parses "ndjson" or "csv".
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch f := ExportFormat(s); f {
+	case ExportNDJSON, ExportCSV:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %q", s)
+}
+
+type exportRecord struct {
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Version  uint64 `json:"version"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func newExportRecord(key string, record Record) exportRecord {
+	if utf8.ValidString(record.Value) && !strings.ContainsRune(record.Value, '\r') {
+		return exportRecord{Key: key, Value: record.Value, Version: record.Version}
+	}
+	value := base64.StdEncoding.EncodeToString([]byte(record.Value))
+	return exportRecord{Key: key, Value: value, Version: record.Version, Encoding: exportBase64}
+}
+
+// decodeValue returns the value of an exported record, for Import.
+func decodeValue(value, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return value, nil
+	case exportBase64:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", err
+		}
+		return string(decoded), nil
+	}
+	return "", fmt.Errorf("unknown value encoding %q", encoding)
+}
+
+// Export writes the live records to w in key order, for migrations and
+// offline analysis. Values are read a page of keys at a time, so only one
+// page is held in memory. Like a KeyIterator, it may or may not see the
+// writes made while it runs.
+func (db *Db) Export(w io.Writer, format ExportFormat) error {
+	var write func(record exportRecord) error
+	flush := func() error { return nil }
+	switch format {
+	case ExportNDJSON:
+		encoder := json.NewEncoder(w)
+		write = func(record exportRecord) error { return encoder.Encode(record) }
+	case ExportCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"key", "value", "version", "encoding"}); err != nil {
+			return err
+		}
+		write = func(record exportRecord) error {
+			return writer.Write([]string{record.Key, record.Value, strconv.FormatUint(record.Version, 10), record.Encoding})
+		}
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+
+	for after := ""; ; {
+		page := db.Keys("", after, iteratorPageSize)
+		records, err := db.MultiGetRecords(page.Keys)
+		if err != nil {
+			return err
+		}
+		for _, key := range page.Keys {
+			// Keys deleted or expired after the listing are left out.
+			if record, found := records[key]; found {
+				if err := write(newExportRecord(key, record)); err != nil {
+					return err
+				}
+			}
+		}
+		if page.Next == "" {
+			return flush()
+		}
+		after = page.Next
+	}
+}
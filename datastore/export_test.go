@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestDb_Export(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 4096, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// More keys than a page, so the export reads several.
+	for i := 0; i < iteratorPageSize+10; i++ {
+		if err := db.Put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.Put("key00001", `a "quoted", value`)
+	_ = db.Delete("key00002")
+	live := iteratorPageSize + 9
+
+	var out bytes.Buffer
+	if err := db.Export(&out, ExportNDJSON); err != nil {
+		t.Fatal(err)
+	}
+	var records []exportRecord
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != live || records[0].Key != "key00000" || records[1] != (exportRecord{Key: "key00001", Value: `a "quoted", value`, Version: 2}) {
+		t.Errorf("Unexpected export of %d records starting with %+v", len(records), records[:2])
+	}
+	if records[2].Key != "key00003" {
+		t.Errorf("Expected the deleted key to be left out, got %+v", records[2])
+	}
+
+	out.Reset()
+	if err := db.Export(&out, ExportCSV); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != live+1 || rows[0][0] != "key" || rows[2][1] != `a "quoted", value` || rows[2][2] != "2" {
+		t.Errorf("Unexpected CSV export of %d rows starting with %v", len(rows), rows[:3])
+	}
+
+	if err := db.Export(&out, "xml"); err == nil {
+		t.Error("Expected an unknown format to fail")
+	}
+	if _, err := ParseExportFormat("csv"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,354 @@
+package datastore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Filesystem is the file access used by the database for segments, the
+// manifest and its other files.
+type Filesystem interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	// SyncDir flushes the entries of a directory, so files created, renamed
+	// or removed in it stay that way after a power loss.
+	SyncDir(path string) error
+}
+
+// File is an open file of a Filesystem.
+type File interface {
+	io.ReadWriteSeeker
+	io.Closer
+	Sync() error
+	Stat() (fs.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// OSFilesystem is the Filesystem of the operating system.
+type OSFilesystem struct{}
+
+func (OSFilesystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFilesystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (OSFilesystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (OSFilesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (OSFilesystem) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFilesystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFilesystem) SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// readOnlyFilesystem fails every change to the files of a database
+// opened with ReadOnly, so none can slip through.
+type readOnlyFilesystem struct {
+	Filesystem
+}
+
+func (r readOnlyFilesystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, ErrReadOnly
+	}
+	return r.Filesystem.OpenFile(name, flag, perm)
+}
+
+func (readOnlyFilesystem) WriteFile(string, []byte, fs.FileMode) error { return ErrReadOnly }
+func (readOnlyFilesystem) MkdirAll(string, fs.FileMode) error          { return ErrReadOnly }
+func (readOnlyFilesystem) Rename(string, string) error                 { return ErrReadOnly }
+func (readOnlyFilesystem) Remove(string) error                         { return ErrReadOnly }
+func (readOnlyFilesystem) SyncDir(string) error                        { return nil }
+
+func openFile(fsys Filesystem, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// MemFilesystem keeps files in memory. Directories are implied by the file
+// paths, so every directory exists.
+//
+// Crash simulates a power loss: directory entries changed since the last
+// SyncDir of their directory are rolled back. File contents are kept.
+type MemFilesystem struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	// synced are the files as of the last SyncDir of their directory.
+	synced map[string]*memData
+}
+
+type memData struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func NewMemFilesystem() *MemFilesystem {
+	return &MemFilesystem{files: make(map[string]*memData), synced: make(map[string]*memData)}
+}
+
+func (m *MemFilesystem) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, found := m.files[name]
+	switch {
+	case found && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !found && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !found:
+		data = &memData{}
+		m.files[name] = data
+	}
+	if flag&os.O_TRUNC != 0 {
+		data.mu.Lock()
+		data.data = nil
+		data.mu.Unlock()
+	}
+	return &memFile{name: name, data: data, flag: flag}, nil
+}
+
+func (m *MemFilesystem) ReadFile(name string) ([]byte, error) {
+	file, err := openFile(m, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (m *MemFilesystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	file, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	return err
+}
+
+func (m *MemFilesystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []fs.DirEntry
+	for path, data := range m.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(data.info(filepath.Base(path))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFilesystem) MkdirAll(string, fs.FileMode) error {
+	return nil
+}
+
+func (m *MemFilesystem) Rename(oldpath, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, found := m.files[oldpath]
+	if !found {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	return nil
+}
+
+func (m *MemFilesystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, found := m.files[name]; !found {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *MemFilesystem) SyncDir(path string) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name := range m.synced {
+		if filepath.Dir(name) == path {
+			delete(m.synced, name)
+		}
+	}
+	for name, data := range m.files {
+		if filepath.Dir(name) == path {
+			m.synced[name] = data
+		}
+	}
+	return nil
+}
+
+// Crash restores the directory entries to their state at the last SyncDir
+// of every directory. Files never synced into a directory are lost.
+func (m *MemFilesystem) Crash() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files = make(map[string]*memData, len(m.synced))
+	for name, data := range m.synced {
+		m.files[name] = data
+	}
+}
+
+// Size returns the size of the file, or -1 when it does not exist.
+func (m *MemFilesystem) Size(name string) int64 {
+	m.mu.Lock()
+	data, found := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+	if !found {
+		return -1
+	}
+	return data.info("").Size()
+}
+
+func (d *memData) info(name string) memFileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memFileInfo{name: name, size: int64(len(d.data))}
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if f.offset >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.data.data)) {
+		f.data.data = append(f.data.data, make([]byte, end-int64(len(f.data.data)))...)
+	}
+	copy(f.data.data[f.offset:], p)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if size < int64(len(f.data.data)) {
+		f.data.data = f.data.data[:size]
+	} else {
+		f.data.data = append(f.data.data, make([]byte, size-int64(len(f.data.data)))...)
+	}
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return f.data.info(filepath.Base(f.name)), nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return 0o600 }
+func (i memFileInfo) ModTime() time.Time { return time.Time{} }
+func (i memFileInfo) IsDir() bool        { return false }
+func (i memFileInfo) Sys() any           { return nil }
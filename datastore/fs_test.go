@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemFilesystem(t *testing.T) {
+	fsys := NewMemFilesystem()
+	path := filepath.Join("dir", "file")
+
+	if _, err := openFile(fsys, path); !os.IsNotExist(err) {
+		t.Fatalf("Expected a not-exist error, got %v", err)
+	}
+
+	for _, part := range []string{"abc", "def"} {
+		file, err := fsys.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+	}
+
+	file, err := openFile(fsys, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(2, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(file)
+	if string(data) != "cdef" {
+		t.Errorf("Unexpected content %q", data)
+	}
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Error("Expected writes to a read-only file to fail")
+	}
+
+	if err := fsys.Rename(path, filepath.Join("dir", "renamed")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := fsys.ReadDir("dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "renamed" {
+		t.Errorf("Unexpected directory listing %v (err: %v)", entries, err)
+	}
+	if size := fsys.Size(filepath.Join("dir", "renamed")); size != 6 {
+		t.Errorf("Expected size 6, got %d", size)
+	}
+}
+
+func TestMemFilesystem_Crash(t *testing.T) {
+	fsys := NewMemFilesystem()
+	if err := fsys.WriteFile(filepath.Join("dir", "synced"), []byte("a"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.SyncDir("dir"); err != nil {
+		t.Fatal(err)
+	}
+	_ = fsys.WriteFile(filepath.Join("dir", "new"), []byte("b"), 0o600)
+	_ = fsys.Rename(filepath.Join("dir", "synced"), filepath.Join("dir", "renamed"))
+
+	fsys.Crash()
+
+	if data, err := fsys.ReadFile(filepath.Join("dir", "synced")); err != nil || string(data) != "a" {
+		t.Errorf("Expected the synced file to survive the crash, got %q (err: %v)", data, err)
+	}
+	for _, name := range []string{"new", "renamed"} {
+		if _, err := openFile(fsys, filepath.Join("dir", name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be lost in the crash, got %v", name, err)
+		}
+	}
+}
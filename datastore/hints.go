@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// hintSuffix names the startup hint kept next to a sealed segment.
+const hintSuffix = ".hint"
+
+// hintEntry is the indexed record of a key in a startup hint. Unlike the
+// hints served to other nodes it carries everything recovery takes from a
+// record, the tags included.
+type hintEntry struct {
+	Key       string   `json:"key"`
+	Offset    int64    `json:"offset"`
+	Size      int64    `json:"size"`
+	Deleted   bool     `json:"deleted,omitempty"`
+	Version   uint64   `json:"version"`
+	Blob      string   `json:"blob,omitempty"`
+	ExpiresAt int64    `json:"expires_at,omitempty"`
+	WrittenAt int64    `json:"written_at,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// writeHint scans a sealed segment once and stores its index in a hint
+// file, so opening the database loads the index without reading the
+// segment. The hint is framed and checksummed like the manifest.
+func (db *Db) writeHint(segmentPath string) error {
+	file, err := openFile(db.fs, segmentPath)
+	if err != nil {
+		return err
+	}
+	scanned := &Segment{index: make(hashIndex)}
+	tags := make(map[string][]string)
+	_, err = scanned.recover(file, func(e *entry) {
+		tags[e.key] = e.tags
+	})
+	file.Close()
+	if err != io.EOF {
+		return err
+	}
+
+	entries := hintEntries(scanned.index)
+	for i := range entries {
+		entries[i].Tags = tags[entries[i].Key]
+	}
+
+	var payload bytes.Buffer
+	encoder := json.NewEncoder(&payload)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	data, err := encodeMetadata(payload.Bytes(), db.compressMetadata)
+	if err != nil {
+		return err
+	}
+	hintPath := segmentPath + hintSuffix
+	tmpPath := hintPath + ".tmp"
+	if err := writeSyncedFile(db.fs, tmpPath, data, db.syncDirs); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, hintPath); err != nil {
+		return err
+	}
+	// A compaction may have removed the segment while it was scanned, and
+	// its hint before this one was in place.
+	file, err = openFile(db.fs, segmentPath)
+	if err != nil {
+		_ = db.fs.Remove(hintPath)
+		return err
+	}
+	file.Close()
+	return db.syncDir(db.directory)
+}
+
+// writeHintInBackground writes the hint of a sealed segment without holding
+// up the caller. A hint that fails to be written only costs a scan of the
+// segment on the next open.
+func (db *Db) writeHintInBackground(segmentPath string) {
+	db.hintWrites.Add(1)
+	go func() {
+		defer db.hintWrites.Done()
+		_ = db.writeHint(segmentPath)
+	}()
+}
+
+// loadHint fills the index of a sealed segment from its hint and passes the
+// tags of the indexed records to onEntry. It reports false, leaving the
+// segment untouched, when the hint is missing, damaged or does not end
+// where the segment file does; the segment must then be scanned.
+func (s *Segment) loadHint(onEntry func(e *entry)) bool {
+	data, err := s.fs.ReadFile(s.filePath + hintSuffix)
+	if err != nil {
+		return false
+	}
+	payload, err := decodeMetadata(data)
+	if err != nil {
+		return false
+	}
+	var entries []hintEntry
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	for decoder.More() {
+		var entry hintEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return false
+		}
+		entries = append(entries, entry)
+	}
+
+	index, end := hintIndex(entries)
+	if size, err := fileSize(s.fs, s.filePath); err != nil || size != end {
+		return false
+	}
+
+	s.index, s.outOffset = index, end
+	if onEntry != nil {
+		for _, hint := range entries {
+			onEntry(&entry{key: hint.Key, deleted: hint.Deleted, tags: hint.Tags})
+		}
+	}
+	return true
+}
+
+// hintEntries lists the index ordered by offset.
+func hintEntries(index hashIndex) []hintEntry {
+	entries := make([]hintEntry, 0, len(index))
+	for key, pos := range index {
+		entries = append(entries, hintEntry{
+			Key:       key,
+			Offset:    pos.offset,
+			Size:      pos.size,
+			Deleted:   pos.deleted,
+			Version:   pos.version,
+			Blob:      pos.blob,
+			ExpiresAt: pos.expiresAt,
+			WrittenAt: pos.writtenAt,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	return entries
+}
+
+// hintIndex builds an index from hint entries and returns it with the end
+// of the last record. The last record of a segment is always indexed.
+func hintIndex(entries []hintEntry) (hashIndex, int64) {
+	index := make(hashIndex, len(entries))
+	var end int64
+	for _, entry := range entries {
+		index[entry.Key] = recordPosition{
+			offset:    entry.Offset,
+			size:      entry.Size,
+			deleted:   entry.Deleted,
+			version:   entry.Version,
+			blob:      entry.Blob,
+			expiresAt: entry.ExpiresAt,
+			writtenAt: entry.WrittenAt,
+		}
+		end = max(end, entry.Offset+entry.Size)
+	}
+	return index, end
+}
+
+func fileSize(fsys Filesystem, path string) (int64, error) {
+	file, err := openFile(fsys, path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
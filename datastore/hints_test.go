@@ -0,0 +1,108 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_Hints(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 200, Clock: clock, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.PutWithTags("tagged", "value", []string{"red"})
+	_ = db.PutWithTTL("expiring", "value", time.Minute)
+	_ = db.Put("victim", "value")
+	_ = db.Put("deleted", "value")
+	_ = db.Delete("deleted")
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	sealed := db.segmentList()[0].filePath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(sealed + hintSuffix); err != nil {
+		t.Fatalf("Expected a hint for the sealed segment: %v", err)
+	}
+
+	// A flipped value goes unnoticed when the index comes from the hint,
+	// proving the segment is not scanned.
+	_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+	data, _ := fs.ReadFile(sealed)
+	data[bytes.Index(data, []byte("victim"))+len("victim")+4] ^= 0x01
+	_ = fs.WriteFile(sealed, data, 0o600)
+
+	clock.Advance(time.Minute)
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Expected the segment to be loaded from its hint, got %v", err)
+	}
+	if keys := db.FindByTag("red"); !reflect.DeepEqual(keys, []string{"tagged"}) {
+		t.Errorf("Expected the tags from the hint, got %v", keys)
+	}
+	for _, key := range []string{"expiring", "deleted"} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Errorf("Expected %s to be missing, got %v", key, err)
+		}
+	}
+	if value, err := db.Get("tagged"); err != nil || value != "value" {
+		t.Errorf("Expected the value located by the hint, got %q, %v", value, err)
+	}
+	if _, err := db.Get("victim"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected the corrupted record to fail its read, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the hint the segment is scanned again.
+	_ = fs.Remove(sealed + hintSuffix)
+	_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+	if _, err := Open("db", opts); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected the scan to find the corrupted record, got %v", err)
+	}
+}
+
+func TestDb_DamagedHint(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 200, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	sealed := db.segmentList()[0].filePath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	hint, _ := fs.ReadFile(sealed + hintSuffix)
+	_ = fs.WriteFile(sealed+hintSuffix, hint[:len(hint)/2], 0o600)
+	_ = fs.Remove(filepath.Join("db", indexSnapshotFileName))
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value" {
+		t.Errorf("Expected the segment to be scanned instead, got %q, %v", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The scan replaced the damaged hint.
+	segment := &Segment{filePath: sealed, fs: fs}
+	if !segment.loadHint(nil) || segment.index["key0"].size == 0 {
+		t.Error("Expected a rewritten hint")
+	}
+}
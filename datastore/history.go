@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type OpKind int
+
+const (
+	OpPut OpKind = iota
+	OpGet
+	OpDelete
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpPut:
+		return "put"
+	case OpGet:
+		return "get"
+	case OpDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// Operation is a completed call recorded in a History. Call and Return are
+// logical timestamps: an operation happened before another one if it
+// returned before the other was called.
+type Operation struct {
+	Kind  OpKind
+	Key   string
+	Value string
+	// Found tells whether a get observed a value.
+	Found bool
+
+	Call, Return int64
+}
+
+func (op Operation) String() string {
+	switch {
+	case op.Kind == OpGet && !op.Found:
+		return fmt.Sprintf("get(%q) -> not found [%d, %d]", op.Key, op.Call, op.Return)
+	case op.Kind == OpGet:
+		return fmt.Sprintf("get(%q) -> %q [%d, %d]", op.Key, op.Value, op.Call, op.Return)
+	case op.Kind == OpPut:
+		return fmt.Sprintf("put(%q, %q) [%d, %d]", op.Key, op.Value, op.Call, op.Return)
+	}
+	return fmt.Sprintf("%s(%q) [%d, %d]", op.Kind, op.Key, op.Call, op.Return)
+}
+
+// History records the successful Put, Delete and Get calls of a database so
+// a concurrent test can check them for linearizability afterwards. Failed
+// writes did not take effect and are left out.
+type History struct {
+	clock atomic.Int64
+
+	mu  sync.Mutex
+	ops []Operation
+}
+
+// EnableHistory makes the database record its operations. It is a test hook:
+// recording slows every call down and keeps all operations in memory. It
+// must be called before the database is used concurrently.
+func (db *Db) EnableHistory() *History {
+	db.history = &History{}
+	return db.history
+}
+
+func (h *History) begin() int64 {
+	return h.clock.Add(1)
+}
+
+func (h *History) end(op Operation) {
+	op.Return = h.clock.Add(1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ops = append(h.ops, op)
+}
+
+// Operations returns the recorded operations in the order they returned.
+func (h *History) Operations() []Operation {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Operation(nil), h.ops...)
+}
+
+// Check verifies that the recorded history is linearizable.
+func (h *History) Check() error {
+	return CheckLinearizable(h.Operations())
+}
+
+// CheckLinearizable verifies that the operations can be ordered so that
+// every operation takes effect at some point between its call and return,
+// and every get observes the latest preceding put or delete of its key.
+// Keys are independent registers, so they are checked one by one.
+func CheckLinearizable(ops []Operation) error {
+	byKey := make(map[string][]Operation)
+	for _, op := range ops {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyOps := byKey[key]
+		sort.Slice(keyOps, func(i, j int) bool {
+			return keyOps[i].Call < keyOps[j].Call
+		})
+		if !newRegisterCheck(keyOps).search(registerState{}) {
+			var lines []string
+			for _, op := range keyOps {
+				lines = append(lines, "  "+op.String())
+			}
+			return fmt.Errorf("history of key %q is not linearizable:\n%s", key, strings.Join(lines, "\n"))
+		}
+	}
+	return nil
+}
+
+type registerState struct {
+	exists bool
+	value  string
+}
+
+// registerCheck is a depth-first search over the linearization orders of a
+// single key, pruning states that were already explored.
+type registerCheck struct {
+	ops       []Operation
+	done      []bool
+	remaining int
+	visited   map[string]bool
+}
+
+func newRegisterCheck(ops []Operation) *registerCheck {
+	return &registerCheck{
+		ops:       ops,
+		done:      make([]bool, len(ops)),
+		remaining: len(ops),
+		visited:   make(map[string]bool),
+	}
+}
+
+func (c *registerCheck) search(state registerState) bool {
+	if c.remaining == 0 {
+		return true
+	}
+	memoKey := c.memoKey(state)
+	if c.visited[memoKey] {
+		return false
+	}
+
+	// Only operations called before the earliest pending return can be
+	// linearized next.
+	var earliestReturn int64 = math.MaxInt64
+	for i, op := range c.ops {
+		if !c.done[i] && op.Return < earliestReturn {
+			earliestReturn = op.Return
+		}
+	}
+	for i, op := range c.ops {
+		if c.done[i] || op.Call > earliestReturn {
+			continue
+		}
+		next, ok := applyOperation(state, op)
+		if !ok {
+			continue
+		}
+		c.done[i] = true
+		c.remaining--
+		if c.search(next) {
+			return true
+		}
+		c.done[i] = false
+		c.remaining++
+	}
+	c.visited[memoKey] = true
+	return false
+}
+
+func (c *registerCheck) memoKey(state registerState) string {
+	var b strings.Builder
+	for _, done := range c.done {
+		if done {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	if state.exists {
+		b.WriteString("+" + state.value)
+	}
+	return b.String()
+}
+
+func applyOperation(state registerState, op Operation) (registerState, bool) {
+	switch op.Kind {
+	case OpPut:
+		return registerState{exists: true, value: op.Value}, true
+	case OpDelete:
+		return registerState{}, true
+	default:
+		return state, op.Found == state.exists && (!op.Found || op.Value == state.value)
+	}
+}
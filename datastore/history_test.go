@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestDb_LinearizableHistory(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 256, CacheSize: 4, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	history := db.EnableHistory()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(worker)))
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("k%d", rnd.Intn(3))
+				switch rnd.Intn(4) {
+				case 0, 1:
+					_, _ = db.Get(key)
+				case 2:
+					_ = db.Put(key, fmt.Sprintf("w%d-%d", worker, i))
+				case 3:
+					_ = db.Delete(key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	db.compactions.Wait()
+
+	if n := len(history.Operations()); n != 8*50 {
+		t.Fatalf("Expected 400 recorded operations, got %d", n)
+	}
+	if err := history.Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	t.Run("concurrent operations may take effect in any order", func(t *testing.T) {
+		ops := []Operation{
+			{Kind: OpPut, Key: "a", Value: "1", Call: 1, Return: 4},
+			{Kind: OpPut, Key: "a", Value: "2", Call: 2, Return: 5},
+			{Kind: OpGet, Key: "a", Value: "1", Found: true, Call: 3, Return: 6},
+		}
+		if err := CheckLinearizable(ops); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("stale read", func(t *testing.T) {
+		ops := []Operation{
+			{Kind: OpPut, Key: "a", Value: "1", Call: 1, Return: 2},
+			{Kind: OpPut, Key: "a", Value: "2", Call: 3, Return: 4},
+			{Kind: OpGet, Key: "a", Value: "1", Found: true, Call: 5, Return: 6},
+		}
+		if err := CheckLinearizable(ops); err == nil {
+			t.Error("Expected a stale read to be reported")
+		}
+	})
+
+	t.Run("read of a deleted key", func(t *testing.T) {
+		ops := []Operation{
+			{Kind: OpPut, Key: "a", Value: "1", Call: 1, Return: 2},
+			{Kind: OpDelete, Key: "a", Call: 3, Return: 4},
+			{Kind: OpGet, Key: "a", Value: "1", Found: true, Call: 5, Return: 6},
+			{Kind: OpGet, Key: "b", Call: 5, Return: 6},
+		}
+		if err := CheckLinearizable(ops); err == nil {
+			t.Error("Expected a read of a deleted key to be reported")
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	sketchDepth        = 4
+	sketchWidth        = 2048
+	hotKeysCapacity    = 128
+	defaultAccessDecay = time.Minute
+)
+
+// KeyAccess is the approximate access frequency of a key.
+type KeyAccess struct {
+	Key string `json:"key"`
+	// Count is the decayed number of accesses.
+	Count uint32 `json:"count"`
+	// Rate estimates accesses per second.
+	Rate float64 `json:"rate"`
+}
+
+// accessTracker counts key reads in a count-min sketch and keeps the
+// heaviest keys as top candidates. All counters are halved every decay
+// interval, so the counts follow the recent access rate.
+type accessTracker struct {
+	decay  time.Duration
+	clock  Clock
+	hasher KeyHasher
+
+	mu        sync.Mutex
+	sketch    [sketchDepth][sketchWidth]uint32
+	top       map[string]uint32
+	lastDecay time.Time
+}
+
+func newAccessTracker(decay time.Duration, clock Clock, hasher KeyHasher) *accessTracker {
+	if decay <= 0 {
+		decay = defaultAccessDecay
+	}
+	return &accessTracker{
+		decay:     decay,
+		clock:     clock,
+		hasher:    hasher,
+		top:       make(map[string]uint32),
+		lastDecay: clock.Now(),
+	}
+}
+
+func (t *accessTracker) record(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decayIfDue()
+
+	slots := sketchSlots(t.hasher.HashKey(key))
+	estimate := ^uint32(0)
+	for row := range t.sketch {
+		estimate = min(estimate, t.sketch[row][slots[row]])
+	}
+	estimate++
+	// Conservative update: only raise counters that are below the new estimate.
+	for row, slot := range slots {
+		if t.sketch[row][slot] < estimate {
+			t.sketch[row][slot] = estimate
+		}
+	}
+
+	if _, found := t.top[key]; found || len(t.top) < hotKeysCapacity {
+		t.top[key] = estimate
+		return
+	}
+	coldest, coldestCount := "", ^uint32(0)
+	for candidate, count := range t.top {
+		if count < coldestCount {
+			coldest, coldestCount = candidate, count
+		}
+	}
+	if estimate > coldestCount {
+		delete(t.top, coldest)
+		t.top[key] = estimate
+	}
+}
+
+func (t *accessTracker) hottest(n int) []KeyAccess {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.decayIfDue()
+
+	hot := make([]KeyAccess, 0, len(t.top))
+	for key, count := range t.top {
+		hot = append(hot, KeyAccess{
+			Key:   key,
+			Count: count,
+			// Halving every interval keeps a steady count around 1.5x the
+			// accesses of one interval.
+			Rate: float64(count) / (1.5 * t.decay.Seconds()),
+		})
+	}
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Count != hot[j].Count {
+			return hot[i].Count > hot[j].Count
+		}
+		return hot[i].Key < hot[j].Key
+	})
+	if n > 0 && len(hot) > n {
+		hot = hot[:n]
+	}
+	return hot
+}
+
+func (t *accessTracker) decayIfDue() {
+	for t.clock.Now().Sub(t.lastDecay) >= t.decay {
+		for row := range t.sketch {
+			for slot := range t.sketch[row] {
+				t.sketch[row][slot] /= 2
+			}
+		}
+		for key, count := range t.top {
+			if count /= 2; count == 0 {
+				delete(t.top, key)
+			} else {
+				t.top[key] = count
+			}
+		}
+		t.lastDecay = t.lastDecay.Add(t.decay)
+	}
+}
+
+// sketchSlots derives the slot of every sketch row from the two halves of
+// one key hash.
+func sketchSlots(hash uint64) [sketchDepth]uint32 {
+	h1, h2 := uint32(hash), uint32(hash>>32)
+	var slots [sketchDepth]uint32
+	for row := range slots {
+		slots[row] = (h1 + uint32(row)*h2) % sketchWidth
+	}
+	return slots
+}
+
+// HotKeys returns up to n most frequently read keys, hottest first. It is
+// empty unless Options.TrackAccess is set.
+func (db *Db) HotKeys(n int) []KeyAccess {
+	if db.access == nil {
+		return nil
+	}
+	return db.access.hottest(n)
+}
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_HotKeys(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-hot-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewFakeClock(time.Now())
+	db, err := Open(dir, Options{SegmentSize: 1024, TrackAccess: true, AccessDecay: 100 * time.Millisecond, Clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	reads := map[string]int{"hot": 30, "warm": 10, "cold": 1}
+	for key, n := range reads {
+		_ = db.Put(key, "value")
+		for i := 0; i < n; i++ {
+			_, _ = db.Get(key)
+		}
+	}
+
+	hot := db.HotKeys(2)
+	if len(hot) != 2 || hot[0].Key != "hot" || hot[1].Key != "warm" {
+		t.Fatalf("Unexpected hot keys %+v", hot)
+	}
+	if hot[0].Count != 30 || hot[0].Rate <= 0 {
+		t.Errorf("Unexpected access estimate %+v", hot[0])
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	if hot := db.HotKeys(0); len(hot) != 2 || hot[0].Count != 15 {
+		t.Errorf("Expected counts to be halved and cold keys dropped, got %+v", hot)
+	}
+}
+
+func TestAccessTracker_TopCandidates(t *testing.T) {
+	tracker := newAccessTracker(time.Hour, systemClock{}, RandomSipHasher())
+	for i := 0; i < hotKeysCapacity+50; i++ {
+		tracker.record(string(rune('a' + i)))
+	}
+	for i := 0; i < 5; i++ {
+		tracker.record("late-but-hot")
+	}
+
+	hot := tracker.hottest(1)
+	if len(hot) != 1 || hot[0].Key != "late-but-hot" {
+		t.Errorf("Expected a late hot key to displace cold candidates, got %+v", hot)
+	}
+}
+
+func TestSipHasher(t *testing.T) {
+	var seed [16]byte
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	hasher := NewSipHasher(seed)
+	// Reference vectors of SipHash-2-4 for the messages 00, 00 01, ...
+	vectors := map[int]uint64{0: 0x726fdb47dd0e0e31, 8: 0x93f5f5799a932462, 15: 0xa129ca6149be45e5}
+	for n, want := range vectors {
+		message := make([]byte, n)
+		for i := range message {
+			message[i] = byte(i)
+		}
+		if got := hasher.HashKey(string(message)); got != want {
+			t.Errorf("Expected %x for a %d byte message, got %x", want, n, got)
+		}
+	}
+	if RandomSipHasher().HashKey("key") == RandomSipHasher().HashKey("key") {
+		t.Error("Expected random seeds to hash keys differently")
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// importBatchRecords is the most records an import writes in one batch.
+const importBatchRecords = 1024
+
+// ErrBadImport is returned for an import input that can't be read.
+var ErrBadImport = errors.New("bad import input")
+
+// Import loads records written by Export, or any NDJSON objects or CSV
+// with a header naming the key and value columns, and optionally the
+// encoding, into the database. The
+// records are streamed into large batches, each appended to the active
+// segment in one write and indexed without waiting record by record, which
+// is much faster than a Put per record for initial loads. Versions are
+// assigned anew. It returns the number of records stored, those of the
+// batches before a failure included.
+func (db *Db) Import(r io.Reader, format ExportFormat) (int, error) {
+	var next func() (Entry, error)
+	switch format {
+	case ExportNDJSON:
+		decoder := json.NewDecoder(bufio.NewReader(r))
+		next = func() (Entry, error) {
+			var record exportRecord
+			if err := decoder.Decode(&record); err != nil {
+				return Entry{}, err
+			}
+			value, err := decodeValue(record.Value, record.Encoding)
+			return Entry{Key: record.Key, Value: value}, err
+		}
+	case ExportCSV:
+		reader := csv.NewReader(bufio.NewReader(r))
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrBadImport, err)
+		}
+		keyColumn, valueColumn := slices.Index(header, "key"), slices.Index(header, "value")
+		encodingColumn := slices.Index(header, "encoding")
+		if keyColumn < 0 || valueColumn < 0 {
+			return 0, fmt.Errorf("%w: the CSV header lacks a key or value column", ErrBadImport)
+		}
+		next = func() (Entry, error) {
+			row, err := reader.Read()
+			if err != nil {
+				return Entry{}, err
+			}
+			if len(row) <= max(keyColumn, valueColumn) {
+				line, _ := reader.FieldPos(0)
+				return Entry{}, fmt.Errorf("%w: line %d lacks the key or value column", ErrBadImport, line)
+			}
+			encoding := ""
+			if encodingColumn >= 0 && encodingColumn < len(row) {
+				encoding = row[encodingColumn]
+			}
+			value, err := decodeValue(row[valueColumn], encoding)
+			return Entry{Key: row[keyColumn], Value: value}, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown import format %q", format)
+	}
+
+	// A batch never spans segments, so it is kept well below their size.
+	maxBytes := int64(-1)
+	if db.segmentSize > 0 {
+		maxBytes = db.segmentSize / 4
+	}
+	var batch []Entry
+	var batchBytes int64
+	imported := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.PutBatch(batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch, batchBytes = batch[:0], 0
+		return nil
+	}
+	for {
+		e, err := next()
+		if err == io.EOF {
+			return imported, flush()
+		}
+		if err != nil {
+			return imported, fmt.Errorf("%w: %v", ErrBadImport, err)
+		}
+		if e.Key == "" {
+			return imported, fmt.Errorf("%w: record %d has no key", ErrBadImport, imported+len(batch)+1)
+		}
+		size := (&entry{key: e.Key, value: e.Value}).GetLength()
+		if len(batch) == importBatchRecords || (maxBytes >= 0 && len(batch) > 0 && batchBytes+size > maxBytes) {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+		batch = append(batch, e)
+		batchBytes += size
+	}
+}
@@ -0,0 +1,114 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDb_Import(t *testing.T) {
+	source, err := Open("source", Options{SegmentSize: 4096, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for i := 0; i < 3000; i++ {
+		if err := source.Put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value,%d\n", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, format := range []ExportFormat{ExportNDJSON, ExportCSV} {
+		var exported bytes.Buffer
+		if err := source.Export(&exported, format); err != nil {
+			t.Fatal(err)
+		}
+		// Small segments make the import split its batches by size.
+		target, err := Open("target", Options{SegmentSize: 4096, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported, err := target.Import(&exported, format)
+		if err != nil || imported != 3000 {
+			t.Fatalf("Expected the %s export to be imported, got %d, %v", format, imported, err)
+		}
+		if n := len(target.segmentList()); n < 2 {
+			t.Errorf("Expected the %s import to fill several segments, got %d", format, n)
+		}
+		for _, i := range []int{0, 1500, 2999} {
+			key := fmt.Sprintf("key%04d", i)
+			if value, err := target.Get(key); err != nil || value != fmt.Sprintf("value,%d\n", i) {
+				t.Errorf("Unexpected %s after the %s import: %q, %v", key, format, value, err)
+			}
+		}
+		target.Close()
+	}
+}
+
+func TestDb_ImportBinary(t *testing.T) {
+	source, err := Open("source", Options{SegmentSize: 4096, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	binary := []byte{0xff, 0x00, 0xc3, 0x28, '"', '\\', '\n'}
+	if err := source.PutBytes("binary", binary); err != nil {
+		t.Fatal(err)
+	}
+	_ = source.Put("crlf", "line\r\n")
+	_ = source.Put("text", "plain")
+
+	for _, format := range []ExportFormat{ExportNDJSON, ExportCSV} {
+		var exported bytes.Buffer
+		if err := source.Export(&exported, format); err != nil {
+			t.Fatal(err)
+		}
+		target, err := Open("target", Options{SegmentSize: 4096, Filesystem: NewMemFilesystem()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported, err := target.Import(&exported, format); err != nil || imported != 3 {
+			t.Fatalf("Expected the %s export to be imported, got %d, %v", format, imported, err)
+		}
+		if value, err := target.GetBytes("binary"); err != nil || !bytes.Equal(value, binary) {
+			t.Errorf("Expected the binary value to survive the %s export, got %q, %v", format, value, err)
+		}
+		for key, expected := range map[string]string{"crlf": "line\r\n", "text": "plain"} {
+			if value, err := target.Get(key); err != nil || value != expected {
+				t.Errorf("Unexpected %s after the %s import: %q, %v", key, format, value, err)
+			}
+		}
+		target.Close()
+	}
+}
+
+func TestDb_ImportBadInput(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 4096, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	imported, err := db.Import(strings.NewReader(`{"key":"a","value":"1"}`+"\n{broken\n"), ExportNDJSON)
+	if !errors.Is(err, ErrBadImport) || imported != 0 {
+		t.Errorf("Expected the broken record to fail the import, got %d, %v", imported, err)
+	}
+	for _, input := range []string{`{"key":"a","value":"!","encoding":"base64"}`, `{"key":"a","value":"1","encoding":"hex"}`} {
+		if _, err := db.Import(strings.NewReader(input), ExportNDJSON); !errors.Is(err, ErrBadImport) {
+			t.Errorf("Expected %q to be refused, got %v", input, err)
+		}
+	}
+	for _, input := range []string{"name,value\na,1\n", "key,value\na\n", "key,value\n,1\n", "key,value,encoding\na,1,hex\n"} {
+		if _, err := db.Import(strings.NewReader(input), ExportCSV); !errors.Is(err, ErrBadImport) {
+			t.Errorf("Expected %q to be refused, got %v", input, err)
+		}
+	}
+	if imported, err := db.Import(strings.NewReader("value,key\n1,a\n"), ExportCSV); err != nil || imported != 1 {
+		t.Errorf("Expected the columns to be found by name, got %d, %v", imported, err)
+	}
+	if value, _ := db.Get("a"); value != "1" {
+		t.Errorf("Unexpected a: %q", value)
+	}
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// indexSnapshotFileName names the snapshot of the in-memory indexes written
+// by a clean Close. Its presence is the clean flag: Recover removes it before
+// the database takes any write, so after a crash the indexes are rebuilt
+// from hints and segment scans instead.
+const indexSnapshotFileName = "INDEX"
+
+// indexSnapshot holds the indexes of all segments, the active one included,
+// with the tags of the live keys.
+type indexSnapshot struct {
+	Segments []indexSnapshotSegment `json:"segments"`
+	Tags     map[string][]string    `json:"tags,omitempty"`
+}
+
+type indexSnapshotSegment struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	Entries []hintEntry `json:"entries"`
+}
+
+// writeIndexSnapshot stores the indexes once no more writes are taken. The
+// snapshot is framed and checksummed like the manifest.
+func (db *Db) writeIndexSnapshot() error {
+	var snapshot indexSnapshot
+	for _, segment := range db.segmentList() {
+		segment.mu.Lock()
+		snapshot.Segments = append(snapshot.Segments, indexSnapshotSegment{
+			Name:    filepath.Base(segment.filePath),
+			Size:    segment.outOffset,
+			Entries: hintEntries(segment.index),
+		})
+		segment.mu.Unlock()
+	}
+	db.tags.mu.RLock()
+	snapshot.Tags = make(map[string][]string, len(db.tags.keyTags))
+	for key, tags := range db.tags.keyTags {
+		snapshot.Tags[key] = tags
+	}
+	db.tags.mu.RUnlock()
+
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	data, err := encodeMetadata(payload, db.compressMetadata)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(db.directory, indexSnapshotFileName)
+	tmpPath := path + ".tmp"
+	if err := writeSyncedFile(db.fs, tmpPath, data, db.syncDirs); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return db.syncDir(db.directory)
+}
+
+// readIndexSnapshot returns the snapshot left by a clean Close when it lists
+// exactly the given segments and every segment file still has the size it
+// had then. Otherwise it returns nil and the indexes must be rebuilt.
+func (db *Db) readIndexSnapshot(names []string) *indexSnapshot {
+	data, err := db.fs.ReadFile(filepath.Join(db.directory, indexSnapshotFileName))
+	if err != nil {
+		return nil
+	}
+	payload, err := decodeMetadata(data)
+	if err != nil {
+		return nil
+	}
+	var snapshot indexSnapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return nil
+	}
+	if len(snapshot.Segments) != len(names) {
+		return nil
+	}
+	for i, segment := range snapshot.Segments {
+		if segment.Name != names[i] {
+			return nil
+		}
+		size, err := fileSize(db.fs, filepath.Join(db.directory, segment.Name))
+		if err != nil || size != segment.Size {
+			return nil
+		}
+	}
+	return &snapshot
+}
+
+// markIndexDirty removes the index snapshot, so it cannot outlive the state
+// it describes.
+func (db *Db) markIndexDirty() error {
+	err := db.fs.Remove(filepath.Join(db.directory, indexSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		return db.syncDir(db.directory)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDb_IndexSnapshot(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 1024, Filesystem: fs}
+	snapshotPath := filepath.Join("db", indexSnapshotFileName)
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.PutWithTags("tagged", "value", []string{"red"})
+	_ = db.Put("victim", "value")
+	_ = db.Put("deleted", "value")
+	_ = db.Delete("deleted")
+	active := db.outPath
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadFile(snapshotPath); err != nil {
+		t.Fatalf("Expected an index snapshot after a clean close: %v", err)
+	}
+
+	// A flipped value goes unnoticed when the index comes from the snapshot,
+	// proving the active segment is not scanned.
+	data, _ := fs.ReadFile(active)
+	data[bytes.Index(data, []byte("victim"))+len("victim")+4] ^= 0x01
+	_ = fs.WriteFile(active, data, 0o600)
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatalf("Expected the index to be loaded from the snapshot, got %v", err)
+	}
+	if _, err := fs.ReadFile(snapshotPath); err == nil {
+		t.Error("Expected the snapshot to be dropped once the database is open")
+	}
+	if keys := db.FindByTag("red"); !reflect.DeepEqual(keys, []string{"tagged"}) {
+		t.Errorf("Expected the tags from the snapshot, got %v", keys)
+	}
+	if value, err := db.Get("tagged"); err != nil || value != "value" {
+		t.Errorf("Expected the value located by the snapshot, got %q, %v", value, err)
+	}
+	if _, err := db.Get("deleted"); err != ErrNotFound {
+		t.Errorf("Expected the deleted key to be missing, got %v", err)
+	}
+	if _, err := db.Get("victim"); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected the corrupted record to fail its read, got %v", err)
+	}
+
+	// A crash leaves no snapshot behind, so the next open scans the log.
+	if _, err := Open("db", opts); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected the scan to find the corrupted record, got %v", err)
+	}
+}
+
+func TestDb_StaleIndexSnapshot(t *testing.T) {
+	fs := NewMemFilesystem()
+	opts := Options{SegmentSize: 1024, Filesystem: fs}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put("key1", "value1")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stale, _ := fs.ReadFile(filepath.Join("db", indexSnapshotFileName))
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put("key2", "value2")
+	// The snapshot of the earlier close reappears, as if its removal had
+	// not reached the disk before a crash.
+	_ = fs.WriteFile(filepath.Join("db", indexSnapshotFileName), stale, 0o600)
+
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Expected the segment grown since the snapshot to be scanned, got %q, %v", value, err)
+	}
+}
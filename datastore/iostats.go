@@ -0,0 +1,107 @@
+package datastore
+
+import (
+	"io/fs"
+	"sync/atomic"
+)
+
+// IOStats compares the work done on disk with the work asked for, so the
+// cost of a compaction policy can be measured: every byte written to a
+// segment again by a compaction, to the WAL, a hint or the manifest adds
+// to the write amplification.
+type IOStats struct {
+	// LogicalBytesWritten are the keys and values of the writes accepted.
+	LogicalBytesWritten int64 `json:"logical_bytes_written"`
+	// DiskBytesWritten and DiskBytesRead are all the bytes moved to and from
+	// the database files.
+	DiskBytesWritten   int64   `json:"disk_bytes_written"`
+	DiskBytesRead      int64   `json:"disk_bytes_read"`
+	WriteAmplification float64 `json:"write_amplification"`
+	// CacheReadBytes and SegmentReadBytes are the values of the reads served
+	// from the value cache and from the segments.
+	CacheReadBytes   int64 `json:"cache_read_bytes"`
+	SegmentReadBytes int64 `json:"segment_read_bytes"`
+	// Fsyncs counts the files and directories flushed.
+	Fsyncs int64 `json:"fsyncs"`
+}
+
+type ioCounters struct {
+	logicalWritten atomic.Int64
+	diskWritten    atomic.Int64
+	diskRead       atomic.Int64
+	cacheRead      atomic.Int64
+	segmentRead    atomic.Int64
+	fsyncs         atomic.Int64
+}
+
+// IOStats returns the IO counters since the database was opened.
+func (db *Db) IOStats() IOStats {
+	stats := IOStats{
+		LogicalBytesWritten: db.io.logicalWritten.Load(),
+		DiskBytesWritten:    db.io.diskWritten.Load(),
+		DiskBytesRead:       db.io.diskRead.Load(),
+		CacheReadBytes:      db.io.cacheRead.Load(),
+		SegmentReadBytes:    db.io.segmentRead.Load(),
+		Fsyncs:              db.io.fsyncs.Load(),
+	}
+	if stats.LogicalBytesWritten > 0 {
+		stats.WriteAmplification = float64(stats.DiskBytesWritten) / float64(stats.LogicalBytesWritten)
+	}
+	return stats
+}
+
+// countingFilesystem counts the bytes moved and the fsyncs of the files of
+// the database.
+type countingFilesystem struct {
+	Filesystem
+	io *ioCounters
+}
+
+func (c countingFilesystem) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := c.Filesystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{File: file, io: c.io}, nil
+}
+
+func (c countingFilesystem) ReadFile(name string) ([]byte, error) {
+	data, err := c.Filesystem.ReadFile(name)
+	c.io.diskRead.Add(int64(len(data)))
+	return data, err
+}
+
+func (c countingFilesystem) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	err := c.Filesystem.WriteFile(name, data, perm)
+	if err == nil {
+		c.io.diskWritten.Add(int64(len(data)))
+	}
+	return err
+}
+
+func (c countingFilesystem) SyncDir(path string) error {
+	c.io.fsyncs.Add(1)
+	return c.Filesystem.SyncDir(path)
+}
+
+type countingFile struct {
+	File
+	io *ioCounters
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.io.diskRead.Add(int64(n))
+	return n, err
+}
+
+func (f countingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.io.diskWritten.Add(int64(n))
+	return n, err
+}
+
+func (f countingFile) Sync() error {
+	f.io.fsyncs.Add(1)
+	return f.File.Sync()
+}
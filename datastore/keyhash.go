@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+)
+
+// KeyHasher hashes keys for the in-memory structures that spread keys over
+// a fixed number of buckets, like the access sketch. Keys come from
+// clients, so a hash they can predict lets them pile keys into a single
+// bucket. The indexes are Go maps, whose hashing is already seeded per map.
+type KeyHasher interface {
+	HashKey(key string) uint64
+}
+
+// SipHasher is SipHash-2-4 keyed with a secret seed. Without the seed,
+// colliding keys can't be searched for offline.
+type SipHasher struct {
+	k0, k1 uint64
+}
+
+// NewSipHasher returns a SipHasher keyed with seed.
+func NewSipHasher(seed [16]byte) SipHasher {
+	return SipHasher{
+		k0: binary.LittleEndian.Uint64(seed[:8]),
+		k1: binary.LittleEndian.Uint64(seed[8:]),
+	}
+}
+
+// RandomSipHasher returns a SipHasher with a random seed, the default of a
+// database.
+func RandomSipHasher() SipHasher {
+	var seed [16]byte
+	_, _ = rand.Read(seed[:])
+	return NewSipHasher(seed)
+}
+
+func (h SipHasher) HashKey(key string) uint64 {
+	v0 := h.k0 ^ 0x736f6d6570736575
+	v1 := h.k1 ^ 0x646f72616e646f6d
+	v2 := h.k0 ^ 0x6c7967656e657261
+	v3 := h.k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+
+	n := len(key)
+	for ; len(key) >= 8; key = key[8:] {
+		m := binary.LittleEndian.Uint64([]byte(key[:8]))
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+	// The last block holds the remaining bytes and the length.
+	m := uint64(n) << 56
+	for i := len(key) - 1; i >= 0; i-- {
+		m |= uint64(key[i]) << (8 * i)
+	}
+	v3 ^= m
+	round()
+	round()
+	v0 ^= m
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// FNVHasher is the unseeded 64-bit FNV-1a hash. It is cheaper than SipHash
+// but only fit for keys from trusted clients.
+type FNVHasher struct{}
+
+func (FNVHasher) HashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
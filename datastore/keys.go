@@ -0,0 +1,212 @@
+package datastore
+
+import (
+	"container/heap"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// KeyPage is one page of a key listing.
+type KeyPage struct {
+	Keys []string `json:"keys"`
+	// Next is the cursor of the following page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// Keys lists the live, unexpired keys starting with prefix in lexical order, only
+// reading the in-memory indexes. Listing starts after the cursor key; pass
+// the Next cursor of a page to get the following one. A limit of zero or
+// less returns all keys.
+func (db *Db) Keys(prefix, after string, limit int) KeyPage {
+	// One key more than the page tells whether another page follows.
+	listed := 0
+	if limit > 0 {
+		listed = limit + 1
+	}
+	keys := db.liveKeys(keyRange{prefix: prefix, after: after}, listed)
+	page := KeyPage{Keys: keys}
+	if limit > 0 && len(keys) > limit {
+		page.Keys = keys[:limit]
+		page.Next = keys[limit-1]
+	}
+	return page
+}
+
+// KeyValue is a key with its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Scan returns the live keys starting with prefix and their values in
+// lexical order.
+func (db *Db) Scan(prefix string) ([]KeyValue, error) {
+	return db.readKeys(db.liveKeys(keyRange{prefix: prefix}, 0))
+}
+
+// GetRange returns the live keys from start up to, but not including, end
+// and their values in lexical order. An empty end reads to the last key.
+func (db *Db) GetRange(start, end string) ([]KeyValue, error) {
+	return db.readKeys(db.liveKeys(keyRange{start: start, end: end}, 0))
+}
+
+// readKeys reads the values of keys listed in order.
+func (db *Db) readKeys(keys []string) ([]KeyValue, error) {
+	records, err := db.MultiGetRecords(keys)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		// Keys deleted or expired after the listing are left out.
+		if record, found := records[key]; found {
+			pairs = append(pairs, KeyValue{Key: key, Value: record.Value})
+		}
+	}
+	return pairs, nil
+}
+
+// keyRange selects keys starting with prefix, from start on and after the
+// after cursor, up to but not including end. Empty bounds are open.
+type keyRange struct {
+	prefix, start, after, end string
+}
+
+// liveKeys returns up to limit live, unexpired keys in r in lexical order,
+// all of them for a limit of zero. The sorted keys of the segments are
+// merged, so only the keys listed and the older records they shadow are
+// visited.
+func (db *Db) liveKeys(r keyRange, limit int) []string {
+	segments := db.segmentList()
+	now := db.clock.Now().UnixNano()
+	// The index of a segment only changes under its lock, so all are held
+	// while their keys are merged.
+	cursors := make(keyCursorHeap, 0, len(segments))
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		segment.mu.Lock()
+		defer segment.mu.Unlock()
+		sorted := segment.sortedKeys()
+		from := sort.SearchStrings(sorted, max(r.prefix, r.start, r.after))
+		if from < len(sorted) {
+			cursors = append(cursors, keyCursor{segment: segment, age: len(cursors), keys: sorted[from:]})
+		}
+	}
+	heap.Init(&cursors)
+
+	keys := []string{}
+	for cursors.Len() > 0 && (limit <= 0 || len(keys) < limit) {
+		key, segment := cursors[0].keys[0], cursors[0].segment
+		if !strings.HasPrefix(key, r.prefix) || (r.end != "" && key >= r.end) {
+			break
+		}
+		// The newest segment holding the key comes first, the records of
+		// older ones are shadowed.
+		for cursors.Len() > 0 && cursors[0].keys[0] == key {
+			if cursors[0].keys = cursors[0].keys[1:]; len(cursors[0].keys) == 0 {
+				heap.Pop(&cursors)
+			} else {
+				heap.Fix(&cursors, 0)
+			}
+		}
+		if key == r.after {
+			continue
+		}
+		if pos := segment.index[key]; !pos.deleted && !pos.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keyCursor is the position of a key listing in the sorted keys of a
+// segment. age orders segments from the newest.
+type keyCursor struct {
+	segment *Segment
+	age     int
+	keys    []string
+}
+
+// keyCursorHeap orders cursors by their next key.
+type keyCursorHeap []keyCursor
+
+func (h keyCursorHeap) Len() int { return len(h) }
+func (h keyCursorHeap) Less(i, j int) bool {
+	if h[i].keys[0] != h[j].keys[0] {
+		return h[i].keys[0] < h[j].keys[0]
+	}
+	return h[i].age < h[j].age
+}
+func (h keyCursorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *keyCursorHeap) Push(x any)   { *h = append(*h, x.(keyCursor)) }
+func (h *keyCursorHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// sortedKeys returns the index keys in order, sorting them again if keys
+// were added since. Callers hold s.mu.
+func (s *Segment) sortedKeys() []string {
+	if len(s.sorted) != len(s.index) {
+		s.sorted = make([]string, 0, len(s.index))
+		for key := range s.index {
+			s.sorted = append(s.sorted, key)
+		}
+		sort.Strings(s.sorted)
+	}
+	return s.sorted
+}
+
+// addSortedKey inserts a key new to the index into the sorted keys, if they
+// are in use. Index keys are never removed, so the active segment keeps its
+// list current with one insertion per new key. Callers hold s.mu.
+func (s *Segment) addSortedKey(key string) {
+	if len(s.sorted) != len(s.index)-1 {
+		return
+	}
+	i, _ := slices.BinarySearch(s.sorted, key)
+	s.sorted = slices.Insert(s.sorted, i, key)
+}
+
+// iteratorPageSize is the number of keys a KeyIterator lists at a time.
+const iteratorPageSize = 1024
+
+// KeyIterator walks the live keys starting with a prefix in lexical order.
+// It lists them a page at a time after the last returned key, so it needs
+// no locks between pages and compaction, which only moves records, can't
+// make it skip or repeat a key. Keys written or deleted while iterating
+// may or may not be seen.
+type KeyIterator struct {
+	db       *Db
+	prefix   string
+	pageSize int
+	page     []string
+	key      string
+	done     bool
+}
+
+// Iterator returns an iterator over the live keys starting with prefix.
+func (db *Db) Iterator(prefix string) *KeyIterator {
+	return &KeyIterator{db: db, prefix: prefix, pageSize: iteratorPageSize}
+}
+
+// Next advances to the following key and reports whether there is one.
+func (it *KeyIterator) Next() bool {
+	if len(it.page) == 0 && !it.done {
+		page := it.db.Keys(it.prefix, it.key, it.pageSize)
+		it.page, it.done = page.Keys, page.Next == ""
+	}
+	if len(it.page) == 0 {
+		return false
+	}
+	it.key, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Key returns the current key.
+func (it *KeyIterator) Key() string {
+	return it.key
+}
@@ -0,0 +1,179 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_Keys(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 60, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user/3", "user/1", "session/1", "user/2", "user/4"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.Put("user/1", "updated")
+	_ = db.Delete("user/4")
+	db.compactions.Wait()
+
+	if page := db.Keys("", "", 0); !reflect.DeepEqual(page, KeyPage{Keys: []string{"session/1", "user/1", "user/2", "user/3"}}) {
+		t.Errorf("Unexpected listing %+v", page)
+	}
+
+	page := db.Keys("user/", "", 2)
+	if !reflect.DeepEqual(page, KeyPage{Keys: []string{"user/1", "user/2"}, Next: "user/2"}) {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	page = db.Keys("user/", page.Next, 2)
+	if !reflect.DeepEqual(page, KeyPage{Keys: []string{"user/3"}}) {
+		t.Errorf("Unexpected last page %+v", page)
+	}
+	// A page holding exactly the keys left is the last one.
+	if page := db.Keys("user/", "", 3); !reflect.DeepEqual(page, KeyPage{Keys: []string{"user/1", "user/2", "user/3"}}) {
+		t.Errorf("Unexpected full page %+v", page)
+	}
+}
+
+func TestDb_KeysMergesSegments(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 1 << 20, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every segment holds keys of the others' ranges; newer records of a
+	// key shadow older ones.
+	for i := 0; i < 3; i++ {
+		for j := i; j < 9; j += 3 {
+			_ = db.Put(fmt.Sprintf("key/%d", j), "value")
+		}
+		_ = db.Put("key/shadowed", "value")
+		if err := db.CreateDataSegment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = db.Delete("key/4")
+	_ = db.Delete("key/shadowed")
+
+	expected := []string{"key/0", "key/1", "key/2", "key/3", "key/5", "key/6", "key/7", "key/8"}
+	if keys := db.Keys("key/", "", 0).Keys; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected listing %v", keys)
+	}
+	var paged []string
+	for next := ""; ; {
+		page := db.Keys("key/", next, 3)
+		paged = append(paged, page.Keys...)
+		if next = page.Next; next == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(paged, expected) {
+		t.Errorf("Unexpected paged listing %v", paged)
+	}
+}
+
+func TestDb_Iterator(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 60, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key/%d", i)
+		_ = db.Put(key, "value")
+		expected = append(expected, key)
+	}
+	_ = db.Put("other", "value")
+
+	it := db.Iterator("key/")
+	it.pageSize = 3
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		if len(keys) == 4 {
+			// Compaction between pages moves the records, not the cursor.
+			db.PerformOldSegmentsCompaction()
+			db.compactions.Wait()
+		}
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+	if it.Next() {
+		t.Error("Expected an exhausted iterator to stay exhausted")
+	}
+}
+
+func TestDb_Scan(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{SegmentSize: 60, Clock: clock, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user/3", "user/1", "usage", "user/2", "user/4"} {
+		_ = db.Put(key, key)
+	}
+	// The sorted keys of the active segment follow later writes.
+	if pairs, _ := db.Scan("user/"); len(pairs) != 4 {
+		t.Fatalf("Expected 4 users, got %+v", pairs)
+	}
+	_ = db.Put("user/1", "updated")
+	_ = db.Put("user/0", "new")
+	_ = db.PutWithTTL("user/5", "expiring", time.Second)
+	_ = db.Delete("user/4")
+	clock.Advance(time.Second)
+	db.compactions.Wait()
+
+	pairs, err := db.Scan("user/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyValue{{"user/0", "new"}, {"user/1", "updated"}, {"user/2", "user/2"}, {"user/3", "user/3"}}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, pairs)
+	}
+	if pairs, _ := db.Scan("none/"); len(pairs) != 0 {
+		t.Errorf("Expected no pairs for an unused prefix, got %+v", pairs)
+	}
+}
+
+func TestDb_GetRange(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 80, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, day := range []string{"2024-03-02", "2024-02-28", "2024-03-01", "2024-02-29", "2024-03-03"} {
+		_ = db.Put("temp/"+day, day)
+	}
+	_ = db.Put("temp/2024-03-01", "updated")
+	_ = db.Delete("temp/2024-03-02")
+	db.compactions.Wait()
+
+	pairs, err := db.GetRange("temp/2024-02-29", "temp/2024-03-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyValue{{"temp/2024-02-29", "2024-02-29"}, {"temp/2024-03-01", "updated"}}
+	if !reflect.DeepEqual(pairs, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, pairs)
+	}
+	if pairs, _ := db.GetRange("temp/2024-03", ""); len(pairs) != 2 || pairs[1].Key != "temp/2024-03-03" {
+		t.Errorf("Expected an open range to reach the last key, got %+v", pairs)
+	}
+	if pairs, _ := db.GetRange("b", "a"); len(pairs) != 0 {
+		t.Errorf("Expected an empty range, got %+v", pairs)
+	}
+}
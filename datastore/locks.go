@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked      = errors.New("key is locked")
+	ErrLockNotHeld = errors.New("lock is not held with this token")
+	ErrBadLockTTL  = errors.New("lock ttl must be positive")
+)
+
+// minLockPrune is the lock count from which expired locks are pruned.
+const minLockPrune = 64
+
+// lockTable holds advisory per-key locks. They do not guard the records,
+// clients use them to coordinate work among themselves. Locks live in
+// memory only and expire on their own, so a crashed holder cannot keep one.
+//
+// Every lock gets a fencing token larger than all tokens handed out
+// before. Tokens start at the open time in nanoseconds, so they keep
+// growing across restarts as long as the clock does.
+type lockTable struct {
+	clock Clock
+
+	mu        sync.Mutex
+	locks     map[string]heldLock
+	lastToken uint64
+	// pruneAt is the lock count at which expired locks are dropped next.
+	pruneAt int
+}
+
+type heldLock struct {
+	owner     string
+	token     uint64
+	expiresAt time.Time
+}
+
+// Lock is a lock acquired with Db.Lock.
+type Lock struct {
+	Key       string    `json:"key"`
+	Owner     string    `json:"owner,omitempty"`
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LockOptions tunes acquiring a lock.
+type LockOptions struct {
+	TTL time.Duration
+	// Owner names the holder, for others to see who holds the lock.
+	Owner string
+	// Token, when set, renews the lock held with it for another TTL
+	// instead of acquiring a new one. The token stays the same.
+	Token uint64
+}
+
+func newLockTable(clock Clock) *lockTable {
+	return &lockTable{
+		clock:     clock,
+		locks:     make(map[string]heldLock),
+		lastToken: uint64(clock.Now().UnixNano()),
+		pruneAt:   minLockPrune,
+	}
+}
+
+func (t *lockTable) lock(key string, opts LockOptions) (Lock, error) {
+	if opts.TTL <= 0 {
+		return Lock{}, ErrBadLockTTL
+	}
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held, found := t.locks[key]
+	active := found && now.Before(held.expiresAt)
+	if opts.Token != 0 {
+		if !active || held.token != opts.Token {
+			return Lock{}, ErrLockNotHeld
+		}
+		held.expiresAt = now.Add(opts.TTL)
+		t.locks[key] = held
+		return held.lock(key), nil
+	}
+	if active {
+		return Lock{}, ErrLocked
+	}
+
+	if len(t.locks) >= t.pruneAt {
+		t.prune(now)
+	}
+	t.lastToken++
+	held = heldLock{owner: opts.Owner, token: t.lastToken, expiresAt: now.Add(opts.TTL)}
+	t.locks[key] = held
+	return held.lock(key), nil
+}
+
+// get returns the unexpired lock of key.
+func (t *lockTable) get(key string) (Lock, error) {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held, found := t.locks[key]
+	if !found || !now.Before(held.expiresAt) {
+		return Lock{}, ErrNotFound
+	}
+	return held.lock(key), nil
+}
+
+func (h heldLock) lock(key string) Lock {
+	return Lock{Key: key, Owner: h.owner, Token: h.token, ExpiresAt: h.expiresAt}
+}
+
+func (t *lockTable) unlock(key string, token uint64) error {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	held, found := t.locks[key]
+	if !found || held.token != token || !now.Before(held.expiresAt) {
+		return ErrLockNotHeld
+	}
+	delete(t.locks, key)
+	return nil
+}
+
+// prune drops the expired locks. t.mu must be held.
+func (t *lockTable) prune(now time.Time) {
+	for key, held := range t.locks {
+		if !now.Before(held.expiresAt) {
+			delete(t.locks, key)
+		}
+	}
+	t.pruneAt = max(2*len(t.locks), minLockPrune)
+}
+
+// Lock acquires the advisory lock of key for ttl and returns it with its
+// fencing token. It fails with ErrLocked while another holder's lock has
+// not expired. Locks are independent of the records and do not survive a
+// restart.
+func (db *Db) Lock(key string, ttl time.Duration) (Lock, error) {
+	return db.LockWithOptions(key, LockOptions{TTL: ttl})
+}
+
+// LockWithOptions acquires or, given a token, renews the lock of key.
+// Renewing fails with ErrLockNotHeld once the lock expired or was taken
+// over.
+func (db *Db) LockWithOptions(key string, opts LockOptions) (Lock, error) {
+	return db.locks.lock(key, opts)
+}
+
+// GetLock returns the lock held on key, or ErrNotFound when it is free.
+func (db *Db) GetLock(key string) (Lock, error) {
+	return db.locks.get(key)
+}
+
+// Unlock releases the lock of key acquired with token. It fails with
+// ErrLockNotHeld when the lock expired or was taken over since.
+func (db *Db) Unlock(key string, token uint64) error {
+	return db.locks.unlock(key, token)
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDb_Lock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first, err := db.Lock("job", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lock("job", time.Second); err != ErrLocked {
+		t.Errorf("Expected the held lock to be refused, got %v", err)
+	}
+	if _, err := db.Lock("other", time.Second); err != nil {
+		t.Errorf("Expected locks of other keys to be independent, got %v", err)
+	}
+	if _, err := db.Lock("job", 0); err != ErrBadLockTTL {
+		t.Errorf("Expected a zero ttl to be refused, got %v", err)
+	}
+
+	// An expired lock can be taken over, with a larger fencing token.
+	clock.Advance(10 * time.Second)
+	second, err := db.Lock("job", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Token <= first.Token {
+		t.Errorf("Expected fencing tokens to grow, got %d after %d", second.Token, first.Token)
+	}
+	if err := db.Unlock("job", first.Token); err != ErrLockNotHeld {
+		t.Errorf("Expected the stale token to be refused, got %v", err)
+	}
+	if err := db.Unlock("job", second.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Lock("job", time.Second); err != nil {
+		t.Errorf("Expected the released lock to be free, got %v", err)
+	}
+}
+
+func TestDb_LockRenewal(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.GetLock("leader"); err != ErrNotFound {
+		t.Errorf("Expected a free lock, got %v", err)
+	}
+	lock, err := db.LockWithOptions("leader", LockOptions{TTL: 10 * time.Second, Owner: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renewals keep the lock, and its token, past the first ttl.
+	for i := 0; i < 3; i++ {
+		clock.Advance(5 * time.Second)
+		renewed, err := db.LockWithOptions("leader", LockOptions{TTL: 10 * time.Second, Token: lock.Token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if renewed.Token != lock.Token || renewed.Owner != "a" {
+			t.Errorf("Unexpected renewed lock %+v", renewed)
+		}
+	}
+	if held, err := db.GetLock("leader"); err != nil || held.Owner != "a" {
+		t.Errorf("Expected a to hold the lock, got %+v (err: %v)", held, err)
+	}
+
+	clock.Advance(10 * time.Second)
+	if _, err := db.LockWithOptions("leader", LockOptions{TTL: time.Second, Token: lock.Token}); err != ErrLockNotHeld {
+		t.Errorf("Expected an expired lock not to be renewed, got %v", err)
+	}
+	if _, err := db.GetLock("leader"); err != ErrNotFound {
+		t.Errorf("Expected the expired lock to be free, got %v", err)
+	}
+}
+
+func TestLockTable_Prune(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	locks := newLockTable(clock)
+	for i := 0; i < minLockPrune; i++ {
+		if _, err := locks.lock(string(rune('a'+i)), LockOptions{TTL: time.Second}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(time.Second)
+	if _, err := locks.lock("fresh", LockOptions{TTL: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if len(locks.locks) != 1 {
+		t.Errorf("Expected expired locks to be pruned, %d left", len(locks.locks))
+	}
+}
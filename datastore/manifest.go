@@ -0,0 +1,155 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const manifestFileName = "MANIFEST"
+
+type manifest struct {
+	// Segments lists segment file names from the oldest to the active one.
+	Segments []string `json:"segments"`
+	// VersionFloor is the highest version of the records compactions
+	// dropped.
+	VersionFloor uint64 `json:"version_floor,omitempty"`
+	// Sequence is the commit sequence reached when the manifest was
+	// written. Records dropped by compactions or loaded from hints are
+	// covered by it; those written since are scanned on recovery.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// raise sets counter to value if it is higher.
+func raise(counter *atomic.Uint64, value uint64) {
+	for {
+		current := counter.Load()
+		if value <= current || counter.CompareAndSwap(current, value) {
+			return
+		}
+	}
+}
+
+// writeManifest atomically replaces the manifest with the given segment list.
+func (db *Db) writeManifest(segments []*Segment) error {
+	db.manifestMu.Lock()
+	defer db.manifestMu.Unlock()
+
+	m := manifest{
+		Segments:     make([]string, len(segments)),
+		VersionFloor: db.versionFloor.Load(),
+		Sequence:     db.sequence.Load(),
+	}
+	for i, segment := range segments {
+		m.Segments[i] = filepath.Base(segment.filePath)
+	}
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	data, err := encodeMetadata(payload, db.compressMetadata)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(db.directory, manifestFileName)
+	tmpPath := manifestPath + ".tmp"
+	if err := writeSyncedFile(db.fs, tmpPath, data, db.syncDirs); err != nil {
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+	return db.syncDir(db.directory)
+}
+
+// writeSyncedFile writes a file, syncing its content when sync is set so
+// it can be renamed in place of an older version.
+func writeSyncedFile(fsys Filesystem, path string, data []byte, sync bool) error {
+	if !sync {
+		return fsys.WriteFile(path, data, 0o600)
+	}
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readManifest returns the manifest, its segment file names in order.
+// Directories created before the manifest existed are listed by segment
+// number instead, and manifests written before it was framed are read as
+// plain JSON.
+func (db *Db) readManifest() (manifest, error) {
+	var m manifest
+	data, err := db.fs.ReadFile(filepath.Join(db.directory, manifestFileName))
+	if os.IsNotExist(err) {
+		m.Segments, err = listSegmentFiles(db.fs, db.directory)
+		return m, err
+	}
+	if err != nil {
+		return m, err
+	}
+
+	if isFramedMetadata(data) {
+		if data, err = decodeMetadata(data); err != nil {
+			return m, fmt.Errorf("manifest: %w", err)
+		}
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+func listSegmentFiles(fsys Filesystem, directory string) ([]string, error) {
+	files, err := fsys.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if _, ok := segmentNumber(file.Name()); ok {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, _ := segmentNumber(names[i])
+		b, _ := segmentNumber(names[j])
+		return a < b
+	})
+	return names, nil
+}
+
+// nextSegmentIndex returns a segment number not used by any file in directory.
+func nextSegmentIndex(fsys Filesystem, directory string) (int, error) {
+	names, err := listSegmentFiles(fsys, directory)
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	last, _ := segmentNumber(names[len(names)-1])
+	return last + 1, nil
+}
+
+func segmentNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, defaultFileName) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(name, defaultFileName))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
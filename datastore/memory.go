@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Estimated bytes an index entry and a cached record hold besides their
+// key and value: the map buckets, list elements and structs around them.
+const (
+	indexEntryOverhead = 80
+	cacheEntryOverhead = 160
+)
+
+// MemoryStats reports the estimated memory held by the indexes and the
+// value cache.
+type MemoryStats struct {
+	IndexBytes int64 `json:"index_bytes"`
+	CacheBytes int64 `json:"cache_bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+	// LimitBytes is the MemoryLimit, zero when unlimited.
+	LimitBytes int64 `json:"limit_bytes,omitempty"`
+	// CacheEvictions counts records dropped from the cache to stay under
+	// the memory limits rather than its entry count.
+	CacheEvictions int64 `json:"cache_evictions"`
+}
+
+// memoryAccountant tracks the bytes held by the indexes and hands the
+// value cache what is left of the limits. Indexes are never evicted, so the
+// cache shrinks as they grow.
+type memoryAccountant struct {
+	// limit caps indexes and cache together, cacheLimit the cache alone.
+	// Zero means unlimited.
+	limit      int64
+	cacheLimit int64
+	index      atomic.Int64
+}
+
+func indexEntryBytes(key string, pos recordPosition) int64 {
+	return int64(len(key)+len(pos.blob)) + indexEntryOverhead
+}
+
+func cacheEntryBytes(value cachedRecord) int64 {
+	return int64(len(value.key)+len(value.record.Value)) + cacheEntryOverhead
+}
+
+// cacheBudget returns the bytes the cache may hold.
+func (m *memoryAccountant) cacheBudget() int64 {
+	budget := int64(math.MaxInt64)
+	if m.cacheLimit > 0 {
+		budget = m.cacheLimit
+	}
+	if m.limit > 0 {
+		budget = min(budget, max(m.limit-m.index.Load(), 0))
+	}
+	return budget
+}
+
+// MemoryStats returns the estimated memory use of the database.
+func (db *Db) MemoryStats() MemoryStats {
+	stats := MemoryStats{IndexBytes: db.memory.index.Load(), LimitBytes: db.memory.limit}
+	if db.cache != nil {
+		stats.CacheBytes, stats.CacheEvictions = db.cache.memory()
+	}
+	stats.TotalBytes = stats.IndexBytes + stats.CacheBytes
+	return stats
+}
+
+// indexGrew accounts for index entries added by a write and shrinks the
+// cache if the indexes now leave it less room.
+func (db *Db) indexGrew(bytes int64) {
+	db.memory.index.Add(bytes)
+	if db.cache != nil && db.memory.limit > 0 {
+		db.cache.trim()
+	}
+}
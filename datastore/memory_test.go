@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDb_MemoryStats(t *testing.T) {
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, CacheSize: 100, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwrites don't add index entries.
+	if err := db.Put("key0", "other"); err != nil {
+		t.Fatal(err)
+	}
+	stats := db.Stats().Memory
+	if expected := int64(10 * (len("key0") + indexEntryOverhead)); stats.IndexBytes != expected {
+		t.Errorf("Expected %d index bytes, got %d", expected, stats.IndexBytes)
+	}
+	if stats.CacheBytes != 0 || stats.TotalBytes != stats.IndexBytes {
+		t.Errorf("Expected an empty cache, got %+v", stats)
+	}
+
+	if _, err := db.Get("key1"); err != nil {
+		t.Fatal(err)
+	}
+	stats = db.MemoryStats()
+	if expected := int64(len("key1") + len("value") + cacheEntryOverhead); stats.CacheBytes != expected {
+		t.Errorf("Expected %d cache bytes, got %d", expected, stats.CacheBytes)
+	}
+	indexBytes := stats.IndexBytes
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The index of recovered segments is accounted for on open.
+	db, err = Open("db", Options{SegmentSize: 1024, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := db.MemoryStats().IndexBytes; got != indexBytes {
+		t.Errorf("Expected %d index bytes after recovery, got %d", indexBytes, got)
+	}
+}
+
+func TestDb_MemoryLimitEvictsCache(t *testing.T) {
+	value := strings.Repeat("v", 100)
+	recordBytes := int64(len("key0")+len(value)) + cacheEntryOverhead
+	indexBytes := int64(len("key0") + indexEntryOverhead)
+
+	// The limit leaves the cache room for three records next to the index
+	// of four keys, and for two once a fifth key is written.
+	limit := 4*indexBytes + 3*recordBytes
+	db, err := Open("db", Options{SegmentSize: 4096, CacheSize: 100, MemoryLimit: limit, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := db.MemoryStats()
+	if stats.CacheBytes != 3*recordBytes || stats.CacheEvictions != 1 || stats.TotalBytes > limit {
+		t.Errorf("Expected the cache to keep three records, got %+v", stats)
+	}
+	if cached := db.cache.keys(); len(cached) != 3 || cached[2] != "key1" {
+		t.Errorf("Expected the least recently used record to be evicted, got %v", cached)
+	}
+
+	if err := db.Put("key4", value); err != nil {
+		t.Fatal(err)
+	}
+	stats = db.MemoryStats()
+	if stats.CacheBytes != 2*recordBytes || stats.CacheEvictions != 2 || stats.TotalBytes > limit {
+		t.Errorf("Expected the grown index to shrink the cache, got %+v", stats)
+	}
+}
+
+func TestDb_CacheMaxBytes(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 4096, CacheSize: 100, CacheMaxBytes: 1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Fatalf("Expected reads to work without room in the cache, got %q, %v", value, err)
+	}
+	if stats := db.MemoryStats(); stats.CacheBytes != 0 || stats.CacheEvictions != 1 {
+		t.Errorf("Expected the record not to stay cached, got %+v", stats)
+	}
+}
@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Metadata files, the manifest and segment hints, are framed with a header
+// of the magic, the format version, flags, the length of the payload as
+// stored and its CRC-32C, so a truncated or corrupted file is detected
+// instead of being loaded as a shorter list. The payload is optionally
+// compressed with DEFLATE at its fastest level, which keeps the hints of
+// segments with many keys small without slowing down startup much.
+const (
+	metadataMagic      = "L4MD"
+	metadataVersion    = 1
+	metadataHeaderSize = len(metadataMagic) + 2 + 4 + 4
+
+	metadataCompressed = 1 << 0
+)
+
+var ErrCorruptMetadata = errors.New("corrupt metadata file")
+
+var metadataCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeMetadata frames payload, compressing it if compress is set.
+func encodeMetadata(payload []byte, compress bool) ([]byte, error) {
+	var flags byte
+	if compress {
+		var compressed bytes.Buffer
+		w, err := flate.NewWriter(&compressed, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		payload, flags = compressed.Bytes(), metadataCompressed
+	}
+
+	data := make([]byte, metadataHeaderSize, metadataHeaderSize+len(payload))
+	copy(data, metadataMagic)
+	data[4], data[5] = metadataVersion, flags
+	binary.LittleEndian.PutUint32(data[6:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[10:], crc32.Checksum(payload, metadataCRCTable))
+	return append(data, payload...), nil
+}
+
+// isFramedMetadata tells framed metadata from the plain JSON written by
+// older versions.
+func isFramedMetadata(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(metadataMagic))
+}
+
+// decodeMetadata verifies framed metadata and returns its payload.
+func decodeMetadata(data []byte) ([]byte, error) {
+	if len(data) < metadataHeaderSize || !isFramedMetadata(data) {
+		return nil, fmt.Errorf("%w: bad header", ErrCorruptMetadata)
+	}
+	if version := data[4]; version != metadataVersion {
+		return nil, fmt.Errorf("%w: unsupported format version %d", ErrCorruptMetadata, version)
+	}
+	flags := data[5]
+	size := binary.LittleEndian.Uint32(data[6:])
+	payload := data[metadataHeaderSize:]
+	if uint64(len(payload)) != uint64(size) {
+		return nil, fmt.Errorf("%w: expected %d bytes, got %d", ErrCorruptMetadata, size, len(payload))
+	}
+	if crc32.Checksum(payload, metadataCRCTable) != binary.LittleEndian.Uint32(data[10:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptMetadata)
+	}
+
+	if flags&metadataCompressed == 0 {
+		return payload, nil
+	}
+	payload, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptMetadata, err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadata_RoundTrip(t *testing.T) {
+	payload := []byte(`{"segments":["current-data0","current-data1"]}`)
+	for _, compress := range []bool{false, true} {
+		data, err := encodeMetadata(payload, compress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeMetadata(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != string(payload) {
+			t.Errorf("Expected %s, got %s (compressed: %t)", payload, decoded, compress)
+		}
+
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		for name, bad := range map[string][]byte{
+			"truncated": data[:len(data)-1],
+			"corrupted": corrupted,
+			"header":    data[:5],
+		} {
+			if _, err := decodeMetadata(bad); !errors.Is(err, ErrCorruptMetadata) {
+				t.Errorf("Expected a %s file to be reported as corrupt, got %v", name, err)
+			}
+		}
+	}
+
+	data, _ := encodeMetadata(payload, false)
+	data[4] = metadataVersion + 1
+	if _, err := decodeMetadata(data); !errors.Is(err, ErrCorruptMetadata) {
+		t.Errorf("Expected an unknown version to be refused, got %v", err)
+	}
+}
+
+func TestDb_ManifestFormats(t *testing.T) {
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 80, CompressMetadata: true, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := filepath.Join("db", manifestFileName)
+	data, err := fs.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFramedMetadata(data) || data[5]&metadataCompressed == 0 {
+		t.Fatalf("Expected a compressed framed manifest, got %q", data)
+	}
+
+	// Manifests are read whichever way they were written.
+	payload, _ := decodeMetadata(data)
+	for name, manifest := range map[string][]byte{"legacy JSON": payload, "compressed": data} {
+		if err := fs.WriteFile(manifestPath, manifest, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open("db", Options{SegmentSize: 80, Filesystem: fs})
+		if err != nil {
+			t.Fatalf("Failed to open with a %s manifest: %v", name, err)
+		}
+		if value, err := db.Get("e"); err != nil || value != "value" {
+			t.Errorf("Expected the data back with a %s manifest, got %q, %v", name, value, err)
+		}
+		db.Close()
+	}
+
+	if err := fs.WriteFile(manifestPath, data[:len(data)-2], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open("db", Options{SegmentSize: 80, Filesystem: fs}); !errors.Is(err, ErrCorruptMetadata) {
+		t.Errorf("Expected a truncated manifest to fail the open, got %v", err)
+	}
+}
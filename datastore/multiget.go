@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"bufio"
+	"sort"
+)
+
+// MultiGet returns the values of the keys that exist, leaving out missing,
+// deleted and expired ones.
+func (db *Db) MultiGet(keys []string) (map[string]string, error) {
+	records, err := db.MultiGetRecords(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(records))
+	for key, record := range records {
+		values[key] = record.Value
+	}
+	return values, nil
+}
+
+// MultiGetRecords works like MultiGet and returns the versions too. Keys
+// missing from the value cache are located in one pass over the segment
+// indexes, and every segment file is opened once and read in offset order.
+func (db *Db) MultiGetRecords(keys []string) (records map[string]Record, err error) {
+	records = make(map[string]Record, len(keys))
+	if db.history != nil {
+		call := db.history.begin()
+		defer func() {
+			if err != nil {
+				return
+			}
+			for _, key := range keys {
+				record, found := records[key]
+				db.history.end(Operation{Kind: OpGet, Key: key, Value: record.Value, Found: found, Call: call})
+			}
+		}()
+	}
+	now := db.clock.Now().UnixNano()
+
+	// pending maps the keys left to look up to their hashes.
+	pending := make(map[string]uint64, len(keys))
+	for _, key := range keys {
+		if db.access != nil {
+			db.access.record(key)
+		}
+		if db.cache != nil {
+			if cached, found := db.cache.get(key); found {
+				if !cached.deleted && !cached.record.expired(now) {
+					records[key] = cached.record
+				}
+				continue
+			}
+		}
+		pending[key] = db.keyHasher.HashKey(key)
+	}
+
+	type lookup struct {
+		key string
+		pos recordPosition
+	}
+	bySegment := make(map[*Segment][]lookup)
+	segments, release := db.pinSegments()
+	defer release()
+	for i := len(segments) - 1; i >= 0 && len(pending) > 0; i-- {
+		segment := segments[i]
+		segment.mu.Lock()
+		for key, hash := range pending {
+			if !segment.mayContain(hash) {
+				continue
+			}
+			if pos, found := segment.index[key]; found {
+				delete(pending, key)
+				if !pos.deleted && !pos.expired(now) {
+					bySegment[segment] = append(bySegment[segment], lookup{key, pos})
+				}
+			}
+		}
+		segment.mu.Unlock()
+	}
+
+	for segment, lookups := range bySegment {
+		sort.Slice(lookups, func(i, j int) bool { return lookups[i].pos.offset < lookups[j].pos.offset })
+		file, err := openFile(segment.fs, segment.filePath)
+		if err != nil {
+			return nil, err
+		}
+		reader := bufio.NewReader(file)
+		for _, l := range lookups {
+			if _, err := file.Seek(l.pos.offset, 0); err != nil {
+				file.Close()
+				return nil, err
+			}
+			reader.Reset(file)
+			e, err := readEntry(reader)
+			if err == nil {
+				err = segment.decompress(&e)
+			}
+			if err == nil && e.blob != "" {
+				e.value, err = segment.blobs.read(e.blob)
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			record := Record{Value: e.value, Version: e.version, expiresAt: e.expiresAt}
+			records[l.key] = record
+			if db.cache != nil {
+				db.cache.fill(l.key, record, func() bool {
+					_, pos, err := db.findRecord(l.key)
+					return err == nil && pos.version == record.Version
+				})
+			}
+		}
+		file.Close()
+	}
+	return records, nil
+}
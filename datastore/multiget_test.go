@@ -0,0 +1,62 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_MultiGet(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{
+		SegmentSize:  200,
+		CacheSize:    2,
+		DedupValues:  true,
+		DedupMinSize: 32,
+		Clock:        clock,
+		Filesystem:   NewMemFilesystem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat("x", 64)
+	expected := map[string]string{"large": large}
+	_ = db.Put("large", large)
+	_ = db.Put("deleted", "value")
+	_ = db.Delete("deleted")
+	_ = db.PutWithTTL("expired", "value", time.Second)
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		key := fmt.Sprintf("key%d", i)
+		_ = db.Put(key, key)
+		expected[key] = key
+	}
+	_ = db.Put("key0", "new")
+	expected["key0"] = "new"
+	clock.Advance(time.Second)
+	// A cached value is served without a lookup.
+	_, _ = db.Get("key1")
+
+	keys := []string{"missing", "deleted", "expired", "key1"}
+	for key := range expected {
+		keys = append(keys, key)
+	}
+	values, err := db.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+
+	records, err := db.MultiGetRecords([]string{"key0", "key0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records["key0"].Version != 2 {
+		t.Errorf("Expected one record of key0 with version 2, got %+v", records)
+	}
+}
@@ -0,0 +1,214 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// maxIndexDump caps the number of entries DumpIndex returns.
+const maxIndexDump = 10000
+
+var ErrIndexTooLarge = fmt.Errorf("index has more than %d entries", maxIndexDump)
+
+// IndexSummary describes the in-memory index.
+type IndexSummary struct {
+	Segments []SegmentIndexSummary `json:"segments"`
+	// Keys counts the distinct keys, deleted ones included.
+	Keys int `json:"keys"`
+}
+
+// SegmentIndexSummary describes the index of one segment.
+type SegmentIndexSummary struct {
+	File       string `json:"file"`
+	Keys       int    `json:"keys"`
+	Tombstones int    `json:"tombstones"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// IndexEntry is the indexed position of the newest record of a key within
+// one segment.
+type IndexEntry struct {
+	Key     string `json:"key"`
+	Segment string `json:"segment"`
+	Offset  int64  `json:"offset"`
+	Size    int64  `json:"size"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Version uint64 `json:"version"`
+	Blob    string `json:"blob,omitempty"`
+}
+
+// ReindexResult describes an index rebuild.
+type ReindexResult struct {
+	Segments int `json:"segments"`
+	Keys     int `json:"keys"`
+	// Changed counts the index entries that differed from the files.
+	Changed  int           `json:"changed"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (db *Db) IndexSummary() IndexSummary {
+	var summary IndexSummary
+	keys := make(map[string]struct{})
+	for _, segment := range db.segmentList() {
+		segment.mu.Lock()
+		segmentSummary := SegmentIndexSummary{
+			File:  filepath.Base(segment.filePath),
+			Keys:  len(segment.index),
+			Bytes: segment.outOffset,
+		}
+		for key, pos := range segment.index {
+			if pos.deleted {
+				segmentSummary.Tombstones++
+			}
+			keys[key] = struct{}{}
+		}
+		segment.mu.Unlock()
+		summary.Segments = append(summary.Segments, segmentSummary)
+	}
+	summary.Keys = len(keys)
+	return summary
+}
+
+// DumpIndex returns every index entry ordered by segment and offset. Large
+// indexes fail with ErrIndexTooLarge instead.
+func (db *Db) DumpIndex() ([]IndexEntry, error) {
+	var entries []IndexEntry
+	for _, segment := range db.segmentList() {
+		segment.mu.Lock()
+		if len(entries)+len(segment.index) > maxIndexDump {
+			segment.mu.Unlock()
+			return nil, ErrIndexTooLarge
+		}
+		name := filepath.Base(segment.filePath)
+		start := len(entries)
+		for key, pos := range segment.index {
+			entries = append(entries, IndexEntry{
+				Key:     key,
+				Segment: name,
+				Offset:  pos.offset,
+				Size:    pos.size,
+				Deleted: pos.deleted,
+				Version: pos.version,
+				Blob:    pos.blob,
+			})
+		}
+		segment.mu.Unlock()
+
+		own := entries[start:]
+		sort.Slice(own, func(i, j int) bool { return own[i].Offset < own[j].Offset })
+	}
+	return entries, nil
+}
+
+// Reindex rebuilds the indexes of all segments, and the tag index, from the
+// segment files while the database stays online. Sealed segments are read
+// first; writes are only paused to read the rest of the active segment and
+// swap the new indexes in at once. The value cache is dropped since it may
+// hold records found through a broken index.
+func (db *Db) Reindex() (ReindexResult, error) {
+	start := db.clock.Now()
+	// Compactions replace segments, so they must not run meanwhile.
+	db.compactionMu.Lock()
+	defer db.compactionMu.Unlock()
+
+	var result ReindexResult
+	tags := newTagIndex()
+	var indexes []hashIndex
+	var offsets []int64
+	rebuild := func(segment *Segment) error {
+		rebuilt := &Segment{index: make(hashIndex)}
+		file, err := openFile(db.fs, segment.filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		offset, err := rebuilt.recover(file, tags.apply)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading %s: %w", segment.filePath, err)
+		}
+		indexes = append(indexes, rebuilt.index)
+		offsets = append(offsets, offset)
+		return nil
+	}
+
+	// Sealed segments do not change while compactions are locked out.
+	current := db.segmentList()
+	sealed := current[:len(current)-1]
+	for _, segment := range sealed {
+		if err := rebuild(segment); err != nil {
+			return result, err
+		}
+	}
+
+	err := db.exclusive(func() error {
+		// The segment list may have grown by rotations in the meantime.
+		segments := db.segmentList()
+		for _, segment := range segments[len(sealed):] {
+			if err := rebuild(segment); err != nil {
+				return err
+			}
+		}
+
+		keys := make(map[string]struct{})
+		for i, segment := range segments {
+			segment.mu.Lock()
+			result.Changed += indexDiff(segment.index, indexes[i])
+			if i < len(segments)-1 {
+				segment.filter.Store(newBloomFilter(indexes[i], db.keyHasher))
+			}
+			segment.index = indexes[i]
+			segment.sorted = nil
+			segment.outOffset = offsets[i]
+			segment.mu.Unlock()
+			for key := range indexes[i] {
+				keys[key] = struct{}{}
+			}
+		}
+		db.outOffset = offsets[len(offsets)-1]
+		db.tags.replace(tags)
+		if err := db.blobs.gc(segments); err != nil {
+			return err
+		}
+		if db.cache != nil {
+			db.cache.clear()
+		}
+		db.recomputeSpaceStats()
+
+		result.Segments = len(segments)
+		result.Keys = len(keys)
+		return nil
+	})
+	result.Duration = db.clock.Now().Sub(start)
+	return result, err
+}
+
+// indexDiff counts the keys whose positions differ between two indexes.
+func indexDiff(old, rebuilt hashIndex) int {
+	changed := 0
+	for key, pos := range rebuilt {
+		if old[key] != pos {
+			changed++
+		}
+	}
+	for key := range old {
+		if _, found := rebuilt[key]; !found {
+			changed++
+		}
+	}
+	return changed
+}
+
+// exclusive runs fn in the entry processor, so no write is applied while
+// it runs.
+func (db *Db) exclusive(fn func() error) error {
+	done := make(chan error)
+	select {
+	case db.exclusiveOps <- func() { done <- fn() }:
+		return <-done
+	case <-db.writesStopped:
+		return ErrClosed
+	}
+}
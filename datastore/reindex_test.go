@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestDb_Reindex(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 200, CacheSize: 10, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if _, err := db.PutWithOptions(key, "value", WriteOptions{Tags: []string{"tag"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	db.compactions.Wait()
+
+	summary := db.IndexSummary()
+	if summary.Keys != 10 || len(summary.Segments) < 2 {
+		t.Fatalf("Unexpected summary %+v", summary)
+	}
+	entries, err := db.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstones := 0
+	for _, entry := range entries {
+		if entry.Deleted {
+			tombstones++
+		}
+	}
+	if tombstones != 1 {
+		t.Errorf("Expected one tombstone in the dump, got %d", tombstones)
+	}
+
+	// Break the index the way a bug could.
+	last := db.GetLastDataSegment()
+	last.mu.Lock()
+	for key, pos := range last.index {
+		pos.offset++
+		last.index[key] = pos
+	}
+	last.mu.Unlock()
+	db.tags.replace(newTagIndex())
+
+	result, err := db.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed == 0 || result.Keys != 10 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	for i := 1; i < 10; i++ {
+		if value, err := db.Get(fmt.Sprintf("key%d", i)); err != nil || value != "value" {
+			t.Errorf("Get(key%d) = %q, %v", i, value, err)
+		}
+	}
+	if _, err := db.Get("key0"); err != ErrNotFound {
+		t.Errorf("Deleted key came back: %v", err)
+	}
+	if keys := db.FindByTag("tag"); len(keys) != 9 {
+		t.Errorf("Expected the tag index to be rebuilt, got %v", keys)
+	}
+
+	result, err = db.Reindex()
+	if err != nil || result.Changed != 0 {
+		t.Errorf("Expected a consistent index, got %+v, %v", result, err)
+	}
+}
+
+func TestDb_ReindexWhileWriting(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 300, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := db.Put(fmt.Sprintf("w%d-%d", w, i), "value"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := db.Reindex(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	db.compactions.Wait()
+
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 50; i++ {
+			if value, err := db.Get(fmt.Sprintf("w%d-%d", w, i)); err != nil || value != "value" {
+				t.Errorf("Get(w%d-%d) = %q, %v", w, i, value, err)
+			}
+		}
+	}
+}
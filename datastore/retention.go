@@ -0,0 +1,192 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionRule expires records of keys starting with Prefix once they are
+// older than MaxAge, whatever their TTL, so log-like data does not grow
+// forever. A trailing "*" in the prefix is ignored. Expired records are
+// removed by SweepRetention and dropped by compaction; until then they
+// still read as present.
+type RetentionRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+type retentionRuleJSON struct {
+	Prefix string `json:"prefix"`
+	MaxAge string `json:"max_age"`
+}
+
+// MarshalJSON writes the age as a duration string such as "720h0m0s".
+func (r RetentionRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(retentionRuleJSON{Prefix: r.Prefix, MaxAge: r.MaxAge.String()})
+}
+
+// UnmarshalJSON reads the age as a duration string such as "720h".
+func (r *RetentionRule) UnmarshalJSON(data []byte) error {
+	var rule retentionRuleJSON
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return err
+	}
+	age, err := time.ParseDuration(rule.MaxAge)
+	if err != nil {
+		return fmt.Errorf("bad max age: %w", err)
+	}
+	*r = RetentionRule{Prefix: rule.Prefix, MaxAge: age}
+	return nil
+}
+
+// ParseRetentionRules reads rules in the "prefix=age,prefix=age" form,
+// e.g. "logs/*=720h,events/=24h".
+func ParseRetentionRules(spec string) ([]RetentionRule, error) {
+	var rules []RetentionRule
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, age, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("missing age in %q", item)
+		}
+		value, err := time.ParseDuration(age)
+		if err != nil {
+			return nil, fmt.Errorf("bad age in %q: %w", item, err)
+		}
+		rules = append(rules, RetentionRule{Prefix: prefix, MaxAge: value})
+	}
+	return rules, nil
+}
+
+// retentionPolicy keeps the maximum age per prefix. A key falls under the
+// rule of its longest matching prefix only.
+type retentionPolicy struct {
+	mu   sync.RWMutex
+	ages map[string]time.Duration
+}
+
+func newRetentionPolicy(rules []RetentionRule) (*retentionPolicy, error) {
+	p := &retentionPolicy{ages: make(map[string]time.Duration)}
+	for _, rule := range rules {
+		if err := p.set(rule); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// set installs or replaces the rule for a prefix. A zero age removes it.
+func (p *retentionPolicy) set(rule RetentionRule) error {
+	if rule.MaxAge < 0 {
+		return fmt.Errorf("negative max age %v for prefix %q", rule.MaxAge, rule.Prefix)
+	}
+	prefix := strings.TrimSuffix(rule.Prefix, "*")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rule.MaxAge == 0 {
+		delete(p.ages, prefix)
+		return nil
+	}
+	p.ages[prefix] = rule.MaxAge
+	return nil
+}
+
+func (p *retentionPolicy) rules() []RetentionRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	rules := make([]RetentionRule, 0, len(p.ages))
+	for prefix, age := range p.ages {
+		rules = append(rules, RetentionRule{Prefix: prefix + "*", MaxAge: age})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Prefix < rules[j].Prefix
+	})
+	return rules
+}
+
+// enabled reports whether any rule is set, so writes must record their time.
+func (p *retentionPolicy) enabled() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.ages) > 0
+}
+
+// match returns the longest prefix with a rule that key starts with.
+func (p *retentionPolicy) match(key string) (prefix string, age time.Duration, found bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for candidate, a := range p.ages {
+		if (!found || len(candidate) > len(prefix)) && strings.HasPrefix(key, candidate) {
+			prefix, age, found = candidate, a, true
+		}
+	}
+	return prefix, age, found
+}
+
+// outlived reports whether the record of key at pos is older than its
+// retention at now. Records written with no rule set and archiving off carry
+// no write time and are kept.
+func (p *retentionPolicy) outlived(key string, pos recordPosition, now int64) bool {
+	if pos.writtenAt == 0 {
+		return false
+	}
+	_, age, found := p.match(key)
+	return found && pos.writtenAt+int64(age) <= now
+}
+
+// SetRetention installs, replaces or, with a zero age, removes the
+// retention rule for a key prefix. Every bucket is a database of its own
+// and has its own rules.
+func (db *Db) SetRetention(rule RetentionRule) error {
+	return db.retention.set(rule)
+}
+
+// RetentionRules returns the configured retention rules ordered by prefix.
+func (db *Db) RetentionRules() []RetentionRule {
+	return db.retention.rules()
+}
+
+// SweepRetention deletes the keys whose newest record is older than the
+// retention of its prefix and returns how many it deleted. A key written
+// again during the sweep is kept. Expired keys are dropped from the tag index.
+func (db *Db) SweepRetention() (int, error) {
+	now := db.clock.Now().UnixNano()
+	swept := 0
+	for _, rule := range db.retention.rules() {
+		prefix := strings.TrimSuffix(rule.Prefix, "*")
+		for _, key := range db.liveKeys(keyRange{prefix: prefix}, 0) {
+			// Keys under a longer prefix are swept with its rule.
+			if matched, _, _ := db.retention.match(key); matched != prefix {
+				continue
+			}
+			_, pos, err := db.findRecord(key)
+			if err != nil || pos.deleted || !db.retention.outlived(key, pos, now) {
+				continue
+			}
+			version := pos.version
+			_, err = db.write(entry{key: key, deleted: true}, &version, DurabilityDefault)
+			if errors.Is(err, ErrVersionConflict) {
+				continue
+			}
+			if err != nil {
+				return swept, err
+			}
+			swept++
+		}
+	}
+	// Tombstones untag the swept keys, expired ones are untagged here.
+	return swept, db.exclusive(func() error {
+		db.pruneTags()
+		return nil
+	})
+}
@@ -0,0 +1,151 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_SweepRetention(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	fs := NewMemFilesystem()
+	opts := Options{
+		SegmentSize: 1024,
+		CacheSize:   10,
+		Retention: []RetentionRule{
+			{Prefix: "logs/*", MaxAge: time.Hour},
+			{Prefix: "logs/audit/", MaxAge: 24 * time.Hour},
+		},
+		Clock:      clock,
+		Filesystem: fs,
+	}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"logs/a", "logs/b", "logs/audit/a", "users/a"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(30 * time.Minute)
+	if err := db.Put("logs/b", "new"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Minute)
+
+	swept, err := db.SweepRetention()
+	if err != nil || swept != 1 {
+		t.Fatalf("Expected one key swept, got %d, %v", swept, err)
+	}
+	if _, err := db.Get("logs/a"); err != ErrNotFound {
+		t.Errorf("Expected the outlived key to be deleted, got %v", err)
+	}
+	// A rewrite restarts the age, a longer prefix has its own rule and keys
+	// without a rule are kept.
+	if keys := db.Keys("", "", 0).Keys; !reflect.DeepEqual(keys, []string{"logs/audit/a", "logs/b", "users/a"}) {
+		t.Errorf("Expected the other keys to be kept, got %v", keys)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write times survive a restart, and rules can be changed at run time.
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SetRetention(RetentionRule{Prefix: "logs/audit/", MaxAge: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetRetention(RetentionRule{Prefix: "logs/audit/", MaxAge: -time.Hour}); err == nil {
+		t.Error("Expected a negative max age to be rejected")
+	}
+	expected := []RetentionRule{{Prefix: "logs/*", MaxAge: time.Hour}, {Prefix: "logs/audit/*", MaxAge: time.Hour}}
+	if rules := db.RetentionRules(); !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Expected rules %v, got %v", expected, rules)
+	}
+	clock.Advance(30 * time.Minute)
+	if swept, err := db.SweepRetention(); err != nil || swept != 2 {
+		t.Errorf("Expected two keys swept after the restart, got %d, %v", swept, err)
+	}
+	if keys := db.Keys("", "", 0).Keys; !reflect.DeepEqual(keys, []string{"users/a"}) {
+		t.Errorf("Expected only the key without a rule to be kept, got %v", keys)
+	}
+}
+
+func TestDb_CompactionDropsOutlivedRecords(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{
+		SegmentSize: 100,
+		Retention:   []RetentionRule{{Prefix: "logs/", MaxAge: time.Minute}},
+		Clock:       clock,
+		Filesystem:  NewMemFilesystem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("logs/old", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	for i := 0; len(db.segmentList()) < 3; i++ {
+		if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.PerformOldSegmentsCompaction()
+	db.compactions.Wait()
+
+	if _, pos, err := db.findRecord("logs/old"); err != ErrNotFound {
+		t.Errorf("Expected compaction to drop the outlived record, found %+v", pos)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Expected the key without a rule to survive compaction, got %q, %v", value, err)
+	}
+}
+
+func TestRetentionRule_JSON(t *testing.T) {
+	var rule RetentionRule
+	if err := rule.UnmarshalJSON([]byte(`{"prefix":"logs/*","max_age":"720h"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if rule != (RetentionRule{Prefix: "logs/*", MaxAge: 720 * time.Hour}) {
+		t.Errorf("Unexpected rule %+v", rule)
+	}
+	data, err := rule.MarshalJSON()
+	if err != nil || string(data) != `{"prefix":"logs/*","max_age":"720h0m0s"}` {
+		t.Errorf("Unexpected encoding %s, %v", data, err)
+	}
+	if err := rule.UnmarshalJSON([]byte(`{"prefix":"logs/*","max_age":"month"}`)); err == nil {
+		t.Error("Expected a bad max age to be rejected")
+	}
+}
+
+func TestParseRetentionRules(t *testing.T) {
+	rules, err := ParseRetentionRules("logs/*=720h, events/=90m,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RetentionRule{
+		{Prefix: "logs/*", MaxAge: 720 * time.Hour},
+		{Prefix: "events/", MaxAge: 90 * time.Minute},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("Unexpected rules %+v", rules)
+	}
+
+	for _, spec := range []string{"logs/*", "logs/*=month"} {
+		if _, err := ParseRetentionRules(spec); err == nil {
+			t.Errorf("Expected an error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// segmentSet is a published segment list. Readers of segment files pin the
+// current set. A compaction publishing a new list hands the segments it
+// replaced to the set it replaced, and their files are removed once that
+// set is released. Every set holds the one after it until it is released
+// itself, so removal also waits for the readers of all older sets.
+type segmentSet struct {
+	segments []*Segment
+	// refs counts the pins of the set, one held by the database while the
+	// set is current and one by the set before it.
+	refs atomic.Int64
+	next *segmentSet
+	// retired are the segments next no longer lists.
+	retired []*Segment
+}
+
+// publishSegments makes segments the current list, removing the retired
+// segments of the previous list once no reader uses them. Callers hold
+// segmentsMu.
+func (db *Db) publishSegments(segments, retired []*Segment) {
+	set := &segmentSet{segments: segments}
+	set.refs.Store(1)
+	previous := db.segments.Swap(set)
+	if previous == nil {
+		db.removeSegments(retired)
+		return
+	}
+	set.refs.Add(1)
+	previous.next, previous.retired = set, retired
+	db.releaseSegments(previous)
+}
+
+// pinSegments returns the current segment list. The files of its segments,
+// and of any listed later, are kept until release is called.
+func (db *Db) pinSegments() (segments []*Segment, release func()) {
+	for {
+		set := db.segments.Load()
+		if set == nil {
+			return nil, func() {}
+		}
+		// A set released meanwhile is no longer current; the next load
+		// returns the one replacing it.
+		if refs := set.refs.Load(); refs > 0 && set.refs.CompareAndSwap(refs, refs+1) {
+			return set.segments, func() { db.releaseSegments(set) }
+		}
+	}
+}
+
+func (db *Db) releaseSegments(set *segmentSet) {
+	for set != nil && set.refs.Add(-1) == 0 {
+		db.removeSegments(set.retired)
+		set = set.next
+	}
+}
+
+// removeSegments deletes the files and hints of segments no longer listed.
+// A file left behind by a failure is removed on the next open.
+func (db *Db) removeSegments(segments []*Segment) {
+	if len(segments) == 0 || db.readOnly {
+		return
+	}
+	for _, segment := range segments {
+		_ = db.fs.Remove(segment.filePath)
+		_ = db.fs.Remove(segment.filePath + hintSuffix)
+	}
+	_ = db.syncDir(db.directory)
+}
+
+// removeUnlistedSegments deletes the segment files and hints the manifest
+// doesn't list, left behind by a crash after a compaction or a rotation
+// wrote the manifest. Directories without a manifest list all segment
+// files, so nothing is removed from them.
+func (db *Db) removeUnlistedSegments() error {
+	files, err := db.fs.ReadDir(db.directory)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]struct{})
+	for _, segment := range db.segmentList() {
+		listed[filepath.Base(segment.filePath)] = struct{}{}
+	}
+	var names []string
+	hasManifest := false
+	for _, file := range files {
+		if file.Name() == manifestFileName {
+			hasManifest = true
+		}
+		if _, ok := segmentNumber(strings.TrimSuffix(file.Name(), hintSuffix)); ok {
+			names = append(names, file.Name())
+		}
+	}
+	if !hasManifest {
+		return nil
+	}
+	removed := false
+	for _, name := range names {
+		if _, ok := listed[strings.TrimSuffix(name, hintSuffix)]; ok {
+			continue
+		}
+		if err := db.fs.Remove(filepath.Join(db.directory, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		return db.syncDir(db.directory)
+	}
+	return nil
+}
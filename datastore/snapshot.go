@@ -0,0 +1,279 @@
+package datastore
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A snapshot is a tar stream of the manifest, the segment files under
+// "segments/" with the index hints of the sealed ones, the referenced blobs
+// under "blobs/" and, last, a "CHECKSUMS" entry mapping every other entry
+// to its sha256.
+const (
+	snapshotSegmentDir = "segments/"
+	snapshotBlobDir    = "blobs/"
+	snapshotChecksums  = "CHECKSUMS"
+)
+
+// snapshotFile is a file captured for a snapshot, with the size it had.
+type snapshotFile struct {
+	name string
+	path string
+	size int64
+}
+
+// Snapshot writes a point-in-time copy of the database into the empty
+// directory dir, which opens as a database of its own: a backup. It is
+// WriteSnapshot restored on the fly, checksums verified.
+func (db *Db) Snapshot(dir string) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(db.WriteSnapshot(w))
+	}()
+	err := RestoreSnapshot(r, dir)
+	// Unblocks the snapshot writer when the restore failed early.
+	r.CloseWithError(err)
+	return err
+}
+
+// WriteSnapshot streams a point-in-time copy of the database to w, to be
+// restored with RestoreSnapshot. Segments are append-only, so the copy is
+// the sealed segments and the active one up to its current size; writes
+// continue meanwhile. Compactions wait for the snapshot to finish. The
+// index hints of the sealed segments are copied too, so the copy opens
+// without scanning them.
+func (db *Db) WriteSnapshot(w io.Writer) error {
+	db.compactionMu.Lock()
+	defer db.compactionMu.Unlock()
+
+	var segments []snapshotFile
+	blobs := make(map[string]bool)
+	err := db.exclusive(func() error {
+		for _, segment := range db.segmentList() {
+			segment.mu.Lock()
+			segments = append(segments, snapshotFile{
+				name: snapshotSegmentDir + filepath.Base(segment.filePath),
+				path: segment.filePath,
+				size: segment.outOffset,
+			})
+			for _, pos := range segment.index {
+				if pos.blob != "" {
+					blobs[pos.blob] = true
+				}
+			}
+			segment.mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m := manifest{Segments: make([]string, len(segments))}
+	for i, segment := range segments {
+		m.Segments[i] = strings.TrimPrefix(segment.name, snapshotSegmentDir)
+	}
+	manifestData, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	checksums := make(map[string]string)
+	add := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: size}); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(tw, hash), r, size); err != nil {
+			return err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	}
+	addFile := func(file snapshotFile) error {
+		in, err := openFile(db.fs, file.path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		return add(file.name, file.size, in)
+	}
+
+	if err := add(manifestFileName, int64(len(manifestData)), strings.NewReader(string(manifestData))); err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		if err := addFile(segment); err != nil {
+			return err
+		}
+		// A hint is replaced in one rename, and missing for a segment just
+		// sealed; it only saves the restored database a scan.
+		if i == len(segments)-1 {
+			continue
+		}
+		if hint, err := db.fs.ReadFile(segment.path + hintSuffix); err == nil {
+			if err := add(segment.name+hintSuffix, int64(len(hint)), bytes.NewReader(hint)); err != nil {
+				return err
+			}
+		}
+	}
+	for hash := range blobs {
+		in, err := openFile(db.fs, db.blobs.path(hash))
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMissingBlob, hash)
+		}
+		info, err := in.Stat()
+		in.Close()
+		if err != nil {
+			return err
+		}
+		if err := addFile(snapshotFile{name: snapshotBlobDir + hash, path: db.blobs.path(hash), size: info.Size()}); err != nil {
+			return err
+		}
+	}
+
+	checksumData, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotChecksums, Mode: 0o600, Size: int64(len(checksumData))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(checksumData); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// RestoreSnapshot writes a snapshot read from r into the empty directory
+// dir. Every file is verified against the checksums closing the snapshot;
+// a mismatch, or a snapshot cut short, fails with ErrChecksumMismatch. On
+// failure dir may be left with part of the files.
+func RestoreSnapshot(r io.Reader, dir string) error {
+	err := restoreSnapshot(r, dir)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: snapshot cut short", ErrChecksumMismatch)
+	}
+	return err
+}
+
+func restoreSnapshot(r io.Reader, dir string) error {
+	if err := os.MkdirAll(filepath.Join(dir, blobDirName), 0o755); err != nil {
+		return err
+	}
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 1 {
+		return fmt.Errorf("restore directory %s is not empty", dir)
+	}
+
+	tr := tar.NewReader(r)
+	received := make(map[string]string)
+	var manifestData []byte
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: snapshot ended before its checksums", ErrChecksumMismatch)
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Name == snapshotChecksums {
+			var checksums map[string]string
+			if err := json.NewDecoder(tr).Decode(&checksums); err != nil {
+				return err
+			}
+			if err := verifySnapshot(received, checksums); err != nil {
+				return err
+			}
+			break
+		}
+
+		target, err := snapshotTarget(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		hash := sha256.New()
+		in := io.TeeReader(tr, hash)
+		if header.Name == manifestFileName {
+			// The manifest is written once its segments are verified.
+			if manifestData, err = io.ReadAll(in); err != nil {
+				return err
+			}
+		} else if err := writeSnapshotFile(target, in); err != nil {
+			return err
+		}
+		received[header.Name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	var m manifest
+	if err := json.Unmarshal(manifestData, &m); err != nil {
+		return fmt.Errorf("bad snapshot manifest: %w", err)
+	}
+	for _, name := range m.Segments {
+		if _, found := received[snapshotSegmentDir+name]; !found {
+			return fmt.Errorf("snapshot lacks segment %s listed in its manifest", name)
+		}
+	}
+	return writeSnapshotFile(filepath.Join(dir, manifestFileName), strings.NewReader(string(manifestData)))
+}
+
+// snapshotTarget maps an entry name to its path in dir, refusing names
+// that are not part of a snapshot.
+func snapshotTarget(dir, name string) (string, error) {
+	if name == manifestFileName {
+		return "", nil
+	}
+	base := path.Base(name)
+	switch {
+	case name == snapshotSegmentDir+base:
+		if _, ok := segmentNumber(strings.TrimSuffix(base, hintSuffix)); ok {
+			return filepath.Join(dir, base), nil
+		}
+	case name == snapshotBlobDir+base && base != "." && base != "..":
+		return filepath.Join(dir, blobDirName, base), nil
+	}
+	return "", fmt.Errorf("unexpected snapshot entry %q", name)
+}
+
+func writeSnapshotFile(path string, in io.Reader) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func verifySnapshot(received, checksums map[string]string) error {
+	if len(received) != len(checksums) {
+		return fmt.Errorf("%w: expected %d files, got %d", ErrChecksumMismatch, len(checksums), len(received))
+	}
+	for name, checksum := range checksums {
+		if received[name] != checksum {
+			return fmt.Errorf("%w: %s", ErrChecksumMismatch, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_Snapshot(t *testing.T) {
+	source, err := Open("db", Options{SegmentSize: 200, DedupValues: true, DedupMinSize: 16, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	large := strings.Repeat("x", 32)
+	for i := 0; i < 20; i++ {
+		if err := source.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := source.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := source.WriteSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), dir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewDatabase(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	for i := 0; i < 20; i++ {
+		value, err := restored.Get(fmt.Sprintf("key%d", i))
+		if i == 3 {
+			if err != ErrNotFound {
+				t.Errorf("Expected key3 to stay deleted, got %q (err: %v)", value, err)
+			}
+			continue
+		}
+		if err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Unexpected key%d: %q (err: %v)", i, value, err)
+		}
+	}
+	if value, err := restored.Get("large"); err != nil || value != large {
+		t.Errorf("Expected the deduplicated value to be restored, got %q (err: %v)", value, err)
+	}
+
+	if err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), dir); err == nil {
+		t.Error("Expected a restore into a used directory to fail")
+	}
+
+	corrupted := bytes.Clone(snapshot.Bytes())
+	at := bytes.Index(corrupted, []byte("value7"))
+	corrupted[at] = 'V'
+	if err := RestoreSnapshot(bytes.NewReader(corrupted), t.TempDir()); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	if err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()/2]), t.TempDir()); err == nil {
+		t.Error("Expected a truncated snapshot to fail")
+	}
+}
+
+func TestDb_SnapshotDir(t *testing.T) {
+	source, err := Open("db", Options{SegmentSize: 200, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for i := 0; i < 20; i++ {
+		if err := source.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source.hintWrites.Wait()
+
+	// Writes go on while the copy is taken; it holds those done before.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			_ = source.Put(fmt.Sprintf("later%d", i), "value")
+		}
+	}()
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := source.Snapshot(dir); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+hintSuffix))
+	if len(hints) == 0 {
+		t.Error("Expected the hints of the sealed segments to be copied")
+	}
+	backup, err := NewDatabase(dir, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	for i := 0; i < 20; i++ {
+		if value, err := backup.Get(fmt.Sprintf("key%d", i)); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Unexpected key%d: %q (err: %v)", i, value, err)
+		}
+	}
+
+	if err := source.Snapshot(dir); err == nil {
+		t.Error("Expected a snapshot into a used directory to fail")
+	}
+}
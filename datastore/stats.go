@@ -0,0 +1,210 @@
+package datastore
+
+import "path/filepath"
+
+// Stats describes the current state of the database files.
+type Stats struct {
+	Segments  []SegmentStats `json:"segments"`
+	LiveBytes int64          `json:"live_bytes"`
+	DeadBytes int64          `json:"dead_bytes"`
+	DeadRatio float64        `json:"dead_ratio"`
+	Cache     *CacheStats    `json:"cache,omitempty"`
+	// Repairs made when the database was opened.
+	Repairs []RepairEvent `json:"repairs,omitempty"`
+	Dedup   *DedupStats   `json:"dedup,omitempty"`
+	Memory  MemoryStats   `json:"memory"`
+	// Compaction describes the compactions run since the database was
+	// opened.
+	Compaction CompactionStats `json:"compaction"`
+	IO         IOStats         `json:"io"`
+}
+
+// SegmentStats splits a segment size into bytes holding current values and
+// dead bytes of overwritten records and tombstones.
+type SegmentStats struct {
+	File      string  `json:"file"`
+	LiveBytes int64   `json:"live_bytes"`
+	DeadBytes int64   `json:"dead_bytes"`
+	DeadRatio float64 `json:"dead_ratio"`
+}
+
+func (db *Db) Stats() Stats {
+	var stats Stats
+	for _, segment := range db.segmentList() {
+		segment.mu.Lock()
+		segmentStats := SegmentStats{
+			File:      filepath.Base(segment.filePath),
+			LiveBytes: segment.liveBytes,
+			DeadBytes: segment.deadBytes,
+			DeadRatio: deadRatio(segment.liveBytes, segment.deadBytes),
+		}
+		segment.mu.Unlock()
+
+		stats.Segments = append(stats.Segments, segmentStats)
+		stats.LiveBytes += segmentStats.LiveBytes
+		stats.DeadBytes += segmentStats.DeadBytes
+	}
+	stats.DeadRatio = deadRatio(stats.LiveBytes, stats.DeadBytes)
+	if db.cache != nil {
+		cacheStats := db.cache.stats()
+		stats.Cache = &cacheStats
+	}
+	stats.Repairs = db.Repairs()
+	stats.Memory = db.MemoryStats()
+	stats.Compaction = db.CompactionStats()
+	stats.IO = db.IOStats()
+	if db.dedupMinSize > 0 {
+		dedup := db.blobs.stats()
+		stats.Dedup = &dedup
+	}
+	return stats
+}
+
+// markDead moves the bytes of the current record of key to the dead space of
+// its segment.
+func (db *Db) markDead(key string) {
+	segments := db.segmentList()
+	hash := db.keyHasher.HashKey(key)
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if !segment.mayContain(hash) {
+			continue
+		}
+		segment.mu.Lock()
+		pos, found := segment.index[key]
+		if found && !pos.deleted {
+			segment.liveBytes -= pos.size
+			segment.deadBytes += pos.size
+		}
+		segment.mu.Unlock()
+		if found {
+			return
+		}
+	}
+}
+
+// recomputeSpaceStats rebuilds live and dead byte counters of all segments
+// from their indexes and sizes, and the memory the indexes hold. Only the
+// newest record of a key is live.
+func (db *Db) recomputeSpaceStats() {
+	segments := db.segmentList()
+	seen := make(map[string]struct{})
+	var indexBytes int64
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		segment.mu.Lock()
+		segment.liveBytes = 0
+		for key, pos := range segment.index {
+			indexBytes += indexEntryBytes(key, pos)
+			if _, shadowed := seen[key]; !shadowed && !pos.deleted {
+				segment.liveBytes += pos.size
+			}
+			seen[key] = struct{}{}
+		}
+		// Records overwritten within the segment are not indexed at all.
+		segment.deadBytes = segment.outOffset - segment.liveBytes
+		segment.mu.Unlock()
+	}
+	db.memory.index.Store(indexBytes)
+	if db.cache != nil {
+		db.cache.trim()
+	}
+}
+
+// CompactionEstimate tells what a compaction started now would do.
+type CompactionEstimate struct {
+	// Segments are the sealed segment files merged, oldest first. A
+	// compaction needs at least two segments, the active one is kept.
+	Segments []string `json:"segments"`
+	// InputBytes is the size of the merged segments, OutputBytes the size of
+	// the records copied to the compacted one.
+	InputBytes     int64 `json:"input_bytes"`
+	OutputBytes    int64 `json:"output_bytes"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+	// Records is the number of records kept, DroppedKeys the number of
+	// deleted, expired and outlived keys removed completely. Only a merge
+	// starting at the oldest segment drops keys.
+	Records     int `json:"records"`
+	DroppedKeys int `json:"dropped_keys"`
+}
+
+// EstimateCompaction works out from the in-memory indexes which records a
+// compaction would keep, without reading the segment files. With tiered
+// compaction it estimates the merge of the run picked next, if there is
+// one; otherwise that of all sealed segments.
+func (db *Db) EstimateCompaction() CompactionEstimate {
+	estimate := CompactionEstimate{Segments: []string{}}
+	segments := db.segmentList()
+	if len(segments) < 2 {
+		return estimate
+	}
+	first, last := allSealed(segments)
+	if db.tierFanout > 0 {
+		if f, l := db.tierRun(segments); l >= f {
+			first, last = f, l
+		}
+	}
+	merged := segments[first : last+1]
+	bottom := first == 0
+	now := db.clock.Now().UnixNano()
+
+	// Like the compaction, only the newest record of a key among the merged
+	// segments is copied, and a merge from the oldest segment drops what
+	// droppable does.
+	seen := make(map[string]struct{})
+	for i := len(merged) - 1; i >= 0; i-- {
+		segment := merged[i]
+		segment.mu.Lock()
+		estimate.InputBytes += segment.outOffset
+		for key, pos := range segment.index {
+			if _, shadowed := seen[key]; shadowed {
+				continue
+			}
+			seen[key] = struct{}{}
+			if bottom && db.droppable(key, pos, now) {
+				estimate.DroppedKeys++
+				continue
+			}
+			estimate.Records++
+			estimate.OutputBytes += pos.size
+		}
+		segment.mu.Unlock()
+	}
+	for _, segment := range merged {
+		estimate.Segments = append(estimate.Segments, filepath.Base(segment.filePath))
+	}
+	estimate.ReclaimedBytes = estimate.InputBytes - estimate.OutputBytes
+	return estimate
+}
+
+// defaultCompactionSegments is the segment count triggering compaction
+// when Options.CompactionSegments is zero.
+const defaultCompactionSegments = 3
+
+// shouldCompact reports whether sealed segments should be merged after a
+// rotation.
+func (db *Db) shouldCompact() bool {
+	segments := db.segmentList()
+	if db.compactionSegments > 0 && len(segments) >= db.compactionSegments {
+		return true
+	}
+	if db.deadRatio <= 0 || len(segments) < 2 {
+		return false
+	}
+
+	var live, dead int64
+	for _, segment := range segments[:len(segments)-1] {
+		segment.mu.Lock()
+		live += segment.liveBytes
+		dead += segment.deadBytes
+		segment.mu.Unlock()
+	}
+	return deadRatio(live, dead) >= db.deadRatio
+}
+
+func deadRatio(live, dead int64) float64 {
+	if live+dead == 0 {
+		return 0
+	}
+	return float64(dead) / float64(live+dead)
+}
@@ -0,0 +1,328 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_ = db.Put("1", "v1")
+	_ = db.Put("2", "v2")
+	_ = db.Put("1", "v3")
+
+	stats := db.Stats()
+	if stats.LiveBytes != 56 || stats.DeadBytes != 26 {
+		t.Errorf("Unexpected space after overwrite: live %d, dead %d", stats.LiveBytes, stats.DeadBytes)
+	}
+
+	_ = db.Delete("2")
+	stats = db.Stats()
+	if stats.LiveBytes != 30 || stats.DeadBytes != 83 {
+		t.Errorf("Unexpected space after delete: live %d, dead %d", stats.LiveBytes, stats.DeadBytes)
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDatabase(dir, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recovered := db.Stats()
+		if recovered.LiveBytes != stats.LiveBytes || recovered.DeadBytes != stats.DeadBytes {
+			t.Errorf("Space stats changed after recovery: %+v vs %+v", recovered, stats)
+		}
+	})
+}
+
+func TestDb_DeadRatioCompaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-dead-ratio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, Options{SegmentSize: 86, CompactionDeadRatio: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		_ = db.Put("1", "v1")
+	}
+	_ = db.Put("2", "v2")
+
+	db.compactions.Wait()
+	if stats := db.Stats(); stats.Segments[0].DeadBytes != 0 || stats.Segments[0].LiveBytes != 30 {
+		t.Fatalf("Sealed segment was not compacted: %+v", stats)
+	}
+
+	if value, err := db.Get("1"); err != nil || value != "v1" {
+		t.Errorf("Bad value returned expected v1, got %s (err: %v)", value, err)
+	}
+}
+
+func TestDb_CompactionSegments(t *testing.T) {
+	rotate := func(db *Db, segments int) {
+		for i := 0; len(db.segmentList()) < segments; i++ {
+			_ = db.Put(fmt.Sprintf("key%d", i), "value")
+		}
+		db.compactions.Wait()
+	}
+
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: 5, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rotate(db, 4)
+	if n := len(db.segmentList()); n != 4 {
+		t.Fatalf("Expected no compaction below the threshold, got %d segments", n)
+	}
+	rotate(db, 5)
+	if n := len(db.segmentList()); n != 2 {
+		t.Errorf("Expected a compaction at 5 segments, got %d segments", n)
+	}
+
+	db, err = Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rotate(db, 6)
+	if n := len(db.segmentList()); n != 6 {
+		t.Errorf("Expected the segment count to trigger nothing, got %d segments", n)
+	}
+
+	if _, err := Open("db", Options{CompactionSegments: 1, Filesystem: NewMemFilesystem()}); err == nil {
+		t.Error("Expected a threshold below 2 segments to be rejected")
+	}
+}
+
+func TestDb_EstimateCompaction(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 120, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if estimate := db.EstimateCompaction(); len(estimate.Segments) != 0 || estimate.ReclaimedBytes != 0 {
+		t.Errorf("Expected nothing to compact in a single segment, got %+v", estimate)
+	}
+	_ = db.Put("a", "1")
+	_ = db.Put("b", "1")
+	_ = db.Put("a", "2")
+	_ = db.Delete("b")
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		_ = db.Put(fmt.Sprintf("filler%d", i), "value")
+	}
+
+	estimate := db.EstimateCompaction()
+	sealed := db.segmentList()[0]
+	if len(estimate.Segments) != 1 || estimate.Segments[0] != filepath.Base(sealed.filePath) {
+		t.Errorf("Expected the sealed segment to be merged, got %v", estimate.Segments)
+	}
+	if estimate.InputBytes != sealed.outOffset || estimate.DroppedKeys != 1 {
+		t.Errorf("Unexpected estimate %+v", estimate)
+	}
+
+	db.PerformOldSegmentsCompaction()
+	db.compactions.Wait()
+	compacted := db.segmentList()[0]
+	if estimate.OutputBytes != compacted.outOffset || estimate.Records != len(compacted.index) {
+		t.Errorf("Expected %+v to match the compacted segment of %d bytes and %d records",
+			estimate, compacted.outOffset, len(compacted.index))
+	}
+	if estimate.ReclaimedBytes != estimate.InputBytes-estimate.OutputBytes || estimate.ReclaimedBytes <= 0 {
+		t.Errorf("Unexpected reclaimed bytes %+v", estimate)
+	}
+}
+
+func TestDb_EstimateCompactionRules(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	fsys := NewMemFilesystem()
+	opts := Options{
+		SegmentSize:        100,
+		CompactionSegments: -1,
+		Retention:          []RetentionRule{{Prefix: "logs/", MaxAge: time.Hour}},
+		Clock:              clock,
+		Filesystem:         fsys,
+	}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Put("logs/a", "1")
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put(fmt.Sprintf("key%02d", i), "value")
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Delete("key00")
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put(fmt.Sprintf("new%d", i), "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+
+	// Outlived records are dropped like the compaction drops them.
+	opts.ReadOnly = true
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimate := db.EstimateCompaction()
+	if len(estimate.Segments) != 3 || estimate.DroppedKeys != 2 {
+		t.Errorf("Expected the tombstone and the outlived key dropped from 3 segments, got %+v", estimate)
+	}
+	_ = db.Close()
+
+	// Tiered compaction merges the newest small segments only, which
+	// keeps the tombstone.
+	opts.CompactionTierFanout = 2
+	db, err = Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	segments := db.segmentList()
+	estimate = db.EstimateCompaction()
+	if len(estimate.Segments) != 2 || estimate.Segments[0] != filepath.Base(segments[1].filePath) {
+		t.Errorf("Expected the run of the two newest sealed segments, got %v", estimate.Segments)
+	}
+	if estimate.DroppedKeys != 0 {
+		t.Errorf("Expected nothing dropped above the oldest segment, got %+v", estimate)
+	}
+}
+
+func TestDb_CompactionManager(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; len(db.segmentList()) < 5; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+
+	// Requests made meanwhile are served by one more round at most.
+	for i := 0; i < 10; i++ {
+		db.PerformOldSegmentsCompaction()
+	}
+	db.compactions.Wait()
+	if n := len(db.segmentList()); n != 2 {
+		t.Errorf("Expected the sealed segments to be merged, got %d segments", n)
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value" {
+		t.Errorf("Expected key0 to survive, got %q, %v", value, err)
+	}
+}
+
+func TestDb_CompactionStats(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 100, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if stats := db.CompactionStats(); stats != (CompactionStats{}) {
+		t.Errorf("Expected no compaction yet, got %+v", stats)
+	}
+	for i := 0; len(db.segmentList()) < 4; i++ {
+		_ = db.Put("key", fmt.Sprintf("value%d", i))
+	}
+	var inputBytes int64
+	for _, segment := range db.segmentList()[:3] {
+		inputBytes += segment.outOffset
+	}
+
+	db.PerformOldSegmentsCompaction()
+	if !db.CompactionStats().InProgress {
+		t.Error("Expected the requested compaction to be in progress")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.CompactionStats().InProgress && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	stats := db.CompactionStats()
+	compacted := db.segmentList()[0].outOffset
+	if stats.InProgress || stats.Runs != 1 || stats.BytesRewritten != compacted || stats.BytesReclaimed != inputBytes-compacted {
+		t.Errorf("Unexpected stats %+v after merging %d bytes into %d", stats, inputBytes, compacted)
+	}
+	if stats.LastDuration <= 0 || db.Stats().Compaction != stats {
+		t.Errorf("Expected the duration in the database stats, got %+v", db.Stats().Compaction)
+	}
+}
+
+func TestDb_IOStats(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 1000, CacheSize: 10, CompactionSegments: -1, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	before := db.IOStats()
+	if _, err := db.PutWithOptions("key", "value", WriteOptions{Durability: DurabilitySync}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBatch([]Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = db.Get("key")
+	_, _ = db.Get("key")
+
+	stats := db.IOStats()
+	if stats.LogicalBytesWritten != 12 || stats.CacheReadBytes != 5 || stats.SegmentReadBytes != 5 {
+		t.Errorf("Unexpected logical IO %+v", stats)
+	}
+	if stats.DiskBytesWritten-before.DiskBytesWritten <= stats.LogicalBytesWritten || stats.WriteAmplification <= 1 {
+		t.Errorf("Expected the record framing to amplify the writes, got %+v", stats)
+	}
+	if stats.Fsyncs <= before.Fsyncs || stats.DiskBytesRead <= before.DiskBytesRead {
+		t.Errorf("Expected the sync write and the segment read to be counted, got %+v after %+v", stats, before)
+	}
+	if db.Stats().IO != db.IOStats() {
+		t.Error("Expected the IO counters in the database stats")
+	}
+}
+
+func TestIOPacer(t *testing.T) {
+	pacer := newIOPacer(10000)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := pacer.wrote(context.Background(), 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected 500 bytes at 10000 B/s to take about 50ms, took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pacer.wrote(ctx, 10000); err != context.Canceled {
+		t.Errorf("Expected the wait to end with the context, got %v", err)
+	}
+	if err := newIOPacer(0).wrote(context.Background(), 1<<30); err != nil {
+		t.Errorf("Expected no limit, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// streamKeyPrefix is the key prefix streams are stored under. Messages are
+// kept as "_streams/<stream>/msg/<seq>" with the sequence number zero
+// padded, so key order is append order, the last sequence number handed
+// out as "_streams/<stream>/last", and the committed offsets of the consumer
+// groups as "_streams/<stream>/offsets/<group>".
+const streamKeyPrefix = "_streams/"
+
+// defaultConsumeLimit is the number of messages Consume returns at most
+// when no limit is given.
+const defaultConsumeLimit = 100
+
+var ErrBadStreamName = errors.New("stream and group names must be non-empty and must not contain '/'")
+
+// Message is an entry of a stream. Sequence numbers start at 1 and grow by
+// one with every append. They are never handed out again, not even after
+// the newest messages were deleted.
+type Message struct {
+	Seq     uint64 `json:"seq"`
+	Payload string `json:"payload"`
+}
+
+// streamSeqs hands out the sequence numbers of appended messages. The last
+// number of a stream is read from its high-water mark on its first append.
+type streamSeqs struct {
+	mu   sync.Mutex
+	last map[string]uint64
+}
+
+func messagePrefix(stream string) string {
+	return streamKeyPrefix + stream + "/msg/"
+}
+
+func messageKey(stream string, seq uint64) string {
+	return fmt.Sprintf("%s%020d", messagePrefix(stream), seq)
+}
+
+func lastSeqKey(stream string) string {
+	return streamKeyPrefix + stream + "/last"
+}
+
+func offsetKey(stream, group string) string {
+	return streamKeyPrefix + stream + "/offsets/" + group
+}
+
+func validStreamName(name string) bool {
+	return name != "" && !strings.Contains(name, "/")
+}
+
+// Append adds payload to the end of stream and returns its sequence
+// number.
+func (db *Db) Append(stream, payload string) (uint64, error) {
+	if !validStreamName(stream) {
+		return 0, ErrBadStreamName
+	}
+	db.streams.mu.Lock()
+	defer db.streams.mu.Unlock()
+
+	last, known := db.streams.last[stream]
+	if !known {
+		var err error
+		if last, err = db.lastSeq(stream); err != nil {
+			return 0, err
+		}
+	}
+
+	// The high-water mark is written with the message, so deleting the
+	// newest messages doesn't hand their numbers out again.
+	seq := last + 1
+	err := db.PutBatch([]Entry{
+		{Key: messageKey(stream, seq), Value: payload},
+		{Key: lastSeqKey(stream), Value: strconv.FormatUint(seq, 10)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	db.streams.last[stream] = seq
+	return seq, nil
+}
+
+// lastSeq returns the last sequence number of stream. Streams appended to
+// before there was a high-water mark continue after their newest message.
+func (db *Db) lastSeq(stream string) (uint64, error) {
+	value, err := db.Get(lastSeqKey(stream))
+	if err == nil {
+		return strconv.ParseUint(value, 10, 64)
+	}
+	if err != ErrNotFound {
+		return 0, err
+	}
+	keys := db.Keys(messagePrefix(stream), "", 0).Keys
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(strings.TrimPrefix(keys[len(keys)-1], messagePrefix(stream)), 10, 64)
+}
+
+// Consume returns up to limit messages of stream for a consumer group.
+// With from set it reads from that sequence number on, otherwise it
+// continues after the offset the group committed with Ack. Messages stay
+// in the stream until they are acknowledged and are returned again until
+// then.
+func (db *Db) Consume(stream, group string, from uint64, limit int) ([]Message, error) {
+	if !validStreamName(stream) || !validStreamName(group) {
+		return nil, ErrBadStreamName
+	}
+	if limit <= 0 {
+		limit = defaultConsumeLimit
+	}
+	if from == 0 {
+		committed, _, err := db.committedOffset(stream, group)
+		if err != nil {
+			return nil, err
+		}
+		from = committed + 1
+	}
+
+	after := ""
+	if from > 1 {
+		after = messageKey(stream, from-1)
+	}
+	messages := []Message{}
+	for _, key := range db.Keys(messagePrefix(stream), after, limit).Keys {
+		payload, err := db.Get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		seq, _ := strconv.ParseUint(strings.TrimPrefix(key, messagePrefix(stream)), 10, 64)
+		messages = append(messages, Message{Seq: seq, Payload: payload})
+	}
+	return messages, nil
+}
+
+// Ack commits the offset of a consumer group: messages up to seq are not
+// returned by Consume anymore. Offsets only move forward, so late or
+// repeated acknowledgements are no-ops.
+func (db *Db) Ack(stream, group string, seq uint64) error {
+	if !validStreamName(stream) || !validStreamName(group) {
+		return ErrBadStreamName
+	}
+	for {
+		committed, version, err := db.committedOffset(stream, group)
+		if err != nil || seq <= committed {
+			return err
+		}
+		_, err = db.PutWithOptions(offsetKey(stream, group), strconv.FormatUint(seq, 10), WriteOptions{ExpectedVersion: &version})
+		if err != ErrVersionConflict {
+			return err
+		}
+		// Another acknowledgement of the group won, check against it.
+	}
+}
+
+// CommittedOffset returns the last sequence number a consumer group
+// acknowledged, zero if none.
+func (db *Db) CommittedOffset(stream, group string) (uint64, error) {
+	offset, _, err := db.committedOffset(stream, group)
+	return offset, err
+}
+
+// committedOffset returns the offset of a group with the version of its
+// record, zero for both if it never acknowledged anything.
+func (db *Db) committedOffset(stream, group string) (uint64, uint64, error) {
+	record, err := db.GetRecord(offsetKey(stream, group))
+	if err == ErrNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	offset, err := strconv.ParseUint(record.Value, 10, 64)
+	return offset, record.Version, err
+}
@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Streams(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 256, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		seq, err := db.Append("orders", fmt.Sprintf("order%d", i))
+		if err != nil || seq != uint64(i) {
+			t.Fatalf("Unexpected append %d (err: %v)", seq, err)
+		}
+	}
+	if _, err := db.Append("orders/x", "bad"); err != ErrBadStreamName {
+		t.Errorf("Expected a bad stream name error, got %v", err)
+	}
+
+	messages, err := db.Consume("orders", "billing", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Message{{Seq: 1, Payload: "order1"}, {Seq: 2, Payload: "order2"}}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Unexpected messages %+v", messages)
+	}
+
+	// Unacknowledged messages are delivered again, acknowledged ones not.
+	if err := db.Ack("orders", "billing", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ack("orders", "billing", 1); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ = db.Consume("orders", "billing", 0, 0)
+	if !reflect.DeepEqual(messages, []Message{{Seq: 3, Payload: "order3"}}) {
+		t.Errorf("Unexpected messages after the ack %+v", messages)
+	}
+	if offset, _ := db.CommittedOffset("orders", "billing"); offset != 2 {
+		t.Errorf("Expected offset 2 not to move back, got %d", offset)
+	}
+
+	// Groups are independent and can replay from any sequence number.
+	if messages, _ := db.Consume("orders", "audit", 0, 0); len(messages) != 3 {
+		t.Errorf("Expected a new group to start at the beginning, got %+v", messages)
+	}
+	if messages, _ := db.Consume("orders", "billing", 2, 1); !reflect.DeepEqual(messages, []Message{{Seq: 2, Payload: "order2"}}) {
+		t.Errorf("Unexpected replayed messages %+v", messages)
+	}
+	db.Close()
+
+	// Sequence numbers and offsets continue after a restart.
+	db, err = Open("db", Options{SegmentSize: 256, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if seq, err := db.Append("orders", "order4"); err != nil || seq != 4 {
+		t.Errorf("Expected sequence 4 after the restart, got %d (err: %v)", seq, err)
+	}
+	messages, _ = db.Consume("orders", "billing", 0, 0)
+	if len(messages) != 2 || messages[0].Seq != 3 {
+		t.Errorf("Unexpected messages after the restart %+v", messages)
+	}
+}
+
+func TestDb_AppendAfterDeletingTail(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 256, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := db.Append("q", fmt.Sprintf("m%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Ack("q", "g", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(messageKey("q", 2)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// A reused sequence number would sit behind the offset of the group.
+	db, err = Open("db", Options{SegmentSize: 256, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	seq, err := db.Append("q", "m3")
+	if err != nil || seq != 3 {
+		t.Fatalf("Expected sequence 3 after deleting the tail, got %d (err: %v)", seq, err)
+	}
+	messages, err := db.Consume("q", "g", 0, 10)
+	if err != nil || !reflect.DeepEqual(messages, []Message{{Seq: 3, Payload: "m3"}}) {
+		t.Errorf("Expected the new message for the group, got %+v (err: %v)", messages, err)
+	}
+}
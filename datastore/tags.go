@@ -0,0 +1,158 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const maxTagsSize = 1<<16 - 1
+
+// tagIndex is the inverted index from tags to the keys currently carrying
+// them. Tags belong to the latest record of a key, so every write replaces
+// the previous tags of the key.
+type tagIndex struct {
+	mu      sync.RWMutex
+	keys    map[string]map[string]struct{}
+	keyTags map[string][]string
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys:    make(map[string]map[string]struct{}),
+		keyTags: make(map[string][]string),
+	}
+}
+
+// apply updates the index with a record written to the database.
+func (ti *tagIndex) apply(e *entry) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	for _, tag := range ti.keyTags[e.key] {
+		delete(ti.keys[tag], e.key)
+		if len(ti.keys[tag]) == 0 {
+			delete(ti.keys, tag)
+		}
+	}
+	delete(ti.keyTags, e.key)
+
+	if e.deleted || len(e.tags) == 0 {
+		return
+	}
+	ti.keyTags[e.key] = e.tags
+	for _, tag := range e.tags {
+		if ti.keys[tag] == nil {
+			ti.keys[tag] = make(map[string]struct{})
+		}
+		ti.keys[tag][e.key] = struct{}{}
+	}
+}
+
+// replace swaps in the contents of a rebuilt index.
+func (ti *tagIndex) replace(other *tagIndex) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.keys, ti.keyTags = other.keys, other.keyTags
+}
+
+func (ti *tagIndex) find(tag string) []string {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	keys := make([]string, 0, len(ti.keys[tag]))
+	for key := range ti.keys[tag] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// prune drops the keys for which live reports false from the index.
+func (ti *tagIndex) prune(live func(key string) bool) {
+	ti.mu.RLock()
+	var dead []string
+	for key := range ti.keyTags {
+		if !live(key) {
+			dead = append(dead, key)
+		}
+	}
+	ti.mu.RUnlock()
+	for _, key := range dead {
+		ti.apply(&entry{key: key, deleted: true})
+	}
+}
+
+// PutWithTags stores the value like Put and attaches the given tags to the
+// key, replacing the tags of its previous value.
+func (db *Db) PutWithTags(key, value string, tags []string) error {
+	_, err := db.PutWithOptions(key, value, WriteOptions{Tags: tags})
+	return err
+}
+
+// FindByTag returns the sorted keys whose current value carries the tag.
+// Keys past their expiry are left out until pruneTags drops them.
+func (db *Db) FindByTag(tag string) []string {
+	now := db.clock.Now().UnixNano()
+	keys := db.tags.find(tag)
+	live := keys[:0]
+	for _, key := range keys {
+		if db.liveTagged(key, now) {
+			live = append(live, key)
+		}
+	}
+	return live
+}
+
+// liveTagged reports whether the newest record of key is neither deleted
+// nor expired at now.
+func (db *Db) liveTagged(key string, now int64) bool {
+	_, pos, err := db.findRecord(key)
+	return err == nil && !pos.deleted && !pos.expired(now)
+}
+
+// pruneTags drops expired keys, and those compaction removed, from the tag
+// index. It runs on the entry processor, so no write retags a key meanwhile.
+func (db *Db) pruneTags() {
+	now := db.clock.Now().UnixNano()
+	db.tags.prune(func(key string) bool {
+		return db.liveTagged(key, now)
+	})
+}
+
+func validateTags(tags []string) error {
+	size := 0
+	for _, tag := range tags {
+		if tag == "" {
+			return fmt.Errorf("empty tag")
+		}
+		size += 2 + len(tag)
+	}
+	if size > maxTagsSize {
+		return fmt.Errorf("tags are too large (%d bytes)", size)
+	}
+	return nil
+}
+
+func encodeTags(tags []string) []byte {
+	var data []byte
+	for _, tag := range tags {
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(tag)))
+		data = append(data, tag...)
+	}
+	return data
+}
+
+func decodeTags(data []byte) []string {
+	var tags []string
+	for len(data) >= 2 {
+		tl := int(binary.LittleEndian.Uint16(data))
+		if len(data) < 2+tl {
+			break
+		}
+		tags = append(tags, string(data[2:2+tl]))
+		data = data[2+tl:]
+	}
+	return tags
+}
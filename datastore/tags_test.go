@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_FindByTag(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDatabase(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_ = db.PutWithTags("user1/profile", "p1", []string{"user1"})
+	_ = db.PutWithTags("user1/settings", "s1", []string{"user1", "settings"})
+	_ = db.PutWithTags("user2/settings", "s2", []string{"user2", "settings"})
+	_ = db.Put("user1/profile", "untagged")
+	_ = db.Delete("user2/settings")
+
+	expected := map[string][]string{
+		"user1":    {"user1/settings"},
+		"settings": {"user1/settings"},
+		"user2":    {},
+	}
+	check := func(t *testing.T) {
+		for tag, keys := range expected {
+			if found := db.FindByTag(tag); !reflect.DeepEqual(found, keys) {
+				t.Errorf("Unexpected keys for tag %s: expected %v, got %v", tag, keys, found)
+			}
+		}
+	}
+	check(t)
+
+	if value, err := db.Get("user1/settings"); err != nil || value != "s1" {
+		t.Errorf("Bad value returned expected s1, got %s (err: %v)", value, err)
+	}
+	if err := db.PutWithTags("key", "value", []string{""}); err == nil {
+		t.Error("Expected an error for an empty tag")
+	}
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDatabase(dir, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestDb_FindByTagExpired(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, _ = db.PutWithOptions("session", "value", WriteOptions{Tags: []string{"user1"}, TTL: 10 * time.Second})
+	_, _ = db.PutWithOptions("profile", "value", WriteOptions{Tags: []string{"user1"}})
+	_, _ = db.PutWithOptions("token", "value", WriteOptions{Tags: []string{"user2"}, TTL: 10 * time.Second})
+	clock.Advance(10 * time.Second)
+
+	if keys := db.FindByTag("user1"); !reflect.DeepEqual(keys, []string{"profile"}) {
+		t.Errorf("Expected the expired key not to be found, got %v", keys)
+	}
+
+	// The sweep and compaction both drop expired keys from the index.
+	if _, err := db.SweepRetention(); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := db.tags.keyTags["token"]; found {
+		t.Error("Expected the sweep to untag the expired key")
+	}
+	_, _ = db.PutWithOptions("cookie", "value", WriteOptions{Tags: []string{"user2"}, TTL: time.Second})
+	clock.Advance(time.Second)
+	// Compaction merges sealed segments only.
+	for i := 0; len(db.segmentList()) < 2; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	if err := db.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := db.tags.keyTags["cookie"]; found {
+		t.Error("Expected compaction to untag the expired key")
+	}
+	if keys := db.FindByTag("user1"); !reflect.DeepEqual(keys, []string{"profile"}) {
+		t.Errorf("Expected the live key to stay tagged, got %v", keys)
+	}
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/QuantumGurus/Lab4-KPI/ratelimit"
+)
+
+var ErrThrottled = fmt.Errorf("write rate limit exceeded")
+
+// WriteLimit caps the write rate of keys starting with Prefix. A trailing
+// "*" in the prefix is ignored, so "sessions/*" and "sessions/" are equal.
+type WriteLimit struct {
+	Prefix string `json:"prefix"`
+	// Rate is the number of writes allowed per second. Bursts of up to one
+	// second worth of writes, but at least one write, are accepted.
+	Rate float64 `json:"rate"`
+}
+
+// writeThrottle keeps a token bucket per limited prefix. A key is charged to
+// the bucket of its longest matching prefix only.
+type writeThrottle struct {
+	clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*ratelimit.TokenBucket
+}
+
+func newWriteThrottle(limits []WriteLimit, clock Clock) (*writeThrottle, error) {
+	t := &writeThrottle{clock: clock, buckets: make(map[string]*ratelimit.TokenBucket)}
+	for _, limit := range limits {
+		if err := t.set(limit); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// set installs or replaces the limit for a prefix. A zero rate removes it.
+func (t *writeThrottle) set(limit WriteLimit) error {
+	if limit.Rate < 0 {
+		return fmt.Errorf("negative write rate %v for prefix %q", limit.Rate, limit.Prefix)
+	}
+	if math.IsNaN(limit.Rate) || math.IsInf(limit.Rate, 0) {
+		return fmt.Errorf("invalid write rate %v for prefix %q", limit.Rate, limit.Prefix)
+	}
+	prefix := strings.TrimSuffix(limit.Prefix, "*")
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if limit.Rate == 0 {
+		delete(t.buckets, prefix)
+		return nil
+	}
+	t.buckets[prefix] = ratelimit.NewTokenBucket(limit.Rate, max(limit.Rate, 1), t.clock)
+	return nil
+}
+
+func (t *writeThrottle) limits() []WriteLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limits := make([]WriteLimit, 0, len(t.buckets))
+	for prefix, bucket := range t.buckets {
+		limits = append(limits, WriteLimit{Prefix: prefix + "*", Rate: bucket.Rate()})
+	}
+	sort.Slice(limits, func(i, j int) bool {
+		return limits[i].Prefix < limits[j].Prefix
+	})
+	return limits
+}
+
+// allow takes a token for every key from the bucket limiting it, if any.
+// Either all tokens are taken or, when a bucket is short of them, none, so
+// a refused batch costs nothing. A batch larger than a burst passes once
+// the bucket is full and leaves it in debt, so it is not refused forever.
+func (t *writeThrottle) allow(keys ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	charges := make(map[*ratelimit.TokenBucket]int)
+	for _, key := range keys {
+		if bucket := t.bucket(key); bucket != nil {
+			charges[bucket]++
+		}
+	}
+	// Every key under the prefix shares one bucket, and only the throttle
+	// takes tokens from it, so none go between the check and the charge.
+	for bucket, n := range charges {
+		if bucket.Tokens("") < min(float64(n), bucket.Burst()) {
+			return false
+		}
+	}
+	for bucket, n := range charges {
+		bucket.Charge("", n)
+	}
+	return true
+}
+
+// bucket returns the bucket of the longest prefix of key, nil if none
+// matches. Callers hold t.mu.
+func (t *writeThrottle) bucket(key string) *ratelimit.TokenBucket {
+	var bucket *ratelimit.TokenBucket
+	matched := -1
+	for prefix, b := range t.buckets {
+		if len(prefix) > matched && strings.HasPrefix(key, prefix) {
+			bucket, matched = b, len(prefix)
+		}
+	}
+	return bucket
+}
+
+// SetWriteLimit installs, replaces or, with a zero rate, removes the write
+// limit for a key prefix.
+func (db *Db) SetWriteLimit(limit WriteLimit) error {
+	return db.throttle.set(limit)
+}
+
+// WriteLimits returns the configured write limits ordered by prefix.
+func (db *Db) WriteLimits() []WriteLimit {
+	return db.throttle.limits()
+}
@@ -0,0 +1,116 @@
+package datastore
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_WriteLimits(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-db-write-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := NewFakeClock(time.Now())
+	db, err := Open(dir, Options{
+		SegmentSize: 1024,
+		Clock:       clock,
+		WriteLimits: []WriteLimit{{Prefix: "sessions/*", Rate: 3}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := db.Put("sessions/a", "value"); err != nil {
+			t.Fatalf("Write %d within the burst failed: %s", i, err)
+		}
+	}
+	if err := db.Put("sessions/b", "value"); err != ErrThrottled {
+		t.Errorf("Expected ErrThrottled, got %v", err)
+	}
+	if err := db.Delete("sessions/a"); err != ErrThrottled {
+		t.Errorf("Expected deletes to be throttled too, got %v", err)
+	}
+	if err := db.Put("users/a", "value"); err != nil {
+		t.Errorf("Unlimited prefix was throttled: %s", err)
+	}
+
+	clock.Advance(300 * time.Millisecond)
+	if err := db.Put("sessions/a", "value"); err == nil {
+		t.Error("Expected the bucket to hold less than a token")
+	}
+	clock.Advance(100 * time.Millisecond)
+	if err := db.Put("sessions/a", "value"); err != nil {
+		t.Errorf("Expected the bucket to refill, got %s", err)
+	}
+
+	t.Run("batch", func(t *testing.T) {
+		if err := db.SetWriteLimit(WriteLimit{Prefix: "reports/", Rate: 2}); err != nil {
+			t.Fatal(err)
+		}
+		// The first bucket has enough tokens, the second one not.
+		batch := []Entry{{Key: "reports/a", Value: "1"}, {Key: "sessions/a", Value: "1"}, {Key: "sessions/b", Value: "1"}}
+		if err := db.PutBatch(batch); err != ErrThrottled {
+			t.Fatalf("Expected the batch to be throttled, got %v", err)
+		}
+		if err := db.PutBatch([]Entry{{Key: "reports/a", Value: "1"}, {Key: "reports/b", Value: "1"}}); err != nil {
+			t.Errorf("Expected a throttled batch to take no tokens, got %v", err)
+		}
+
+		// A batch larger than the burst passes once the bucket is full,
+		// and the debt it leaves is paid back before the next write.
+		large := make([]Entry, 5)
+		for i := range large {
+			large[i] = Entry{Key: fmt.Sprintf("reports/%d", i), Value: "1"}
+		}
+		if err := db.PutBatch(large); err != ErrThrottled {
+			t.Errorf("Expected the batch to wait for a full bucket, got %v", err)
+		}
+		clock.Advance(time.Second)
+		if err := db.PutBatch(large); err != nil {
+			t.Errorf("Expected a batch larger than the burst to pass, got %v", err)
+		}
+		clock.Advance(time.Second)
+		if err := db.Put("reports/a", "1"); err != ErrThrottled {
+			t.Errorf("Expected the debt of the batch to throttle writes, got %v", err)
+		}
+		clock.Advance(time.Second)
+		if err := db.Put("reports/a", "1"); err != nil {
+			t.Errorf("Expected the debt to be paid back, got %v", err)
+		}
+		_ = db.SetWriteLimit(WriteLimit{Prefix: "reports/", Rate: 0})
+	})
+
+	t.Run("longest prefix wins", func(t *testing.T) {
+		if err := db.SetWriteLimit(WriteLimit{Prefix: "sessions/admin/", Rate: 100}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("sessions/admin/x", "value"); err != nil {
+			t.Errorf("Write under the more specific limit failed: %s", err)
+		}
+	})
+
+	t.Run("adjust", func(t *testing.T) {
+		if err := db.SetWriteLimit(WriteLimit{Prefix: "sessions/*", Rate: 0}); err != nil {
+			t.Fatal(err)
+		}
+		limits := db.WriteLimits()
+		if len(limits) != 1 || limits[0].Prefix != "sessions/admin/*" {
+			t.Errorf("Unexpected limits %+v", limits)
+		}
+		if err := db.Put("sessions/b", "value"); err != nil {
+			t.Errorf("Removed limit still applies: %s", err)
+		}
+		for _, rate := range []float64{-1, math.NaN(), math.Inf(1)} {
+			if err := db.SetWriteLimit(WriteLimit{Prefix: "x", Rate: rate}); err == nil {
+				t.Errorf("Expected an error for the rate %v", rate)
+			}
+		}
+	})
+}
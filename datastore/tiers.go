@@ -0,0 +1,38 @@
+package datastore
+
+// segmentTier is the size tier of a sealed segment: 0 below SegmentSize
+// times the fanout, 1 below that times the fanout again, and so on.
+func (db *Db) segmentTier(segment *Segment) int {
+	segment.mu.Lock()
+	size := segment.outOffset
+	segment.mu.Unlock()
+	tier := 0
+	for limit := db.segmentSize * int64(db.tierFanout); size >= limit; limit *= int64(db.tierFanout) {
+		tier++
+	}
+	return tier
+}
+
+// tierRun picks the newest run of at least tierFanout consecutive sealed
+// segments of the same tier. Newer runs hold the smaller segments, so they
+// are merged first.
+func (db *Db) tierRun(segments []*Segment) (int, int) {
+	last := len(segments) - 2
+	for last >= 0 {
+		tier := db.segmentTier(segments[last])
+		first := last
+		for first > 0 && db.segmentTier(segments[first-1]) == tier {
+			first--
+		}
+		if last-first+1 >= db.tierFanout {
+			return first, last
+		}
+		last = first - 1
+	}
+	return 0, -1
+}
+
+func (db *Db) hasTierRun() bool {
+	first, last := db.tierRun(db.segmentList())
+	return last >= first
+}
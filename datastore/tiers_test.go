@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDb_TieredCompaction(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 100, CompactionTierFanout: 2, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	put := func(key, value string) {
+		t.Helper()
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		// Waiting keeps every rotation looking at merged segments.
+		db.compactions.Wait()
+	}
+	put("gone", "value")
+	const keys = 200
+	for i := 0; i < keys; i++ {
+		put(fmt.Sprintf("key%03d", i), "value")
+		if i == keys/2 {
+			_ = db.Delete("gone")
+		}
+	}
+
+	segments := db.segmentList()
+	if len(segments) < 3 {
+		t.Fatalf("Expected several tiers to be kept apart, got %d segments", len(segments))
+	}
+	for i := 1; i < len(segments)-1; i++ {
+		if db.segmentTier(segments[i-1]) < db.segmentTier(segments[i]) {
+			t.Errorf("Expected older segments in higher tiers, segment %d is in tier %d, %d in tier %d",
+				i-1, db.segmentTier(segments[i-1]), i, db.segmentTier(segments[i]))
+		}
+	}
+	if db.hasTierRun() {
+		t.Error("Expected every run of a tier to be merged")
+	}
+	for i := 0; i < keys; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%03d", i)); err != nil {
+			t.Errorf("Expected key%03d to survive, got %v", i, err)
+		}
+	}
+	if _, err := db.Get("gone"); err != ErrNotFound {
+		t.Errorf("Expected the deletion to survive merges above the value, got %v", err)
+	}
+
+	// A rotation merges the new small segments, not the oldest data.
+	oldest := segments[0].filePath
+	for i := 0; len(db.segmentList()) <= len(segments); i++ {
+		put(fmt.Sprintf("more%d", i), "value")
+	}
+	if db.segmentList()[0].filePath != oldest {
+		t.Error("Expected the oldest tier to be left alone")
+	}
+
+	if _, err := Open("db", Options{SegmentSize: 100, CompactionTierFanout: 1, Filesystem: NewMemFilesystem()}); err == nil {
+		t.Error("Expected a fanout below 2 to be rejected")
+	}
+}
@@ -0,0 +1,33 @@
+package datastore
+
+import "context"
+
+// Tracer starts the spans of storage operations: Get, Put, Delete,
+// compaction and recovery. The span of an operation is a child of the one
+// in the context it is given, so an adapter to OpenTelemetry or any other
+// tracing system links it to the request that caused it.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation. Attributes describe it: the key, the segment
+// read, the bytes moved, whether the value cache answered.
+type Span interface {
+	SetAttribute(key string, value any)
+	// End finishes the span, failed if err is not nil.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, any) {}
+func (noopSpan) End(error)                {}
+
+// startSpan starts a span with the tracer of the database, a span doing
+// nothing without one.
+func (db *Db) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if db.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return db.tracer.Start(ctx, name)
+}
@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// recordingTracer keeps the finished spans with the name of their parent.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name, parent string
+	attributes   map[string]any
+	err          error
+}
+
+type spanNameKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(spanNameKey{}).(string)
+	span := &recordedSpan{name: name, parent: parent, attributes: make(map[string]any)}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanNameKey{}, name), span
+}
+
+func (s *recordedSpan) SetAttribute(key string, value any) { s.attributes[key] = value }
+func (s *recordedSpan) End(err error)                      { s.err = err }
+
+func (t *recordingTracer) last(name string) *recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := len(t.spans) - 1; i >= 0; i-- {
+		if t.spans[i].name == name {
+			return t.spans[i]
+		}
+	}
+	return nil
+}
+
+func TestDb_Tracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	db, err := Open("db", Options{SegmentSize: 100, CacheSize: 10, CompactionSegments: -1, Tracer: tracer, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if span := tracer.last("datastore.Recover"); span == nil || span.err != nil {
+		t.Errorf("Expected the recovery to be traced, got %+v", span)
+	}
+
+	ctx := context.WithValue(context.Background(), spanNameKey{}, "http GET")
+	if _, err := db.PutContext(ctx, "key", "value", WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if span := tracer.last("datastore.Put"); span.parent != "http GET" || span.attributes["bytes"] != 5 || span.attributes["version"] != uint64(1) {
+		t.Errorf("Unexpected put span %+v", span)
+	}
+
+	_, _ = db.GetRecordContext(ctx, "key")
+	if span := tracer.last("datastore.Get"); span.parent != "http GET" || span.attributes["cache_hit"] != false || span.attributes["segment"] == nil {
+		t.Errorf("Unexpected get span %+v", span)
+	}
+	_, _ = db.GetRecordContext(ctx, "key")
+	if span := tracer.last("datastore.Get"); span.attributes["cache_hit"] != true {
+		t.Errorf("Expected a cache hit, got %+v", span)
+	}
+
+	if _, err := db.DeleteContext(ctx, "key", DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = db.GetRecordContext(ctx, "key")
+	if span := tracer.last("datastore.Get"); span.err != ErrNotFound {
+		t.Errorf("Expected the miss to fail the span, got %+v", span)
+	}
+
+	for i := 0; len(db.segmentList()) < 3; i++ {
+		_ = db.Put("filler", "value")
+	}
+	if err := db.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if span := tracer.last("datastore.Compact"); span == nil || span.parent != "http GET" || span.attributes["segments"] != 2 {
+		t.Errorf("Unexpected compaction span %+v", span)
+	}
+}
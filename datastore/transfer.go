@@ -0,0 +1,253 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var ErrChecksumMismatch = errors.New("segment checksum mismatch")
+
+// SegmentInfo describes a sealed segment offered for transfer to another
+// node.
+type SegmentInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Checksum is the hex encoded SHA-256 of the segment file.
+	Checksum string `json:"checksum"`
+}
+
+// SealedSegments describes the segments that no longer receive writes, from
+// the oldest one.
+func (db *Db) SealedSegments() ([]SegmentInfo, error) {
+	segments, release := db.pinSegments()
+	defer release()
+	infos := make([]SegmentInfo, 0, len(segments))
+	for _, segment := range segments[:len(segments)-1] {
+		info, err := segment.info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// OpenSealedSegment opens a sealed segment for reading.
+func (db *Db) OpenSealedSegment(name string) (File, SegmentInfo, error) {
+	// An open file stays readable when a compaction removes it.
+	_, release := db.pinSegments()
+	defer release()
+	segment := db.sealedSegment(name)
+	if segment == nil {
+		return nil, SegmentInfo{}, ErrNotFound
+	}
+	info, err := segment.info()
+	if err != nil {
+		return nil, info, err
+	}
+	file, err := openFile(db.fs, segment.filePath)
+	return file, info, err
+}
+
+// SegmentHint returns the hint of a sealed segment: its index as JSON lines
+// of IndexEntry ordered by offset, which lets a reader locate the keys of
+// the segment without scanning it, framed like the manifest and read back
+// with DecodeSegmentHint. The hint is built from the in-memory index and
+// its checksum is the hex encoded SHA-256 of the data.
+func (db *Db) SegmentHint(name string) ([]byte, string, error) {
+	segment := db.sealedSegment(name)
+	if segment == nil {
+		return nil, "", ErrNotFound
+	}
+
+	segment.mu.Lock()
+	entries := make([]IndexEntry, 0, len(segment.index))
+	for key, pos := range segment.index {
+		entries = append(entries, IndexEntry{
+			Key:     key,
+			Segment: name,
+			Offset:  pos.offset,
+			Size:    pos.size,
+			Deleted: pos.deleted,
+			Version: pos.version,
+			Blob:    pos.blob,
+		})
+	}
+	segment.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+
+	var hint bytes.Buffer
+	encoder := json.NewEncoder(&hint)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return nil, "", err
+		}
+	}
+	data, err := encodeMetadata(hint.Bytes(), db.compressMetadata)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+	return data, hex.EncodeToString(sum[:]), nil
+}
+
+// DecodeSegmentHint verifies a hint returned by SegmentHint and returns
+// its entries. A truncated or corrupted hint fails with
+// ErrCorruptMetadata.
+func DecodeSegmentHint(data []byte) ([]IndexEntry, error) {
+	payload, err := decodeMetadata(data)
+	if err != nil {
+		return nil, fmt.Errorf("segment hint: %w", err)
+	}
+	var entries []IndexEntry
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	for decoder.More() {
+		var entry IndexEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("%w: segment hint: %v", ErrCorruptMetadata, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (db *Db) sealedSegment(name string) *Segment {
+	segments := db.segmentList()
+	for _, segment := range segments[:len(segments)-1] {
+		if filepath.Base(segment.filePath) == name {
+			return segment
+		}
+	}
+	return nil
+}
+
+// info computes the checksum of a sealed segment once. Sealed segment files
+// never change.
+func (s *Segment) info() (SegmentInfo, error) {
+	s.mu.Lock()
+	checksum, size := s.checksum, s.outOffset
+	s.mu.Unlock()
+
+	if checksum == "" {
+		file, err := openFile(s.fs, s.filePath)
+		if err != nil {
+			return SegmentInfo{}, err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, file); err != nil {
+			return SegmentInfo{}, err
+		}
+		checksum = hex.EncodeToString(hash.Sum(nil))
+
+		s.mu.Lock()
+		s.checksum = checksum
+		s.mu.Unlock()
+	}
+	return SegmentInfo{Name: filepath.Base(s.filePath), Size: size, Checksum: checksum}, nil
+}
+
+// ImportSegment stores a segment received from another node. The data is
+// verified against the size and checksum in info before the segment is
+// registered in the manifest right before the active segment, so its
+// records replace older local ones but not the ones written since.
+func (db *Db) ImportSegment(r io.Reader, info SegmentInfo) error {
+	// Compaction replaces the sealed part of the segment list.
+	db.compactionMu.Lock()
+	defer db.compactionMu.Unlock()
+
+	filePath := db.GenerateNewFileName()
+	tmpPath := filePath + ".import"
+	if err := db.receiveSegment(r, tmpPath, info); err != nil {
+		_ = db.fs.Remove(tmpPath)
+		return err
+	}
+	if err := db.fs.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	if err := db.syncDir(db.directory); err != nil {
+		return err
+	}
+
+	segment := &Segment{
+		filePath: filePath,
+		fs:       db.fs,
+		blobs:    db.blobs,
+		index:    make(hashIndex),
+		checksum: info.Checksum,
+	}
+	file, err := openFile(db.fs, filePath)
+	if err != nil {
+		return err
+	}
+	var tagged []entry
+	offset, err := segment.recover(file, func(e *entry) {
+		raise(&db.sequence, e.sequence)
+		// Tags of keys written locally since stay in place.
+		if _, _, err := db.findRecord(e.key); err == ErrNotFound {
+			tagged = append(tagged, entry{key: e.key, deleted: e.deleted, tags: e.tags})
+		}
+	})
+	file.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	segment.outOffset = offset
+	// Transfers carry segments only, deduplicated values must be here.
+	for _, pos := range segment.index {
+		if pos.blob != "" && !db.blobs.exists(pos.blob) {
+			_ = db.fs.Remove(filePath)
+			return fmt.Errorf("%w: %s", ErrMissingBlob, pos.blob)
+		}
+	}
+	for i := range tagged {
+		db.tags.apply(&tagged[i])
+	}
+	db.seal(segment)
+
+	db.segmentsMu.Lock()
+	current := db.segmentList()
+	segments := make([]*Segment, 0, len(current)+1)
+	segments = append(segments, current[:len(current)-1]...)
+	segments = append(segments, segment, current[len(current)-1])
+	err = db.writeManifest(segments)
+	if err == nil {
+		db.publishSegments(segments, nil)
+	}
+	db.segmentsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	db.recomputeSpaceStats()
+	db.writeHintInBackground(filePath)
+	return nil
+}
+
+func (db *Db) receiveSegment(r io.Reader, path string, info SegmentInfo) error {
+	out, err := db.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), r)
+	if err != nil {
+		return err
+	}
+	if size != info.Size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrChecksumMismatch, info.Size, size)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != info.Checksum {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, info.Checksum, checksum)
+	}
+	return out.Sync()
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_SegmentTransfer(t *testing.T) {
+	source, err := Open("source", Options{SegmentSize: 80, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for i := 0; i < 6; i++ {
+		if err := source.PutWithTags(fmt.Sprintf("key%d", i), "remote", []string{"remote"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source.compactions.Wait()
+
+	target, err := Open("target", Options{SegmentSize: 1024, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if err := target.Put("key0", "local"); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := source.SealedSegments()
+	if err != nil || len(sealed) == 0 {
+		t.Fatalf("Expected sealed segments, got %v (err: %v)", sealed, err)
+	}
+	for _, info := range sealed {
+		file, opened, err := source.OpenSealedSegment(info.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened != info {
+			t.Errorf("Segment info changed: %+v vs %+v", opened, info)
+		}
+		err = target.ImportSegment(file, info)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want := "remote"
+		if i == 0 {
+			want = "local"
+		}
+		// Keys written after the last sealed segment of the source are not
+		// transferred.
+		if value, err := target.Get(key); err == nil && value != want {
+			t.Errorf("Bad value of %s: expected %s, got %s", key, want, value)
+		}
+	}
+	if value, err := target.Get("key1"); err != nil || value != "remote" {
+		t.Errorf("Imported key1 is missing: %q (err: %v)", value, err)
+	}
+	tagged := target.FindByTag("remote")
+	if len(tagged) == 0 || tagged[0] == "key0" {
+		t.Errorf("Unexpected tagged keys %v", tagged)
+	}
+
+	recovered, err := Open("target", Options{SegmentSize: 1024, Filesystem: target.fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := recovered.Get("key1"); err != nil || value != "remote" {
+		t.Errorf("Imported segment is not registered in the manifest: %q (err: %v)", value, err)
+	}
+}
+
+func TestDb_ImportSegmentVerifies(t *testing.T) {
+	db, err := Open("db", Options{SegmentSize: 1024, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	data := (&entry{key: "key", value: "value"}).Encode()
+	info := SegmentInfo{Name: "current-data0", Size: int64(len(data)), Checksum: "bad"}
+	err = db.ImportSegment(bytes.NewReader(data), info)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	info.Size++
+	err = db.ImportSegment(io.LimitReader(bytes.NewReader(data), 5), info)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a size mismatch, got %v", err)
+	}
+	if len(db.segmentList()) != 1 {
+		t.Errorf("Rejected segments must not be registered, got %d segments", len(db.segmentList()))
+	}
+	if _, err := db.Get("key"); err != ErrNotFound {
+		t.Errorf("Expected rejected data to stay invisible, got %v", err)
+	}
+}
+
+func TestDb_SegmentHint(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%t", compress), func(t *testing.T) {
+			testSegmentHint(t, compress)
+		})
+	}
+}
+
+func testSegmentHint(t *testing.T, compress bool) {
+	db, err := Open("db", Options{SegmentSize: 80, CompressMetadata: compress, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 6; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sealed, err := db.SealedSegments()
+	if err != nil || len(sealed) == 0 {
+		t.Fatalf("Expected sealed segments, got %v (err: %v)", sealed, err)
+	}
+	hint, checksum, err := db.SegmentHint(sealed[0].Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(hint)
+	if checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("Checksum does not match the hint")
+	}
+
+	entries, err := DecodeSegmentHint(hint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64 = -1
+	for _, entry := range entries {
+		if entry.Segment != sealed[0].Name || entry.Offset <= last {
+			t.Errorf("Unexpected hint entry %+v", entry)
+		}
+		last = entry.Offset
+		value, err := db.Get(entry.Key)
+		if err != nil || value != "value" {
+			t.Errorf("Hint lists an unknown key %s", entry.Key)
+		}
+	}
+	if last < 0 {
+		t.Errorf("Empty hint")
+	}
+	if _, err := DecodeSegmentHint(hint[:len(hint)-1]); !errors.Is(err, ErrCorruptMetadata) {
+		t.Errorf("Expected a truncated hint to be reported as corrupt, got %v", err)
+	}
+
+	if _, _, err := db.SegmentHint(filepath.Base(db.outPath)); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for the active segment, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+)
+
+// SweepExpired replaces the records whose time to live ran out with
+// tombstones marked as expiries and returns how many it replaced. Reads
+// miss expired keys already; the sweep frees their values at the next
+// compaction and tells watchers about them with ChangeExpired. A key
+// written again during the sweep is kept.
+func (db *Db) SweepExpired() (int, error) {
+	swept := 0
+	for _, key := range db.expiredKeys(db.clock.Now().UnixNano()) {
+		_, pos, err := db.findRecord(key)
+		if err != nil || pos.deleted {
+			continue
+		}
+		version := pos.version
+		_, err = db.write(entry{key: key, deleted: true, expired: true}, &version, DurabilityDefault)
+		if errors.Is(err, ErrVersionConflict) {
+			continue
+		}
+		if err != nil {
+			return swept, err
+		}
+		swept++
+	}
+	return swept, nil
+}
+
+// expiredKeys returns the keys whose newest record expired by now, in
+// lexical order.
+func (db *Db) expiredKeys(now int64) []string {
+	segments := db.segmentList()
+	seen := make(map[string]struct{})
+	var keys []string
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		segment.mu.Lock()
+		for key, pos := range segment.index {
+			if _, shadowed := seen[key]; shadowed {
+				continue
+			}
+			seen[key] = struct{}{}
+			if !pos.deleted && pos.expired(now) {
+				keys = append(keys, key)
+			}
+		}
+		segment.mu.Unlock()
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_PutWithTTL(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, CacheSize: 10, Clock: clock, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutWithTTL("session", "value", 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("later", "value", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("bad", "value", 0); err != ErrBadTTL {
+		t.Errorf("Expected ErrBadTTL for a zero ttl, got %v", err)
+	}
+	if value, err := db.Get("session"); err != nil || value != "value" {
+		t.Fatalf("Expected the key before its expiry, got %q, %v", value, err)
+	}
+
+	clock.Advance(10 * time.Second)
+	// Expired keys are missing for cached and uncached reads and listings.
+	for i := 0; i < 2; i++ {
+		if _, err := db.Get("session"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for the expired key, got %v", err)
+		}
+	}
+	if keys := db.Keys("", "", 0).Keys; len(keys) != 2 || keys[0] != "kept" || keys[1] != "later" {
+		t.Errorf("Expected the expired key not to be listed, got %v", keys)
+	}
+
+	// An expired key can be created again and keeps counting versions.
+	noRecord := uint64(0)
+	version, err := db.PutWithOptions("session", "new", WriteOptions{ExpectedVersion: &noRecord})
+	if err != nil || version != 2 {
+		t.Fatalf("Expected the expired key to be written as new with version 2, got %d, %v", version, err)
+	}
+	if value, err := db.Get("session"); err != nil || value != "new" {
+		t.Errorf("Expected the rewritten key without ttl, got %q, %v", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The expiry is part of the record and survives a restart.
+	db, err = Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("later"); err != nil || value != "value" {
+		t.Errorf("Expected the recovered key before its expiry, got %q, %v", value, err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := db.Get("later"); err != ErrNotFound {
+		t.Errorf("Expected the recovered key to expire, got %v", err)
+	}
+}
+
+func TestDb_CompactionDropsExpiredKeys(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	db, err := Open("db", Options{SegmentSize: 100, Clock: clock, Filesystem: NewMemFilesystem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.PutWithTTL("expiring", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	for i := 0; len(db.segmentList()) < 3; i++ {
+		if err := db.Put(fmt.Sprintf("filler%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.PerformOldSegmentsCompaction()
+	db.compactions.Wait()
+
+	if _, pos, err := db.findRecord("expiring"); err != ErrNotFound {
+		t.Errorf("Expected compaction to drop the expired key, found %+v", pos)
+	}
+	if value, err := db.Get("kept"); err != nil || value != "value" {
+		t.Errorf("Expected the key without ttl to survive compaction, got %q, %v", value, err)
+	}
+}
+
+func TestDb_SweepExpired(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	fs := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := db.Watch("")
+	if err := db.PutBatch([]Entry{{Key: "session", Value: "a", TTL: time.Minute}, {Key: "renewed", Value: "b", TTL: time.Minute}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("later", "c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	// A key written again after its expiry is not swept.
+	if err := db.Put("renewed", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if swept, err := db.SweepExpired(); err != nil || swept != 1 {
+		t.Fatalf("Expected one expired key swept, got %d, %v", swept, err)
+	}
+	if swept, err := db.SweepExpired(); err != nil || swept != 0 {
+		t.Errorf("Expected nothing left to sweep, got %d, %v", swept, err)
+	}
+	watcher.Close()
+
+	var changes []Change
+	for c := range watcher.Changes() {
+		changes = append(changes, c)
+	}
+	expected := []Change{
+		{Type: ChangePut, Key: "session", Value: "a", Version: 1},
+		{Type: ChangePut, Key: "renewed", Value: "b", Version: 1},
+		{Type: ChangePut, Key: "later", Value: "c", Version: 1},
+		{Type: ChangePut, Key: "renewed", Value: "d", Version: 2},
+		{Type: ChangeExpired, Key: "session", Version: 2},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+
+	// The tombstone keeps its expiry mark and versions keep counting.
+	segment, pos, err := db.findRecord("session")
+	if err != nil || !pos.deleted {
+		t.Fatalf("Expected a tombstone for the swept key, got %+v, %v", pos, err)
+	}
+	e, err := segment.readEntry(pos.offset)
+	if err != nil || !e.deleted || !e.expired {
+		t.Errorf("Expected the tombstone marked as expiry, got %+v, %v", e, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("db", Options{SegmentSize: 1024, Clock: clock, Filesystem: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	noRecord := uint64(0)
+	if version, err := db.PutWithOptions("session", "new", WriteOptions{ExpectedVersion: &noRecord}); err != nil || version != 3 {
+		t.Errorf("Expected the swept key to be written as new with version 3, got %d, %v", version, err)
+	}
+}
@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	walFileName = "WAL"
+	// walMaxBatch limits how many writes share one WAL fsync.
+	walMaxBatch = 128
+)
+
+// writeAheadLog makes writes durable without syncing segment files. Every
+// write is also appended to the log together with its offset in the active
+// segment, and a group of writes is acknowledged only after one fsync of the
+// log. Sealing a segment syncs it and empties the log, so the log only ever
+// covers the active segment.
+type writeAheadLog struct {
+	file    File
+	pending []byte
+}
+
+func openWAL(fsys Filesystem, directory string) (*writeAheadLog, error) {
+	file, err := fsys.OpenFile(filepath.Join(directory, walFileName), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+// add buffers a record written to the active segment at offset.
+func (w *writeAheadLog) add(offset int64, data []byte) {
+	w.pending = binary.LittleEndian.AppendUint64(w.pending, uint64(offset))
+	w.pending = append(w.pending, data...)
+}
+
+// commit appends the buffered records to the log and syncs it.
+func (w *writeAheadLog) commit() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	_, err := w.file.Write(w.pending)
+	w.pending = w.pending[:0]
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// reset empties the log once the active segment is synced.
+func (w *writeAheadLog) reset() error {
+	w.pending = w.pending[:0]
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *writeAheadLog) Close() error {
+	return w.file.Close()
+}
+
+// replay restores the records of the log missing from the active segment.
+// The segment is cut after its last complete record first, then the logged
+// records from that offset on are appended again. A record failing its
+// checksum ends the complete ones too when the log holds a copy of it, as
+// the log does for every record written since the segment was last synced.
+func (w *writeAheadLog) replay(fsys Filesystem, segmentPath string) error {
+	segment, err := fsys.OpenFile(segmentPath, os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	type logged struct {
+		offset int64
+		e      entry
+	}
+	var records []logged
+	in := bufio.NewReader(w.file)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(in, header[:]); err != nil {
+			break
+		}
+		e, err := readEntry(in)
+		if err != nil {
+			// A torn record at the end was never acknowledged.
+			break
+		}
+		records = append(records, logged{int64(binary.LittleEndian.Uint64(header[:])), e})
+	}
+
+	// Whatever follows the last complete record is a torn write.
+	complete, _ := scanEntries(segment, func(offset int64, data []byte) error {
+		var e entry
+		if err := e.Decode(data); err != nil {
+			for _, r := range records {
+				if r.offset == offset {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err := segment.Truncate(complete); err != nil {
+		return err
+	}
+	if _, err := segment.Seek(complete, io.SeekStart); err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.offset < complete {
+			continue
+		}
+		if _, err := segment.Write(r.e.Encode()); err != nil {
+			return err
+		}
+	}
+	return segment.Sync()
+}
@@ -0,0 +1,298 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// syncCountingFS counts the syncs of the WAL file.
+type syncCountingFS struct {
+	*MemFilesystem
+	walSyncs atomic.Int32
+}
+
+type syncCountingFile struct {
+	File
+	syncs *atomic.Int32
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func (c *syncCountingFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := c.MemFilesystem.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != walFileName {
+		return file, err
+	}
+	return &syncCountingFile{File: file, syncs: &c.walSyncs}, nil
+}
+
+func TestDb_WALRecovery(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash losing the unsynced tail of the segment, leaving a
+	// torn record behind, and a torn record at the end of the log.
+	segment, _ := fsys.OpenFile(db.outPath, os.O_RDWR, 0)
+	_ = segment.Truncate(40)
+	segment.Close()
+	wal, _ := fsys.OpenFile(filepath.Join("db", walFileName), os.O_APPEND|os.O_WRONLY, 0)
+	_, _ = wal.Write([]byte{1, 2, 3})
+	wal.Close()
+
+	recovered, err := Open("db", Options{SegmentSize: 1024, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+
+	for i := 0; i < 10; i++ {
+		value, err := recovered.Get(fmt.Sprintf("key%d", i))
+		if i == 3 {
+			if err != ErrNotFound {
+				t.Errorf("Expected key3 to stay deleted, got %q (err: %v)", value, err)
+			}
+			continue
+		}
+		if err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Acknowledged write of key%d lost: %q (err: %v)", i, value, err)
+		}
+	}
+	if size := fsys.Size(filepath.Join("db", walFileName)); size != 0 {
+		t.Errorf("Expected the log to be emptied after replay, got %d bytes", size)
+	}
+}
+
+func TestDb_WALRecoveryRestoresCorruptedTail(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 1024, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("a", "value-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("b", "value-b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash leaving the unsynced last record damaged with its
+	// size intact; the log holds the acknowledged copy.
+	data, _ := fsys.ReadFile(db.outPath)
+	data[bytes.Index(data, []byte("value-b"))] ^= 0x01
+	_ = fsys.WriteFile(db.outPath, data, 0o600)
+
+	recovered, err := Open("db", Options{SegmentSize: 1024, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	for key, expected := range map[string]string{"a": "value-a", "b": "value-b"} {
+		if value, err := recovered.Get(key); err != nil || value != expected {
+			t.Errorf("Acknowledged write of %s lost: %q (err: %v)", key, value, err)
+		}
+	}
+	if repairs := recovered.Repairs(); len(repairs) != 0 {
+		t.Errorf("Expected the log to restore the record without repairs, got %+v", repairs)
+	}
+}
+
+func TestDb_WALRotation(t *testing.T) {
+	fsys := NewMemFilesystem()
+	db, err := Open("db", Options{SegmentSize: 60, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		_ = db.Put(fmt.Sprintf("key%d", i), "value")
+	}
+	// The crashed process removes no merged segments behind the new one.
+	db.compactions.Wait()
+
+	// Only the records of the active segment are logged.
+	logged := fsys.Size(filepath.Join("db", walFileName))
+	if logged <= 0 || logged >= 5*(8+(&entry{key: "key0", value: "value"}).GetLength()) {
+		t.Errorf("Unexpected log size %d", logged)
+	}
+
+	recovered, err := Open("db", Options{SegmentSize: 60, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	for i := 0; i < 5; i++ {
+		if value, err := recovered.Get(fmt.Sprintf("key%d", i)); err != nil || value != "value" {
+			t.Errorf("Bad value of key%d: %q (err: %v)", i, value, err)
+		}
+	}
+}
+
+func TestDb_WALGroupCommit(t *testing.T) {
+	fsys := &syncCountingFS{MemFilesystem: NewMemFilesystem()}
+	db, err := Open("db", Options{SegmentSize: 1 << 20, WAL: true, Filesystem: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	fsys.walSyncs.Store(0)
+
+	const writers, writes = 16, 20
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := db.Put(fmt.Sprintf("key%d-%d", w, i), "value"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if syncs := fsys.walSyncs.Load(); syncs == 0 || syncs >= writers*writes {
+		t.Errorf("Expected concurrent writes to share syncs, got %d syncs for %d writes", syncs, writers*writes)
+	}
+}
+
+func TestDb_Durability(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		fsys := &syncCountingFS{MemFilesystem: NewMemFilesystem()}
+		db, err := Open("db", Options{SegmentSize: 1024, WAL: wal, Filesystem: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := DurabilityAsync
+		if wal {
+			expected = DurabilitySync
+		}
+		if d := db.Durability(DurabilityDefault); d != expected {
+			t.Errorf("Expected default durability %q with WAL %t, got %q", expected, wal, d)
+		}
+		if d := db.Durability(DurabilityAsync); d != DurabilityAsync {
+			t.Errorf("Expected requested durability to be kept, got %q", d)
+		}
+
+		for i, d := range []Durability{DurabilitySync, DurabilityAsync, DurabilityDefault} {
+			if _, err := db.PutWithOptions(fmt.Sprintf("key%d", i), "value", WriteOptions{Durability: d}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.DeleteWithOptions("key0", DeleteOptions{Durability: DurabilityAsync}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := Open("db", Options{SegmentSize: 1024, WAL: wal, Filesystem: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reopened.Get("key0"); err != ErrNotFound {
+			t.Errorf("Expected key0 to be deleted, got %v", err)
+		}
+		for i := 1; i < 3; i++ {
+			if value, err := reopened.Get(fmt.Sprintf("key%d", i)); err != nil || value != "value" {
+				t.Errorf("Bad value of key%d: %q (err: %v)", i, value, err)
+			}
+		}
+		reopened.Close()
+	}
+
+	if _, err := ParseDurability("eventually"); err == nil {
+		t.Errorf("Expected an error for an unknown durability")
+	}
+}
+
+func TestDb_CloseAfterAsyncWrites(t *testing.T) {
+	fsys := NewMemFilesystem()
+	opts := Options{SegmentSize: 1 << 16, WAL: true, Filesystem: fsys}
+	db, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, err := db.PutWithOptions(fmt.Sprintf("key%d", i), "value", WriteOptions{Durability: DurabilityAsync}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("late", "value"); err != ErrClosed {
+		t.Errorf("Expected ErrClosed for a write after Close, got %v", err)
+	}
+
+	reopened, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for i := 0; i < 200; i++ {
+		if _, err := reopened.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatalf("Expected key%d to survive Close, got %v", i, err)
+		}
+	}
+}
+
+func TestDb_SyncDirectoriesCrash(t *testing.T) {
+	for _, syncDirs := range []bool{true, false} {
+		t.Run(fmt.Sprintf("sync-dirs=%t", syncDirs), func(t *testing.T) {
+			fsys := NewMemFilesystem()
+			opts := Options{SegmentSize: 60, WAL: true, SyncDirectories: syncDirs, Filesystem: fsys}
+			db, err := Open("db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Enough writes to rotate and compact segments.
+			for i := 0; i < 20; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+
+			fsys.Crash()
+
+			recovered, err := Open("db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer recovered.Close()
+			for i := 15; i < 20; i++ {
+				key := fmt.Sprintf("key%d", i%5)
+				value, err := recovered.Get(key)
+				if !syncDirs {
+					if err == nil {
+						t.Fatalf("Expected unsynced directory entries to be lost, read %s=%q", key, value)
+					}
+					return
+				}
+				if err != nil || value != fmt.Sprintf("value%d", i) {
+					t.Errorf("Write of %s lost in the crash: %q (err: %v)", key, value, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBufferFull   = errors.New("dbclient: write buffer is full")
+	ErrBufferClosed = errors.New("dbclient: write buffer is closed")
+)
+
+const (
+	defaultFlushInterval = time.Second
+	defaultFlushEntries  = 100
+	defaultBufferBytes   = 1 << 20
+)
+
+// OverflowPolicy is what a Put into a full buffer does.
+type OverflowPolicy int
+
+const (
+	// OverflowDrop drops the write and returns ErrBufferFull.
+	OverflowDrop OverflowPolicy = iota
+	// OverflowBlock waits for a flush to make room.
+	OverflowBlock
+)
+
+// BufferOptions tunes a Buffer. Zero values take the defaults.
+type BufferOptions struct {
+	// FlushInterval is how often buffered writes are sent, one second by
+	// default.
+	FlushInterval time.Duration
+	// FlushEntries sends the buffered writes as soon as that many keys are
+	// buffered, 100 by default.
+	FlushEntries int
+	// MaxBytes bounds the keys and values held by the buffer, including
+	// the ones of a flush on its way, 1 MiB by default.
+	MaxBytes int
+	Overflow OverflowPolicy
+}
+
+// BufferStats counts the writes a Buffer handled.
+type BufferStats struct {
+	Buffered int   `json:"buffered"`
+	Bytes    int   `json:"bytes"`
+	Flushed  int64 `json:"flushed"`
+	// Coalesced counts writes replaced by a later write of the same key
+	// before they were sent.
+	Coalesced int64 `json:"coalesced"`
+	Dropped   int64 `json:"dropped"`
+	// Failed counts writes lost with a batch the node did not store.
+	Failed int64 `json:"failed"`
+	// Sequence is the commit sequence of the last batch stored, for
+	// reading the flushed writes back with httptools.ContextWithMinSequence.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// Buffer accumulates writes in memory and sends them with PutBatch on a
+// timer or once enough are buffered, for high-volume writes that may be lost,
+// like counters. Writes of the same key waiting for a flush are coalesced
+// into the last one. A batch the node fails to store is dropped, not retried.
+type Buffer struct {
+	client *Client
+	opts   BufferOptions
+
+	mu      sync.Mutex
+	room    *sync.Cond
+	pending []BatchEntry
+	keys    map[string]int
+	bytes   int
+	closed  bool
+	stats   BufferStats
+
+	flushMu sync.Mutex
+	kick    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewBuffer starts a buffer writing through c. Close it to send the writes
+// left in it.
+func (c *Client) NewBuffer(opts BufferOptions) *Buffer {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.FlushEntries <= 0 {
+		opts.FlushEntries = defaultFlushEntries
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultBufferBytes
+	}
+	b := &Buffer{
+		client:  c,
+		opts:    opts,
+		keys:    make(map[string]int),
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	b.room = sync.NewCond(&b.mu)
+	go b.run()
+	return b
+}
+
+// Put buffers the write of value under key. A full buffer drops the write
+// or blocks, as its overflow policy says; a write larger than the whole
+// buffer is always dropped.
+func (b *Buffer) Put(key, value string) error {
+	size := len(key) + len(value)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		if b.closed {
+			return ErrBufferClosed
+		}
+		if b.bytes+size <= b.opts.MaxBytes {
+			break
+		}
+		b.flushSoon()
+		if b.opts.Overflow != OverflowBlock || size > b.opts.MaxBytes {
+			b.stats.Dropped++
+			return ErrBufferFull
+		}
+		b.room.Wait()
+	}
+
+	// The replaced value stays counted until its batch is sent, which
+	// keeps the accounting simple.
+	if i, found := b.keys[key]; found {
+		b.pending[i].Value = value
+		b.stats.Coalesced++
+	} else {
+		b.keys[key] = len(b.pending)
+		b.pending = append(b.pending, BatchEntry{Key: key, Value: value})
+	}
+	b.bytes += size
+	if len(b.pending) >= b.opts.FlushEntries {
+		b.flushSoon()
+	}
+	return nil
+}
+
+// Flush sends the buffered writes now.
+func (b *Buffer) Flush(ctx context.Context) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	batch, size := b.pending, b.bytes
+	b.pending, b.keys = nil, make(map[string]int)
+	b.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	sequence, err := b.client.PutBatchSequence(ctx, batch)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Bytes of writes buffered during the flush are still counted.
+	b.bytes -= size
+	if err != nil {
+		b.stats.Failed += int64(len(batch))
+	} else {
+		b.stats.Flushed += int64(len(batch))
+		b.stats.Sequence = max(b.stats.Sequence, sequence)
+	}
+	b.room.Broadcast()
+	return err
+}
+
+// Close stops the buffer, sends the writes left in it and returns the error
+// of that last flush. Puts after Close fail with ErrBufferClosed.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.room.Broadcast()
+	b.mu.Unlock()
+
+	close(b.done)
+	<-b.stopped
+	return b.Flush(context.Background())
+}
+
+// Stats returns the counters of the buffer.
+func (b *Buffer) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Buffered, stats.Bytes = len(b.pending), b.bytes
+	return stats
+}
+
+// flushSoon wakes the flushing goroutine without waiting for it.
+func (b *Buffer) flushSoon() {
+	select {
+	case b.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (b *Buffer) run() {
+	defer close(b.stopped)
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.kick:
+		}
+		// Failed batches are counted in the stats.
+		_ = b.Flush(context.Background())
+	}
+}
@@ -0,0 +1,122 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchServer records the batches it receives and stores their values.
+type batchServer struct {
+	mu      sync.Mutex
+	batches [][]string
+	values  map[string]string
+}
+
+func newBatchServer(t *testing.T) (*batchServer, *Client) {
+	s := &batchServer{values: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var request batchRequest
+		if r.URL.Path != "/db/_batch" || json.NewDecoder(r.Body).Decode(&request) != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		var keys []string
+		for _, e := range request.Entries {
+			keys = append(keys, e.Key)
+			s.values[e.Key] = e.Value
+		}
+		s.batches = append(s.batches, keys)
+		rw.Header().Set(httptools.SequenceHeader, strconv.Itoa(len(s.batches)))
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return s, New(server.URL)
+}
+
+func (s *batchServer) snapshot() ([][]string, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string]string, len(s.values))
+	for k, v := range s.values {
+		values[k] = v
+	}
+	return append([][]string(nil), s.batches...), values
+}
+
+func TestBuffer(t *testing.T) {
+	server, client := newBatchServer(t)
+	buffer := client.NewBuffer(BufferOptions{FlushInterval: time.Hour, FlushEntries: 2})
+
+	assert.Nil(t, buffer.Put("a", "1"))
+	assert.Nil(t, buffer.Put("a", "2"))
+	assert.Nil(t, buffer.Put("b", "1"))
+	// The second key sends the batch.
+	assert.Eventually(t, func() bool {
+		batches, _ := server.snapshot()
+		return len(batches) == 1
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, buffer.Put("c", "1"))
+	assert.Nil(t, buffer.Close())
+	assert.Equal(t, ErrBufferClosed, buffer.Put("d", "1"))
+
+	batches, values := server.snapshot()
+	assert.Equal(t, [][]string{{"a", "b"}, {"c"}}, batches)
+	assert.Equal(t, map[string]string{"a": "2", "b": "1", "c": "1"}, values)
+	assert.Equal(t, BufferStats{Flushed: 3, Coalesced: 1, Sequence: 2}, buffer.Stats())
+}
+
+func TestBuffer_FlushInterval(t *testing.T) {
+	server, client := newBatchServer(t)
+	buffer := client.NewBuffer(BufferOptions{FlushInterval: 10 * time.Millisecond})
+	defer buffer.Close()
+
+	assert.Nil(t, buffer.Put("a", "1"))
+	assert.Eventually(t, func() bool {
+		_, values := server.snapshot()
+		return values["a"] == "1"
+	}, time.Second, time.Millisecond)
+}
+
+func TestBuffer_Overflow(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	client := New(server.URL)
+
+	drop := client.NewBuffer(BufferOptions{FlushInterval: time.Hour, MaxBytes: 10})
+	assert.Nil(t, drop.Put("a", "12345678"))
+	assert.Equal(t, ErrBufferFull, drop.Put("b", "12"))
+	assert.Equal(t, ErrBufferFull, drop.Put("c", "a value over the whole buffer"))
+	assert.Equal(t, int64(2), drop.Stats().Dropped)
+
+	block := client.NewBuffer(BufferOptions{FlushInterval: time.Hour, MaxBytes: 10, Overflow: OverflowBlock})
+	assert.Nil(t, block.Put("a", "12345678"))
+	put := make(chan error)
+	go func() { put <- block.Put("b", "12") }()
+	select {
+	case err := <-put:
+		t.Fatalf("Expected the put to wait for the flush, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	// The flush of the first write makes room.
+	close(release)
+	assert.Nil(t, <-put)
+
+	assert.Nil(t, drop.Close())
+	assert.Nil(t, block.Close())
+	assert.Equal(t, int64(2), block.Stats().Flushed)
+}
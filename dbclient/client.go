@@ -0,0 +1,510 @@
+// Package dbclient is the HTTP client of the cmd/db key-value service.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+)
+
+var (
+	ErrNotFound        = errors.New("dbclient: key not found")
+	ErrVersionConflict = errors.New("dbclient: version conflict")
+	ErrLocked          = errors.New("dbclient: key is locked")
+	ErrLockNotHeld     = errors.New("dbclient: lock is not held with this token")
+)
+
+// Record is a value stored under a key together with its version.
+type Record struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	// Sequence is the commit sequence the node had applied when it
+	// answered, zero if it has none. Passed to a later read with
+	// httptools.ContextWithMinSequence, it makes the read see this record
+	// or a newer one.
+	Sequence uint64 `json:"-"`
+}
+
+// PutOptions tunes a single write.
+type PutOptions struct {
+	Tags []string
+	// ExpectedVersion, when set, makes the write fail with ErrVersionConflict
+	// unless the key currently has this version. Zero means the key must not
+	// exist.
+	ExpectedVersion *uint64
+	// Durability is "sync" to be acknowledged once the write is on disk or
+	// "async" once it is applied in memory. Empty uses the node default.
+	Durability string
+	// TTL, when set, makes the key expire that long after the write.
+	TTL time.Duration
+}
+
+type putRequest struct {
+	Value     string   `json:"value"`
+	Tags      []string `json:"tags,omitempty"`
+	Version   *uint64  `json:"version,omitempty"`
+	TTLMillis int64    `json:"ttl_ms,omitempty"`
+}
+
+// BatchEntry is a key written by PutBatch.
+type BatchEntry struct {
+	Key   string
+	Value string
+	Tags  []string
+	// TTL, when set, makes the key expire that long after the write.
+	TTL time.Duration
+}
+
+type batchRequest struct {
+	Entries []batchEntry `json:"entries"`
+}
+
+type batchEntry struct {
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	Tags      []string `json:"tags,omitempty"`
+	TTLMillis int64    `json:"ttl_ms,omitempty"`
+}
+
+type mgetRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetResponse struct {
+	Records []Record `json:"records"`
+}
+
+// Client talks to one db node or to a leader with read replicas. Writes
+// always go to the leader, reads are spread round-robin over the healthy
+// endpoints and fail over to the next one on network or server errors.
+type Client struct {
+	endpoints  []*endpoint
+	next       atomic.Uint32
+	httpClient *http.Client
+	adminToken string
+}
+
+// New creates a client of the db service available at baseURL, for example
+// "http://db:8080". Further URLs are read replicas of the first one.
+func New(baseURL string, replicas ...string) *Client {
+	c := &Client{httpClient: &http.Client{Timeout: 5 * time.Second}}
+	for _, u := range append([]string{baseURL}, replicas...) {
+		c.endpoints = append(c.endpoints, &endpoint{url: u})
+	}
+	return c
+}
+
+// SetTLSConfig makes the client reach the nodes over TLS with config, for
+// nodes that require client certificates. Node URLs must use https.
+func (c *Client) SetTLSConfig(config *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.httpClient.Transport = transport
+}
+
+func (c *Client) Get(key string) (Record, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get bounded by ctx. The time left until the deadline of ctx
+// is passed on to the db node, which gives up on the request after it, and
+// so is the sequence of httptools.ContextWithMinSequence: the record read is
+// from a node that has applied it.
+func (c *Client) GetContext(ctx context.Context, key string) (Record, error) {
+	record, _, err := c.get(ctx, key)
+	return record, err
+}
+
+// get reads the record and returns it with the response content type.
+func (c *Client) get(ctx context.Context, key string) (Record, string, error) {
+	var record Record
+	resp, err := c.read(ctx, http.MethodGet, keyPath(key), nil)
+	if err != nil {
+		return record, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return record, "", err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&record)
+	record.Sequence = responseSequence(resp)
+	return record, resp.Header.Get("Content-Type"), err
+}
+
+// responseSequence returns the commit sequence a node answered with.
+func responseSequence(resp *http.Response) uint64 {
+	sequence, _ := strconv.ParseUint(resp.Header.Get(httptools.SequenceHeader), 10, 64)
+	return sequence
+}
+
+// Put stores the value and returns the new version of the key.
+func (c *Client) Put(key, value string) (uint64, error) {
+	return c.PutWithOptions(key, value, PutOptions{})
+}
+
+// PutIfVersion stores the value only if the key currently has the given
+// version, otherwise it returns ErrVersionConflict.
+func (c *Client) PutIfVersion(key, value string, version uint64) (uint64, error) {
+	return c.PutWithOptions(key, value, PutOptions{ExpectedVersion: &version})
+}
+
+func (c *Client) PutWithOptions(key, value string, opts PutOptions) (uint64, error) {
+	return c.PutContext(context.Background(), key, value, opts)
+}
+
+// PutContext is PutWithOptions bounded by ctx.
+func (c *Client) PutContext(ctx context.Context, key, value string, opts PutOptions) (uint64, error) {
+	record, err := c.PutRecord(ctx, key, value, opts)
+	return record.Version, err
+}
+
+// PutRecord is PutContext returning the stored record, with the commit
+// sequence of the write.
+func (c *Client) PutRecord(ctx context.Context, key, value string, opts PutOptions) (Record, error) {
+	requestJSON, _ := json.Marshal(putRequest{
+		Value:     value,
+		Tags:      opts.Tags,
+		Version:   opts.ExpectedVersion,
+		TTLMillis: opts.TTL.Milliseconds(),
+	})
+	path := keyPath(key)
+	if opts.Durability != "" {
+		path += "?durability=" + url.QueryEscape(opts.Durability)
+	}
+	var record Record
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodPost, path, requestJSON)
+	if err != nil {
+		return record, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return record, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&record)
+	record.Sequence = responseSequence(resp)
+	return record, err
+}
+
+// GetBytes reads a binary value, stored with PutBytes, as it was written.
+func (c *Client) GetBytes(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.read(ctx, http.MethodGet, keyPath(key)+"?envelope=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// PutBytes stores an arbitrary binary value, sent as is rather than in a
+// JSON string, and returns the new version of the key.
+func (c *Client) PutBytes(ctx context.Context, key string, value []byte) (uint64, error) {
+	ep := c.endpoints[0]
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ep.url+keyPath(key), bytes.NewReader(value))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("content-type", "application/octet-stream")
+	resp, err := c.do(ep, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(resp.Header.Get(httptools.VersionHeader), 10, 64)
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete bounded by ctx.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.DeleteSequence(ctx, key)
+	return err
+}
+
+// DeleteSequence is DeleteContext returning the commit sequence of the
+// delete.
+func (c *Client) DeleteSequence(ctx context.Context, key string) (uint64, error) {
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodDelete, keyPath(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	return responseSequence(resp), nil
+}
+
+// MGet reads several keys in one request. Keys that do not exist are left
+// out of the result.
+func (c *Client) MGet(ctx context.Context, keys []string) ([]Record, error) {
+	requestJSON, _ := json.Marshal(mgetRequest{Keys: keys})
+	resp, err := c.read(ctx, http.MethodPost, "/db/_mget", requestJSON)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	var response mgetResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	return response.Records, err
+}
+
+// PutBatch stores all entries in one request. The node writes them
+// atomically: either every entry is stored or none is. A key listed more
+// than once ends with its last value.
+func (c *Client) PutBatch(ctx context.Context, entries []BatchEntry) error {
+	_, err := c.PutBatchSequence(ctx, entries)
+	return err
+}
+
+// PutBatchSequence is PutBatch returning the commit sequence of the batch.
+func (c *Client) PutBatchSequence(ctx context.Context, entries []BatchEntry) (uint64, error) {
+	request := batchRequest{Entries: make([]batchEntry, len(entries))}
+	for i, e := range entries {
+		request.Entries[i] = batchEntry{Key: e.Key, Value: e.Value, Tags: e.Tags, TTLMillis: e.TTL.Milliseconds()}
+	}
+	requestJSON, _ := json.Marshal(request)
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodPost, "/db/_batch", requestJSON)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return 0, err
+	}
+	return responseSequence(resp), nil
+}
+
+// KeyPage is one page of a key listing.
+type KeyPage struct {
+	Keys []string `json:"keys"`
+	// Next is the cursor of the following page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// Keys lists up to limit live keys starting with prefix in lexical order,
+// after the cursor key. Pass the Next cursor of a page to get the
+// following one.
+func (c *Client) Keys(ctx context.Context, prefix, after string, limit int) (KeyPage, error) {
+	query := url.Values{"prefix": {prefix}, "after": {after}, "limit": {strconv.Itoa(limit)}}
+	var page KeyPage
+	resp, err := c.read(ctx, http.MethodGet, "/db?"+query.Encode(), nil)
+	if err != nil {
+		return page, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return page, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	return page, err
+}
+
+// Lock is an advisory lock held on a key.
+type Lock struct {
+	Key   string `json:"key"`
+	Owner string `json:"owner,omitempty"`
+	// Token is the fencing token of the lock, larger than the tokens of all
+	// locks acquired before.
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LockOptions tunes acquiring a lock.
+type LockOptions struct {
+	TTL time.Duration
+	// Owner names the holder, for others to see who holds the lock.
+	Owner string
+	// Token, when set, renews the lock held with it for another TTL.
+	Token uint64
+}
+
+type lockRequest struct {
+	TTLMillis int64  `json:"ttl_ms"`
+	Owner     string `json:"owner,omitempty"`
+	Token     uint64 `json:"token,omitempty"`
+}
+
+// Lock acquires the advisory lock of key on the leader for ttl. It returns
+// ErrLocked while someone else holds it.
+func (c *Client) Lock(ctx context.Context, key string, ttl time.Duration) (Lock, error) {
+	return c.LockWithOptions(ctx, key, LockOptions{TTL: ttl})
+}
+
+// LockWithOptions acquires or, given a token, renews the lock of key.
+// Renewing returns ErrLockNotHeld once the lock was lost.
+func (c *Client) LockWithOptions(ctx context.Context, key string, opts LockOptions) (Lock, error) {
+	requestJSON, _ := json.Marshal(lockRequest{TTLMillis: opts.TTL.Milliseconds(), Owner: opts.Owner, Token: opts.Token})
+	var lock Lock
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodPost, keyPath(key)+"/lock", requestJSON)
+	if err != nil {
+		return lock, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusLocked:
+		return lock, ErrLocked
+	case http.StatusConflict:
+		return lock, ErrLockNotHeld
+	}
+	if err := checkStatus(resp); err != nil {
+		return lock, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&lock)
+	return lock, err
+}
+
+// GetLock returns the lock held on key, or ErrNotFound when it is free.
+func (c *Client) GetLock(ctx context.Context, key string) (Lock, error) {
+	var lock Lock
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodGet, keyPath(key)+"/lock", nil)
+	if err != nil {
+		return lock, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return lock, err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&lock)
+	return lock, err
+}
+
+// Unlock releases a lock. It returns ErrLockNotHeld when the lock expired
+// or was taken over since.
+func (c *Client) Unlock(ctx context.Context, lock Lock) error {
+	path := keyPath(lock.Key) + "/lock?token=" + strconv.FormatUint(lock.Token, 10)
+	resp, err := c.send(ctx, c.endpoints[0], http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return ErrLockNotHeld
+	}
+	return checkStatus(resp)
+}
+
+// read sends the request to the endpoints in round-robin order, skipping the
+// ones marked unhealthy, until one of them answers without a server error,
+// or 425 of a replica behind the sequence of ctx. When every endpoint is
+// unhealthy all of them are still tried.
+func (c *Client) read(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	start := int(c.next.Add(1)-1) % len(c.endpoints)
+	order := make([]*endpoint, 0, len(c.endpoints))
+	var down []*endpoint
+	for i := range c.endpoints {
+		ep := c.endpoints[(start+i)%len(c.endpoints)]
+		if ep.healthy() {
+			order = append(order, ep)
+		} else {
+			down = append(down, ep)
+		}
+	}
+	order = append(order, down...)
+
+	var lastErr error
+	for i, ep := range order {
+		resp, err := c.send(ctx, ep, method, path, body)
+		if err == nil && (!retryElsewhere(resp.StatusCode) || i == len(order)-1) {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("dbclient: unexpected status %d", resp.StatusCode)
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// retryElsewhere tells whether a read answered with status may succeed on
+// another endpoint: one that failed, or a replica too stale for the
+// sequence of the context that the leader is fresh enough for.
+func retryElsewhere(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooEarly
+}
+
+// send performs a single request with a JSON body, if any, against ep.
+func (c *Client) send(ctx context.Context, ep *endpoint, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, ep.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	return c.do(ep, req)
+}
+
+// do performs req against ep and records its outcome.
+func (c *Client) do(ep *endpoint, req *http.Request) (*http.Response, error) {
+	c.authorize(req)
+	httptools.SetTimeout(req)
+	httptools.SetMinSequence(req)
+
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	ep.observe(time.Since(start), err != nil || resp.StatusCode >= http.StatusInternalServerError)
+	return resp, err
+}
+
+// Stats returns the metrics of every endpoint, the leader first.
+func (c *Client) Stats() []EndpointStats {
+	stats := make([]EndpointStats, len(c.endpoints))
+	for i, ep := range c.endpoints {
+		stats[i] = ep.stats()
+	}
+	return stats
+}
+
+func keyPath(key string) string {
+	return "/db/" + url.PathEscape(key)
+}
+
+func checkStatus(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return ErrVersionConflict
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("dbclient: unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	versions := map[string]uint64{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path[len("/db/"):]
+		switch r.Method {
+		case http.MethodGet:
+			version, ok := versions[key]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(rw).Encode(Record{Key: key, Value: "value", Version: version})
+		case http.MethodPost:
+			var request putRequest
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			if request.Version != nil && *request.Version != versions[key] {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			}
+			versions[key]++
+			_ = json.NewEncoder(rw).Encode(Record{Key: key, Value: request.Value, Version: versions[key]})
+		case http.MethodDelete:
+			delete(versions, key)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL)
+
+	_, err := client.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+
+	version, err := client.Put("key", "value")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), version)
+
+	record, err := client.Get("key")
+	assert.Nil(t, err)
+	assert.Equal(t, Record{Key: "key", Value: "value", Version: 1}, record)
+
+	version, err = client.PutIfVersion("key", "value", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), version)
+
+	_, err = client.PutIfVersion("key", "value", 1)
+	assert.Equal(t, ErrVersionConflict, err)
+
+	assert.Nil(t, client.Delete("key"))
+	_, err = client.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestClient_MGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/db/_mget", r.URL.Path)
+		var request mgetRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		assert.Equal(t, []string{"a", "b"}, request.Keys)
+		_ = json.NewEncoder(rw).Encode(mgetResponse{Records: []Record{{Key: "a", Value: "value", Version: 3}}})
+	}))
+	defer server.Close()
+
+	records, err := New(server.URL).MGet(context.Background(), []string{"a", "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{{Key: "a", Value: "value", Version: 3}}, records)
+}
+
+func TestClient_Replicas(t *testing.T) {
+	var leaderReads, leaderWrites, replicaReads int
+	leader := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			leaderReads++
+		} else {
+			leaderWrites++
+		}
+		_ = json.NewEncoder(rw).Encode(Record{Key: "key", Value: "leader", Version: 1})
+	}))
+	defer leader.Close()
+	replicaFailing := false
+	replica := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method, "writes must go to the leader")
+		replicaReads++
+		if replicaFailing {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(Record{Key: "key", Value: "replica", Version: 1})
+	}))
+	defer replica.Close()
+
+	client := New(leader.URL, replica.URL)
+	for i := 0; i < 4; i++ {
+		_, err := client.Get("key")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 2, leaderReads)
+	assert.Equal(t, 2, replicaReads)
+
+	_, err := client.Put("key", "value")
+	assert.Nil(t, err)
+	assert.Nil(t, client.Delete("key"))
+	assert.Equal(t, 2, leaderWrites)
+
+	replicaFailing = true
+	for i := 0; i < 4; i++ {
+		record, err := client.Get("key")
+		assert.Nil(t, err)
+		assert.Equal(t, "leader", record.Value)
+	}
+	assert.Equal(t, 3, replicaReads, "unhealthy replica must be skipped after the failure")
+
+	stats := client.Stats()
+	assert.Equal(t, leader.URL, stats[0].URL)
+	assert.True(t, stats[0].Healthy)
+	assert.Equal(t, int64(8), stats[0].Requests)
+	assert.False(t, stats[1].Healthy)
+	assert.Equal(t, int64(1), stats[1].Failures)
+}
+
+func TestClient_PropagatesDeadline(t *testing.T) {
+	var budgets []string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		budgets = append(budgets, r.Header.Get(httptools.TimeoutHeader))
+		_ = json.NewEncoder(rw).Encode(Record{Key: "key"})
+	}))
+	defer server.Close()
+
+	client := New(server.URL)
+	_, err := client.Get("key")
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = client.GetContext(ctx, "key")
+	assert.Nil(t, err)
+	assert.Nil(t, client.DeleteContext(ctx, "key"))
+
+	assert.Equal(t, "", budgets[0], "no budget without a deadline")
+	for _, budget := range budgets[1:] {
+		assert.Regexp(t, `^\d{3,4}$`, budget)
+	}
+}
+
+func TestClient_MinSequence(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(rw).Encode(Record{Key: "key", Value: "leader", Version: 2})
+	}))
+	defer leader.Close()
+	replica := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(httptools.MinSequenceHeader) == "2" {
+			rw.WriteHeader(http.StatusTooEarly)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(Record{Key: "key", Value: "replica", Version: 1})
+	}))
+	defer replica.Close()
+
+	client := New(leader.URL, replica.URL)
+	ctx := httptools.ContextWithMinSequence(context.Background(), 2)
+	for i := 0; i < 4; i++ {
+		record, err := client.GetContext(ctx, "key")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), record.Version, "a stale replica must send the read to the leader")
+	}
+	assert.True(t, client.Stats()[1].Healthy, "a stale replica is not unhealthy")
+}
+
+func TestClient_Keys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/db", r.URL.Path)
+		assert.Equal(t, "user/", r.URL.Query().Get("prefix"))
+		assert.Equal(t, "user/a", r.URL.Query().Get("after"))
+		assert.Equal(t, "2", r.URL.Query().Get("limit"))
+		_ = json.NewEncoder(rw).Encode(KeyPage{Keys: []string{"user/b", "user/c"}, Next: "user/c"})
+	}))
+	defer server.Close()
+
+	page, err := New(server.URL).Keys(context.Background(), "user/", "user/a", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, KeyPage{Keys: []string{"user/b", "user/c"}, Next: "user/c"}, page)
+}
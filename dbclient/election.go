@@ -0,0 +1,160 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LeaderElector elects one leader among the candidates campaigning for the
+// same key, for jobs that must run on a single instance. The leader holds
+// the advisory lock of the key, named after its id, and renews it every
+// third of the ttl. A leader that stops renewing, say because it crashed,
+// is replaced once the lock expires.
+type LeaderElector struct {
+	client *Client
+	key    string
+	id     string
+	ttl    time.Duration
+
+	mu     sync.Mutex
+	lease  Lock
+	resign context.CancelFunc
+	done   chan struct{}
+}
+
+func NewLeaderElector(client *Client, key, id string, ttl time.Duration) *LeaderElector {
+	return &LeaderElector{client: client, key: key, id: id, ttl: ttl}
+}
+
+// Campaign blocks until the candidate becomes the leader or ctx is done.
+// The returned context lasts as long as the leadership: it is cancelled
+// when the lease is lost or the candidate resigns, so jobs run with it
+// stop before another leader takes over.
+func (e *LeaderElector) Campaign(ctx context.Context) (context.Context, error) {
+	for {
+		lease, err := e.client.LockWithOptions(ctx, e.key, LockOptions{TTL: e.ttl, Owner: e.id})
+		if err == nil {
+			return e.lead(lease), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Both a held lock and an unreachable db are waited out.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(e.ttl / 3):
+		}
+	}
+}
+
+func (e *LeaderElector) lead(lease Lock) context.Context {
+	leading, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	e.mu.Lock()
+	e.lease, e.resign, e.done = lease, cancel, done
+	e.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		e.keepAlive(leading, cancel, lease)
+		e.mu.Lock()
+		if e.done == done {
+			e.resign = nil
+		}
+		e.mu.Unlock()
+	}()
+	return leading
+}
+
+// keepAlive renews the lease until it is lost or the leader resigns. A
+// lease that could not be renewed is given up just before it would expire
+// at the db, measured from the start of the last successful renewal.
+func (e *LeaderElector) keepAlive(ctx context.Context, cancel context.CancelFunc, lease Lock) {
+	defer cancel()
+	deadline := time.Now().Add(e.ttl)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		renewCtx, cancelRenew := context.WithDeadline(ctx, deadline)
+		_, err := e.client.LockWithOptions(renewCtx, e.key, LockOptions{TTL: e.ttl, Token: lease.Token})
+		cancelRenew()
+		switch {
+		case err == nil:
+			deadline = start.Add(e.ttl)
+		case errors.Is(err, ErrLockNotHeld), !time.Now().Before(deadline):
+			return
+		}
+	}
+}
+
+// Lease returns the lock held while leading. Its token fences writes of
+// an old leader that still runs after losing the lease.
+func (e *LeaderElector) Lease() (Lock, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.resign == nil {
+		return Lock{}, false
+	}
+	return e.lease, true
+}
+
+// Resign gives up the leadership, letting another candidate take over
+// right away instead of after the ttl.
+func (e *LeaderElector) Resign(ctx context.Context) error {
+	e.mu.Lock()
+	lease, resign, done := e.lease, e.resign, e.done
+	e.resign = nil
+	e.mu.Unlock()
+	if resign == nil {
+		return nil
+	}
+	resign()
+	<-done
+
+	err := e.client.Unlock(ctx, lease)
+	if errors.Is(err, ErrLockNotHeld) {
+		return nil
+	}
+	return err
+}
+
+// Observe reports the id of the current leader, empty while there is
+// none, whenever it changes. The leader is polled every third of the ttl
+// and the channel is closed when ctx is done.
+func (e *LeaderElector) Observe(ctx context.Context) <-chan string {
+	leaders := make(chan string, 1)
+	go func() {
+		defer close(leaders)
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+		last, first := "", true
+		for {
+			lock, err := e.client.GetLock(ctx, e.key)
+			if err == nil || errors.Is(err, ErrNotFound) {
+				if lock.Owner != last || first {
+					select {
+					case leaders <- lock.Owner:
+					case <-ctx.Done():
+						return
+					}
+					last, first = lock.Owner, false
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return leaders
+}
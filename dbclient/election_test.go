@@ -0,0 +1,98 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/QuantumGurus/Lab4-KPI/datastore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newLockServer serves the lock API of a db node.
+func newLockServer(t *testing.T) *httptest.Server {
+	db, err := datastore.Open("db", datastore.Options{SegmentSize: 1024, Filesystem: datastore.NewMemFilesystem()})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /db/{key}/lock", func(rw http.ResponseWriter, r *http.Request) {
+		lock, err := db.GetLock(r.PathValue("key"))
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(lock)
+	})
+	mux.HandleFunc("POST /db/{key}/lock", func(rw http.ResponseWriter, r *http.Request) {
+		var request lockRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		lock, err := db.LockWithOptions(r.PathValue("key"), datastore.LockOptions{
+			TTL:   time.Duration(request.TTLMillis) * time.Millisecond,
+			Owner: request.Owner,
+			Token: request.Token,
+		})
+		switch err {
+		case nil:
+			_ = json.NewEncoder(rw).Encode(lock)
+		case datastore.ErrLocked:
+			rw.WriteHeader(http.StatusLocked)
+		default:
+			rw.WriteHeader(http.StatusConflict)
+		}
+	})
+	mux.HandleFunc("DELETE /db/{key}/lock", func(rw http.ResponseWriter, r *http.Request) {
+		token, _ := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+		if db.Unlock(r.PathValue("key"), token) != nil {
+			rw.WriteHeader(http.StatusConflict)
+		}
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLeaderElector(t *testing.T) {
+	client := New(newLockServer(t).URL)
+	ttl := 150 * time.Millisecond
+	a := NewLeaderElector(client, "leader", "a", ttl)
+	b := NewLeaderElector(client, "leader", "b", ttl)
+
+	observeCtx, stopObserving := context.WithCancel(context.Background())
+	defer stopObserving()
+	leaders := a.Observe(observeCtx)
+	assert.Equal(t, "", <-leaders)
+
+	leadingA, err := a.Campaign(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "a", <-leaders)
+
+	// b waits while a renews its lease past the ttl.
+	waitCtx, cancel := context.WithTimeout(context.Background(), 3*ttl)
+	_, err = b.Campaign(waitCtx)
+	cancel()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, leadingA.Err())
+	lease, leading := a.Lease()
+	assert.True(t, leading)
+	assert.Equal(t, "a", lease.Owner)
+
+	// Once a resigns, b takes over with a larger fencing token.
+	require.NoError(t, a.Resign(context.Background()))
+	assert.ErrorIs(t, leadingA.Err(), context.Canceled)
+	_, err = b.Campaign(context.Background())
+	require.NoError(t, err)
+	leaseB, _ := b.Lease()
+	assert.Greater(t, leaseB.Token, lease.Token)
+	for leader := range leaders {
+		if leader == "b" {
+			break
+		}
+	}
+	require.NoError(t, b.Resign(context.Background()))
+}
@@ -0,0 +1,56 @@
+package dbclient
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// endpointCooldown is how long a failed endpoint is skipped by reads.
+const endpointCooldown = 5 * time.Second
+
+// EndpointStats are the request metrics of a single db endpoint.
+type EndpointStats struct {
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+	// AvgLatency is the mean request duration.
+	AvgLatency time.Duration `json:"avgLatency"`
+}
+
+type endpoint struct {
+	url string
+
+	requests  atomic.Int64
+	failures  atomic.Int64
+	latency   atomic.Int64
+	downUntil atomic.Int64
+}
+
+func (ep *endpoint) observe(latency time.Duration, failed bool) {
+	ep.requests.Add(1)
+	ep.latency.Add(int64(latency))
+	if failed {
+		ep.failures.Add(1)
+		ep.downUntil.Store(time.Now().Add(endpointCooldown).UnixNano())
+	} else {
+		ep.downUntil.Store(0)
+	}
+}
+
+func (ep *endpoint) healthy() bool {
+	return time.Now().UnixNano() >= ep.downUntil.Load()
+}
+
+func (ep *endpoint) stats() EndpointStats {
+	stats := EndpointStats{
+		URL:      ep.url,
+		Healthy:  ep.healthy(),
+		Requests: ep.requests.Load(),
+		Failures: ep.failures.Load(),
+	}
+	if stats.Requests > 0 {
+		stats.AvgLatency = time.Duration(ep.latency.Load() / stats.Requests)
+	}
+	return stats
+}
@@ -0,0 +1,74 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+)
+
+// ErrContentType is returned when the db answers with a non-JSON body.
+var ErrContentType = errors.New("dbclient: unexpected content type")
+
+// NotFoundError reports a missing key. It matches ErrNotFound with errors.Is.
+type NotFoundError struct {
+	Key string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("dbclient: key %q not found", e.Key)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return ErrNotFound
+}
+
+// ConflictError reports a failed optimistic write. It matches
+// ErrVersionConflict with errors.Is.
+type ConflictError struct {
+	Key string
+	// ExpectedVersion is the version the write was conditioned on.
+	ExpectedVersion uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("dbclient: key %q is not at version %d", e.Key, e.ExpectedVersion)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// GetJSON reads the key and decodes its value, stored as a JSON document,
+// into T. It also returns the version of the key.
+func GetJSON[T any](c *Client, key string) (T, uint64, error) {
+	var doc T
+	record, contentType, err := c.get(context.Background(), key)
+	if errors.Is(err, ErrNotFound) {
+		return doc, 0, &NotFoundError{Key: key}
+	}
+	if err != nil {
+		return doc, 0, err
+	}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "application/json" {
+		return doc, 0, fmt.Errorf("%w %q", ErrContentType, contentType)
+	}
+	if err := json.Unmarshal([]byte(record.Value), &doc); err != nil {
+		return doc, 0, fmt.Errorf("dbclient: decoding value of %q: %w", key, err)
+	}
+	return doc, record.Version, nil
+}
+
+// PutJSON stores doc encoded as JSON under the key and returns the new version.
+func PutJSON[T any](c *Client, key string, doc T, opts PutOptions) (uint64, error) {
+	value, err := json.Marshal(doc)
+	if err != nil {
+		return 0, fmt.Errorf("dbclient: encoding value of %q: %w", key, err)
+	}
+	version, err := c.PutWithOptions(key, string(value), opts)
+	if errors.Is(err, ErrVersionConflict) && opts.ExpectedVersion != nil {
+		return 0, &ConflictError{Key: key, ExpectedVersion: *opts.ExpectedVersion}
+	}
+	return version, err
+}
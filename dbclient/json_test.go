@@ -0,0 +1,75 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testDoc struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestJSONHelpers(t *testing.T) {
+	records := map[string]Record{}
+	contentType := "application/json; charset=utf-8"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.URL.Path[len("/db/"):]
+		switch r.Method {
+		case http.MethodGet:
+			record, ok := records[key]
+			if !ok {
+				rw.WriteHeader(http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Content-Type", contentType)
+			_ = json.NewEncoder(rw).Encode(record)
+		case http.MethodPost:
+			var request putRequest
+			_ = json.NewDecoder(r.Body).Decode(&request)
+			if request.Version != nil && *request.Version != records[key].Version {
+				rw.WriteHeader(http.StatusConflict)
+				return
+			}
+			records[key] = Record{Key: key, Value: request.Value, Version: records[key].Version + 1}
+			_ = json.NewEncoder(rw).Encode(records[key])
+		}
+	}))
+	defer server.Close()
+	client := New(server.URL)
+
+	_, _, err := GetJSON[testDoc](client, "doc")
+	var notFound *NotFoundError
+	assert.True(t, errors.As(err, &notFound))
+	assert.Equal(t, "doc", notFound.Key)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	version, err := PutJSON(client, "doc", testDoc{Name: "a", Count: 1}, PutOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), version)
+
+	doc, version, err := GetJSON[testDoc](client, "doc")
+	assert.Nil(t, err)
+	assert.Equal(t, testDoc{Name: "a", Count: 1}, doc)
+	assert.Equal(t, uint64(1), version)
+
+	stale := uint64(0)
+	_, err = PutJSON(client, "doc", testDoc{Name: "b"}, PutOptions{ExpectedVersion: &stale})
+	var conflict *ConflictError
+	assert.True(t, errors.As(err, &conflict))
+	assert.Equal(t, uint64(0), conflict.ExpectedVersion)
+	assert.True(t, errors.Is(err, ErrVersionConflict))
+
+	records["text"] = Record{Key: "text", Value: "not json", Version: 1}
+	_, _, err = GetJSON[testDoc](client, "text")
+	assert.NotNil(t, err)
+
+	contentType = "text/plain"
+	_, _, err = GetJSON[testDoc](client, "doc")
+	assert.True(t, errors.Is(err, ErrContentType))
+}
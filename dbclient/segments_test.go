@@ -0,0 +1,59 @@
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient_DownloadSegment(t *testing.T) {
+	data := strings.Repeat("segment data ", 100)
+	info := SegmentInfo{Name: "current-data0", Size: int64(len(data)), Checksum: "abc"}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/db-admin/segments":
+			_ = json.NewEncoder(rw).Encode([]SegmentInfo{info})
+		case "/db-admin/compaction":
+			_, _ = rw.Write([]byte(`{"segments": ["segment-1"], "input_bytes": 300, "output_bytes": 100, "reclaimed_bytes": 200}`))
+		case "/db-admin/segments/current-data0":
+			rw.Header().Set(SegmentChecksumHeader, info.Checksum)
+			rw.Header().Set(SegmentSizeHeader, "1300")
+			http.ServeContent(rw, r, info.Name, time.Time{}, strings.NewReader(data))
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := New(server.URL)
+	ctx := context.Background()
+
+	segments, err := client.Segments(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []SegmentInfo{info}, segments)
+
+	estimate, err := client.EstimateCompaction(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, CompactionEstimate{Segments: []string{"segment-1"}, InputBytes: 300, OutputBytes: 100, ReclaimedBytes: 200}, estimate)
+
+	var buf bytes.Buffer
+	buf.WriteString(data[:500])
+	got, err := client.DownloadSegment(ctx, info.Name, 500, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, info, got)
+	assert.Equal(t, data, buf.String())
+
+	got, err = client.DownloadSegment(ctx, info.Name, info.Size, &buf)
+	assert.Nil(t, err, "a complete download needs no more data")
+	assert.Equal(t, data, buf.String())
+
+	_, err = client.DownloadSegment(ctx, "missing", 0, &buf)
+	assert.Equal(t, ErrNotFound, err)
+}
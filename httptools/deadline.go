@@ -0,0 +1,50 @@
+package httptools
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader carries the time in milliseconds the caller is still willing
+// to wait for the response. A relative budget is used instead of an absolute
+// deadline so the tiers do not depend on synchronized clocks.
+const TimeoutHeader = "X-Timeout"
+
+// WithDeadline bounds the request context of next by the budget in the
+// TimeoutHeader of the request, if any. Requests whose budget is already
+// used up are rejected with 504 without reaching next.
+func WithDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(TimeoutHeader)
+		if value == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid "+TimeoutHeader+" header", http.StatusBadRequest)
+			return
+		}
+		if ms <= 0 {
+			http.Error(rw, "Deadline exceeded", http.StatusGatewayTimeout)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(ms)*time.Millisecond)
+		defer cancel()
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// SetTimeout sets the TimeoutHeader of an outgoing request to the time left
+// until the deadline of its context, so the next tier stops working on it
+// when the caller gives up. Requests without a deadline are left unchanged.
+func SetTimeout(r *http.Request) {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return
+	}
+	r.Header.Set(TimeoutHeader, strconv.FormatInt(time.Until(deadline).Milliseconds(), 10))
+}
@@ -0,0 +1,54 @@
+package httptools
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithDeadline(t *testing.T) {
+	var remaining time.Duration
+	handler := WithDeadline(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		remaining = 0
+		if deadline, ok := r.Context().Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+	}))
+
+	serve := func(timeout string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if timeout != "" {
+			r.Header.Set(TimeoutHeader, timeout)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(""))
+	assert.Zero(t, remaining, "no deadline without the header")
+
+	assert.Equal(t, http.StatusOK, serve("1500"))
+	assert.InDelta(t, 1500*time.Millisecond, remaining, float64(100*time.Millisecond))
+
+	remaining = -1
+	assert.Equal(t, http.StatusGatewayTimeout, serve("0"))
+	assert.Equal(t, time.Duration(-1), remaining, "expired requests must not be handled")
+	assert.Equal(t, http.StatusBadRequest, serve("soon"))
+}
+
+func TestSetTimeout(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	SetTimeout(r)
+	assert.Empty(t, r.Header.Get(TimeoutHeader))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r = r.WithContext(ctx)
+	SetTimeout(r)
+	assert.Regexp(t, `^1\d{3}$`, r.Header.Get(TimeoutHeader))
+}
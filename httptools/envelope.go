@@ -0,0 +1,173 @@
+package httptools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelope selects how a record read is wrapped in the response body.
+type Envelope string
+
+const (
+	// EnvelopeRecord is the {"key","value","version"} object clients have
+	// always received, the default.
+	EnvelopeRecord Envelope = "record"
+	// EnvelopeBare is the value alone, as a JSON string.
+	EnvelopeBare Envelope = "bare"
+	// EnvelopeData puts the key and value in "data" and everything known
+	// about them in "meta": the version, the remaining TTL and the request
+	// ID.
+	EnvelopeData Envelope = "data"
+	// EnvelopeRaw is the value bytes alone, as application/octet-stream,
+	// for binary values JSON strings can't carry. The version is sent in
+	// the VersionHeader.
+	EnvelopeRaw Envelope = "raw"
+)
+
+// FieldNaming selects how the names of multi-word fields are spelled.
+type FieldNaming string
+
+const (
+	// SnakeCase names fields like ttl_ms, the default.
+	SnakeCase FieldNaming = "snake"
+	// CamelCase names fields like ttlMs.
+	CamelCase FieldNaming = "camel"
+)
+
+// requestIDHeader identifies a request across the tiers; the balancer sets
+// it on every request it forwards.
+const requestIDHeader = "X-Request-Id"
+
+// ResponseFormat is the envelope and field naming a client asked for.
+type ResponseFormat struct {
+	Envelope Envelope
+	Naming   FieldNaming
+}
+
+// ParseResponseFormat reads the format of a response from the envelope and
+// naming query parameters, or else from the profile of an application/json
+// Accept header, like `application/json; profile="data camel"`, where
+// application/octet-stream asks for EnvelopeRaw. Unknown query values are
+// an error; unknown profiles are ignored, as Accept is only a preference.
+func ParseResponseFormat(r *http.Request) (ResponseFormat, error) {
+	format := ResponseFormat{Envelope: EnvelopeRecord, Naming: SnakeCase}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err == nil && mediaType == "application/octet-stream" {
+			format.Envelope = EnvelopeRaw
+			break
+		}
+		if err != nil || (mediaType != "application/json" && mediaType != "*/*") {
+			continue
+		}
+		for _, token := range strings.Fields(params["profile"]) {
+			format.set(token)
+		}
+		break
+	}
+
+	query := r.URL.Query()
+	if value := query.Get("envelope"); value != "" {
+		if !format.set(value) || format.Envelope != Envelope(value) {
+			return format, fmt.Errorf("unknown envelope %q", value)
+		}
+	}
+	if value := query.Get("naming"); value != "" {
+		if !format.set(value) || format.Naming != FieldNaming(value) {
+			return format, fmt.Errorf("unknown field naming %q", value)
+		}
+	}
+	return format, nil
+}
+
+// set applies an envelope or naming name, reporting whether it is one.
+func (f *ResponseFormat) set(name string) bool {
+	switch value := Envelope(name); value {
+	case EnvelopeRecord, EnvelopeBare, EnvelopeData, EnvelopeRaw:
+		f.Envelope = value
+		return true
+	}
+	switch value := FieldNaming(name); value {
+	case SnakeCase, CamelCase:
+		f.Naming = value
+		return true
+	}
+	return false
+}
+
+// ResponseRecord is a record read, with what an envelope may report about
+// it.
+type ResponseRecord struct {
+	Key     string
+	Value   string
+	Version uint64
+	// TTL is the time left until the record expires, zero when it doesn't
+	// or isn't known.
+	TTL time.Duration
+}
+
+type recordBody struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+}
+
+type dataBody struct {
+	Data struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"data"`
+	Meta map[string]any `json:"meta"`
+}
+
+// Body returns the JSON body answering r with record.
+func (f ResponseFormat) Body(r *http.Request, record ResponseRecord) any {
+	switch f.Envelope {
+	case EnvelopeBare, EnvelopeRaw:
+		return record.Value
+	case EnvelopeData:
+		var body dataBody
+		body.Data.Key, body.Data.Value = record.Key, record.Value
+		body.Meta = map[string]any{"version": record.Version}
+		if record.TTL > 0 {
+			body.Meta[f.field("ttl_ms")] = record.TTL.Milliseconds()
+		}
+		if id := r.Header.Get(requestIDHeader); id != "" {
+			body.Meta[f.field("request_id")] = id
+		}
+		return body
+	default:
+		return recordBody{Key: record.Key, Value: record.Value, Version: record.Version}
+	}
+}
+
+// Write answers r with record: the body of the envelope as JSON, or the
+// value bytes for EnvelopeRaw.
+func (f ResponseFormat) Write(rw http.ResponseWriter, r *http.Request, record ResponseRecord) error {
+	if f.Envelope == EnvelopeRaw {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		rw.Header().Set(VersionHeader, strconv.FormatUint(record.Version, 10))
+		_, err := io.WriteString(rw, record.Value)
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(rw).Encode(f.Body(r, record))
+}
+
+// field spells a snake case field name in the naming of f.
+func (f ResponseFormat) field(name string) string {
+	if f.Naming != CamelCase {
+		return name
+	}
+	words := strings.Split(name, "_")
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
@@ -0,0 +1,65 @@
+package httptools
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResponseFormat(t *testing.T) {
+	for _, tc := range []struct {
+		target, accept string
+		expected       ResponseFormat
+	}{
+		{"/", "", ResponseFormat{EnvelopeRecord, SnakeCase}},
+		{"/", "text/html, application/json", ResponseFormat{EnvelopeRecord, SnakeCase}},
+		{"/", `application/json; profile="data camel"`, ResponseFormat{EnvelopeData, CamelCase}},
+		{"/", `application/json; profile="bare future"`, ResponseFormat{EnvelopeBare, SnakeCase}},
+		{"/?envelope=bare", `application/json; profile="data camel"`, ResponseFormat{EnvelopeBare, CamelCase}},
+		{"/?envelope=data&naming=snake", "", ResponseFormat{EnvelopeData, SnakeCase}},
+		{"/", "application/octet-stream", ResponseFormat{EnvelopeRaw, SnakeCase}},
+		{"/?envelope=raw", "", ResponseFormat{EnvelopeRaw, SnakeCase}},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		r.Header.Set("Accept", tc.accept)
+		format, err := ParseResponseFormat(r)
+		assert.NoError(t, err, tc.target)
+		assert.Equal(t, tc.expected, format, "%s with %q", tc.target, tc.accept)
+	}
+
+	for _, target := range []string{"/?envelope=camel", "/?naming=kebab"} {
+		_, err := ParseResponseFormat(httptest.NewRequest("GET", target, nil))
+		assert.Error(t, err, target)
+	}
+}
+
+func TestResponseFormat_Body(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(requestIDHeader, "req-1")
+	record := ResponseRecord{Key: "k", Value: "v", Version: 3, TTL: 1500 * time.Millisecond}
+	encode := func(format ResponseFormat) string {
+		data, err := json.Marshal(format.Body(r, record))
+		assert.NoError(t, err)
+		return string(data)
+	}
+
+	assert.Equal(t, `{"key":"k","value":"v","version":3}`, encode(ResponseFormat{EnvelopeRecord, CamelCase}))
+	assert.Equal(t, `"v"`, encode(ResponseFormat{EnvelopeBare, SnakeCase}))
+	assert.Equal(t, `{"data":{"key":"k","value":"v"},"meta":{"request_id":"req-1","ttl_ms":1500,"version":3}}`,
+		encode(ResponseFormat{EnvelopeData, SnakeCase}))
+	assert.Equal(t, `{"data":{"key":"k","value":"v"},"meta":{"requestId":"req-1","ttlMs":1500,"version":3}}`,
+		encode(ResponseFormat{EnvelopeData, CamelCase}))
+}
+
+func TestResponseFormat_WriteRaw(t *testing.T) {
+	rw := httptest.NewRecorder()
+	value := string([]byte{0xff, 0x00, '\n'})
+	err := ResponseFormat{EnvelopeRaw, SnakeCase}.Write(rw, httptest.NewRequest("GET", "/", nil), ResponseRecord{Key: "k", Value: value, Version: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "application/octet-stream", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "3", rw.Header().Get(VersionHeader))
+	assert.Equal(t, value, rw.Body.String())
+}
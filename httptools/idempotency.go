@@ -0,0 +1,186 @@
+package httptools
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+)
+
+// IdempotencyStore remembers responses of write requests carrying an
+// Idempotency-Key header so a retried request gets the original response
+// instead of being applied again. Results are kept in memory for ttl.
+type IdempotencyStore struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	results   map[string]*idempotentResult
+	lastPurge time.Time
+}
+
+type idempotentResult struct {
+	// bodyHash identifies the request the key was first used with.
+	bodyHash  [sha256.Size]byte
+	done      chan struct{}
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:       ttl,
+		results:   make(map[string]*idempotentResult),
+		lastPurge: time.Now(),
+	}
+}
+
+// Wrap deduplicates POST and DELETE requests passed to next. A duplicate
+// arriving while the original is still processed waits for its result.
+// Server errors are not remembered so the client can retry them. A key
+// reused with another request body is refused with 422, as the request is
+// not a retry. Streams, gRPC calls and event streams, pass through unrecorded.
+func (s *IdempotencyStore) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodDelete) || isStream(r.Header) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, "Failed to read the request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := sha256.Sum256(body)
+
+		result, found := s.acquire(key, bodyHash)
+		for found {
+			if result.bodyHash != bodyHash {
+				http.Error(rw, IdempotencyKeyHeader+" reused with another request body", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-result.done:
+			case <-r.Context().Done():
+				return
+			}
+			if result.status != 0 {
+				result.replay(rw)
+				return
+			}
+			// The original request failed, process this one instead.
+			result, found = s.acquire(key, bodyHash)
+		}
+
+		recorder := &responseRecorder{ResponseWriter: rw, status: http.StatusOK}
+		served := false
+		defer func() {
+			// A panicking handler is a server error, its key is released
+			// for the waiting duplicates and retries.
+			if !served {
+				recorder.status = http.StatusInternalServerError
+			}
+			s.complete(key, result, recorder)
+		}()
+		next.ServeHTTP(recorder, r)
+		served = true
+	})
+}
+
+func (s *IdempotencyStore) acquire(key string, bodyHash [sha256.Size]byte) (*idempotentResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPurge) > s.ttl {
+		for k, result := range s.results {
+			if !result.expiresAt.IsZero() && now.After(result.expiresAt) {
+				delete(s.results, k)
+			}
+		}
+		s.lastPurge = now
+	}
+
+	if result, found := s.results[key]; found && (result.expiresAt.IsZero() || now.Before(result.expiresAt)) {
+		return result, true
+	}
+	result := &idempotentResult{bodyHash: bodyHash, done: make(chan struct{})}
+	s.results[key] = result
+	return result, false
+}
+
+func (s *IdempotencyStore) complete(key string, result *idempotentResult, recorder *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if recorder.status >= http.StatusInternalServerError || isStream(recorder.Header()) {
+		delete(s.results, key)
+	} else {
+		result.status = recorder.status
+		result.header = recorder.Header().Clone()
+		result.body = recorder.body.Bytes()
+		result.expiresAt = time.Now().Add(s.ttl)
+	}
+	close(result.done)
+}
+
+func (result *idempotentResult) replay(rw http.ResponseWriter) {
+	for k, values := range result.header {
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	rw.Header().Set(IdempotencyReplayedHeader, "true")
+	rw.WriteHeader(result.status)
+	_, _ = rw.Write(result.body)
+}
+
+// isStream reports whether the content type in header is that of a stream,
+// which is neither buffered nor replayed.
+func isStream(header http.Header) bool {
+	contentType := header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "application/grpc") || strings.HasPrefix(contentType, "text/event-stream")
+}
+
+// responseRecorder passes the response through while keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if !isStream(r.Header()) {
+		r.body.Write(data)
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Flush sends the buffered response on, for handlers asserting
+// http.Flusher.
+func (r *responseRecorder) Flush() {
+	_ = http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,104 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	var calls atomic.Int32
+	handler := NewIdempotencyStore(time.Minute).Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if r.URL.Path == "/fail" && n == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("created"))
+	}))
+	serve := func(method, path, key string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(`{"value":"1"}`))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	first := serve(http.MethodPost, "/db/a", "k1")
+	retry := serve(http.MethodPost, "/db/a", "k1")
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "true", retry.Header().Get(IdempotencyReplayedHeader))
+
+	changed := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/db/a", strings.NewReader(`{"value":"2"}`))
+	req.Header.Set(IdempotencyKeyHeader, "k1")
+	handler.ServeHTTP(changed, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, changed.Code, "a key is bound to its request body")
+	assert.Equal(t, int32(1), calls.Load())
+
+	serve(http.MethodPost, "/db/b", "k1")
+	serve(http.MethodPost, "/db/a", "")
+	serve(http.MethodGet, "/db/a", "k1")
+	assert.Equal(t, int32(4), calls.Load(), "only identical writes are deduplicated")
+
+	calls.Store(0)
+	assert.Equal(t, http.StatusInternalServerError, serve(http.MethodPost, "/fail", "k2").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPost, "/fail", "k2").Code, "failed writes can be retried")
+}
+
+func TestIdempotencyStore_Panic(t *testing.T) {
+	var calls atomic.Int32
+	handler := NewIdempotencyStore(time.Minute).Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/db/a", nil)
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Panics(t, func() { serve() })
+	done := make(chan int)
+	go func() { done <- serve().Code }()
+	select {
+	case code := <-done:
+		assert.Equal(t, http.StatusCreated, code, "a retry after a panic is processed")
+	case <-time.After(time.Second):
+		t.Fatal("Expected the key of a panicking request to be released")
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestIdempotencyStore_Stream(t *testing.T) {
+	var calls atomic.Int32
+	handler := NewIdempotencyStore(time.Minute).Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = rw.Write([]byte("data: 1\n\n"))
+		assert.NoError(t, http.NewResponseController(rw).Flush())
+	}))
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/events", nil)
+		req.Header.Set(IdempotencyKeyHeader, "k1")
+		handler.ServeHTTP(rw, req)
+		assert.True(t, rw.Flushed, "streams are flushed through the recorder")
+		assert.Empty(t, rw.Header().Get(IdempotencyReplayedHeader))
+	}
+	assert.Equal(t, int32(2), calls.Load(), "streams are not replayed")
+}
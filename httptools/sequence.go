@@ -0,0 +1,59 @@
+package httptools
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// SequenceHeader carries the consistency token of a response, the commit
+// sequence the db node had applied. A reader that wants to see a write
+// presents its token in MinSequenceHeader, and every tier passes it on
+// until a db node, which answers only once it has applied that sequence.
+const (
+	SequenceHeader    = "X-Sequence"
+	MinSequenceHeader = "X-Min-Sequence"
+)
+
+// VersionHeader carries the version of a record sent without a JSON body.
+const VersionHeader = "X-Version"
+
+type minSequenceKey struct{}
+
+// WithMinSequence puts the MinSequenceHeader of a request in its context,
+// for SetMinSequence to pass it on. An invalid token is rejected with 400.
+func WithMinSequence(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(MinSequenceHeader)
+		if value == "" {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		sequence, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(rw, "Invalid "+MinSequenceHeader+" header", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(rw, r.WithContext(ContextWithMinSequence(r.Context(), sequence)))
+	})
+}
+
+// ContextWithMinSequence returns ctx asking for data at least as fresh as
+// sequence.
+func ContextWithMinSequence(ctx context.Context, sequence uint64) context.Context {
+	return context.WithValue(ctx, minSequenceKey{}, sequence)
+}
+
+// MinSequence returns the sequence ctx asks for, zero for any.
+func MinSequence(ctx context.Context) uint64 {
+	sequence, _ := ctx.Value(minSequenceKey{}).(uint64)
+	return sequence
+}
+
+// SetMinSequence sets the MinSequenceHeader of an outgoing request from its
+// context. Requests asking for no sequence are left unchanged.
+func SetMinSequence(r *http.Request) {
+	if sequence := MinSequence(r.Context()); sequence > 0 {
+		r.Header.Set(MinSequenceHeader, strconv.FormatUint(sequence, 10))
+	}
+}
@@ -0,0 +1,34 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMinSequence(t *testing.T) {
+	var sequence uint64
+	handler := WithMinSequence(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		sequence = MinSequence(r.Context())
+		out := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(r.Context())
+		SetMinSequence(out)
+		assert.Equal(t, r.Header.Get(MinSequenceHeader), out.Header.Get(MinSequenceHeader))
+	}))
+
+	serve := func(value string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if value != "" {
+			r.Header.Set(MinSequenceHeader, value)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, serve(""))
+	assert.Zero(t, sequence)
+	assert.Equal(t, http.StatusOK, serve("42"))
+	assert.Equal(t, uint64(42), sequence)
+	assert.Equal(t, http.StatusBadRequest, serve("-1"))
+}
@@ -1,9 +1,13 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -13,24 +17,91 @@ type Server interface {
 
 type server struct {
 	httpServer *http.Server
+	// socketPath is set for servers listening on a unix domain socket.
+	socketPath string
+	// certFile and keyFile are set for servers serving TLS.
+	certFile, keyFile string
 }
 
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		switch {
+		case s.socketPath != "":
+			err = s.serveUnix()
+		case s.certFile != "":
+			err = s.httpServer.ListenAndServeTLS(s.certFile, s.keyFile)
+		default:
+			err = s.httpServer.ListenAndServe()
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+func (s server) serveUnix() error {
+	// A socket file left by a previous process would make Listen fail.
+	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return err
+	}
+	return s.httpServer.Serve(listener)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+	return server{httpServer: newHTTPServer(fmt.Sprintf(":%d", port), handler)}
+}
+
+// CreateTLSServer creates a server serving TLS with the given certificate.
+// Clients negotiating it are served HTTP/2, which gRPC requires.
+func CreateTLSServer(port int, handler http.Handler, certFile, keyFile string) Server {
+	return server{httpServer: newHTTPServer(fmt.Sprintf(":%d", port), handler), certFile: certFile, keyFile: keyFile}
+}
+
+// CreateMTLSServer creates a TLS server that only accepts clients showing a
+// certificate signed by one of the CAs in clientCAFile.
+func CreateMTLSServer(port int, handler http.Handler, certFile, keyFile, clientCAFile string) (Server, error) {
+	clientCAs, err := LoadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	httpServer := newHTTPServer(fmt.Sprintf(":%d", port), handler)
+	httpServer.TLSConfig = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	return server{httpServer: httpServer, certFile: certFile, keyFile: keyFile}, nil
+}
+
+// CreateUnixServer creates a server listening on the unix domain socket at
+// socketPath, with the same timeouts as the TCP server, for sidecar setups
+// where the balancer and the app server share a host.
+func CreateUnixServer(socketPath string, handler http.Handler) Server {
+	return server{httpServer: newHTTPServer("", handler), socketPath: socketPath}
+}
+
+// ConnTracker follows the connections of a server: ConnContext is called
+// for every accepted connection, ConnState whenever its state changes, as
+// with the hooks of http.Server.
+type ConnTracker interface {
+	ConnContext(ctx context.Context, c net.Conn) context.Context
+	ConnState(c net.Conn, state http.ConnState)
+}
+
+// TrackConnections has tracker follow the connections of s, a server
+// created by this package, from the next one accepted.
+func TrackConnections(s Server, tracker ConnTracker) {
+	httpServer := s.(server).httpServer
+	httpServer.ConnContext = tracker.ConnContext
+	httpServer.ConnState = tracker.ConnState
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
 	}
 }
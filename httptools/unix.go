@@ -0,0 +1,49 @@
+package httptools
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// UnixAddrPrefix marks backend addresses that are unix socket paths, for
+// example "unix:/run/app.sock".
+const UnixAddrPrefix = "unix:"
+
+// SocketPath returns the socket path of a "unix:" address.
+func SocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, UnixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, UnixAddrPrefix), true
+}
+
+// UnixTransport sends every request over the unix domain socket at
+// socketPath, whatever the host of the request URL is.
+func UnixTransport(socketPath string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", socketPath)
+	}
+	return transport
+}
+
+// NewUnixReverseProxy proxies requests to the server listening on the unix
+// domain socket at socketPath. The request deadline budget is passed on as
+// by the TCP balancer.
+func NewUnixReverseProxy(socketPath string) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = "unix"
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+			SetTimeout(r.Out)
+		},
+		Transport: UnixTransport(socketPath),
+	}
+}
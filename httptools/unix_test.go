@@ -0,0 +1,71 @@
+package httptools
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// socketPath returns a short socket path; unix socket paths are limited to
+// about a hundred bytes, which t.TempDir may exceed.
+func socketPath(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "app.sock")
+}
+
+func TestUnixServer(t *testing.T) {
+	path := socketPath(t)
+	// A stale socket file must not prevent the server from starting.
+	assert.Nil(t, os.WriteFile(path, nil, 0o600))
+
+	s := CreateUnixServer(path, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Header.Get(TimeoutHeader)))
+	})).(server)
+	done := make(chan error)
+	go func() { done <- s.serveUnix() }()
+	defer func() {
+		_ = s.httpServer.Close()
+		assert.Equal(t, http.ErrServerClosed, <-done)
+	}()
+
+	var resp *http.Response
+	var err error
+	client := &http.Client{Transport: UnixTransport(path)}
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("http://any-host/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	proxy := NewUnixReverseProxy(path)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(TimeoutHeader, "1000")
+	rw := httptest.NewRecorder()
+	WithDeadline(proxy).ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	body, _ := io.ReadAll(rw.Body)
+	assert.Regexp(t, `^\d{3,4}$`, string(body), "the deadline budget is passed on")
+}
+
+func TestSocketPath(t *testing.T) {
+	path, ok := SocketPath("unix:/run/app.sock")
+	assert.True(t, ok)
+	assert.Equal(t, "/run/app.sock", path)
+	_, ok = SocketPath("server1:8080")
+	assert.False(t, ok)
+}
@@ -0,0 +1,127 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stalenessSlack is added to the read cache ttl of an instance to bound how
+// long it may serve an overwritten value, covering db and network latency.
+const stalenessSlack = 2 * time.Second
+
+// instance is an app server read from directly, bypassing the balancer.
+type instance struct {
+	address            string
+	ID                 string `json:"id"`
+	ReadCacheTTLMillis int64  `json:"read_cache_ttl_ms"`
+}
+
+// discoverInstances asks every app server listed in SERVER_HOSTS, separated
+// by commas, to identify itself.
+func discoverInstances(t *testing.T) []instance {
+	hosts := os.Getenv("SERVER_HOSTS")
+	if hosts == "" {
+		hosts = "server1:8080,server2:8080,server3:8080"
+	}
+	var instances []instance
+	for _, host := range strings.Split(hosts, ",") {
+		server := instance{address: "http://" + strings.TrimSpace(host)}
+		resp, err := client.Get(server.address + "/instance")
+		require.NoError(t, err)
+		err = json.NewDecoder(resp.Body).Decode(&server)
+		resp.Body.Close()
+		require.NoError(t, err)
+		instances = append(instances, server)
+	}
+	return instances
+}
+
+// put writes the value through the balancer and returns the instance that
+// handled the write.
+func put(t *testing.T, key, value string) string {
+	body, _ := json.Marshal(map[string]string{"key": key, "value": value})
+	resp, err := client.Post(baseAddress+"/api/v1/some-data", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	return resp.Header.Get("X-Server-Instance")
+}
+
+// get reads the value of key from the instance.
+func get(server instance, key string) (string, error) {
+	resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data?key=%s", server.address, key))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var record struct {
+		Value string `json:"value"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&record)
+	return record.Value, err
+}
+
+func TestWriteReadConsistency(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+	instances := discoverInstances(t)
+	key := fmt.Sprintf("consistency-%d", time.Now().UnixNano())
+
+	// A new key is read from the db by every instance, filling their caches.
+	put(t, key, "v1")
+	for _, server := range instances {
+		value, err := get(server, key)
+		require.NoError(t, err, server.address)
+		assert.Equal(t, "v1", value, "%s reads a new key", server.ID)
+	}
+
+	writer := put(t, key, "v2")
+	written := time.Now()
+	var maxBound time.Duration
+	for _, server := range instances {
+		if server.ID == writer {
+			// The instance that took the write updates its own cache.
+			value, err := get(server, key)
+			require.NoError(t, err, server.address)
+			assert.Equal(t, "v2", value, "%s reads its own write", server.ID)
+		}
+		maxBound = max(maxBound, time.Duration(server.ReadCacheTTLMillis)*time.Millisecond+stalenessSlack)
+	}
+
+	// Every instance is polled until it serves the new value, which its
+	// read cache may delay by up to its ttl.
+	windows := make(map[string]time.Duration)
+	for len(windows) < len(instances) && time.Since(written) <= maxBound {
+		for _, server := range instances {
+			if _, done := windows[server.ID]; done {
+				continue
+			}
+			if value, err := get(server, key); err == nil && value == "v2" {
+				windows[server.ID] = time.Since(written)
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, server := range instances {
+		window, converged := windows[server.ID]
+		if !assert.True(t, converged, "%s still serves a stale value", server.ID) {
+			continue
+		}
+		bound := time.Duration(server.ReadCacheTTLMillis)*time.Millisecond + stalenessSlack
+		assert.LessOrEqual(t, window, bound, "%s served a stale value for too long", server.ID)
+		t.Logf("%s (read cache ttl %dms) served the new value after %s", server.ID, server.ReadCacheTTLMillis, window.Round(time.Millisecond))
+	}
+}
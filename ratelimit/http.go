@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// KeyFunc extracts the key a request is limited by.
+type KeyFunc func(r *http.Request) string
+
+// ByIP limits every client address separately.
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByHeader limits by the value of a header, such as an API key, falling back
+// to the client address for requests without it.
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(name); value != "" {
+			return name + ":" + value
+		}
+		return ByIP(r)
+	}
+}
+
+// ByRoute limits every method and path separately.
+func ByRoute(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// Global limits all requests together.
+func Global(*http.Request) string {
+	return ""
+}
+
+// Metrics counts the requests passed and rejected by a limiter.
+type Metrics struct {
+	allowed  atomic.Int64
+	rejected atomic.Int64
+}
+
+// Stats is a snapshot of Metrics.
+type Stats struct {
+	Allowed  int64 `json:"allowed"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (m *Metrics) Stats() Stats {
+	return Stats{Allowed: m.allowed.Load(), Rejected: m.rejected.Load()}
+}
+
+// ServeHTTP reports the metrics as JSON.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(m.Stats())
+}
+
+// Wrap rejects requests with 429 when limiter does not let them through.
+// metrics may be nil.
+func Wrap(next http.Handler, limiter Limiter, key KeyFunc, metrics *Metrics) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		release, ok := limiter.Acquire(key(r))
+		if !ok {
+			if metrics != nil {
+				metrics.rejected.Add(1)
+			}
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		if metrics != nil {
+			metrics.allowed.Add(1)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,222 @@
+// Package ratelimit limits the rate or concurrency of requests per key. The
+// limiters are shared by the balancer, the app server and the db.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter decides whether a request for a key may proceed.
+type Limiter interface {
+	// Acquire reports whether the request may proceed. If it may, release
+	// must be called once the request is done.
+	Acquire(key string) (release func(), ok bool)
+}
+
+// Clock tells the current time. datastore.FakeClock satisfies it in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func noop() {}
+
+// idleTimeout is how long the state of a key is kept after its last request.
+const idleTimeout = time.Minute
+
+// TokenBucket allows bursts of up to burst requests per key, refilled at rate
+// requests per second.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	clock Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPurge time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a token bucket limiter. A nil clock means the
+// system clock.
+func NewTokenBucket(rate, burst float64, clock Clock) *TokenBucket {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &TokenBucket{rate: rate, burst: burst, clock: clock, buckets: make(map[string]*bucket), lastPurge: clock.Now()}
+}
+
+// Rate returns the refill rate in requests per second.
+func (l *TokenBucket) Rate() float64 {
+	return l.rate
+}
+
+// Burst returns the most requests passing at once.
+func (l *TokenBucket) Burst() float64 {
+	return l.burst
+}
+
+func (l *TokenBucket) Acquire(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key)
+	if b.tokens < 1 {
+		return nil, false
+	}
+	b.tokens--
+	return noop, true
+}
+
+// Charge takes n tokens for key whether it has them or not. A bucket left
+// in debt refuses requests until the refill pays it back.
+func (l *TokenBucket) Charge(key string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(key).tokens -= float64(n)
+}
+
+// Tokens returns the tokens key has left.
+func (l *TokenBucket) Tokens(key string) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.refill(key).tokens
+}
+
+// refill returns the bucket of key with the tokens added since its last
+// request. Callers hold l.mu.
+func (l *TokenBucket) refill(key string) *bucket {
+	now := l.clock.Now()
+	l.purge(now)
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// purge forgets idle keys; their buckets would be full again anyway.
+func (l *TokenBucket) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < idleTimeout {
+		return
+	}
+	l.lastPurge = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > idleTimeout && b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// SlidingWindow allows limit requests per key in any window long period. It
+// approximates the window by weighting the count of the previous fixed window
+// by its overlap with the sliding one.
+type SlidingWindow struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	mu        sync.Mutex
+	counters  map[string]*windowCounter
+	lastPurge time.Time
+}
+
+type windowCounter struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+// NewSlidingWindow creates a sliding window limiter. A nil clock means the
+// system clock.
+func NewSlidingWindow(limit int, window time.Duration, clock Clock) *SlidingWindow {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return &SlidingWindow{limit: limit, window: window, clock: clock, counters: make(map[string]*windowCounter), lastPurge: clock.Now()}
+}
+
+func (l *SlidingWindow) Acquire(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.purge(now)
+	c, found := l.counters[key]
+	if !found {
+		c = &windowCounter{start: now.Truncate(l.window)}
+		l.counters[key] = c
+	}
+	if elapsed := now.Sub(c.start); elapsed >= l.window {
+		if elapsed < 2*l.window {
+			c.previous = c.current
+		} else {
+			c.previous = 0
+		}
+		c.current = 0
+		c.start = now.Truncate(l.window)
+	}
+
+	overlap := 1 - float64(now.Sub(c.start))/float64(l.window)
+	if float64(c.previous)*overlap+float64(c.current) >= float64(l.limit) {
+		return nil, false
+	}
+	c.current++
+	return noop, true
+}
+
+func (l *SlidingWindow) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < max(idleTimeout, 2*l.window) {
+		return
+	}
+	l.lastPurge = now
+	for key, c := range l.counters {
+		if now.Sub(c.start) >= 2*l.window {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// Concurrency allows at most limit requests per key in flight.
+type Concurrency struct {
+	limit int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+}
+
+func NewConcurrency(limit int) *Concurrency {
+	return &Concurrency{limit: limit, inFlight: make(map[string]int)}
+}
+
+func (l *Concurrency) Acquire(key string) (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight[key] >= l.limit {
+		return nil, false
+	}
+	l.inFlight[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.inFlight[key]--; l.inFlight[key] == 0 {
+				delete(l.inFlight, key)
+			}
+		})
+	}, true
+}
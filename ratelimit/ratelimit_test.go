@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func allowed(l Limiter, key string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if _, ok := l.Acquire(key); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := NewTokenBucket(2, 4, clock)
+
+	assert.Equal(t, 4, allowed(l, "a", 10), "the burst passes at once")
+	assert.Equal(t, 4, allowed(l, "b", 10), "keys are limited separately")
+
+	clock.now = clock.now.Add(time.Second)
+	assert.Equal(t, 2, allowed(l, "a", 10))
+	clock.now = clock.now.Add(time.Hour)
+	assert.Equal(t, 4, allowed(l, "a", 10), "tokens are capped at the burst")
+
+	clock.now = clock.now.Add(2 * idleTimeout)
+	allowed(l, "a", 1)
+	assert.Len(t, l.buckets, 1, "idle keys are forgotten")
+
+	l.Charge("c", 6)
+	assert.Equal(t, -2.0, l.Tokens("c"), "a charge may exceed the tokens left")
+	assert.Equal(t, 0, allowed(l, "c", 1), "a bucket in debt refuses requests")
+	clock.now = clock.now.Add(1500 * time.Millisecond)
+	assert.Equal(t, 1, allowed(l, "c", 10), "the refill pays the debt back first")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := NewSlidingWindow(10, time.Second, clock)
+
+	assert.Equal(t, 10, allowed(l, "a", 20))
+	assert.Equal(t, 10, allowed(l, "b", 20))
+
+	// Half of the previous window still counts.
+	clock.now = clock.now.Add(1500 * time.Millisecond)
+	assert.Equal(t, 5, allowed(l, "a", 20))
+
+	clock.now = clock.now.Add(2 * time.Second)
+	assert.Equal(t, 10, allowed(l, "a", 20), "windows older than one period do not count")
+}
+
+func TestConcurrency(t *testing.T) {
+	l := NewConcurrency(2)
+	release1, ok := l.Acquire("a")
+	assert.True(t, ok)
+	_, ok = l.Acquire("a")
+	assert.True(t, ok)
+	_, ok = l.Acquire("a")
+	assert.False(t, ok)
+	_, ok = l.Acquire("b")
+	assert.True(t, ok)
+
+	release1()
+	release1()
+	_, ok = l.Acquire("a")
+	assert.True(t, ok, "a released slot is reused")
+	_, ok = l.Acquire("a")
+	assert.False(t, ok, "release is idempotent")
+}
+
+func TestWrap(t *testing.T) {
+	metrics := new(Metrics)
+	handler := Wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		NewTokenBucket(1, 1, &fakeClock{}), ByHeader("X-Api-Key"), metrics)
+
+	send := func(remote, apiKey string) int {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if apiKey != "" {
+			r.Header.Set("X-Api-Key", apiKey)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1000", "key1"))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.2:1000", "key1"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1000", "key2"))
+	assert.Equal(t, http.StatusOK, send("10.0.0.1:1000", ""))
+	assert.Equal(t, http.StatusTooManyRequests, send("10.0.0.1:2000", ""), "requests without a key are limited by IP")
+
+	assert.Equal(t, Stats{Allowed: 3, Rejected: 2}, metrics.Stats())
+}
+
+func TestKeyFuncs(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/some-data?key=a", nil)
+	r.RemoteAddr = "192.168.0.1:5000"
+	assert.Equal(t, "192.168.0.1", ByIP(r))
+	assert.Equal(t, "POST /api/v1/some-data", ByRoute(r))
+	assert.Equal(t, "", Global(r))
+}
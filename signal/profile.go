@@ -0,0 +1,97 @@
+package signal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultProfileDuration is how long a CPU profile runs when no duration
+// is configured.
+const DefaultProfileDuration = 30 * time.Second
+
+// Profiler captures a CPU profile and then a heap snapshot into Dir. The
+// files are named after the program and the capture start, e.g.
+// lb-20240501T120000-cpu.pprof, and read with go tool pprof.
+type Profiler struct {
+	Dir      string
+	Duration time.Duration
+
+	running atomic.Bool
+}
+
+// Capture profiles the process for p.Duration and returns the paths of the
+// CPU profile and the heap snapshot. Only one capture runs at a time.
+func (p *Profiler) Capture() (cpuPath, heapPath string, err error) {
+	if !p.running.CompareAndSwap(false, true) {
+		return "", "", fmt.Errorf("a capture is already running")
+	}
+	defer p.running.Store(false)
+
+	if err := os.MkdirAll(p.Dir, 0o755); err != nil {
+		return "", "", err
+	}
+	prefix := filepath.Join(p.Dir, fmt.Sprintf("%s-%s", filepath.Base(os.Args[0]), time.Now().Format("20060102T150405")))
+	cpuPath, heapPath = prefix+"-cpu.pprof", prefix+"-heap.pprof"
+
+	cpu, err := os.Create(cpuPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer cpu.Close()
+	if err := pprof.StartCPUProfile(cpu); err != nil {
+		return "", "", err
+	}
+	duration := p.Duration
+	if duration <= 0 {
+		duration = DefaultProfileDuration
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+	if err := cpu.Close(); err != nil {
+		return "", "", err
+	}
+
+	heap, err := os.Create(heapPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer heap.Close()
+	// The snapshot shows the live heap as of the last collection.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(heap); err != nil {
+		return "", "", err
+	}
+	return cpuPath, heapPath, heap.Close()
+}
+
+// ProfileOnSignal starts a capture into dir every time the process gets the
+// profiling signal, SIGUSR1, so a running process can be profiled, e.g. with
+// docker compose kill -s SIGUSR1 server1, without attaching a debugger.
+// A signal received while a capture runs is ignored.
+func ProfileOnSignal(dir string, duration time.Duration) {
+	p := &Profiler{Dir: dir, Duration: duration}
+	signals := notifyProfileSignal()
+	if signals == nil {
+		log.Println("Profiling on signal is not supported on this platform")
+		return
+	}
+	go func() {
+		for range signals {
+			go func() {
+				log.Printf("Capturing profiles into %s", p.Dir)
+				cpuPath, heapPath, err := p.Capture()
+				if err != nil {
+					log.Printf("Profile capture failed: %s", err)
+					return
+				}
+				log.Printf("Captured profiles %s and %s", cpuPath, heapPath)
+			}()
+		}
+	}()
+}
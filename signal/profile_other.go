@@ -0,0 +1,10 @@
+//go:build !unix
+
+package signal
+
+import "os"
+
+// notifyProfileSignal returns nil, there is no SIGUSR1 to profile on.
+func notifyProfileSignal() chan os.Signal {
+	return nil
+}
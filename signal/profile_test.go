@@ -0,0 +1,35 @@
+package signal
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProfiler_Capture(t *testing.T) {
+	p := &Profiler{Dir: t.TempDir(), Duration: 50 * time.Millisecond}
+
+	done := make(chan error)
+	var cpuPath, heapPath string
+	go func() {
+		var err error
+		cpuPath, heapPath, err = p.Capture()
+		done <- err
+	}()
+	for !p.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := p.Capture(); err == nil {
+		t.Error("Expected a second capture to be refused while one runs")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{cpuPath, heapPath} {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == 0 {
+			t.Errorf("Expected a profile at %s, got %v", path, err)
+		}
+	}
+}
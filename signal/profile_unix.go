@@ -0,0 +1,15 @@
+//go:build unix
+
+package signal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func notifyProfileSignal() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	return signals
+}